@@ -0,0 +1,194 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// Package remote runs commands and copies files on a VM whatever the protocol
+// it is reached with: SSH for Linux guests, WinRM for Windows ones.
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/apcera/libretto/ssh"
+	"github.com/apcera/libretto/winrm"
+)
+
+// Transport is the protocol a Remote talks.
+type Transport string
+
+const (
+	// SSH is the default transport.
+	SSH Transport = "ssh"
+	// WinRM is Windows Remote Management, for Windows guests.
+	WinRM Transport = "winrm"
+)
+
+// Options configures a Remote.
+type Options struct {
+	// Transport defaults to SSH.
+	Transport Transport
+	// SSH configures the SSH client; it is also used to find the IP of the
+	// VM, as with GetSSH.
+	SSH ssh.Options
+	// WinRM configures the WinRM client.
+	WinRM winrm.Options
+}
+
+// Remote runs commands and copies files on a VM.
+type Remote interface {
+	// Run runs command, in the shell of the user over SSH and in cmd.exe
+	// over WinRM, copying its output to stdout and stderr, which may be
+	// nil. A command that fails returns an *ExitError.
+	Run(ctx context.Context, command string, stdout, stderr io.Writer) error
+	// Upload copies src to the file dst. mode is ignored over WinRM.
+	Upload(ctx context.Context, src io.Reader, dst string, mode uint32) error
+	// Download copies the file src to dst.
+	Download(ctx context.Context, dst io.Writer, src string) error
+	// WaitReady waits for at most maxWait until the VM accepts commands.
+	WaitReady(ctx context.Context, maxWait time.Duration) error
+	// Close releases the connection to the VM, if any.
+	Close() error
+}
+
+// ExitError is returned by Run when the command exits with a non-zero
+// status, or, over SSH, is killed by a signal.
+type ExitError struct {
+	Status int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("Command exited with status %d", e.Status)
+}
+
+// NewSSH returns a Remote that uses client. If client is already connected,
+// the Remote takes over its connection; otherwise it connects on first use,
+// or when WaitReady succeeds. Either way, Close disconnects client.
+func NewSSH(client ssh.Client) Remote {
+	r := &sshRemote{client: client}
+	if c, ok := client.(connectedClient); ok {
+		r.connected = c.Connected()
+	}
+	return r
+}
+
+// connectedClient is implemented by the clients that know whether they are
+// connected, such as *ssh.SSHClient.
+type connectedClient interface {
+	Connected() bool
+}
+
+type sshRemote struct {
+	client    ssh.Client
+	connected bool
+}
+
+func (r *sshRemote) connect() error {
+	if r.connected {
+		return nil
+	}
+	if err := r.client.Connect(); err != nil {
+		return err
+	}
+	r.connected = true
+	return nil
+}
+
+func (r *sshRemote) Run(ctx context.Context, command string, stdout, stderr io.Writer) error {
+	if err := r.connect(); err != nil {
+		return err
+	}
+	result, err := r.client.Command(ctx, command, ssh.RunOptions{Stdout: stdout, Stderr: stderr})
+	if err != nil {
+		return err
+	}
+	if !result.Success() {
+		return &ExitError{Status: result.ExitStatus}
+	}
+	return nil
+}
+
+func (r *sshRemote) Upload(ctx context.Context, src io.Reader, dst string, mode uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := r.connect(); err != nil {
+		return err
+	}
+	return r.client.Upload(src, dst, mode)
+}
+
+func (r *sshRemote) Download(ctx context.Context, dst io.Writer, src string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := r.connect(); err != nil {
+		return err
+	}
+	return r.client.Download(nopCloser{dst}, src)
+}
+
+func (r *sshRemote) WaitReady(ctx context.Context, maxWait time.Duration) error {
+	if err := r.client.WaitForSSHContext(ctx, maxWait); err != nil {
+		return err
+	}
+	r.connected = true
+	return nil
+}
+
+func (r *sshRemote) Close() error {
+	if r.connected {
+		r.client.Disconnect()
+		r.connected = false
+	}
+	return nil
+}
+
+// nopCloser turns the io.Writer of Download into the io.WriteCloser of
+// ssh.Client.
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// NewWinRM returns a Remote that talks to the WinRM service of ip. It logs in
+// with the SSHUser and SSHPassword of creds, unless options sets a user.
+func NewWinRM(ip net.IP, creds *ssh.Credentials, options winrm.Options) Remote {
+	var user, password string
+	if creds != nil {
+		user, password = creds.SSHUser, creds.SSHPassword
+	}
+	return &winrmRemote{client: winrm.NewClient(ip.String(), user, password, options)}
+}
+
+type winrmRemote struct {
+	client *winrm.Client
+}
+
+func (r *winrmRemote) Run(ctx context.Context, command string, stdout, stderr io.Writer) error {
+	code, err := r.client.Run(ctx, command, stdout, stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return &ExitError{Status: code}
+	}
+	return nil
+}
+
+func (r *winrmRemote) Upload(ctx context.Context, src io.Reader, dst string, mode uint32) error {
+	return r.client.Upload(ctx, src, dst)
+}
+
+func (r *winrmRemote) Download(ctx context.Context, dst io.Writer, src string) error {
+	return r.client.Download(ctx, dst, src)
+}
+
+func (r *winrmRemote) WaitReady(ctx context.Context, maxWait time.Duration) error {
+	return r.client.WaitReady(ctx, maxWait)
+}
+
+// Close does nothing: every command of WinRM opens and deletes its shell.
+func (r *winrmRemote) Close() error {
+	return nil
+}
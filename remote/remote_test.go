@@ -0,0 +1,82 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apcera/libretto/ssh"
+	"github.com/apcera/libretto/ssh/sshtest"
+)
+
+func TestSSH(t *testing.T) {
+	s, err := sshtest.NewServer(&sshtest.Config{PasswordCallback: sshtest.Password("foo", "bar")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Handle("uname", sshtest.Reply("Linux\n", 0))
+	s.Handle("false", sshtest.Reply("", 1))
+
+	r := NewSSH(&ssh.SSHClient{
+		Creds: &ssh.Credentials{SSHUser: "foo", SSHPassword: "bar"},
+		IP:    s.IP(),
+		Port:  s.Port(),
+	})
+	defer r.Close()
+	ctx := context.Background()
+	if err := r.WaitReady(ctx, time.Second); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+
+	var stdout bytes.Buffer
+	if err := r.Run(ctx, "uname", &stdout, nil); err != nil || stdout.String() != "Linux\n" {
+		t.Fatalf("Expected the command to run, got %q: %v", stdout.String(), err)
+	}
+	if e, ok := r.Run(ctx, "false", nil, nil).(*ExitError); !ok || e.Status != 1 {
+		t.Fatalf("Expected an ExitError with status 1, got: %v", e)
+	}
+
+	if err := r.Upload(ctx, strings.NewReader("hello"), "/tmp/hello.txt", 0600); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	var download bytes.Buffer
+	if err := r.Download(ctx, &download, "/tmp/hello.txt"); err != nil || download.String() != "hello" {
+		t.Fatalf("Expected the file to be downloaded, got %q: %v", download.String(), err)
+	}
+}
+
+// TestSSHConnected tests that a Remote takes over the connection of a
+// connected client rather than opening another one.
+func TestSSHConnected(t *testing.T) {
+	s, err := sshtest.NewServer(&sshtest.Config{PasswordCallback: sshtest.Password("foo", "bar")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Handle("true", sshtest.Reply("", 0))
+
+	client := &ssh.SSHClient{
+		Creds: &ssh.Credentials{SSHUser: "foo", SSHPassword: "bar"},
+		IP:    s.IP(),
+		Port:  s.Port(),
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	r := NewSSH(client)
+	if err := r.Run(context.Background(), "true", nil, nil); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if n := s.Connections(); n != 1 {
+		t.Fatalf("Expected the connection of the client to be used, got %d connections", n)
+	}
+	r.Close()
+	if client.Connected() {
+		t.Fatal("Expected Close to disconnect the client")
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	cssh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ErrInvalidCertificate is returned when Credentials.SSHCertificate is not a
+// certificate for SSHPrivateKey.
+var ErrInvalidCertificate = errors.New("Invalid certificate for the private key")
+
+// dialAgent connects to the ssh-agent listening on socket.
+var dialAgent = func(socket string) (agent.Agent, func() error, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil, err
+	}
+	return agent.NewClient(conn), conn.Close, nil
+}
+
+// hasAuth reports whether c has a way to authenticate.
+func (c *Credentials) hasAuth() bool {
+	return c.SSHPrivateKey != "" || c.SSHPassword != "" || c.SSHAgentSocket != "" ||
+		c.Signers != nil || c.KeyboardInteractive != nil || len(c.AuthMethods) > 0
+}
+
+// authOrder returns the auth methods of c, in the order they are tried.
+func (c *Credentials) authOrder() []string {
+	if len(c.AuthMethods) > 0 {
+		return c.AuthMethods
+	}
+	var order []string
+	if c.SSHPrivateKey != "" {
+		order = append(order, KeyAuth)
+	}
+	if c.SSHAgentSocket != "" {
+		order = append(order, AgentAuth)
+	}
+	if c.Signers != nil {
+		order = append(order, SignerAuth)
+	}
+	if c.SSHPassword != "" {
+		order = append(order, PasswordAuth)
+	}
+	if c.KeyboardInteractive != nil || c.SSHPassword != "" {
+		order = append(order, KeyboardInteractiveAuth)
+	}
+	return order
+}
+
+// authMethods returns the methods to log in with c. The SSH client tries
+// only one method of each kind, so the keys of KeyAuth, AgentAuth and
+// SignerAuth are all offered by one public key method, in order. done closes
+// the connection to the agent once the handshake is over.
+func authMethods(c *Credentials) (auth []cssh.AuthMethod, done func(), err error) {
+	var (
+		closers []func() error
+		sources []func() ([]cssh.Signer, error)
+		keys    = -1
+	)
+	closeAll := func() {
+		for _, f := range closers {
+			f()
+		}
+	}
+	defer func() {
+		if err != nil {
+			closeAll()
+		}
+	}()
+
+	for _, method := range c.authOrder() {
+		var source func() ([]cssh.Signer, error)
+		switch method {
+		case KeyAuth:
+			if c.SSHPrivateKey == "" {
+				return nil, nil, ErrInvalidAuth
+			}
+			signers, err := keySigners(c)
+			if err != nil {
+				return nil, nil, err
+			}
+			source = func() ([]cssh.Signer, error) { return signers, nil }
+		case AgentAuth:
+			socket := c.SSHAgentSocket
+			if socket == "" {
+				socket = os.Getenv("SSH_AUTH_SOCK")
+			}
+			if socket == "" {
+				return nil, nil, ErrInvalidAuth
+			}
+			a, closeAgent, err := dialAgent(socket)
+			if err != nil {
+				return nil, nil, fmt.Errorf("ssh: agent: %w", err)
+			}
+			closers = append(closers, closeAgent)
+			source = a.Signers
+		case SignerAuth:
+			if c.Signers == nil {
+				return nil, nil, ErrInvalidAuth
+			}
+			source = c.Signers
+		case PasswordAuth:
+			if c.SSHPassword == "" {
+				return nil, nil, ErrInvalidAuth
+			}
+			auth = append(auth, cssh.Password(c.SSHPassword))
+		case KeyboardInteractiveAuth:
+			challenge := c.KeyboardInteractive
+			if challenge == nil {
+				if c.SSHPassword == "" {
+					return nil, nil, ErrInvalidAuth
+				}
+				challenge = passwordChallenge(c.SSHPassword)
+			}
+			auth = append(auth, cssh.KeyboardInteractive(challenge))
+		default:
+			return nil, nil, fmt.Errorf("Unknown auth method: %s", method)
+		}
+
+		if source != nil {
+			if keys < 0 {
+				keys = len(auth)
+				auth = append(auth, nil)
+			}
+			sources = append(sources, source)
+		}
+	}
+	if keys >= 0 {
+		auth[keys] = cssh.PublicKeysCallback(func() ([]cssh.Signer, error) {
+			var all []cssh.Signer
+			for _, source := range sources {
+				// A source that fails, such as an agent that went
+				// away, should not prevent the others from being
+				// tried.
+				signers, err := source()
+				if err == nil {
+					all = append(all, signers...)
+				}
+			}
+			return all, nil
+		})
+	}
+	if len(auth) == 0 {
+		return nil, nil, ErrInvalidAuth
+	}
+	return auth, closeAll, nil
+}
+
+// keySigners returns the signers of the private key of c: with its
+// certificate first if it has one, then the bare key.
+func keySigners(c *Credentials) ([]cssh.Signer, error) {
+	signer, err := readPrivateKey(c.SSHPrivateKey, c.SSHPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	if c.SSHCertificate == "" {
+		return []cssh.Signer{signer}, nil
+	}
+
+	pub, _, _, _, err := cssh.ParseAuthorizedKey([]byte(c.SSHCertificate))
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*cssh.Certificate)
+	if !ok || cert.CertType != cssh.UserCert {
+		return nil, ErrInvalidCertificate
+	}
+	certSigner, err := cssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, ErrInvalidCertificate
+	}
+	return []cssh.Signer{certSigner, signer}, nil
+}
+
+// passwordChallenge answers the questions of keyboard-interactive
+// authentication that are not echoed with password.
+func passwordChallenge(password string) cssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			if !echos[i] {
+				answers[i] = password
+			}
+		}
+		return answers, nil
+	}
+}
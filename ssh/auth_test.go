@@ -0,0 +1,176 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/apcera/libretto/ssh/sshtest"
+	cssh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// handshake logs in with creds to an sshtest server configured by server.
+func handshake(t *testing.T, server *sshtest.Config, creds *Credentials) error {
+	s, err := sshtest.NewServer(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c1, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	config, done, err := clientConfig(creds, nil, new(seenHostKey))
+	if err != nil {
+		return err
+	}
+	defer done()
+	conn, _, _, err := cssh.NewClientConn(c1, s.Addr(), config)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func newKey(t *testing.T) (string, cssh.Signer) {
+	return newKeyOfType(t, Ed25519Key)
+}
+
+func newKeyOfType(t *testing.T, typ KeyType) (string, cssh.Signer) {
+	kp, err := NewKeyPairWithOptions(KeyOptions{Type: typ})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ParsePrivateKey(kp.PrivateKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(kp.PrivateKey), signer
+}
+
+func newSigner(t *testing.T) cssh.Signer {
+	_, signer := newKey(t)
+	return signer
+}
+
+func useRealKeys() func() {
+	old := readPrivateKey
+	readPrivateKey = func(key, passphrase string) (cssh.Signer, error) {
+		return ParsePrivateKey([]byte(key), passphrase)
+	}
+	return func() { readPrivateKey = old }
+}
+
+func TestAuthCertificate(t *testing.T) {
+	defer useRealKeys()()
+
+	// The server of the SSH package does not take Ed25519 certificates.
+	ca := newSigner(t)
+	key, signer := newKeyOfType(t, ECDSAKey)
+	cert := &cssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        cssh.UserCert,
+		ValidPrincipals: []string{"foo"},
+		ValidBefore:     cssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	checker := &cssh.CertChecker{
+		IsUserAuthority: func(k cssh.PublicKey) bool { return keysEqual(k, ca.PublicKey()) },
+	}
+	server := &sshtest.Config{PublicKeyCallback: checker.Authenticate}
+
+	creds := &Credentials{SSHUser: "foo", SSHPrivateKey: key, SSHCertificate: string(cssh.MarshalAuthorizedKey(cert))}
+	if err := handshake(t, server, creds); err != nil {
+		t.Fatalf("Expected the certificate to be accepted, got: %s", err)
+	}
+
+	creds.SSHCertificate = ""
+	if err := handshake(t, server, creds); err == nil {
+		t.Fatal("Expected the bare key to be rejected")
+	}
+
+	other, _ := newKey(t)
+	creds.SSHPrivateKey = other
+	creds.SSHCertificate = string(cssh.MarshalAuthorizedKey(cert))
+	if err := handshake(t, server, creds); err != ErrInvalidCertificate {
+		t.Fatalf("Expected ErrInvalidCertificate, got: %v", err)
+	}
+}
+
+// TestAuthOrder tests that the key, the agent and the signers are all
+// offered, then the password and keyboard-interactive.
+func TestAuthOrder(t *testing.T) {
+	defer useRealKeys()()
+
+	keyring := agent.NewKeyring()
+	agentKey, _ := newKey(t)
+	raw, err := cssh.ParseRawPrivateKey([]byte(agentKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Add(agent.AddedKey{PrivateKey: raw}); err != nil {
+		t.Fatal(err)
+	}
+	agentSigners, _ := keyring.Signers()
+
+	closed := 0
+	oldDialAgent := dialAgent
+	defer func() { dialAgent = oldDialAgent }()
+	dialAgent = func(socket string) (agent.Agent, func() error, error) {
+		if socket != "/tmp/agent.sock" {
+			t.Errorf("Unexpected agent socket %s", socket)
+		}
+		return keyring, func() error { closed++; return nil }, nil
+	}
+
+	key, _ := newKey(t)
+	extra := newSigner(t)
+	creds := &Credentials{
+		SSHUser:        "foo",
+		SSHPrivateKey:  key,
+		SSHAgentSocket: "/tmp/agent.sock",
+		Signers:        func() ([]cssh.Signer, error) { return []cssh.Signer{extra}, nil },
+	}
+	for _, k := range []cssh.PublicKey{agentSigners[0].PublicKey(), extra.PublicKey()} {
+		if err := handshake(t, &sshtest.Config{PublicKeyCallback: sshtest.PublicKeys(k)}, creds); err != nil {
+			t.Fatalf("Expected the key to be offered, got: %s", err)
+		}
+	}
+	if closed != 2 {
+		t.Fatalf("Expected the agent connection to be closed, got %d closes", closed)
+	}
+
+	var questions []string
+	server := &sshtest.Config{
+		KeyboardInteractiveCallback: func(conn cssh.ConnMetadata, challenge cssh.KeyboardInteractiveChallenge) (*cssh.Permissions, error) {
+			answers, err := challenge("foo", "", []string{"Password: "}, []bool{false})
+			if err != nil || len(answers) != 1 || answers[0] != "bar" {
+				return nil, errors.New("wrong password")
+			}
+			questions = append(questions, "Password: ")
+			return nil, nil
+		},
+	}
+	creds = &Credentials{SSHUser: "foo", SSHPassword: "bar"}
+	if err := handshake(t, server, creds); err != nil || len(questions) != 1 {
+		t.Fatalf("Expected keyboard-interactive to answer with the password, got: %v", err)
+	}
+
+	creds.AuthMethods = []string{PasswordAuth}
+	if err := handshake(t, server, creds); err == nil {
+		t.Fatal("Expected only the password method to be tried")
+	}
+	creds.AuthMethods = []string{"kerberos"}
+	if err := handshake(t, server, creds); err == nil || !strings.Contains(err.Error(), "Unknown auth method") {
+		t.Fatalf("Expected an unknown method error, got: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apcera/libretto/ssh/sshtest"
+	cssh "golang.org/x/crypto/ssh"
+)
+
+// nopCloser turns a bytes.Buffer into the io.WriteCloser Download takes.
+type nopCloser struct{ *bytes.Buffer }
+
+func (nopCloser) Close() error { return nil }
+
+// startServer starts an sshtest server that takes the password of the
+// client it returns.
+func startServer(t *testing.T) (*sshtest.Server, *SSHClient) {
+	s, err := sshtest.NewServer(&sshtest.Config{PasswordCallback: sshtest.Password("foo", "bar")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &SSHClient{
+		Creds: &Credentials{SSHUser: "foo", SSHPassword: "bar"},
+		IP:    s.IP(),
+		Port:  s.Port(),
+	}
+	return s, client
+}
+
+// startLocalServer starts an sshtest server that lets any client in and runs
+// the commands with the local shell.
+func startLocalServer(t *testing.T) *sshtest.Server {
+	s, err := sshtest.NewServer(&sshtest.Config{Exec: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newClient returns a client of s that connects with Connect, through p if
+// it is not nil.
+func newClient(s *sshtest.Server, p *Pool) *SSHClient {
+	return &SSHClient{
+		Creds:   &Credentials{SSHUser: "foo", SSHPassword: "bar"},
+		IP:      s.IP(),
+		Port:    s.Port(),
+		Options: Options{Pool: p},
+	}
+}
+
+// dialServer returns a client connected to s without going through dial,
+// which the tests mock.
+func dialServer(t *testing.T, s *sshtest.Server) *SSHClient {
+	c, err := cssh.Dial("tcp", s.Addr(), &cssh.ClientConfig{User: "foo", HostKeyCallback: cssh.FixedHostKey(s.HostKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SSHClient{cryptoClient: c}
+}
+
+func TestClientRunAndTransfer(t *testing.T) {
+	oldDial := dial
+	defer func() { dial = oldDial }()
+	dial = realDial
+
+	s, client := startServer(t)
+	defer s.Close()
+	s.Handle("uname", sshtest.Reply("Linux\n", 0))
+
+	if err := client.WaitForSSH(time.Second); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer client.Disconnect()
+
+	var stdout bytes.Buffer
+	if err := client.Run("uname", &stdout, nil); err != nil || stdout.String() != "Linux\n" {
+		t.Fatalf("Expected the command to run, got %q: %v", stdout.String(), err)
+	}
+	if err := client.Run("false", nil, nil); err == nil {
+		t.Fatal("Expected an unknown command to fail")
+	}
+
+	if err := client.Upload(strings.NewReader("hello"), "/tmp/hello.txt", 0600); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if b, err := s.FS.ReadFile("/tmp/hello.txt"); err != nil || string(b) != "hello" {
+		t.Fatalf("Expected the file to be uploaded, got %q: %v", b, err)
+	}
+	var download bytes.Buffer
+	if err := client.Download(nopCloser{&download}, "/tmp/hello.txt"); err != nil || download.String() != "hello" {
+		t.Fatalf("Expected the file to be downloaded, got %q: %v", download.String(), err)
+	}
+
+	local, err := ioutil.TempDir("", "libretto-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(local)
+	src := filepath.Join(local, "src")
+	os.MkdirAll(filepath.Join(src, "conf.d"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "conf.d", "app.conf"), []byte("port 80"), 0640)
+
+	if err := client.UploadDir(src, "/etc/app"); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if info, err := s.FS.Stat("/etc/app/conf.d/app.conf"); err != nil || info.Mode() != 0640 {
+		t.Fatalf("Expected the directory to be uploaded, got: %v", err)
+	}
+	dst := filepath.Join(local, "dst")
+	if err := client.DownloadDir("/etc/app", dst); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dst, "conf.d", "app.conf")); err != nil || string(b) != "port 80" {
+		t.Fatalf("Expected the directory to be downloaded, got %q: %v", b, err)
+	}
+}
+
+func TestClientWaitForSSHAuthFailure(t *testing.T) {
+	oldDial := dial
+	defer func() { dial = oldDial }()
+	dial = realDial
+
+	s, client := startServer(t)
+	defer s.Close()
+	client.Creds.SSHPassword = "baz"
+
+	if err := client.WaitForSSH(0); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got: %v", err)
+	}
+}
+
+// TestClientKeepAlive tests that the keepalive requests close the tunnels
+// once the connection is gone.
+func TestClientKeepAlive(t *testing.T) {
+	oldDial := dial
+	defer func() { dial = oldDial }()
+	dial = realDial
+
+	s, client := startServer(t)
+	defer s.Close()
+	client.Options.KeepAlive = 1
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer client.Disconnect()
+
+	tunnel, err := client.ForwardLocal("127.0.0.1:0", "127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	s.CloseConnections()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := net.Dial("tcp", tunnel.Addr().String())
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the tunnel to be closed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cssh "golang.org/x/crypto/ssh"
+)
+
+// cancelGrace is how long a command has to exit after it was sent the
+// cancel signal before its session is closed.
+var cancelGrace = 5 * time.Second
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// RunOptions sets up a command run by Command or Sudo.
+type RunOptions struct {
+	// Stdin, Stdout and Stderr are connected to the command if set.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// Env is added to the environment of the command. It is exported by
+	// the remote shell, since sshd usually refuses to set variables.
+	Env map[string]string
+	// Dir is the working directory of the command. It defaults to the
+	// home directory of the user.
+	Dir string
+	// Timeout cancels the command if it runs longer. Zero means no
+	// timeout.
+	Timeout time.Duration
+	// Pty requests a pseudo terminal for the command, of PtyWidth by
+	// PtyHeight characters. The size defaults to that of Options.
+	Pty       bool
+	PtyWidth  int
+	PtyHeight int
+	// CancelSignal is sent to the command when it is canceled or times
+	// out. It defaults to SIGTERM. The session is closed if the command
+	// is still running a few seconds later, which hangs it up if it has a
+	// pseudo terminal.
+	CancelSignal cssh.Signal
+}
+
+// CommandResult is how a command run by Command or Sudo ended.
+type CommandResult struct {
+	// ExitStatus is the exit status of the command. It is 128 plus the
+	// number of the signal that killed the command, as in a shell, and -1
+	// if the server did not tell.
+	ExitStatus int
+	// Signal is the name of the signal that killed the command, such as
+	// "TERM", if any.
+	Signal string
+	// Duration is how long the command ran.
+	Duration time.Duration
+}
+
+// Success reports whether the command exited with status 0.
+func (r *CommandResult) Success() bool {
+	return r.ExitStatus == 0 && r.Signal == ""
+}
+
+// Command runs command through the shell of the user with opts. Unlike Run,
+// a command that fails is not an error: its exit status and signal are in
+// the result. An error is returned if the command could not be run, with a
+// nil result, or if ctx was done or the timeout expired before the command
+// exited, along with what is known of how it ended.
+func (client *SSHClient) Command(ctx context.Context, command string, opts RunOptions) (*CommandResult, error) {
+	return client.command(ctx, command, opts, false)
+}
+
+// Sudo runs command as root with sudo, like Command. sudo is made to ask for
+// the password of the user even if it was cached, and
+// Credentials.SSHPassword is written to sudo -S on stdin once its prompt shows
+// up on stderr, so that the command never reads it. opts.Stdin is only passed
+// on once sudo runs the command. Without a password, sudo -n fails rather
+// than prompting.
+func (client *SSHClient) Sudo(ctx context.Context, command string, opts RunOptions) (*CommandResult, error) {
+	return client.command(ctx, command, opts, true)
+}
+
+func (client *SSHClient) command(ctx context.Context, command string, opts RunOptions, sudo bool) (*CommandResult, error) {
+	script, err := commandScript(command, opts)
+	if err != nil {
+		return nil, err
+	}
+	var prompter *sudoPrompter
+	if sudo {
+		password := client.GetSSHPassword()
+		if password == "" {
+			script = "sudo -n -- sh -c " + shellQuote(script)
+		} else {
+			if prompter, err = newSudoPrompter(password, opts.Stdin); err != nil {
+				return nil, err
+			}
+			script = fmt.Sprintf("sudo -k -S -p %s -- sh -c %s", shellQuote(prompter.prompt),
+				shellQuote(fmt.Sprintf("printf '%%s' %s >&2\n%s", shellQuote(prompter.ready), script)))
+		}
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	session, err := client.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	session.Stdin = opts.Stdin
+	session.Stdout = opts.Stdout
+	session.Stderr = opts.Stderr
+	if prompter != nil {
+		session.Stdin = nil
+		if prompter.stdin, err = session.StdinPipe(); err != nil {
+			return nil, err
+		}
+		// With a pseudo terminal, sudo prompts on stdout.
+		session.Stdout = prompter.filter(opts.Stdout)
+		session.Stderr = prompter.filter(opts.Stderr)
+		defer prompter.finish()
+	}
+	if opts.Pty || client.Options.Pty {
+		if err := client.requestPty(session, opts.PtyWidth, opts.PtyHeight); err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	if err := session.Start(script); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	var ctxErr error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		ctxErr = ctx.Err()
+		sig := opts.CancelSignal
+		if sig == "" {
+			sig = cssh.SIGTERM
+		}
+		session.Signal(sig)
+		select {
+		case err = <-done:
+		case <-time.After(cancelGrace):
+			session.Close()
+			err = <-done
+		}
+	}
+
+	if prompter != nil {
+		prompter.finish()
+	}
+	result, err := commandResult(err, start)
+	if ctxErr != nil {
+		return result, ctxErr
+	}
+	return result, err
+}
+
+// sudoPrompter answers the password prompt of sudo -S and then passes the
+// stdin of the command on. sudo is given a random prompt, and the command
+// writes a random marker to stderr before it runs, so that the password is
+// only written to sudo and the stdin only to the command. Both are removed
+// from the output.
+type sudoPrompter struct {
+	prompt, ready string
+	password      string
+	src           io.Reader
+	stdin         io.WriteCloser
+
+	mu       sync.Mutex
+	prompted bool
+	started  bool
+	finished bool
+	streams  []*sudoStream
+}
+
+func newSudoPrompter(password string, src io.Reader) (*sudoPrompter, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(b)
+	return &sudoPrompter{
+		prompt:   "[libretto sudo " + id + "] password: ",
+		ready:    "[libretto sudo " + id + "] ready\n",
+		password: password,
+		src:      src,
+	}, nil
+}
+
+// filter returns a writer that copies the output of the session to w, which
+// may be nil, and watches it for the prompt and the marker.
+func (p *sudoPrompter) filter(w io.Writer) io.Writer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &sudoStream{p: p, w: w}
+	p.streams = append(p.streams, s)
+	return s
+}
+
+// finish writes the output held back and closes stdin. It is called once the
+// command exited.
+func (p *sudoPrompter) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished {
+		return
+	}
+	p.finished = true
+	for _, s := range p.streams {
+		s.flush(len(s.buf))
+	}
+	p.stdin.Close()
+}
+
+// sudoStream is the stdout or the stderr of a command run by Sudo.
+type sudoStream struct {
+	p   *sudoPrompter
+	w   io.Writer
+	buf []byte
+}
+
+func (s *sudoStream) Write(b []byte) (int, error) {
+	p := s.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.buf = append(s.buf, b...)
+	for !p.started && !p.finished {
+		i := strings.Index(string(s.buf), p.prompt)
+		j := strings.Index(string(s.buf), p.ready)
+		switch {
+		case i >= 0 && (j < 0 || i < j):
+			s.flush(i)
+			s.buf = s.buf[len(p.prompt):]
+			if p.prompted {
+				// The password was wrong: let sudo read EOF and
+				// give up.
+				p.stdin.Close()
+				continue
+			}
+			p.prompted = true
+			io.WriteString(p.stdin, p.password+"\n")
+		case j >= 0:
+			s.flush(j)
+			s.buf = s.buf[len(p.ready):]
+			p.started = true
+			go func() {
+				if p.src != nil {
+					io.Copy(p.stdin, p.src)
+				}
+				p.stdin.Close()
+			}()
+		default:
+			// Hold back what may be the start of the prompt or the
+			// marker.
+			keep := len(p.prompt)
+			if len(p.ready) > keep {
+				keep = len(p.ready)
+			}
+			if n := len(s.buf) - keep + 1; n > 0 {
+				s.flush(n)
+			}
+			return len(b), nil
+		}
+	}
+	s.flush(len(s.buf))
+	return len(b), nil
+}
+
+// flush writes the first n bytes held back.
+func (s *sudoStream) flush(n int) {
+	if s.w != nil && n > 0 {
+		s.w.Write(s.buf[:n])
+	}
+	s.buf = s.buf[n:]
+}
+
+// commandResult returns how a session started at start ended, given the
+// error of Wait. Errors other than the exit status are returned.
+func commandResult(err error, start time.Time) (*CommandResult, error) {
+	result := &CommandResult{Duration: time.Since(start)}
+	switch e := err.(type) {
+	case nil:
+	case *cssh.ExitError:
+		result.ExitStatus = e.ExitStatus()
+		result.Signal = e.Signal()
+	default:
+		result.ExitStatus = -1
+		return result, err
+	}
+	return result, nil
+}
+
+// commandScript returns the shell script that runs command in the directory
+// and with the environment of opts.
+func commandScript(command string, opts RunOptions) (string, error) {
+	var b strings.Builder
+	if opts.Dir != "" {
+		fmt.Fprintf(&b, "cd %s || exit 1\n", shellQuote(opts.Dir))
+	}
+	names := make([]string, 0, len(opts.Env))
+	for name := range opts.Env {
+		if !envName.MatchString(name) {
+			return "", fmt.Errorf("Invalid environment variable name: %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "export %s=%s\n", name, shellQuote(opts.Env[name]))
+	}
+	b.WriteString(command)
+	return b.String(), nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	cssh "golang.org/x/crypto/ssh"
+)
+
+func TestCommand(t *testing.T) {
+	s := startLocalServer(t)
+	defer s.Close()
+	client := dialServer(t, s)
+	defer client.Disconnect()
+
+	dir, err := ioutil.TempDir("", "libretto-command")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var stdout, stderr bytes.Buffer
+	result, err := client.Command(context.Background(), `printf '%s:%s:' "$FOO" "$(pwd)"; cat; echo oops >&2; exit 3`, RunOptions{
+		Stdin:  strings.NewReader("input"),
+		Stdout: &stdout,
+		Stderr: &stderr,
+		Env:    map[string]string{"FOO": "it's $HOME"},
+		Dir:    dir,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if result.ExitStatus != 3 || result.Success() {
+		t.Fatalf("Expected exit status 3, got: %+v", result)
+	}
+	pwd, _ := filepath.EvalSymlinks(dir)
+	if got, want := stdout.String(), "it's $HOME:"+pwd+":input"; got != want {
+		t.Fatalf("Expected stdout %q, got: %q", want, got)
+	}
+	if stderr.String() != "oops\n" {
+		t.Fatalf("Expected stderr oops, got: %q", stderr.String())
+	}
+
+	if _, err := client.Command(context.Background(), "true", RunOptions{Env: map[string]string{"A=B": "C"}}); err == nil {
+		t.Fatal("Expected an invalid environment variable name to be an error")
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	s := startLocalServer(t)
+	defer s.Close()
+	client := dialServer(t, s)
+	defer client.Disconnect()
+
+	result, err := client.Command(context.Background(), "exec sleep 10", RunOptions{Timeout: 100 * time.Millisecond})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected the deadline to be exceeded, got: %v", err)
+	}
+	if result.Signal != "TERM" || result.Duration > 5*time.Second {
+		t.Fatalf("Expected the command to be terminated, got: %+v", result)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	result, err = client.Command(ctx, "exec sleep 10", RunOptions{CancelSignal: cssh.SIGKILL})
+	if err != context.Canceled || result.Signal != "KILL" {
+		t.Fatalf("Expected the command to be killed, got: %+v, %v", result, err)
+	}
+}
+
+func TestSudo(t *testing.T) {
+	// sudo is faked by a script that takes "secret" as the password, and
+	// does not ask for it if $NOPASSWD is set.
+	dir, err := ioutil.TempDir("", "libretto-sudo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sudo := `#!/bin/sh
+prompt=Password:
+while [ "$1" != -- ]; do
+	case "$1" in
+	-n) nopass=1 ;;
+	-p) prompt=$2; shift ;;
+	esac
+	shift
+done
+shift
+if [ -z "$NOPASSWD" ]; then
+	[ -z "$nopass" ] || { echo "a password is required" >&2; exit 1; }
+	printf '%s' "$prompt" >&2
+	read pw
+	if [ "$pw" != secret ]; then
+		echo "Sorry, try again." >&2
+		printf '%s' "$prompt" >&2
+		read pw && [ "$pw" = secret ] || { echo "no password was provided" >&2; exit 1; }
+	fi
+fi
+exec "$@"
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "sudo"), []byte(sudo), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	s := startLocalServer(t)
+	defer s.Close()
+	client := dialServer(t, s)
+	defer client.Disconnect()
+	client.Creds = &Credentials{SSHPassword: "secret"}
+
+	var stdout, stderr bytes.Buffer
+	result, err := client.Sudo(context.Background(), "echo oops >&2; cat", RunOptions{Stdin: strings.NewReader("input"), Stdout: &stdout, Stderr: &stderr})
+	if err != nil || !result.Success() || stdout.String() != "input" {
+		t.Fatalf("Expected the command to run, got: %+v, %v, %q", result, err, stdout.String())
+	}
+	if stderr.String() != "oops\n" {
+		t.Fatalf("Expected the prompt to be hidden, got stderr %q", stderr.String())
+	}
+
+	client.Creds.SSHPassword = "wrong"
+	if result, err := client.Sudo(context.Background(), "true", RunOptions{}); err != nil || result.ExitStatus != 1 {
+		t.Fatalf("Expected sudo to fail, got: %+v, %v", result, err)
+	}
+	client.Creds.SSHPassword = ""
+	if result, err := client.Sudo(context.Background(), "true", RunOptions{}); err != nil || result.ExitStatus != 1 {
+		t.Fatalf("Expected sudo not to prompt, got: %+v, %v", result, err)
+	}
+
+	// The password is not given to commands sudo does not ask it for.
+	t.Setenv("NOPASSWD", "1")
+	client.Creds.SSHPassword = "secret"
+	stdout.Reset()
+	result, err = client.Sudo(context.Background(), "cat", RunOptions{Stdin: strings.NewReader("input"), Stdout: &stdout})
+	if err != nil || !result.Success() || stdout.String() != "input" {
+		t.Fatalf("Expected the command to read only its input, got: %+v, %v, %q", result, err, stdout.String())
+	}
+}
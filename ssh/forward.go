@@ -0,0 +1,300 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	cssh "golang.org/x/crypto/ssh"
+)
+
+// ErrSOCKSProtocol is returned when a client of the SOCKS proxy sends
+// something that does not follow the SOCKS5 protocol.
+var ErrSOCKSProtocol = errors.New("Invalid SOCKS5 message")
+
+// Tunnel is a port forwarding through an SSH connection, as set up by
+// ForwardLocal, ForwardRemote and ForwardDynamic. It stops when it is
+// closed, when the client disconnects or when the keepalive requests find
+// the connection gone.
+type Tunnel struct {
+	listener net.Listener
+	client   *SSHClient
+	wg       sync.WaitGroup
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// Addr returns the address the tunnel listens on, which tells the port
+// picked when the port asked for is 0.
+func (t *Tunnel) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Close stops listening and closes the connections of the tunnel.
+func (t *Tunnel) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	conns := t.conns
+	t.conns = nil
+	t.mu.Unlock()
+
+	err := t.listener.Close()
+	for c := range conns {
+		c.Close()
+	}
+	t.client.removeTunnel(t)
+	t.wg.Wait()
+	return err
+}
+
+// ForwardLocal listens on localAddr, such as "127.0.0.1:5432", and forwards
+// the connections it accepts to remoteAddr, as seen from the remote host,
+// like ssh -L.
+func (client *SSHClient) ForwardLocal(localAddr, remoteAddr string) (*Tunnel, error) {
+	l, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	sc := client.cryptoClient
+	return client.newTunnel(l, func(c net.Conn) (net.Conn, error) {
+		return sc.Dial("tcp", remoteAddr)
+	}), nil
+}
+
+// ForwardRemote asks the remote host to listen on remoteAddr and forwards
+// the connections it accepts to localAddr, like ssh -R. The SSH server may
+// only allow remote hosts to connect if GatewayPorts is set.
+func (client *SSHClient) ForwardRemote(remoteAddr, localAddr string) (*Tunnel, error) {
+	l, err := client.cryptoClient.Listen("tcp", remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	return client.newTunnel(l, func(c net.Conn) (net.Conn, error) {
+		return net.Dial("tcp", localAddr)
+	}), nil
+}
+
+// ForwardDynamic runs a SOCKS5 proxy on localAddr whose connections are made
+// from the remote host, like ssh -D. Only the CONNECT command without
+// authentication is supported.
+func (client *SSHClient) ForwardDynamic(localAddr string) (*Tunnel, error) {
+	l, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	sc := client.cryptoClient
+	return client.newTunnel(l, func(c net.Conn) (net.Conn, error) {
+		return serveSOCKS(sc, c)
+	}), nil
+}
+
+// newTunnel serves the connections l accepts, connecting each with connect.
+func (client *SSHClient) newTunnel(l net.Listener, connect func(net.Conn) (net.Conn, error)) *Tunnel {
+	t := &Tunnel{
+		listener: l,
+		client:   client,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	client.addTunnel(t)
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if !t.track(c) {
+				c.Close()
+				return
+			}
+			t.wg.Add(1)
+			go func() {
+				defer t.wg.Done()
+				defer t.untrack(c)
+
+				r, err := connect(c)
+				if err != nil {
+					return
+				}
+				defer t.untrack(r)
+				if !t.track(r) {
+					return
+				}
+				pipe(c, r)
+			}()
+		}
+	}()
+	return t
+}
+
+// track adds c to the connections closed with the tunnel. It returns false
+// if the tunnel is closed already.
+func (t *Tunnel) track(c net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns[c] = struct{}{}
+	return true
+}
+
+// untrack closes c and removes it from the connections of the tunnel.
+func (t *Tunnel) untrack(c net.Conn) {
+	c.Close()
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+}
+
+func (client *SSHClient) addTunnel(t *Tunnel) {
+	closeMutex.Lock()
+	defer closeMutex.Unlock()
+	if client.tunnels == nil {
+		client.tunnels = make(map[*Tunnel]struct{})
+	}
+	client.tunnels[t] = struct{}{}
+}
+
+func (client *SSHClient) removeTunnel(t *Tunnel) {
+	closeMutex.Lock()
+	defer closeMutex.Unlock()
+	delete(client.tunnels, t)
+}
+
+// closeTunnels closes the tunnels of the client.
+func (client *SSHClient) closeTunnels() {
+	closeMutex.Lock()
+	tunnels := client.tunnels
+	client.tunnels = nil
+	closeMutex.Unlock()
+
+	for t := range tunnels {
+		t.Close()
+	}
+}
+
+// pipe copies data both ways between a and b until both directions are done,
+// passing on the end of each direction.
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface {
+			CloseWrite() error
+		}); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	<-done
+}
+
+// SOCKS5 constants, from RFC 1928.
+const (
+	socksVersion    = 5
+	socksNoAuth     = 0
+	socksNoMethods  = 0xff
+	socksConnect    = 1
+	socksIPv4       = 1
+	socksDomainName = 3
+	socksIPv6       = 4
+
+	socksSucceeded           = 0
+	socksGeneralFailure      = 1
+	socksCommandNotSupported = 7
+	socksAddressNotSupported = 8
+)
+
+// serveSOCKS reads the SOCKS5 request of the client on c and connects to
+// the address it asks for through sc.
+func serveSOCKS(sc *cssh.Client, c net.Conn) (net.Conn, error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return nil, err
+	}
+	if buf[0] != socksVersion {
+		return nil, ErrSOCKSProtocol
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return nil, err
+	}
+	if bytes.IndexByte(methods, socksNoAuth) < 0 {
+		c.Write([]byte{socksVersion, socksNoMethods})
+		return nil, ErrSOCKSProtocol
+	}
+	if _, err := c.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return nil, err
+	}
+
+	reply := func(code byte) {
+		c.Write([]byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	}
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		return nil, err
+	}
+	if buf[0] != socksVersion {
+		return nil, ErrSOCKSProtocol
+	}
+	cmd := buf[1]
+
+	var host string
+	switch buf[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if buf[3] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case socksDomainName:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return nil, err
+		}
+		name := buf[:buf[0]]
+		if _, err := io.ReadFull(c, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		reply(socksAddressNotSupported)
+		return nil, ErrSOCKSProtocol
+	}
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return nil, err
+	}
+	port := int(buf[0])<<8 | int(buf[1])
+
+	if cmd != socksConnect {
+		reply(socksCommandNotSupported)
+		return nil, ErrSOCKSProtocol
+	}
+	r, err := sc.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		reply(socksGeneralFailure)
+		return nil, err
+	}
+	reply(socksSucceeded)
+	return r, nil
+}
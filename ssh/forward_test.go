@@ -0,0 +1,135 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// startEcho runs a server that echoes lines back.
+func startEcho(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fmt.Fprintf(c, "echo %s", line)
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func roundTrip(t *testing.T, c net.Conn, msg string) {
+	if _, err := fmt.Fprintf(c, "%s\n", msg); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || line != "echo "+msg+"\n" {
+		t.Fatalf("Expected the message to be echoed, got %q: %v", line, err)
+	}
+}
+
+func TestForwardLocalAndRemote(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	s := startLocalServer(t)
+	defer s.Close()
+	client := dialServer(t, s)
+
+	local, err := client.ForwardLocal("127.0.0.1:0", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	c, err := net.Dial("tcp", local.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	roundTrip(t, c, "local")
+
+	remote, err := client.ForwardRemote("127.0.0.1:0", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	rc, err := net.Dial("tcp", remote.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	roundTrip(t, rc, "remote")
+
+	// Disconnect closes the tunnels and their connections.
+	client.Disconnect()
+	if _, err := net.Dial("tcp", local.Addr().String()); err == nil {
+		t.Fatal("Expected the local tunnel to be closed")
+	}
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected the connection through the tunnel to be closed")
+	}
+	if err := local.Close(); err != nil {
+		t.Fatalf("Expected closing twice to be a no-op, got: %s", err)
+	}
+}
+
+func TestForwardDynamic(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	s := startLocalServer(t)
+	defer s.Close()
+	client := dialServer(t, s)
+
+	proxy, err := client.ForwardDynamic("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer proxy.Close()
+
+	port := echo.Addr().(*net.TCPAddr).Port
+	tests := []struct {
+		name    string
+		request []byte
+		reply   byte
+	}{
+		{"ipv4", []byte{5, 1, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)}, 0},
+		{"domain", append(append([]byte{5, 1, 0, 3, 9}, "localhost"...), byte(port>>8), byte(port)), 0},
+		{"bind", []byte{5, 2, 0, 1, 127, 0, 0, 1, 0, 1}, 7},
+	}
+	for _, tt := range tests {
+		c, err := net.Dial("tcp", proxy.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte{5, 1, 0})
+		c.Write(tt.request)
+		b := make([]byte, 12)
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatalf("%s: expected a reply, got: %s", tt.name, err)
+		}
+		if b[0] != 5 || b[1] != 0 || b[2] != 5 || b[3] != tt.reply {
+			t.Fatalf("%s: unexpected reply %v", tt.name, b)
+		}
+		if tt.reply == 0 {
+			roundTrip(t, c, tt.name)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	cssh "golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrUnknownHostKey is returned when a host key policy does not know the
+	// host it connects to.
+	ErrUnknownHostKey = errors.New("Unknown host key")
+	// ErrHostKeyMismatch is returned when the key of a host is not the one a
+	// host key policy expects. Someone may be intercepting the connection.
+	ErrHostKeyMismatch = errors.New("Host key mismatch")
+	// ErrNoHostKeys is returned by ParseHostKeys when the console output has
+	// no host keys.
+	ErrNoHostKeys = errors.New("No host keys in console output")
+)
+
+// HostKeyCallback decides whether to trust the key a server presents. The
+// hostname is the address dialed, such as "10.0.0.1:22". It returns nil to
+// accept the key.
+type HostKeyCallback func(hostname string, remote net.Addr, key cssh.PublicKey) error
+
+// KnownHosts returns a HostKeyCallback that accepts only the keys listed for
+// the host in the known_hosts files, such as ~/.ssh/known_hosts. Hashed host
+// names, wildcards, negations and @revoked markers are supported. The files
+// are read on every connection, so that changes are picked up. A host listed
+// with other keys only, whatever their type, is a mismatch.
+func KnownHosts(files ...string) HostKeyCallback {
+	return func(hostname string, remote net.Addr, key cssh.PublicKey) error {
+		return checkKnownHosts(files, false, hostname, remote, key)
+	}
+}
+
+// tofuMu serializes the updates of known_hosts files by TrustOnFirstUse.
+var tofuMu sync.Mutex
+
+// TrustOnFirstUse returns a HostKeyCallback that accepts the key of a host it
+// does not know yet and records it in the known_hosts file, which is created
+// if needed. Later connections to the host must present the same key.
+func TrustOnFirstUse(file string) HostKeyCallback {
+	return func(hostname string, remote net.Addr, key cssh.PublicKey) error {
+		tofuMu.Lock()
+		defer tofuMu.Unlock()
+
+		err := checkKnownHosts([]string{file}, true, hostname, remote, key)
+		if !errors.Is(err, ErrUnknownHostKey) {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		line := knownHostsAddr(hostname) + " " + string(cssh.MarshalAuthorizedKey(key))
+		if _, err := f.WriteString(line); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+}
+
+// HostKeys returns a HostKeyCallback that accepts only the given keys, such
+// as those a provider reports for a VM.
+func HostKeys(keys ...cssh.PublicKey) HostKeyCallback {
+	return func(hostname string, remote net.Addr, key cssh.PublicKey) error {
+		for _, k := range keys {
+			if keysEqual(k, key) {
+				return nil
+			}
+		}
+		return hostKeyError(hostname, key, ErrHostKeyMismatch)
+	}
+}
+
+// HostKeyFingerprint returns a HostKeyCallback that accepts only the keys
+// with one of the given fingerprints, either SHA256 ("SHA256:...") or MD5
+// ("aa:bb:..." with an optional "MD5:" prefix), as ssh-keygen -l prints
+// them.
+func HostKeyFingerprint(fingerprints ...string) HostKeyCallback {
+	return func(hostname string, remote net.Addr, key cssh.PublicKey) error {
+		sha := cssh.FingerprintSHA256(key)
+		md5 := cssh.FingerprintLegacyMD5(key)
+		for _, fp := range fingerprints {
+			if fp == sha || strings.TrimPrefix(fp, "MD5:") == md5 {
+				return nil
+			}
+		}
+		return hostKeyError(hostname, key, ErrHostKeyMismatch)
+	}
+}
+
+// ParseHostKeys returns the host keys printed by cloud-init on the console of
+// a VM, between the "-----BEGIN SSH HOST KEY KEYS-----" and
+// "-----END SSH HOST KEY KEYS-----" lines. If the keys were printed more than
+// once, such as after a reboot, the last ones are returned.
+func ParseHostKeys(console []byte) ([]cssh.PublicKey, error) {
+	var keys, block []cssh.PublicKey
+	in := false
+	s := bufio.NewScanner(bytes.NewReader(console))
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.Contains(line, "-----BEGIN SSH HOST KEY KEYS-----"):
+			in, block = true, nil
+		case strings.Contains(line, "-----END SSH HOST KEY KEYS-----"):
+			if in && len(block) > 0 {
+				keys = block
+			}
+			in = false
+		case in:
+			// Serial consoles may prefix the lines with a timestamp.
+			i := strings.Index(line, "ssh-")
+			if j := strings.Index(line, "ecdsa-"); j >= 0 && (i < 0 || j < i) {
+				i = j
+			}
+			if i >= 0 {
+				if key, _, _, _, err := cssh.ParseAuthorizedKey([]byte(line[i:])); err == nil {
+					block = append(block, key)
+				}
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoHostKeys
+	}
+	return keys, nil
+}
+
+// checkKnownHosts checks key against the entries of files for hostname and
+// remote. If ignoreMissing is set, missing files are taken as empty.
+func checkKnownHosts(files []string, ignoreMissing bool, hostname string, remote net.Addr, key cssh.PublicKey) error {
+	addrs := []string{knownHostsAddr(hostname)}
+	if remote != nil {
+		if a := knownHostsAddr(remote.String()); a != addrs[0] {
+			addrs = append(addrs, a)
+		}
+	}
+
+	found, mismatch := false, false
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			if ignoreMissing && os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for len(b) > 0 {
+			marker, hosts, k, _, rest, err := cssh.ParseKnownHosts(b)
+			if err != nil {
+				// Skip the invalid line.
+				i := bytes.IndexByte(b, '\n')
+				if i < 0 {
+					break
+				}
+				b = b[i+1:]
+				continue
+			}
+			b = rest
+			if marker == "cert-authority" || !hostsMatch(hosts, addrs) {
+				continue
+			}
+			// A revoked key is rejected wherever it is listed, so the
+			// files are read to the end.
+			switch {
+			case marker == "revoked":
+				if keysEqual(k, key) {
+					return hostKeyError(hostname, key, ErrHostKeyMismatch)
+				}
+			case keysEqual(k, key):
+				found = true
+			default:
+				mismatch = true
+			}
+		}
+	}
+	if found {
+		return nil
+	}
+	if mismatch {
+		return hostKeyError(hostname, key, ErrHostKeyMismatch)
+	}
+	return hostKeyError(hostname, key, ErrUnknownHostKey)
+}
+
+// knownHostsAddr returns the name of the address "host:port" in known_hosts
+// files: the host alone on port 22, "[host]:port" otherwise.
+func knownHostsAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// hostsMatch reports whether one of addrs matches the host patterns of a
+// known_hosts entry.
+func hostsMatch(patterns, addrs []string) bool {
+	matched := false
+	for _, p := range patterns {
+		negated := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		for _, a := range addrs {
+			if !hostMatch(p, a) {
+				continue
+			}
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// hostMatch matches one pattern, which may be hashed ("|1|salt|hash") or
+// have * and ? wildcards.
+func hostMatch(pattern, addr string) bool {
+	if strings.HasPrefix(pattern, "|1|") {
+		parts := strings.Split(pattern[3:], "|")
+		if len(parts) != 2 {
+			return false
+		}
+		salt, err1 := base64.StdEncoding.DecodeString(parts[0])
+		hash, err2 := base64.StdEncoding.DecodeString(parts[1])
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(addr))
+		return hmac.Equal(mac.Sum(nil), hash)
+	}
+	return wildcardMatch(strings.ToLower(pattern), strings.ToLower(addr))
+}
+
+// wildcardMatch matches s against pattern, where * matches any sequence of
+// characters and ? any one character.
+func wildcardMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+func keysEqual(a, b cssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
+
+func hostKeyError(hostname string, key cssh.PublicKey, err error) error {
+	return fmt.Errorf("ssh: %s key %s of %s: %w", key.Type(), cssh.FingerprintSHA256(key), hostname, err)
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cssh "golang.org/x/crypto/ssh"
+)
+
+func newHostKey(t *testing.T) cssh.PublicKey {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := cssh.NewPublicKey(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func authorizedKey(k cssh.PublicKey) string {
+	return strings.TrimSpace(string(cssh.MarshalAuthorizedKey(k)))
+}
+
+func TestKnownHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	known, other, revoked, wild := newHostKey(t), newHostKey(t), newHostKey(t), newHostKey(t)
+	mac := hmac.New(sha1.New, []byte("salt"))
+	mac.Write([]byte("10.0.0.3"))
+	hashed := "|1|" + base64.StdEncoding.EncodeToString([]byte("salt")) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	file := filepath.Join(dir, "known_hosts")
+	content := strings.Join([]string{
+		"# comment",
+		"10.0.0.1,[10.0.0.2]:2222 " + authorizedKey(known),
+		"not a valid line",
+		hashed + " " + authorizedKey(known),
+		"@revoked * " + authorizedKey(revoked),
+		"*.example.com,!bad.example.com " + authorizedKey(wild),
+	}, "\n")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	check := KnownHosts(file)
+	tests := []struct {
+		host string
+		key  cssh.PublicKey
+		want error
+	}{
+		{"10.0.0.1:22", known, nil},
+		{"10.0.0.2:2222", known, nil},
+		{"10.0.0.3:22", known, nil},
+		{"10.0.0.1:22", other, ErrHostKeyMismatch},
+		{"10.0.0.2:22", known, ErrUnknownHostKey},
+		{"10.0.0.1:22", revoked, ErrHostKeyMismatch},
+		{"vm.example.com:22", wild, nil},
+		{"bad.example.com:22", wild, ErrUnknownHostKey},
+	}
+	for _, tt := range tests {
+		err := check(tt.host, nil, tt.key)
+		if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.host, tt.want, err)
+		}
+	}
+
+	if err := KnownHosts(filepath.Join(dir, "missing"))("10.0.0.1:22", nil, known); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing file error, got %v", err)
+	}
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "ssh", "known_hosts")
+	check := TrustOnFirstUse(file)
+	key := newHostKey(t)
+	if err := check("10.0.0.1:2222", nil, key); err != nil {
+		t.Fatalf("Expected the first key to be trusted, got: %s", err)
+	}
+	if err := check("10.0.0.1:2222", nil, key); err != nil {
+		t.Fatalf("Expected the same key to be trusted, got: %s", err)
+	}
+	if err := check("10.0.0.1:2222", nil, newHostKey(t)); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("Expected a mismatch, got: %v", err)
+	}
+	if err := KnownHosts(file)("10.0.0.1:2222", nil, key); err != nil {
+		t.Fatalf("Expected the key to be recorded, got: %s", err)
+	}
+}
+
+// TestTrustOnFirstUseOtherType tests that a host recorded with a key of one
+// type is not trusted again with a key of another type.
+func TestTrustOnFirstUseOtherType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, ed25519Key := newKeyOfType(t, Ed25519Key)
+	_, rsaKey := newKeyOfType(t, RSAKey)
+	file := filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(file, []byte("10.0.0.1 "+authorizedKey(ed25519Key.PublicKey())+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := TrustOnFirstUse(file)("10.0.0.1:22", nil, rsaKey.PublicKey()); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("Expected a mismatch, got: %v", err)
+	}
+	if err := KnownHosts(file)("10.0.0.1:22", nil, rsaKey.PublicKey()); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("Expected the RSA key not to be recorded, got: %v", err)
+	}
+}
+
+func TestHostKeyFingerprint(t *testing.T) {
+	key := newHostKey(t)
+	for _, fp := range []string{cssh.FingerprintSHA256(key), cssh.FingerprintLegacyMD5(key), "MD5:" + cssh.FingerprintLegacyMD5(key)} {
+		if err := HostKeyFingerprint("SHA256:other", fp)("h:22", nil, key); err != nil {
+			t.Errorf("Expected %s to match, got: %s", fp, err)
+		}
+	}
+	if err := HostKeyFingerprint(cssh.FingerprintSHA256(key))("h:22", nil, newHostKey(t)); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Errorf("Expected a mismatch, got: %v", err)
+	}
+}
+
+func TestParseHostKeys(t *testing.T) {
+	old, k1, k2 := newHostKey(t), newHostKey(t), newHostKey(t)
+	console := fmt.Sprintf(`[    5.1] cloud-init[800]: Generating public/private rsa key pair.
+-----BEGIN SSH HOST KEY KEYS-----
+%s root@old
+-----END SSH HOST KEY KEYS-----
+rebooting
+[   10.2] -----BEGIN SSH HOST KEY KEYS-----
+[   10.2] %s root@vm
+%s root@vm
+[   10.3] -----END SSH HOST KEY KEYS-----
+`, authorizedKey(old), authorizedKey(k1), authorizedKey(k2))
+
+	keys, err := ParseHostKeys([]byte(strings.Replace(console, "\n", "\r\n", -1)))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if len(keys) != 2 || !keysEqual(keys[0], k1) || !keysEqual(keys[1], k2) {
+		t.Fatalf("Expected the keys of the last boot, got: %v", keys)
+	}
+	if err := HostKeys(keys...)("h:22", nil, old); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("Expected the old key to be rejected, got: %v", err)
+	}
+
+	if _, err := ParseHostKeys([]byte("booting\n")); err != ErrNoHostKeys {
+		t.Fatalf("Expected ErrNoHostKeys, got: %v", err)
+	}
+}
+
+// TestConnectHostKeyError tests that Connect returns the error of the host
+// key policy as is, and that WaitForSSH does not retry after it.
+func TestConnectHostKeyError(t *testing.T) {
+	c := requireMockedClient()
+	c.Creds.SSHUser = "foo"
+	c.Creds.SSHPassword = "bar"
+	key := newHostKey(t)
+	c.Options.HostKey = HostKeys(newHostKey(t))
+
+	oldDial := dial
+	defer func() { dial = oldDial }()
+	calls := 0
+	dial = func(network, addr string, config *cssh.ClientConfig) (*cssh.Client, error) {
+		calls++
+		if err := config.HostKeyCallback(addr, nil, key); err != nil {
+			return nil, fmt.Errorf("ssh: handshake failed: %v", err)
+		}
+		return nil, nil
+	}
+
+	if err := c.WaitForSSH(Timeout); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("Expected a host key mismatch, got: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("Expected one connection attempt, got %d", calls)
+	}
+}
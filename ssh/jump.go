@@ -0,0 +1,106 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	cssh "golang.org/x/crypto/ssh"
+)
+
+// JumpHost is a bastion an SSHClient connects through to reach a server that
+// is not reachable directly, such as a VM with only a private IP.
+type JumpHost struct {
+	// Host is the name or IP of the jump host.
+	Host string
+	// Port defaults to 22.
+	Port int
+	// Creds log in to the jump host. If nil, those of the client are used.
+	Creds *Credentials
+	// HostKey verifies the key of the jump host. If nil, any host key is
+	// accepted.
+	HostKey HostKeyCallback
+}
+
+// creds returns the credentials that log in to j when those of the client
+// are creds.
+func (j JumpHost) creds(creds *Credentials) *Credentials {
+	if j.Creds != nil {
+		return j.Creds
+	}
+	return creds
+}
+
+func (j JumpHost) addr() string {
+	port := sshPort
+	if j.Port != 0 {
+		port = j.Port
+	}
+	return net.JoinHostPort(j.Host, strconv.Itoa(port))
+}
+
+// dialJumpHosts connects to the jump hosts in order, each through the
+// previous one, and returns their clients and the host keys they presented.
+// creds log in to the jump hosts without their own.
+func dialJumpHosts(hosts []JumpHost, creds *Credentials) ([]*cssh.Client, []seenHostKey, error) {
+	var (
+		jumps    []*cssh.Client
+		hostKeys []seenHostKey
+	)
+	for _, j := range hosts {
+		c, seen, err := dialJumpHost(j, creds, jumps)
+		if err != nil {
+			closeClients(jumps)
+			return nil, nil, fmt.Errorf("ssh: jump host %s: %w", j.addr(), err)
+		}
+		jumps = append(jumps, c)
+		hostKeys = append(hostKeys, seen)
+	}
+	return jumps, hostKeys, nil
+}
+
+func dialJumpHost(j JumpHost, creds *Credentials, jumps []*cssh.Client) (*cssh.Client, seenHostKey, error) {
+	var seen seenHostKey
+	config, done, err := clientConfig(j.creds(creds), j.HostKey, &seen)
+	if err != nil {
+		return nil, seen, err
+	}
+	defer done()
+
+	var c *cssh.Client
+	if len(jumps) == 0 {
+		c, err = dial("tcp", j.addr(), config)
+	} else {
+		c, err = dialVia(jumps[len(jumps)-1], j.addr(), config)
+	}
+	if seen.err != nil {
+		return nil, seen, seen.err
+	}
+	return c, seen, err
+}
+
+// dialVia connects to the SSH server at addr through the connection of via.
+var dialVia = func(via *cssh.Client, addr string, config *cssh.ClientConfig) (*cssh.Client, error) {
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := cssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return cssh.NewClient(c, chans, reqs), nil
+}
+
+// closeClients closes clients, the last one first since it goes through the
+// others.
+func closeClients(clients []*cssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
+	}
+}
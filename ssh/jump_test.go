@@ -0,0 +1,82 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	cssh "golang.org/x/crypto/ssh"
+)
+
+// TestConnectJumpHosts tests that Connect dials the first jump host, then
+// each next hop through the previous one, with the credentials of each.
+func TestConnectJumpHosts(t *testing.T) {
+	c := requireMockedClient()
+	c.Creds.SSHUser = "target"
+	c.Creds.SSHPassword = "bar"
+	c.IP = net.ParseIP("10.0.0.5")
+	c.Options.JumpHosts = []JumpHost{
+		{Host: "bastion.example.com", Creds: &Credentials{SSHUser: "bastion", SSHPassword: "baz"}},
+		{Host: "192.168.0.1", Port: 2222},
+	}
+
+	oldDial, oldDialVia := dial, dialVia
+	defer func() { dial, dialVia = oldDial, oldDialVia }()
+
+	var hops []string
+	clients := map[*cssh.Client]string{}
+	dial = func(network, addr string, config *cssh.ClientConfig) (*cssh.Client, error) {
+		hops = append(hops, fmt.Sprintf("%s@%s", config.User, addr))
+		cl := &cssh.Client{}
+		clients[cl] = addr
+		return cl, nil
+	}
+	dialVia = func(via *cssh.Client, addr string, config *cssh.ClientConfig) (*cssh.Client, error) {
+		hops = append(hops, fmt.Sprintf("%s@%s via %s", config.User, addr, clients[via]))
+		cl := &cssh.Client{}
+		clients[cl] = addr
+		return cl, nil
+	}
+
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	want := []string{
+		"bastion@bastion.example.com:22",
+		"target@192.168.0.1:2222 via bastion.example.com:22",
+		"target@10.0.0.5:22 via 192.168.0.1:2222",
+	}
+	if fmt.Sprint(hops) != fmt.Sprint(want) {
+		t.Fatalf("Expected hops %v, got %v", want, hops)
+	}
+	if len(c.jumps) != 2 || clients[c.cryptoClient] != "10.0.0.5:22" {
+		t.Fatalf("Expected the client to go through both jump hosts")
+	}
+}
+
+func TestConnectJumpHostErrors(t *testing.T) {
+	c := requireMockedClient()
+	c.Creds.SSHUser = "foo"
+	c.Creds.SSHPassword = "bar"
+	c.Options.JumpHosts = []JumpHost{{Host: "bastion", Creds: &Credentials{SSHUser: "foo"}}}
+	if err := c.Connect(); err != ErrInvalidAuth {
+		t.Fatalf("Expected ErrInvalidAuth, got: %v", err)
+	}
+
+	oldDial := dial
+	defer func() { dial = oldDial }()
+	key := newHostKey(t)
+	dial = func(network, addr string, config *cssh.ClientConfig) (*cssh.Client, error) {
+		if err := config.HostKeyCallback(addr, nil, key); err != nil {
+			return nil, fmt.Errorf("ssh: handshake failed: %v", err)
+		}
+		return nil, nil
+	}
+	c.Options.JumpHosts = []JumpHost{{Host: "bastion", HostKey: HostKeys(newHostKey(t))}}
+	if err := c.WaitForSSH(Timeout); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("Expected a host key mismatch on the jump host, got: %v", err)
+	}
+}
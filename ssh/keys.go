@@ -3,45 +3,231 @@
 package ssh
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	stded25519 "crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"runtime"
+	"strings"
 
+	"golang.org/x/crypto/ed25519"
 	gossh "golang.org/x/crypto/ssh"
 )
 
+// opensshPEMType is the PEM type of private keys in the OpenSSH format.
+const opensshPEMType = "OPENSSH PRIVATE KEY"
+
+// KeyType is the algorithm of an SSH key.
+type KeyType string
+
+const (
+	// RSAKey is an RSA key. It is the default.
+	RSAKey KeyType = "rsa"
+	// ECDSAKey is an ECDSA key on a NIST curve.
+	ECDSAKey KeyType = "ecdsa"
+	// Ed25519Key is an Ed25519 key.
+	Ed25519Key KeyType = "ed25519"
+)
+
+// KeyOptions configures the keys NewKeyPairWithOptions generates.
+type KeyOptions struct {
+	// Type is the algorithm of the key, RSAKey by default.
+	Type KeyType
+	// Bits is the size of RSA keys, 2048 by default, or the curve of ECDSA
+	// keys: 256 (the default), 384 or 521.
+	Bits int
+	// OpenSSH writes the private key in the OpenSSH format, as ssh-keygen
+	// does, rather than PEM. Ed25519 keys and keys with a passphrase are
+	// always in the OpenSSH format.
+	OpenSSH bool
+	// Passphrase encrypts the private key with aes256-ctr and bcrypt if set.
+	Passphrase string
+	// Comment is appended to the public key and stored in OpenSSH private
+	// keys.
+	Comment string
+}
+
 // NewKeyPair generates a new SSH keypair. This will return a private & public key encoded as DER.
 func NewKeyPair() (keyPair *KeyPair, err error) {
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, ErrKeyGeneration
-	}
+	return NewKeyPairWithOptions(KeyOptions{})
+}
 
-	if err := priv.Validate(); err != nil {
-		return nil, ErrValidation
+// NewKeyPairWithOptions generates a new SSH keypair of the type and size set
+// in opts. The public key is in the authorized_keys format.
+func NewKeyPairWithOptions(opts KeyOptions) (*KeyPair, error) {
+	var (
+		key   crypto.Signer
+		block *pem.Block
+	)
+	switch opts.Type {
+	case RSAKey, "":
+		bits := opts.Bits
+		if bits == 0 {
+			bits = 2048
+		}
+		priv, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, ErrKeyGeneration
+		}
+		if err := priv.Validate(); err != nil {
+			return nil, ErrValidation
+		}
+		key = priv
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}
+	case ECDSAKey:
+		var curve elliptic.Curve
+		switch opts.Bits {
+		case 256, 0:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Invalid ECDSA key size: %d", opts.Bits)
+		}
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, ErrKeyGeneration
+		}
+		der, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, ErrKeyGeneration
+		}
+		key = priv
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case Ed25519Key:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, ErrKeyGeneration
+		}
+		key = priv
+		opts.OpenSSH = true
+	default:
+		return nil, fmt.Errorf("Invalid key type: %s", opts.Type)
 	}
 
-	privDer := x509.MarshalPKCS1PrivateKey(priv)
-	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Headers: nil, Bytes: privDer})
-	pubSSH, err := gossh.NewPublicKey(&priv.PublicKey)
+	pubSSH, err := gossh.NewPublicKey(key.Public())
 	if err != nil {
 		return nil, ErrPublicKey
 	}
+	publicKey := gossh.MarshalAuthorizedKey(pubSSH)
+	if opts.Comment != "" {
+		publicKey = append(bytes.TrimSuffix(publicKey, []byte("\n")), []byte(" "+opts.Comment+"\n")...)
+	}
+
+	switch {
+	case opts.Passphrase != "":
+		block, err = gossh.MarshalPrivateKeyWithPassphrase(key, opts.Comment, []byte(opts.Passphrase))
+	case opts.OpenSSH:
+		block, err = gossh.MarshalPrivateKey(key, opts.Comment)
+	}
+	if err != nil {
+		return nil, err
+	}
+	privateKey := pem.EncodeToMemory(block)
 
 	return &KeyPair{
 		PrivateKey: privateKey,
-		PublicKey:  gossh.MarshalAuthorizedKey(pubSSH),
+		PublicKey:  publicKey,
 	}, nil
 }
 
+// ParsePrivateKey returns a signer for a private key in the PEM (PKCS#1,
+// SEC 1, PKCS#8 or DSA) or OpenSSH format. Encrypted keys are decrypted with
+// passphrase; ErrPassphraseRequired is returned if it is empty and
+// ErrInvalidPassphrase if it is wrong.
+func ParsePrivateKey(privateKey []byte, passphrase string) (gossh.Signer, error) {
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return nil, errors.New("ssh: no key found")
+	}
+
+	var (
+		key interface{}
+		err error
+	)
+	if block.Type == opensshPEMType {
+		key, err = parseOpenSSHPrivateKey(privateKey, []byte(passphrase))
+	} else {
+		key, err = parsePEMPrivateKey(block, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gossh.NewSignerFromKey(key)
+}
+
+// parseOpenSSHPrivateKey parses a key in the OpenSSH format, which is
+// decrypted with passphrase if it is encrypted.
+func parseOpenSSHPrivateKey(privateKey, passphrase []byte) (interface{}, error) {
+	key, err := gossh.ParseRawPrivateKey(privateKey)
+	var missing *gossh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return key, err
+	}
+	if len(passphrase) == 0 {
+		return nil, ErrPassphraseRequired
+	}
+	key, err = gossh.ParseRawPrivateKeyWithPassphrase(privateKey, passphrase)
+	if err == x509.IncorrectPasswordError {
+		return nil, ErrInvalidPassphrase
+	}
+	return key, err
+}
+
+func parsePEMPrivateKey(block *pem.Block, passphrase []byte) (interface{}, error) {
+	if !x509.IsEncryptedPEMBlock(block) {
+		return parsePEMKey(block.Type, block.Bytes)
+	}
+	if len(passphrase) == 0 {
+		return nil, ErrPassphraseRequired
+	}
+	der, err := x509.DecryptPEMBlock(block, passphrase)
+	if err == x509.IncorrectPasswordError {
+		return nil, ErrInvalidPassphrase
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The padding check of DecryptPEMBlock misses some wrong passphrases.
+	key, err := parsePEMKey(block.Type, der)
+	if err != nil {
+		return nil, ErrInvalidPassphrase
+	}
+	return key, nil
+}
+
+func parsePEMKey(typ string, der []byte) (interface{}, error) {
+	switch typ {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(der)
+	case "DSA PRIVATE KEY":
+		return gossh.ParseDSAPrivateKey(der)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if k, ok := key.(stded25519.PrivateKey); ok {
+			return ed25519.PrivateKey(k), nil
+		}
+		return key, err
+	default:
+		return nil, fmt.Errorf("ssh: unsupported key type %q", typ)
+	}
+}
+
 // KeyPair represents a Public and Private keypair.
 type KeyPair struct {
 	PrivateKey []byte
@@ -104,12 +290,24 @@ func (kp *KeyPair) WriteToFile(privateKeyPath string, publicKeyPath string) erro
 	return nil
 }
 
-// Fingerprint calculates the fingerprint of the public key
+// Fingerprint calculates the MD5 fingerprint of the public key, in
+// hexadecimal without colons.
 func (kp *KeyPair) Fingerprint() string {
-	b, _ := base64.StdEncoding.DecodeString(string(kp.PublicKey))
-	h := md5.New()
-
-	io.WriteString(h, string(b))
+	pub, _, _, _, err := gossh.ParseAuthorizedKey(kp.PublicKey)
+	if err != nil {
+		// The public key may be the bare base64 encoded key.
+		b, _ := base64.StdEncoding.DecodeString(string(kp.PublicKey))
+		return fmt.Sprintf("%x", md5.Sum(b))
+	}
+	return strings.Replace(gossh.FingerprintLegacyMD5(pub), ":", "", -1)
+}
 
-	return fmt.Sprintf("%x", h.Sum(nil))
+// FingerprintSHA256 calculates the SHA256 fingerprint of the public key, as
+// ssh-keygen -l prints it ("SHA256:...").
+func (kp *KeyPair) FingerprintSHA256() (string, error) {
+	pub, _, _, _, err := gossh.ParseAuthorizedKey(kp.PublicKey)
+	if err != nil {
+		return "", ErrPublicKey
+	}
+	return gossh.FingerprintSHA256(pub), nil
 }
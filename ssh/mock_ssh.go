@@ -3,10 +3,19 @@
 package ssh
 
 import (
+	"context"
 	"io"
 	"time"
 )
 
+// Command calls the mocked Command.
+func (c *MockSSHClient) Command(ctx context.Context, command string, opts RunOptions) (*CommandResult, error) {
+	if c.MockCommand != nil {
+		return c.MockCommand(ctx, command, opts)
+	}
+	return nil, ErrNotImplemented
+}
+
 // Connect calls the mocked connect.
 func (c *MockSSHClient) Connect() error {
 	if c.MockConnect != nil {
@@ -40,6 +49,30 @@ func (c *MockSSHClient) Run(command string, stdout io.Writer, stderr io.Writer)
 	return ErrNotImplemented
 }
 
+// Shell calls the mocked Shell.
+func (c *MockSSHClient) Shell(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, opts ShellOptions) (*CommandResult, error) {
+	if c.MockShell != nil {
+		return c.MockShell(ctx, stdin, stdout, stderr, opts)
+	}
+	return nil, ErrNotImplemented
+}
+
+// Sudo calls the mocked Sudo.
+func (c *MockSSHClient) Sudo(ctx context.Context, command string, opts RunOptions) (*CommandResult, error) {
+	if c.MockSudo != nil {
+		return c.MockSudo(ctx, command, opts)
+	}
+	return nil, ErrNotImplemented
+}
+
+// Sync calls the mocked Sync.
+func (c *MockSSHClient) Sync(ctx context.Context, localDir, remoteDir string, opts SyncOptions) (*SyncResult, error) {
+	if c.MockSync != nil {
+		return c.MockSync(ctx, localDir, remoteDir, opts)
+	}
+	return nil, ErrNotImplemented
+}
+
 // Upload calls the mocked upload
 func (c *MockSSHClient) Upload(src io.Reader, dst string, mode uint32) error {
 	if c.MockUpload != nil {
@@ -48,6 +81,54 @@ func (c *MockSSHClient) Upload(src io.Reader, dst string, mode uint32) error {
 	return ErrNotImplemented
 }
 
+// UploadStream calls the mocked UploadStream
+func (c *MockSSHClient) UploadStream(src io.Reader, size int64, dst string, mode uint32, progress ProgressFunc) error {
+	if c.MockUploadStream != nil {
+		return c.MockUploadStream(src, size, dst, mode, progress)
+	}
+	return ErrNotImplemented
+}
+
+// UploadDir calls the mocked UploadDir
+func (c *MockSSHClient) UploadDir(localDir, remoteDir string) error {
+	if c.MockUploadDir != nil {
+		return c.MockUploadDir(localDir, remoteDir)
+	}
+	return ErrNotImplemented
+}
+
+// DownloadDir calls the mocked DownloadDir
+func (c *MockSSHClient) DownloadDir(remoteDir, localDir string) error {
+	if c.MockDownloadDir != nil {
+		return c.MockDownloadDir(remoteDir, localDir)
+	}
+	return ErrNotImplemented
+}
+
+// ForwardLocal calls the mocked ForwardLocal.
+func (c *MockSSHClient) ForwardLocal(localAddr, remoteAddr string) (*Tunnel, error) {
+	if c.MockForwardLocal != nil {
+		return c.MockForwardLocal(localAddr, remoteAddr)
+	}
+	return nil, ErrNotImplemented
+}
+
+// ForwardRemote calls the mocked ForwardRemote.
+func (c *MockSSHClient) ForwardRemote(remoteAddr, localAddr string) (*Tunnel, error) {
+	if c.MockForwardRemote != nil {
+		return c.MockForwardRemote(remoteAddr, localAddr)
+	}
+	return nil, ErrNotImplemented
+}
+
+// ForwardDynamic calls the mocked ForwardDynamic.
+func (c *MockSSHClient) ForwardDynamic(localAddr string) (*Tunnel, error) {
+	if c.MockForwardDynamic != nil {
+		return c.MockForwardDynamic(localAddr)
+	}
+	return nil, ErrNotImplemented
+}
+
 // Validate calls the mocked validate.
 func (c *MockSSHClient) Validate() error {
 	if c.MockValidate != nil {
@@ -64,6 +145,14 @@ func (c *MockSSHClient) WaitForSSH(maxWait time.Duration) error {
 	return ErrNotImplemented
 }
 
+// WaitForSSHContext calls the mocked WaitForSSHContext
+func (c *MockSSHClient) WaitForSSHContext(ctx context.Context, maxWait time.Duration) error {
+	if c.MockWaitForSSHContext != nil {
+		return c.MockWaitForSSHContext(ctx, maxWait)
+	}
+	return ErrNotImplemented
+}
+
 // SetSSHPrivateKey calls the mocked SetSSHPrivateKey
 func (c *MockSSHClient) SetSSHPrivateKey(s string) {
 	if c.MockSetSSHPrivateKey != nil {
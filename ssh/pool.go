@@ -0,0 +1,199 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	cssh "golang.org/x/crypto/ssh"
+)
+
+// DefaultIdleTimeout is how long a Pool keeps a connection that no client
+// uses when no idle timeout is given.
+const DefaultIdleTimeout = 5 * time.Minute
+
+// Pool shares one SSH connection per user and host among the clients whose
+// Options.Pool it is, each command or transfer opening its own session on
+// it. Connect takes the connection from the pool, dialing it if there is none
+// or if it broke, and Disconnect gives it back. A connection no client uses
+// is closed after the idle timeout.
+//
+// Only clients logging in with the same credentials share a connection, and
+// Connect fails, as dialing would, if the client's HostKey or those of its
+// jump hosts reject the keys presented when the connection was made.
+//
+// A Pool is safe for concurrent use, but an SSHClient is not: give each
+// goroutine its own client, with the same Pool.
+type Pool struct {
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[string]*pooledConn
+}
+
+// pooledConn is a connection of a Pool and the number of clients using it.
+type pooledConn struct {
+	key    string
+	client *cssh.Client
+	jumps  []*cssh.Client
+	// hostKeys are the keys presented by the jump hosts, in order, then by
+	// the server.
+	hostKeys []seenHostKey
+	refs     int
+	idle     *time.Timer
+}
+
+// NewPool returns a Pool that closes connections no client used for
+// idleTimeout, or DefaultIdleTimeout if it is 0.
+func NewPool(idleTimeout time.Duration) *Pool {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	return &Pool{
+		idleTimeout: idleTimeout,
+		conns:       make(map[string]*pooledConn),
+	}
+}
+
+// Close closes the connections of the pool. The clients using them fail
+// until they connect again.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = make(map[string]*pooledConn)
+	p.mu.Unlock()
+
+	for _, pc := range conns {
+		pc.close()
+	}
+	return nil
+}
+
+// poolKey identifies the connections a client can share: those to the same
+// server, through the same jump hosts, logged in with the same credentials.
+func (client *SSHClient) poolKey() string {
+	key := []string{client.addr() + "/" + client.Creds.fingerprint()}
+	for _, j := range client.Options.JumpHosts {
+		key = append(key, j.addr()+"/"+j.creds(client.Creds).fingerprint())
+	}
+	return strings.Join(key, ",")
+}
+
+// fingerprint identifies the user and the secrets that c logs in with.
+// Callbacks cannot be compared, so credentials with Signers or
+// KeyboardInteractive only match themselves.
+func (c *Credentials) fingerprint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := sha256.New()
+	for _, s := range []string{c.SSHUser, c.SSHPassword, c.SSHPrivateKey, c.SSHPassphrase, c.SSHCertificate, c.SSHAgentSocket, strings.Join(c.AuthMethods, ",")} {
+		fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+	if c.Signers != nil || c.KeyboardInteractive != nil {
+		fmt.Fprintf(h, "%p", c)
+	}
+	return c.SSHUser + "@" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// acquire returns the connection for key, connecting with dial if the pool
+// has none. A connection dialed by another client is only returned if check,
+// which verifies its host keys, accepts it.
+func (p *Pool) acquire(key string, dial func() (*pooledConn, error), check func(*pooledConn) error) (*pooledConn, error) {
+	p.mu.Lock()
+	if pc, ok := p.conns[key]; ok {
+		pc.use()
+		p.mu.Unlock()
+		return p.checked(pc, check)
+	}
+	p.mu.Unlock()
+
+	pc, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	pc.key = key
+
+	p.mu.Lock()
+	if other, ok := p.conns[key]; ok {
+		// Another client connected meanwhile.
+		other.use()
+		p.mu.Unlock()
+		pc.close()
+		return p.checked(other, check)
+	}
+	pc.use()
+	p.conns[key] = pc
+	p.mu.Unlock()
+
+	// Forget the connection as soon as it breaks.
+	go func() {
+		pc.client.Wait()
+		p.evict(pc)
+	}()
+	return pc, nil
+}
+
+// checked returns pc, which the caller uses already, if check accepts it, and
+// gives it back otherwise.
+func (p *Pool) checked(pc *pooledConn, check func(*pooledConn) error) (*pooledConn, error) {
+	if err := check(pc); err != nil {
+		p.release(pc)
+		return nil, err
+	}
+	return pc, nil
+}
+
+// release gives pc back, starting its idle timeout if no client uses it.
+func (p *Pool) release(pc *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc.refs--
+	if pc.refs > 0 {
+		return
+	}
+	if p.conns[pc.key] != pc {
+		// It was evicted already.
+		pc.close()
+		return
+	}
+	pc.idle = time.AfterFunc(p.idleTimeout, func() {
+		p.mu.Lock()
+		if pc.refs > 0 || p.conns[pc.key] != pc {
+			p.mu.Unlock()
+			return
+		}
+		delete(p.conns, pc.key)
+		p.mu.Unlock()
+		pc.close()
+	})
+}
+
+// evict removes pc from the pool and closes it, so that the next client
+// connects again.
+func (p *Pool) evict(pc *pooledConn) {
+	p.mu.Lock()
+	if p.conns[pc.key] == pc {
+		delete(p.conns, pc.key)
+	}
+	p.mu.Unlock()
+	pc.close()
+}
+
+// use counts one more client of pc. The pool must be locked.
+func (pc *pooledConn) use() {
+	pc.refs++
+	if pc.idle != nil {
+		pc.idle.Stop()
+		pc.idle = nil
+	}
+}
+
+func (pc *pooledConn) close() {
+	pc.client.Close()
+	closeClients(pc.jumps)
+}
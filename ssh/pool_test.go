@@ -0,0 +1,183 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	cssh "golang.org/x/crypto/ssh"
+)
+
+// realDial is dial before the tests mock it.
+var realDial = dial
+
+func poolSize(p *Pool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+func TestPool(t *testing.T) {
+	oldDial := dial
+	defer func() { dial = oldDial }()
+	dial = realDial
+
+	s := startLocalServer(t)
+	defer s.Close()
+	p := NewPool(time.Minute)
+	defer p.Close()
+
+	a, b := newClient(s, p), newClient(s, p)
+	for _, c := range []*SSHClient{a, b} {
+		if err := c.Connect(); err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		if result, err := c.Command(context.Background(), "true", RunOptions{}); err != nil || !result.Success() {
+			t.Fatalf("Expected the command to run, got: %v", err)
+		}
+	}
+	if n := s.Connections(); n != 1 {
+		t.Fatalf("Expected the clients to share one connection, got %d", n)
+	}
+
+	a.Disconnect()
+	b.Disconnect()
+	if poolSize(p) != 1 {
+		t.Fatal("Expected the pool to keep the idle connection")
+	}
+
+	// A broken connection is dialed again.
+	if err := a.Connect(); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	a.cryptoClient.Close()
+	if result, err := a.Command(context.Background(), "true", RunOptions{}); err != nil || !result.Success() {
+		t.Fatalf("Expected the client to connect again, got: %v", err)
+	}
+	if n := s.Connections(); n != 2 {
+		t.Fatalf("Expected a new connection, got %d", n)
+	}
+	a.Disconnect()
+}
+
+// TestPoolOptions tests that clients only share connections made with their
+// credentials and accepted by their host key policy.
+func TestPoolOptions(t *testing.T) {
+	oldDial := dial
+	defer func() { dial = oldDial }()
+	dial = realDial
+
+	s := startLocalServer(t)
+	defer s.Close()
+	p := NewPool(time.Minute)
+	defer p.Close()
+
+	var serverKey cssh.PublicKey
+	a := newClient(s, p)
+	a.Options.HostKey = func(hostname string, remote net.Addr, key cssh.PublicKey) error {
+		serverKey = key
+		return nil
+	}
+	if err := a.Connect(); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer a.Disconnect()
+
+	// Other credentials get their own connection.
+	b := newClient(s, p)
+	b.Creds.SSHPassword = "other"
+	if err := b.Connect(); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer b.Disconnect()
+	if n := s.Connections(); n != 2 {
+		t.Fatalf("Expected clients with other credentials not to share, got %d connections", n)
+	}
+
+	// The pooled connection is checked with the host key policy of each
+	// client.
+	c := newClient(s, p)
+	c.Options.HostKey = HostKeyFingerprint("SHA256:nope")
+	if err := c.Connect(); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("Expected ErrHostKeyMismatch, got: %v", err)
+	}
+	d := newClient(s, p)
+	d.Options.HostKey = HostKeys(serverKey)
+	if err := d.Connect(); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	d.Disconnect()
+	if n := s.Connections(); n != 2 {
+		t.Fatalf("Expected the pinned client to share the connection, got %d connections", n)
+	}
+	p.mu.Lock()
+	refs := p.conns[a.poolKey()].refs
+	p.mu.Unlock()
+	if refs != 1 {
+		t.Fatalf("Expected the rejected clients to give the connection back, got %d users", refs)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	oldDial := dial
+	defer func() { dial = oldDial }()
+	dial = realDial
+
+	s := startLocalServer(t)
+	defer s.Close()
+	p := NewPool(50 * time.Millisecond)
+	defer p.Close()
+
+	c := newClient(s, p)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	conn := c.cryptoClient
+	c.Disconnect()
+
+	done := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the idle connection to be closed")
+	}
+	if poolSize(p) != 0 {
+		t.Fatal("Expected the idle connection to be evicted")
+	}
+}
+
+// TestDisconnectCloses tests that Disconnect closes the connection of a
+// client without a pool.
+func TestDisconnectCloses(t *testing.T) {
+	oldDial := dial
+	defer func() { dial = oldDial }()
+	dial = realDial
+
+	s := startLocalServer(t)
+	defer s.Close()
+	c := newClient(s, nil)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	conn := c.cryptoClient
+	c.Disconnect()
+
+	done := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the connection to be closed")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// ProgressFunc is called while a file is transferred with the number of bytes
+// sent so far and the total size, which is -1 if it is not known.
+type ProgressFunc func(sent, total int64)
+
+// progressReader calls a ProgressFunc as it is read.
+type progressReader struct {
+	r        io.Reader
+	sent     int64
+	total    int64
+	progress ProgressFunc
+}
+
+// newProgressReader returns r itself if progress is nil.
+func newProgressReader(r io.Reader, total int64, progress ProgressFunc) io.Reader {
+	if progress == nil {
+		return r
+	}
+	return &progressReader{r: r, total: total, progress: progress}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.sent += int64(n)
+		p.progress(p.sent, p.total)
+	}
+	return n, err
+}
+
+// sizedReader reads the first size bytes of r and fails if r ends before.
+type sizedReader struct {
+	r    io.Reader
+	read int64
+	size int64
+}
+
+func (s *sizedReader) Read(b []byte) (int, error) {
+	if s.read >= s.size {
+		return 0, io.EOF
+	}
+	if left := s.size - s.read; int64(len(b)) > left {
+		b = b[:left]
+	}
+	n, err := s.r.Read(b)
+	s.read += int64(n)
+	if err == io.EOF && s.read < s.size {
+		err = shortSourceError(s.read, s.size)
+	}
+	return n, err
+}
+
+// shortSourceError reports an upload source that ended after n of size
+// bytes.
+func shortSourceError(n, size int64) error {
+	return fmt.Errorf("upload source ended after %d of %d bytes", n, size)
+}
+
+// readerSize returns the number of bytes left in r, or -1 if it cannot tell
+// without reading it.
+func readerSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return -1
+		}
+		pos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return fi.Size() - pos
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case io.Seeker:
+		pos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return -1
+		}
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return -1
+		}
+		return end - pos
+	}
+	return -1
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReaderSize(t *testing.T) {
+	f, err := ioutil.TempFile("", "size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.WriteString("0123456789")
+	f.Seek(4, io.SeekStart)
+
+	sr := strings.NewReader("0123456789")
+	sr.Seek(3, io.SeekStart)
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	tests := []struct {
+		name string
+		r    io.Reader
+		want int64
+	}{
+		{"file", f, 6},
+		{"buffer", bytes.NewBufferString("abc"), 3},
+		{"seeker", sr, 7},
+		{"pipe", pr, -1},
+	}
+	for _, tt := range tests {
+		if got := readerSize(tt.r); got != tt.want {
+			t.Errorf("%s: expected size %d, got %d", tt.name, tt.want, got)
+		}
+	}
+	if pos, _ := sr.Seek(0, io.SeekCurrent); pos != 3 {
+		t.Errorf("Expected the seeker to be back at 3, got %d", pos)
+	}
+}
+
+func TestProgressReader(t *testing.T) {
+	var calls [][2]int64
+	r := newProgressReader(strings.NewReader("0123456789"), 10, func(sent, total int64) {
+		calls = append(calls, [2]int64{sent, total})
+	})
+	buf := make([]byte, 4)
+	for {
+		if _, err := r.Read(buf); err == io.EOF {
+			break
+		}
+	}
+	want := [][2]int64{{4, 10}, {8, 10}, {10, 10}}
+	if len(calls) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, calls)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("Expected %v, got %v", want, calls)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrSCPProtocol is returned when scp on the remote host sends something that
+// does not follow the protocol.
+var ErrSCPProtocol = errors.New("Invalid scp message")
+
+// UploadDir copies the local directory localDir to remoteDir, creating it and
+// its parents if needed, with the modes and modification times of the local
+// files. It runs scp -r on the remote host, or uses SFTP as set in
+// Options.FileTransfer. Symbolic links to files are copied as files; other
+// special files and links to directories are skipped.
+func (client *SSHClient) UploadDir(localDir, remoteDir string) error {
+	if client.Options.FileTransfer == TransferSFTP {
+		s, err := client.SFTP()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		return s.UploadDir(localDir, remoteDir)
+	}
+
+	info, err := os.Stat(localDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "upload", Path: localDir, Err: errors.New("not a directory")}
+	}
+
+	// scp creates the directories it is sent in its target, so the target is
+	// the parent of remoteDir.
+	remoteDir = path.Clean(remoteDir)
+	parent := shellQuote(path.Dir(remoteDir))
+	return client.scp(fmt.Sprintf("mkdir -p %s && /usr/bin/scp -r -p -t %s", parent, parent), func(w io.Writer, r *bufio.Reader) error {
+		if err := scpReadAck(r); err != nil {
+			return err
+		}
+		return scpSendDir(w, r, localDir, path.Base(remoteDir), info)
+	})
+}
+
+// DownloadDir copies the remote directory remoteDir to localDir, creating it
+// if needed, with the modes and modification times of the remote files. It
+// runs scp -r on the remote host, or uses SFTP as set in
+// Options.FileTransfer.
+func (client *SSHClient) DownloadDir(remoteDir, localDir string) error {
+	if client.Options.FileTransfer == TransferSFTP {
+		s, err := client.SFTP()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		return s.DownloadDir(remoteDir, localDir)
+	}
+
+	return client.scp("/usr/bin/scp -r -p -f "+shellQuote(remoteDir), func(w io.Writer, r *bufio.Reader) error {
+		return scpReceive(w, r, localDir)
+	})
+}
+
+// scp runs command and calls transfer with its standard input and output.
+func (client *SSHClient) scp(command string, transfer func(w io.Writer, r *bufio.Reader) error) error {
+	session, err := client.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	w, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.Start(command); err != nil {
+		return err
+	}
+
+	err = transfer(w, bufio.NewReader(r))
+	w.Close()
+	if werr := session.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// scpSendDir sends the directory dir, under name, and its content.
+func scpSendDir(w io.Writer, r *bufio.Reader, dir, name string, info os.FileInfo) error {
+	if err := scpSendRecord(w, r, "T%d 0 %d 0\n", info.ModTime().Unix(), info.ModTime().Unix()); err != nil {
+		return err
+	}
+	if err := scpSendRecord(w, r, "D%04o 0 %s\n", fromFileMode(info.Mode()), name); err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		if e.Mode()&os.ModeSymlink != 0 {
+			if e, err = os.Stat(p); err != nil || e.IsDir() {
+				continue
+			}
+		}
+		switch {
+		case e.IsDir():
+			err = scpSendDir(w, r, p, e.Name(), e)
+		case e.Mode().IsRegular():
+			err = scpSendFile(w, r, p, e.Name(), e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return scpSendRecord(w, r, "E\n")
+}
+
+// scpSendFile sends the file at p under name.
+func scpSendFile(w io.Writer, r *bufio.Reader, p, name string, info os.FileInfo) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := scpSendRecord(w, r, "T%d 0 %d 0\n", info.ModTime().Unix(), info.ModTime().Unix()); err != nil {
+		return err
+	}
+	if err := scpSendRecord(w, r, "C%04o %d %s\n", fromFileMode(info.Mode()), info.Size(), name); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, f, info.Size()); err != nil {
+		return err
+	}
+	return scpSendRecord(w, r, "\x00")
+}
+
+// scpSendRecord sends a record and waits for it to be acknowledged.
+func scpSendRecord(w io.Writer, r *bufio.Reader, format string, args ...interface{}) error {
+	if strings.Contains(fmt.Sprint(args...), "\n") {
+		return fmt.Errorf("scp: file name with a newline: %q", args)
+	}
+	if _, err := fmt.Fprintf(w, format, args...); err != nil {
+		return err
+	}
+	return scpReadAck(r)
+}
+
+// scpReadAck reads the reply to a record, which is a zero byte or a message.
+func scpReadAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := r.ReadString('\n')
+	if b != 1 && b != 2 {
+		return ErrSCPProtocol
+	}
+	return fmt.Errorf("scp: %s", strings.TrimSpace(msg))
+}
+
+// scpReceive receives the directory sent by scp -r -f into localDir.
+func scpReceive(w io.Writer, r *bufio.Reader, localDir string) error {
+	ack := func() error {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+
+	type dir struct {
+		path  string
+		mode  os.FileMode
+		times []time.Time
+	}
+	var (
+		dirs    []dir
+		times   []time.Time
+		warning error
+	)
+	if err := ack(); err != nil {
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" && len(dirs) == 0 {
+			return warning
+		}
+		if err != nil {
+			return err
+		}
+		line = line[:len(line)-1]
+		if line == "" {
+			return ErrSCPProtocol
+		}
+
+		switch line[0] {
+		case 1:
+			// A warning, such as a file that cannot be read; the
+			// transfer carries on and the first one is returned.
+			if warning == nil {
+				warning = fmt.Errorf("scp: %s", line[1:])
+			}
+			continue
+		case 2:
+			return fmt.Errorf("scp: %s", line[1:])
+		case 'T':
+			var mtime, atime int64
+			var mus, aus int
+			if _, err := fmt.Sscanf(line, "T%d %d %d %d", &mtime, &mus, &atime, &aus); err != nil {
+				return ErrSCPProtocol
+			}
+			times = []time.Time{time.Unix(atime, 0), time.Unix(mtime, 0)}
+		case 'D', 'C':
+			mode, size, name, err := scpParseRecord(line)
+			if err != nil {
+				return err
+			}
+			var p string
+			switch {
+			case len(dirs) > 0:
+				p = filepath.Join(dirs[len(dirs)-1].path, name)
+			case line[0] == 'D':
+				p = localDir
+			default:
+				return &os.PathError{Op: "download", Path: name, Err: errors.New("not a directory")}
+			}
+
+			if line[0] == 'D' {
+				if err := os.MkdirAll(p, 0700); err != nil {
+					return err
+				}
+				dirs = append(dirs, dir{p, mode, times})
+				times = nil
+				break
+			}
+			if err := ack(); err != nil {
+				return err
+			}
+			if err := scpReceiveFile(r, p, mode, size, times); err != nil {
+				return err
+			}
+			times = nil
+		case 'E':
+			if len(dirs) == 0 {
+				return ErrSCPProtocol
+			}
+			d := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if err := os.Chmod(d.path, d.mode); err != nil {
+				return err
+			}
+			if d.times != nil {
+				if err := os.Chtimes(d.path, d.times[0], d.times[1]); err != nil {
+					return err
+				}
+			}
+		default:
+			return ErrSCPProtocol
+		}
+		if err := ack(); err != nil {
+			return err
+		}
+	}
+}
+
+// scpReceiveFile writes the size bytes of a file sent by scp to p.
+func scpReceiveFile(r *bufio.Reader, p string, mode os.FileMode, size int64, times []time.Time) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, r, size); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := scpReadAck(r); err != nil {
+		return err
+	}
+	if err := os.Chmod(p, mode); err != nil {
+		return err
+	}
+	if times != nil {
+		return os.Chtimes(p, times[0], times[1])
+	}
+	return nil
+}
+
+// scpParseRecord parses a D or C record, such as "C0644 14 somefile".
+func scpParseRecord(line string) (os.FileMode, int64, string, error) {
+	fields := strings.SplitN(line[1:], " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", ErrSCPProtocol
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", ErrSCPProtocol
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", ErrSCPProtocol
+	}
+	name := fields[2]
+	if !validName(name) {
+		return 0, 0, "", fmt.Errorf("scp: invalid file name %q", name)
+	}
+	return toFileMode(uint32(mode)) &^ os.ModeType, size, name, nil
+}
+
+// validName reports whether name, as sent by the server, names an entry of
+// the directory being copied rather than a path that could escape it.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
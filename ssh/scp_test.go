@@ -0,0 +1,140 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSCPDirectoryTransfer sends a directory tree with the source side of the
+// scp protocol to its sink side.
+func TestSCPDirectoryTransfer(t *testing.T) {
+	root, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	src := filepath.Join(root, "src")
+	mtime := time.Unix(1500000000, 0)
+	files := map[string]os.FileMode{
+		"top":         0644,
+		"empty":       0600,
+		"sub/script":  0755,
+		"sub/a/b/key": 0400,
+	}
+	for name, mode := range files {
+		p := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		content := name
+		if name == "empty" {
+			content = ""
+		}
+		if err := ioutil.WriteFile(p, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(src, "sub", "a"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	dirTime := time.Unix(1400000000, 0)
+	if err := os.Chtimes(filepath.Join(src, "sub"), dirTime, dirTime); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wire the sender to the receiver like scp -t and scp -f would be.
+	dataR, dataW := io.Pipe()
+	ackR, ackW := io.Pipe()
+	dst := filepath.Join(root, "dst")
+	done := make(chan error, 1)
+	go func() {
+		err := scpReceive(ackW, bufio.NewReader(dataR), dst)
+		dataR.Close()
+		done <- err
+	}()
+
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := bufio.NewReader(ackR)
+	if err := scpReadAck(ack); err != nil {
+		t.Fatalf("Expected the initial ack, got: %s", err)
+	}
+	if err := scpSendDir(dataW, ack, src, "ignored", info); err != nil {
+		t.Fatalf("Expected no error sending, got: %s", err)
+	}
+	dataW.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("Expected no error receiving, got: %s", err)
+	}
+
+	for name, mode := range files {
+		p := filepath.Join(dst, name)
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("Expected %s to exist, got: %s", p, err)
+		}
+		if fi.Mode() != mode || !fi.ModTime().Equal(mtime) {
+			t.Fatalf("Expected %s to have mode %s and time %s, got %s and %s", p, mode, mtime, fi.Mode(), fi.ModTime())
+		}
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dst, "sub", "script")); string(b) != "sub/script" {
+		t.Fatalf("Unexpected content: %q", b)
+	}
+	fi, err := os.Stat(filepath.Join(dst, "sub", "a"))
+	if err != nil || fi.Mode().Perm() != 0750 {
+		t.Fatalf("Expected the directory mode to be kept, got: %v %v", fi, err)
+	}
+	fi, err = os.Stat(filepath.Join(dst, "sub"))
+	if err != nil || !fi.ModTime().Equal(dirTime) {
+		t.Fatalf("Expected the directory time to be kept, got: %v %v", fi, err)
+	}
+}
+
+func TestSCPReceiveErrors(t *testing.T) {
+	root, err := ioutil.TempDir("", "scp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"single file", "C0644 1 f\n", "not a directory"},
+		{"traversal", "D0755 0 d\nC0644 1 ../f\n", "invalid file name"},
+		{"error", "\x02scp: /nope: No such file or directory\n", "No such file"},
+		{"warning", "D0755 0 d\n\x01scp: /d/f: Permission denied\nE\n", "Permission denied"},
+		{"truncated", "D0755 0 d\n", "EOF"},
+		{"garbage", "X\n", ErrSCPProtocol.Error()},
+	}
+	for _, tt := range tests {
+		var acks bytes.Buffer
+		err := scpReceive(&acks, bufio.NewReader(strings.NewReader(tt.in)), filepath.Join(root, tt.name))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected an error containing %q, got: %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if got := shellQuote("/tmp/it's here"); got != `'/tmp/it'\''s here'` {
+		t.Fatalf("Unexpected quoting: %s", got)
+	}
+}
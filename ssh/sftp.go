@@ -0,0 +1,921 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SFTP protocol version 3 packet types, from draft-ietf-secsh-filexfer-02.
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpSetstat  = 9
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpProtocol = 3
+)
+
+// Flags of SSH_FXP_OPEN.
+const (
+	sftpFlagRead  = 0x01
+	sftpFlagWrite = 0x02
+	sftpFlagCreat = 0x08
+	sftpFlagTrunc = 0x10
+)
+
+// Flags telling which attributes are present.
+const (
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+// Status codes of SSH_FXP_STATUS.
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+)
+
+// File type bits of the permissions attribute.
+const (
+	sIFMT   = 0170000
+	sIFSOCK = 0140000
+	sIFLNK  = 0120000
+	sIFREG  = 0100000
+	sIFBLK  = 0060000
+	sIFDIR  = 0040000
+	sIFCHR  = 0020000
+	sIFIFO  = 0010000
+)
+
+// sftpChunk is the size of the reads and writes sent to the server. Servers
+// must accept packets of at least 34000 bytes.
+const sftpChunk = 32 * 1024
+
+// ErrSFTPProtocol is returned when the SFTP server sends something that does
+// not follow the protocol.
+var ErrSFTPProtocol = errors.New("Invalid SFTP response")
+
+// StatusError is an error status returned by the SFTP server. It matches
+// os.ErrNotExist and os.ErrPermission with errors.Is when its code does.
+type StatusError struct {
+	Code uint32
+	Msg  string
+}
+
+func (e *StatusError) Error() string {
+	if e.Msg != "" {
+		return fmt.Sprintf("sftp: %s (status %d)", e.Msg, e.Code)
+	}
+	return fmt.Sprintf("sftp: status %d", e.Code)
+}
+
+// Is reports whether the status matches target.
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case os.ErrNotExist:
+		return e.Code == sftpNoSuchFile
+	case os.ErrPermission:
+		return e.Code == sftpPermissionDenied
+	}
+	return false
+}
+
+// SFTP is a client of the SFTP subsystem of an SSH server. Its methods are
+// safe for concurrent use, though requests are sent one at a time. Errors
+// about a path are *os.PathError wrapping a *StatusError, so
+// errors.Is(err, os.ErrNotExist) tells whether a file is missing.
+type SFTP struct {
+	mu     sync.Mutex
+	r      io.Reader
+	w      io.WriteCloser
+	close  func() error
+	nextID uint32
+}
+
+// SFTP starts the SFTP subsystem on the connected client. The returned SFTP
+// must be closed when no longer needed.
+func (client *SSHClient) SFTP() (*SFTP, error) {
+	session, err := client.newSession()
+	if err != nil {
+		return nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("unable to start the sftp subsystem: %w", err)
+	}
+	return newSFTP(r, w, session.Close)
+}
+
+// sftpUpload is Upload over SFTP.
+func (client *SSHClient) sftpUpload(src io.Reader, dst string, mode os.FileMode) error {
+	s, err := client.SFTP()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.upload(src, dst, mode)
+}
+
+// sftpDownload is Download over SFTP.
+func (client *SSHClient) sftpDownload(dst io.Writer, remotePath string) error {
+	s, err := client.SFTP()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	f, err := s.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// newSFTP initializes an SFTP session over r and w. closer is called by
+// Close after w is closed.
+func newSFTP(r io.Reader, w io.WriteCloser, closer func() error) (*SFTP, error) {
+	s := &SFTP{r: r, w: w, close: closer}
+	var b sftpBuffer
+	b.byte(sftpInit)
+	b.uint32(sftpProtocol)
+	if err := s.writePacket(b); err != nil {
+		s.Close()
+		return nil, err
+	}
+	typ, p, err := s.readPacket()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if typ != sftpVersion {
+		s.Close()
+		return nil, ErrSFTPProtocol
+	}
+	if v, ok := p.uint32(); !ok || v < sftpProtocol {
+		s.Close()
+		return nil, fmt.Errorf("unsupported sftp version %d", v)
+	}
+	return s, nil
+}
+
+// Close ends the SFTP session.
+func (s *SFTP) Close() error {
+	err := s.w.Close()
+	if s.close != nil {
+		if cerr := s.close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Stat returns the FileInfo of the file at p, following symbolic links.
+func (s *SFTP) Stat(p string) (os.FileInfo, error) {
+	return s.stat(sftpStat, "stat", p)
+}
+
+// Lstat is like Stat but does not follow symbolic links.
+func (s *SFTP) Lstat(p string) (os.FileInfo, error) {
+	return s.stat(sftpLstat, "lstat", p)
+}
+
+func (s *SFTP) stat(typ byte, op, p string) (os.FileInfo, error) {
+	resp, err := s.request(typ, func(b *sftpBuffer) {
+		b.string(p)
+	})
+	if err != nil {
+		return nil, pathError(op, p, err)
+	}
+	a, err := resp.attrs()
+	if err != nil {
+		return nil, pathError(op, p, err)
+	}
+	return &fileInfo{name: path.Base(p), attrs: a}, nil
+}
+
+// Mkdir creates the directory p with the permission bits of mode.
+func (s *SFTP) Mkdir(p string, mode os.FileMode) error {
+	err := s.status(sftpMkdir, func(b *sftpBuffer) {
+		b.string(p)
+		b.attrs(fileAttrs{flags: sftpAttrPermissions, mode: fromFileMode(mode.Perm())})
+	})
+	return pathError("mkdir", p, err)
+}
+
+// MkdirAll creates the directory p and any missing parent, like mkdir -p. It
+// does nothing if p is already a directory.
+func (s *SFTP) MkdirAll(p string, mode os.FileMode) error {
+	if fi, err := s.Stat(p); err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		return pathError("mkdir", p, errors.New("not a directory"))
+	}
+	if parent := path.Dir(p); parent != p && parent != "." {
+		if err := s.MkdirAll(parent, mode); err != nil {
+			return err
+		}
+	}
+	if err := s.Mkdir(p, mode); err != nil {
+		// It may have been created in the meantime.
+		if fi, serr := s.Stat(p); serr == nil && fi.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Rename renames the file oldpath to newpath.
+func (s *SFTP) Rename(oldpath, newpath string) error {
+	err := s.status(sftpRename, func(b *sftpBuffer) {
+		b.string(oldpath)
+		b.string(newpath)
+	})
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
+
+// Chmod sets the permission bits of the file at p to those of mode.
+func (s *SFTP) Chmod(p string, mode os.FileMode) error {
+	return pathError("chmod", p, s.setstat(p, fileAttrs{flags: sftpAttrPermissions, mode: fromFileMode(mode)}))
+}
+
+// Chtimes sets the access and modification times of the file at p.
+func (s *SFTP) Chtimes(p string, atime, mtime time.Time) error {
+	a := fileAttrs{flags: sftpAttrACModTime, atime: uint32(atime.Unix()), mtime: uint32(mtime.Unix())}
+	return pathError("chtimes", p, s.setstat(p, a))
+}
+
+func (s *SFTP) setstat(p string, a fileAttrs) error {
+	return s.status(sftpSetstat, func(b *sftpBuffer) {
+		b.string(p)
+		b.attrs(a)
+	})
+}
+
+// Remove removes the file or empty directory at p.
+func (s *SFTP) Remove(p string) error {
+	err := s.status(sftpRemove, func(b *sftpBuffer) {
+		b.string(p)
+	})
+	if err == nil {
+		return nil
+	}
+	if fi, serr := s.Lstat(p); serr == nil && fi.IsDir() {
+		err = s.status(sftpRmdir, func(b *sftpBuffer) {
+			b.string(p)
+		})
+	}
+	return pathError("remove", p, err)
+}
+
+// ReadDir returns the entries of the directory p, sorted by name, without
+// "." and "..". Names that are not those of entries of p, such as "../x", are
+// rejected, so that a hostile server cannot make DownloadDir write outside
+// the local directory.
+func (s *SFTP) ReadDir(p string) ([]os.FileInfo, error) {
+	h, err := s.handle(sftpOpendir, func(b *sftpBuffer) {
+		b.string(p)
+	})
+	if err != nil {
+		return nil, pathError("readdir", p, err)
+	}
+	defer s.closeHandle(h)
+
+	var entries []os.FileInfo
+	for {
+		resp, err := s.request(sftpReaddir, func(b *sftpBuffer) {
+			b.string(h)
+		})
+		if isEOF(err) {
+			break
+		}
+		if err != nil {
+			return nil, pathError("readdir", p, err)
+		}
+		if resp.typ != sftpName {
+			return nil, ErrSFTPProtocol
+		}
+		n, ok := resp.data.uint32()
+		if !ok {
+			return nil, ErrSFTPProtocol
+		}
+		for i := uint32(0); i < n; i++ {
+			name, ok1 := resp.data.string()
+			_, ok2 := resp.data.string() // long name, as ls -l prints it
+			a, ok3 := resp.data.attrs()
+			if !ok1 || !ok2 || !ok3 {
+				return nil, ErrSFTPProtocol
+			}
+			if name == "." || name == ".." {
+				continue
+			}
+			if !validName(name) {
+				return nil, fmt.Errorf("sftp: invalid file name %q", name)
+			}
+			entries = append(entries, &fileInfo{name: name, attrs: a})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Open opens the file at p for reading.
+func (s *SFTP) Open(p string) (*SFTPFile, error) {
+	return s.open(p, sftpFlagRead, fileAttrs{})
+}
+
+// Create creates or truncates the file at p for writing. A new file gets the
+// permission bits of mode.
+func (s *SFTP) Create(p string, mode os.FileMode) (*SFTPFile, error) {
+	a := fileAttrs{flags: sftpAttrPermissions, mode: fromFileMode(mode.Perm())}
+	return s.open(p, sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc, a)
+}
+
+func (s *SFTP) open(p string, flags uint32, a fileAttrs) (*SFTPFile, error) {
+	h, err := s.handle(sftpOpen, func(b *sftpBuffer) {
+		b.string(p)
+		b.uint32(flags)
+		b.attrs(a)
+	})
+	if err != nil {
+		return nil, pathError("open", p, err)
+	}
+	return &SFTPFile{s: s, path: p, handle: h}, nil
+}
+
+// handle sends a request answered with a handle and returns it.
+func (s *SFTP) handle(typ byte, fill func(*sftpBuffer)) (string, error) {
+	resp, err := s.request(typ, fill)
+	if err != nil {
+		return "", err
+	}
+	if resp.typ != sftpHandle {
+		return "", ErrSFTPProtocol
+	}
+	h, ok := resp.data.string()
+	if !ok {
+		return "", ErrSFTPProtocol
+	}
+	return h, nil
+}
+
+func (s *SFTP) closeHandle(h string) error {
+	return s.status(sftpClose, func(b *sftpBuffer) {
+		b.string(h)
+	})
+}
+
+// status sends a request answered with a status only.
+func (s *SFTP) status(typ byte, fill func(*sftpBuffer)) error {
+	resp, err := s.request(typ, fill)
+	if err != nil {
+		return err
+	}
+	if resp.typ != sftpStatus {
+		return ErrSFTPProtocol
+	}
+	return nil
+}
+
+// sftpResponse is a response to a request, without its ID.
+type sftpResponse struct {
+	typ  byte
+	data *sftpReader
+}
+
+// attrs returns the attributes of an SSH_FXP_ATTRS response.
+func (r *sftpResponse) attrs() (fileAttrs, error) {
+	if r.typ != sftpAttrs {
+		return fileAttrs{}, ErrSFTPProtocol
+	}
+	a, ok := r.data.attrs()
+	if !ok {
+		return fileAttrs{}, ErrSFTPProtocol
+	}
+	return a, nil
+}
+
+// request sends a request of type typ whose fields are written by fill, and
+// returns the response. Error statuses are returned as *StatusError.
+func (s *SFTP) request(typ byte, fill func(*sftpBuffer)) (*sftpResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	id := s.nextID
+	var b sftpBuffer
+	b.byte(typ)
+	b.uint32(id)
+	fill(&b)
+	if err := s.writePacket(b); err != nil {
+		return nil, err
+	}
+
+	rtyp, p, err := s.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if rid, ok := p.uint32(); !ok || rid != id {
+		return nil, ErrSFTPProtocol
+	}
+	if rtyp == sftpStatus {
+		code, ok := p.uint32()
+		if !ok {
+			return nil, ErrSFTPProtocol
+		}
+		if code != sftpOK {
+			msg, _ := p.string()
+			return nil, &StatusError{Code: code, Msg: msg}
+		}
+	}
+	return &sftpResponse{typ: rtyp, data: p}, nil
+}
+
+func (s *SFTP) writePacket(b sftpBuffer) error {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(b)))
+	if _, err := s.w.Write(append(l[:], b...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// maxPacket bounds the size of the packets accepted from the server.
+const maxPacket = 256 * 1024
+
+func (s *SFTP) readPacket() (byte, *sftpReader, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(s.r, l[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n == 0 || n > maxPacket {
+		return 0, nil, ErrSFTPProtocol
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(s.r, p); err != nil {
+		return 0, nil, err
+	}
+	return p[0], &sftpReader{b: p[1:]}, nil
+}
+
+// SFTPFile is a file opened with SFTP.Open or SFTP.Create.
+type SFTPFile struct {
+	s      *SFTP
+	path   string
+	handle string
+	offset uint64
+}
+
+// Read reads from the file. It returns io.EOF at the end of the file.
+func (f *SFTPFile) Read(b []byte) (int, error) {
+	if len(b) > sftpChunk {
+		b = b[:sftpChunk]
+	}
+	resp, err := f.s.request(sftpRead, func(p *sftpBuffer) {
+		p.string(f.handle)
+		p.uint64(f.offset)
+		p.uint32(uint32(len(b)))
+	})
+	if isEOF(err) {
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, pathError("read", f.path, err)
+	}
+	if resp.typ != sftpData {
+		return 0, ErrSFTPProtocol
+	}
+	data, ok := resp.data.string()
+	if !ok || len(data) > len(b) {
+		return 0, ErrSFTPProtocol
+	}
+	n := copy(b, data)
+	f.offset += uint64(n)
+	return n, nil
+}
+
+// Write writes b to the file.
+func (f *SFTPFile) Write(b []byte) (int, error) {
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > sftpChunk {
+			chunk = chunk[:sftpChunk]
+		}
+		err := f.s.status(sftpWrite, func(p *sftpBuffer) {
+			p.string(f.handle)
+			p.uint64(f.offset)
+			p.string(string(chunk))
+		})
+		if err != nil {
+			return n, pathError("write", f.path, err)
+		}
+		f.offset += uint64(len(chunk))
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// Close closes the file.
+func (f *SFTPFile) Close() error {
+	return pathError("close", f.path, f.s.closeHandle(f.handle))
+}
+
+// fileAttrs are the attributes of a file. Only the fields whose flag is set
+// are meaningful.
+type fileAttrs struct {
+	flags    uint32
+	size     uint64
+	uid, gid uint32
+	mode     uint32
+	atime    uint32
+	mtime    uint32
+}
+
+// fileInfo implements os.FileInfo for the attributes sent by the server.
+type fileInfo struct {
+	name  string
+	attrs fileAttrs
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(fi.attrs.size) }
+func (fi *fileInfo) Mode() os.FileMode  { return toFileMode(fi.attrs.mode) }
+func (fi *fileInfo) ModTime() time.Time { return time.Unix(int64(fi.attrs.mtime), 0) }
+func (fi *fileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+// toFileMode converts the Unix mode sent by the server to an os.FileMode.
+func toFileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	switch mode & sIFMT {
+	case sIFDIR:
+		m |= os.ModeDir
+	case sIFLNK:
+		m |= os.ModeSymlink
+	case sIFSOCK:
+		m |= os.ModeSocket
+	case sIFIFO:
+		m |= os.ModeNamedPipe
+	case sIFCHR:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case sIFBLK:
+		m |= os.ModeDevice
+	}
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// fromFileMode converts the permission bits of an os.FileMode to a Unix mode.
+func fromFileMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
+// sftpBuffer builds a packet.
+type sftpBuffer []byte
+
+func (b *sftpBuffer) byte(v byte) {
+	*b = append(*b, v)
+}
+
+func (b *sftpBuffer) uint32(v uint32) {
+	*b = append(*b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (b *sftpBuffer) uint64(v uint64) {
+	b.uint32(uint32(v >> 32))
+	b.uint32(uint32(v))
+}
+
+func (b *sftpBuffer) string(s string) {
+	b.uint32(uint32(len(s)))
+	*b = append(*b, s...)
+}
+
+func (b *sftpBuffer) attrs(a fileAttrs) {
+	b.uint32(a.flags)
+	if a.flags&sftpAttrSize != 0 {
+		b.uint64(a.size)
+	}
+	if a.flags&sftpAttrUIDGID != 0 {
+		b.uint32(a.uid)
+		b.uint32(a.gid)
+	}
+	if a.flags&sftpAttrPermissions != 0 {
+		b.uint32(a.mode)
+	}
+	if a.flags&sftpAttrACModTime != 0 {
+		b.uint32(a.atime)
+		b.uint32(a.mtime)
+	}
+}
+
+// sftpReader reads the fields of a packet.
+type sftpReader struct {
+	b []byte
+}
+
+func (r *sftpReader) uint32() (uint32, bool) {
+	if len(r.b) < 4 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v, true
+}
+
+func (r *sftpReader) uint64() (uint64, bool) {
+	if len(r.b) < 8 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v, true
+}
+
+func (r *sftpReader) string() (string, bool) {
+	n, ok := r.uint32()
+	if !ok || uint32(len(r.b)) < n {
+		return "", false
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s, true
+}
+
+func (r *sftpReader) attrs() (fileAttrs, bool) {
+	var a fileAttrs
+	var ok bool
+	if a.flags, ok = r.uint32(); !ok {
+		return a, false
+	}
+	if a.flags&sftpAttrSize != 0 {
+		if a.size, ok = r.uint64(); !ok {
+			return a, false
+		}
+	}
+	if a.flags&sftpAttrUIDGID != 0 {
+		if a.uid, ok = r.uint32(); !ok {
+			return a, false
+		}
+		if a.gid, ok = r.uint32(); !ok {
+			return a, false
+		}
+	}
+	if a.flags&sftpAttrPermissions != 0 {
+		if a.mode, ok = r.uint32(); !ok {
+			return a, false
+		}
+	}
+	if a.flags&sftpAttrACModTime != 0 {
+		if a.atime, ok = r.uint32(); !ok {
+			return a, false
+		}
+		if a.mtime, ok = r.uint32(); !ok {
+			return a, false
+		}
+	}
+	if a.flags&sftpAttrExtended != 0 {
+		n, ok := r.uint32()
+		if !ok {
+			return a, false
+		}
+		for i := uint32(0); i < n; i++ {
+			if _, ok := r.string(); !ok {
+				return a, false
+			}
+			if _, ok := r.string(); !ok {
+				return a, false
+			}
+		}
+	}
+	return a, true
+}
+
+func isEOF(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Code == sftpEOF
+}
+
+// pathError wraps err in an *os.PathError, unless it is nil.
+func pathError(op, p string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: p, Err: err}
+}
+
+// UploadDir copies the local directory localDir to remoteDir, creating it if
+// needed, with the modes and modification times of the local files. Symbolic
+// links to files are copied as files; other special files and links to
+// directories are skipped.
+func (s *SFTP) UploadDir(localDir, remoteDir string) error {
+	// The directories are made writable while their files are uploaded,
+	// and get their mode and time once they are complete.
+	type dir struct {
+		path string
+		info os.FileInfo
+	}
+	var dirs []dir
+	err := filepath.Walk(localDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		dst := path.Join(remoteDir, filepath.ToSlash(rel))
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(p); err != nil || info.IsDir() {
+				return nil
+			}
+		}
+		switch {
+		case info.IsDir():
+			dirs = append(dirs, dir{dst, info})
+			return s.MkdirAll(dst, info.Mode().Perm()|0700)
+		case info.Mode().IsRegular():
+			if err := s.uploadFile(p, dst, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return s.Chtimes(dst, info.ModTime(), info.ModTime())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		if err := s.Chmod(d.path, d.info.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := s.Chtimes(d.path, d.info.ModTime(), d.info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SFTP) uploadFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return s.upload(in, dst, mode)
+}
+
+// upload writes r to the remote file dst and sets its mode.
+func (s *SFTP) upload(r io.Reader, dst string, mode os.FileMode) error {
+	f, err := s.Create(dst, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// Create only sets the mode of new files.
+	return s.Chmod(dst, mode)
+}
+
+// DownloadDir copies the remote directory remoteDir to localDir, creating it
+// if needed, with the modes and modification times of the remote files.
+// Symbolic links to files are copied as files; other special files and links
+// to directories are skipped.
+func (s *SFTP) DownloadDir(remoteDir, localDir string) error {
+	info, err := s.Stat(remoteDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return pathError("download", remoteDir, errors.New("not a directory"))
+	}
+	return s.downloadDir(remoteDir, localDir, info)
+}
+
+func (s *SFTP) downloadDir(remoteDir, localDir string, info os.FileInfo) error {
+	if err := os.MkdirAll(localDir, 0700); err != nil {
+		return err
+	}
+	entries, err := s.ReadDir(remoteDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		src := path.Join(remoteDir, e.Name())
+		dst := filepath.Join(localDir, e.Name())
+		if e.Mode()&os.ModeSymlink != 0 {
+			if e, err = s.Stat(src); err != nil || e.IsDir() {
+				continue
+			}
+		}
+		switch {
+		case e.IsDir():
+			err = s.downloadDir(src, dst, e)
+		case e.Mode().IsRegular():
+			err = s.downloadFile(src, dst, e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(localDir, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(localDir, info.ModTime(), info.ModTime())
+}
+
+func (s *SFTP) downloadFile(src, dst string, info os.FileInfo) error {
+	in, err := s.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
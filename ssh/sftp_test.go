@@ -0,0 +1,239 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apcera/libretto/ssh/sshtest"
+)
+
+// startSFTP starts an sshtest server and returns an SFTP session with it.
+func startSFTP(t *testing.T) (*sshtest.Server, *SFTP) {
+	srv, err := sshtest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := dialServer(t, srv).SFTP()
+	if err != nil {
+		t.Fatalf("Expected no error starting the SFTP session, got: %s", err)
+	}
+	return srv, s
+}
+
+func TestSFTPFileOperations(t *testing.T) {
+	srv, s := startSFTP(t)
+	defer srv.Close()
+	defer s.Close()
+
+	if _, err := s.Stat("/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected a not exist error, got: %v", err)
+	}
+	if err := s.MkdirAll("/a/b/c", 0755); err != nil {
+		t.Fatalf("Expected no error creating directories, got: %s", err)
+	}
+	if err := s.MkdirAll("/a/b", 0755); err != nil {
+		t.Fatalf("Expected no error for an existing directory, got: %s", err)
+	}
+
+	f, err := s.Create("/a/b/file", 0600)
+	if err != nil {
+		t.Fatalf("Expected no error creating a file, got: %s", err)
+	}
+	content := make([]byte, 3*sftpChunk+10)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	if _, err := f.Write(content); err != nil {
+		t.Fatalf("Expected no error writing, got: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Expected no error closing, got: %s", err)
+	}
+	if err := s.Chmod("/a/b/file", 0640); err != nil {
+		t.Fatalf("Expected no error changing the mode, got: %s", err)
+	}
+	fi, err := s.Stat("/a/b/file")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if fi.Size() != int64(len(content)) || fi.Mode() != 0640 || fi.Name() != "file" {
+		t.Fatalf("Unexpected file info: %d %s %s", fi.Size(), fi.Mode(), fi.Name())
+	}
+
+	if err := s.Rename("/a/b/file", "/a/file"); err != nil {
+		t.Fatalf("Expected no error renaming, got: %s", err)
+	}
+	r, err := s.Open("/a/file")
+	if err != nil {
+		t.Fatalf("Expected no error opening, got: %s", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(got) != string(content) {
+		t.Fatalf("Expected to read the written content, got %d bytes, %v", len(got), err)
+	}
+
+	entries, err := s.ReadDir("/a")
+	if err != nil {
+		t.Fatalf("Expected no error listing, got: %s", err)
+	}
+	if len(entries) != 2 || entries[0].Name() != "b" || !entries[0].IsDir() || entries[1].Name() != "file" {
+		t.Fatalf("Unexpected entries: %v", entries)
+	}
+
+	if err := s.Remove("/a/file"); err != nil {
+		t.Fatalf("Expected no error removing a file, got: %s", err)
+	}
+	if err := s.Remove("/a/b/c"); err != nil {
+		t.Fatalf("Expected no error removing a directory, got: %s", err)
+	}
+	if err := s.Remove("/a/b/c"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected a not exist error, got: %v", err)
+	}
+}
+
+func TestSFTPDirectoryTransfer(t *testing.T) {
+	root, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	srv, s := startSFTP(t)
+	defer srv.Close()
+	defer s.Close()
+
+	src := filepath.Join(root, "src")
+	mtime := time.Unix(1500000000, 0)
+	files := map[string]os.FileMode{
+		"top":         0644,
+		"sub/script":  0755,
+		"sub/a/b/key": 0600,
+	}
+	for name, mode := range files {
+		p := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(name), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(src, "sub", "a"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(src, "sub", "a"), 0755)
+
+	if err := s.UploadDir(src, "/remote/dir"); err != nil {
+		t.Fatalf("Expected no error uploading, got: %s", err)
+	}
+	dst := filepath.Join(root, "dst")
+	if err := s.DownloadDir("/remote/dir", dst); err != nil {
+		t.Fatalf("Expected no error downloading, got: %s", err)
+	}
+	defer os.Chmod(filepath.Join(dst, "sub", "a"), 0755)
+
+	// The uploaded files are checked on the server, and the downloaded
+	// ones locally.
+	dirs := []struct {
+		dir      string
+		stat     func(string) (os.FileInfo, error)
+		readFile func(string) ([]byte, error)
+	}{
+		{"/remote/dir", srv.FS.Stat, srv.FS.ReadFile},
+		{dst, os.Stat, ioutil.ReadFile},
+	}
+	for _, d := range dirs {
+		for name, mode := range files {
+			p := path.Join(d.dir, name)
+			fi, err := d.stat(p)
+			if err != nil {
+				t.Fatalf("Expected %s to exist, got: %s", p, err)
+			}
+			if fi.Mode() != mode || !fi.ModTime().Equal(mtime) {
+				t.Fatalf("Expected %s to have mode %s and time %s, got %s and %s", p, mode, mtime, fi.Mode(), fi.ModTime())
+			}
+			if b, _ := d.readFile(p); string(b) != name {
+				t.Fatalf("Unexpected content of %s: %q", p, b)
+			}
+		}
+		fi, err := d.stat(path.Join(d.dir, "sub", "a"))
+		if err != nil || fi.Mode().Perm() != 0555 {
+			t.Fatalf("Expected the directory mode to be kept, got: %v %v", fi, err)
+		}
+	}
+
+	if err := s.DownloadDir("/remote/dir/top", dst); err == nil {
+		t.Fatal("Expected an error downloading a file as a directory")
+	}
+}
+
+// TestSFTPHostileNames tests that the names a server lists cannot make
+// DownloadDir write outside the local directory.
+func TestSFTPHostileNames(t *testing.T) {
+	root, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	srv, s := startSFTP(t)
+	defer srv.Close()
+	defer s.Close()
+
+	for _, name := range []string{"../../.ssh/authorized_keys", "a/../../x", `..\x`, ""} {
+		srv.FS.RemoveAll("/remote")
+		if err := srv.FS.WriteFile("/remote/dir/file", []byte("ssh-ed25519 AAAA attacker"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		srv.FS.SetListedName("/remote/dir/file", name)
+
+		dst := filepath.Join(root, "a", "b")
+		if err := s.DownloadDir("/remote/dir", dst); err == nil || !strings.Contains(err.Error(), "invalid file name") {
+			t.Fatalf("%q: expected an invalid file name error, got: %v", name, err)
+		}
+		if _, err := s.ReadDir("/remote/dir"); err == nil {
+			t.Fatalf("%q: expected ReadDir to fail", name)
+		}
+	}
+	err = filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			t.Errorf("Expected no file to be written, found %s", p)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSFTPUploadStream(t *testing.T) {
+	srv, err := sshtest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := dialServer(t, srv)
+	client.Options.FileTransfer = TransferSFTP
+
+	if err := client.UploadStream(strings.NewReader("hello world"), 5, "/tmp/hello", 0644, nil); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if b, err := srv.FS.ReadFile("/tmp/hello"); err != nil || string(b) != "hello" {
+		t.Fatalf("Expected the first 5 bytes to be uploaded, got %q: %v", b, err)
+	}
+
+	err = client.UploadStream(strings.NewReader("hello world"), 20, "/tmp/short", 0644, nil)
+	if err == nil || !strings.Contains(err.Error(), "ended after 11 of 20 bytes") {
+		t.Fatalf("Expected a short read error, got: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	cssh "golang.org/x/crypto/ssh"
+)
+
+// ShellOptions sets up an interactive session started by Shell.
+type ShellOptions struct {
+	// Command is run in the pseudo terminal instead of the login shell of
+	// the user, such as "sudo -i" or "top".
+	Command string
+	// Term is the terminal type. It defaults to $TERM, or xterm.
+	Term string
+	// Width and Height are the size of the pseudo terminal when the output
+	// is not a terminal. They default to the size in Options.
+	Width  int
+	Height int
+}
+
+// Shell starts a login shell on the server in a pseudo terminal connected to
+// stdin, stdout and stderr, and waits for it to exit.
+//
+// If stdin is a terminal, it is put in raw mode until Shell returns, so that
+// keys such as Ctrl-C and Tab go to the remote shell rather than to the local
+// one. If stdout is a terminal, the pseudo terminal takes its size, and
+// follows it when the window is resized on systems with SIGWINCH.
+//
+// As with Command, the exit status of the shell is in the result. If ctx is
+// done before the shell exits, the session is closed, which hangs the shell
+// up, and ctx.Err() is returned.
+func (client *SSHClient) Shell(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, opts ShellOptions) (*CommandResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session, err := client.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	width, height := opts.Width, opts.Height
+	sizeFd, sized := terminalFd(stdout)
+	if sized {
+		if w, h, ok := terminalSize(sizeFd); ok {
+			width, height = w, h
+		}
+	}
+	width, height = client.ptySize(width, height)
+	term := opts.Term
+	if term == "" {
+		term = os.Getenv("TERM")
+	}
+	if term == "" {
+		term = "xterm"
+	}
+	modes := cssh.TerminalModes{
+		cssh.ECHO:          1,
+		cssh.TTY_OP_ISPEED: 14400,
+		cssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty(term, height, width, modes); err != nil {
+		return nil, err
+	}
+
+	if fd, ok := terminalFd(stdin); ok {
+		restore, err := makeRaw(fd)
+		if err != nil {
+			return nil, err
+		}
+		defer restore()
+	}
+
+	start := time.Now()
+	if opts.Command != "" {
+		err = session.Start(opts.Command)
+	} else {
+		err = session.Shell()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if sized {
+		stop := watchResize(func() {
+			if w, h, ok := terminalSize(sizeFd); ok {
+				windowChange(session, w, h)
+			}
+		})
+		defer stop()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+	var ctxErr error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		ctxErr = ctx.Err()
+		session.Close()
+		err = <-done
+	}
+
+	result, err := commandResult(err, start)
+	if ctxErr != nil {
+		return result, ctxErr
+	}
+	return result, err
+}
+
+// windowChange tells the server that the terminal of session is now width by
+// height characters.
+func windowChange(session *cssh.Session, width, height int) error {
+	req := struct {
+		Columns     uint32
+		Rows        uint32
+		PixelWidth  uint32
+		PixelHeight uint32
+	}{uint32(width), uint32(height), 0, 0}
+	_, err := session.SendRequest("window-change", false, cssh.Marshal(&req))
+	return err
+}
+
+// terminalFd returns the file descriptor of f if it is a terminal.
+func terminalFd(f interface{}) (int, bool) {
+	file, ok := f.(*os.File)
+	if !ok || !isTerminal(int(file.Fd())) {
+		return 0, false
+	}
+	return int(file.Fd()), true
+}
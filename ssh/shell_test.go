@@ -0,0 +1,100 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apcera/libretto/ssh/sshtest"
+)
+
+func TestShell(t *testing.T) {
+	oldDial := dial
+	defer func() { dial = oldDial }()
+	dial = realDial
+
+	s, client := startServer(t)
+	defer s.Close()
+	s.Handle("", func(session *sshtest.Session) int {
+		line, _ := bufio.NewReader(session.Stdin).ReadString('\n')
+		fmt.Fprintf(session.Stdout, "%v %s %dx%d %s", session.Pty, session.Term, session.Width, session.Height, line)
+		return 7
+	})
+	s.Handle("top", func(session *sshtest.Session) int {
+		fmt.Fprintf(session.Stdout, "%dx%d", session.Width, session.Height)
+		return 0
+	})
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer client.Disconnect()
+
+	var stdout bytes.Buffer
+	result, err := client.Shell(context.Background(), strings.NewReader("exit\n"), &stdout, nil, ShellOptions{Term: "vt100"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if result.ExitStatus != 7 || stdout.String() != "true vt100 80x40 exit\n" {
+		t.Fatalf("Unexpected result %+v, %q", result, stdout.String())
+	}
+
+	stdout.Reset()
+	result, err = client.Shell(context.Background(), nil, &stdout, nil, ShellOptions{Command: "top", Width: 100, Height: 30})
+	if err != nil || !result.Success() || stdout.String() != "100x30" {
+		t.Fatalf("Unexpected result %+v, %q: %v", result, stdout.String(), err)
+	}
+
+	// The shell waits for input that never comes.
+	r, w := io.Pipe()
+	defer w.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.Shell(ctx, r, &stdout, nil, ShellOptions{}); err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+}
+
+func TestWindowChange(t *testing.T) {
+	oldDial := dial
+	defer func() { dial = oldDial }()
+	dial = realDial
+
+	s, client := startServer(t)
+	defer s.Close()
+	s.Handle("", func(session *sshtest.Session) int {
+		size := <-session.Resizes
+		fmt.Fprintf(session.Stdout, "%dx%d", size.Width, size.Height)
+		return 0
+	})
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer client.Disconnect()
+
+	session, err := client.newSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	if err := client.requestPty(session, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	if err := windowChange(session, 120, 50); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if err := session.Wait(); err != nil || stdout.String() != "120x50" {
+		t.Fatalf("Expected the new size, got %q: %v", stdout.String(), err)
+	}
+}
@@ -4,7 +4,7 @@ package ssh
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -35,6 +35,12 @@ var (
 	ErrValidation = errors.New("Unable to validate key")
 	// ErrPublicKey is returned when gossh fails to parse the public key.
 	ErrPublicKey = errors.New("Unable to convert public key")
+	// ErrPassphraseRequired is returned when a private key is encrypted and
+	// no passphrase is supplied.
+	ErrPassphraseRequired = errors.New("A passphrase is required to decrypt the private key")
+	// ErrInvalidPassphrase is returned when a private key cannot be decrypted
+	// with the passphrase supplied.
+	ErrInvalidPassphrase = errors.New("Invalid passphrase for the private key")
 	// ErrUnableToWriteFile is returned when the library fails to write to a file.
 	ErrUnableToWriteFile = errors.New("Unable to write file")
 	// ErrNotImplemented is returned when a function is not implemented (typically by the Mock implementation).
@@ -49,22 +55,43 @@ const (
 	// PasswordAuth represents password based auth.
 	PasswordAuth = "password"
 
-	// KeyAuth represents key based authentication.
+	// KeyAuth represents key based authentication, with a certificate if
+	// one is set.
 	KeyAuth = "key"
 
+	// AgentAuth represents authentication with the keys of an ssh-agent.
+	AgentAuth = "agent"
+
+	// SignerAuth represents authentication with the signers of Credentials.
+	SignerAuth = "signer"
+
+	// KeyboardInteractiveAuth represents keyboard-interactive authentication.
+	KeyboardInteractiveAuth = "keyboard-interactive"
+
 	// Timeout for connecting to an SSH server.
 	Timeout = 60 * time.Second
 )
 
 // Client represents an interface for abstracting common ssh operations.
 type Client interface {
+	Command(ctx context.Context, command string, opts RunOptions) (*CommandResult, error)
 	Connect() error
 	Disconnect()
 	Download(src io.WriteCloser, dst string) error
+	DownloadDir(remoteDir, localDir string) error
+	ForwardDynamic(localAddr string) (*Tunnel, error)
+	ForwardLocal(localAddr, remoteAddr string) (*Tunnel, error)
+	ForwardRemote(remoteAddr, localAddr string) (*Tunnel, error)
 	Run(command string, stdout io.Writer, stderr io.Writer) error
+	Shell(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, opts ShellOptions) (*CommandResult, error)
+	Sudo(ctx context.Context, command string, opts RunOptions) (*CommandResult, error)
+	Sync(ctx context.Context, localDir, remoteDir string, opts SyncOptions) (*SyncResult, error)
 	Upload(src io.Reader, dst string, mode uint32) error
+	UploadStream(src io.Reader, size int64, dst string, mode uint32, progress ProgressFunc) error
+	UploadDir(localDir, remoteDir string) error
 	Validate() error
 	WaitForSSH(maxWait time.Duration) error
+	WaitForSSHContext(ctx context.Context, maxWait time.Duration) error
 
 	SetSSHPrivateKey(string)
 	GetSSHPrivateKey() string
@@ -78,13 +105,60 @@ type Credentials struct {
 	SSHUser       string
 	SSHPassword   string
 	SSHPrivateKey string
+	// SSHPassphrase decrypts SSHPrivateKey if it is encrypted.
+	SSHPassphrase string
+	// SSHCertificate is an OpenSSH user certificate for SSHPrivateKey, as in
+	// the -cert.pub file ssh-keygen -s writes. It is offered before the
+	// bare key.
+	SSHCertificate string
+	// SSHAgentSocket is the socket of an ssh-agent whose keys are offered,
+	// such as os.Getenv("SSH_AUTH_SOCK").
+	SSHAgentSocket string
+	// Signers returns more keys to offer, such as keys held in hardware. It
+	// is called on every connection.
+	Signers func() ([]cssh.Signer, error)
+	// KeyboardInteractive answers the questions of keyboard-interactive
+	// authentication. If nil, SSHPassword answers the questions that are not
+	// echoed, as password prompts are.
+	KeyboardInteractive cssh.KeyboardInteractiveChallenge
+	// AuthMethods are the methods tried, in order, such as KeyAuth and
+	// PasswordAuth. By default, every method set up above is tried: the
+	// keys first, then the password, then keyboard-interactive. AgentAuth
+	// falls back on SSH_AUTH_SOCK if SSHAgentSocket is empty.
+	AuthMethods []string
 }
 
+// FileTransfer is a protocol Upload and Download copy files with.
+type FileTransfer int
+
+const (
+	// TransferSCP runs /usr/bin/scp on the remote host. It is the default.
+	TransferSCP FileTransfer = iota
+	// TransferSFTP uses the SFTP subsystem of the SSH server.
+	TransferSFTP
+)
+
 // Options provides SSH options like KeepAlive.
 type Options struct {
 	IPs       []net.IP
 	KeepAlive int
 	Pty       bool
+	// PtyWidth and PtyHeight are the size, in characters, of the terminal
+	// requested with Pty. They default to 80x40.
+	PtyWidth  int
+	PtyHeight int
+	// FileTransfer selects the protocol used by Upload and Download.
+	FileTransfer FileTransfer
+	// HostKey verifies the key of the server, such as KnownHosts or
+	// TrustOnFirstUse. If nil, any host key is accepted.
+	HostKey HostKeyCallback
+	// JumpHosts are the bastions to connect through, in order: the first
+	// one is dialed directly and each next one, then the server, through
+	// the previous one.
+	JumpHosts []JumpHost
+	// Pool, if set, shares the connections of the clients to the same user
+	// and host. See Pool.
+	Pool *Pool
 }
 
 // SSHClient provides details for the SSH connection.
@@ -95,7 +169,10 @@ type SSHClient struct {
 	Options Options
 
 	cryptoClient *cssh.Client
+	jumps        []*cssh.Client
+	pooled       *pooledConn
 	close        chan bool
+	tunnels      map[*Tunnel]struct{}
 }
 
 // MockSSHClient represents a Mock Client wrapper.
@@ -108,6 +185,18 @@ type MockSSHClient struct {
 	MockValidate   func() error
 	MockWaitForSSH func(maxWait time.Duration) error
 
+	MockWaitForSSHContext func(ctx context.Context, maxWait time.Duration) error
+	MockUploadStream      func(src io.Reader, size int64, dst string, mode uint32, progress ProgressFunc) error
+	MockUploadDir         func(localDir, remoteDir string) error
+	MockDownloadDir       func(remoteDir, localDir string) error
+	MockForwardLocal      func(localAddr, remoteAddr string) (*Tunnel, error)
+	MockForwardRemote     func(remoteAddr, localAddr string) (*Tunnel, error)
+	MockForwardDynamic    func(localAddr string) (*Tunnel, error)
+	MockCommand           func(ctx context.Context, command string, opts RunOptions) (*CommandResult, error)
+	MockSudo              func(ctx context.Context, command string, opts RunOptions) (*CommandResult, error)
+	MockSync              func(ctx context.Context, localDir, remoteDir string, opts SyncOptions) (*SyncResult, error)
+	MockShell             func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, opts ShellOptions) (*CommandResult, error)
+
 	MockSetSSHPrivateKey func(string)
 	MockGetSSHPrivateKey func() string
 	MockSetSSHPassword   func(string)
@@ -131,119 +220,228 @@ var dial = func(network, addr string, config *cssh.ClientConfig) (*cssh.Client,
 	return cssh.NewClient(c, chans, reqs), nil
 }
 
-var readPrivateKey = func(key string) (cssh.AuthMethod, error) {
-	signer, err := cssh.ParsePrivateKey([]byte(key))
-	if err != nil {
-		return nil, err
-	}
+var readPrivateKey = func(key, passphrase string) (cssh.Signer, error) {
+	return ParsePrivateKey([]byte(key), passphrase)
+}
 
-	return cssh.PublicKeys(signer), nil
+// seenHostKey is the host key a server presented during the handshake, and
+// the error the HostKeyCallback returned for it. The SSH handshake flattens
+// the error of the callback into its own, so it is kept to be returned as is.
+type seenHostKey struct {
+	hostname string
+	remote   net.Addr
+	key      cssh.PublicKey
+	err      error
 }
 
-var getAuth = func(c *Credentials, authType string) (cssh.AuthMethod, error) {
-	var (
-		auth cssh.AuthMethod
-		err  error
-	)
+// check verifies the key with hostKey, as the handshake did with the
+// callback it was seen with.
+func (k *seenHostKey) check(hostKey HostKeyCallback) error {
+	if hostKey == nil {
+		return nil
+	}
+	return hostKey(k.hostname, k.remote, k.key)
+}
 
-	switch authType {
-	case PasswordAuth:
-		return cssh.Password(c.SSHPassword), nil
-	case KeyAuth:
-		return readPrivateKey(c.SSHPrivateKey)
+// clientConfig returns the configuration to log in with creds and to verify
+// the host key with hostKey. The key the server presents is kept in seen.
+// done must be called once the handshake is over.
+func clientConfig(creds *Credentials, hostKey HostKeyCallback, seen *seenHostKey) (config *cssh.ClientConfig, done func(), err error) {
+	auth, done, err := authMethods(creds)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config = &cssh.ClientConfig{
+		User: creds.SSHUser,
+		Auth: auth,
+		HostKeyCallback: func(hostname string, remote net.Addr, key cssh.PublicKey) error {
+			*seen = seenHostKey{hostname: hostname, remote: remote, key: key}
+			seen.err = seen.check(hostKey)
+			return seen.err
+		},
 	}
-	return auth, err
+	return config, done, nil
 }
 
-// Connect connects to a machine using SSH.
+// Connect connects to a machine using SSH, through the jump hosts of
+// Options.JumpHosts if any, or takes a connection from Options.Pool. A client
+// that is connected already is disconnected first.
 func (client *SSHClient) Connect() error {
-	var (
-		auth cssh.AuthMethod
-		err  error
-	)
-
-	if err = client.Validate(); err != nil {
+	if err := client.Validate(); err != nil {
 		return err
 	}
+	if client.cryptoClient != nil {
+		client.Disconnect()
+	}
 
-	if client.Creds.SSHPrivateKey != "" {
-		auth, err = getAuth(client.Creds, KeyAuth)
+	var (
+		c     *cssh.Client
+		jumps []*cssh.Client
+	)
+	if client.Options.Pool != nil {
+		pc, err := client.Options.Pool.acquire(client.poolKey(), client.dial, client.checkHostKeys)
 		if err != nil {
 			return err
 		}
+		c = pc.client
+		closeMutex.Lock()
+		client.pooled = pc
+		closeMutex.Unlock()
 	} else {
-		auth, err = getAuth(client.Creds, PasswordAuth)
+		conn, err := client.dial()
 		if err != nil {
 			return err
 		}
+		c, jumps = conn.client, conn.jumps
 	}
 
-	config := &cssh.ClientConfig{
-		User: client.Creds.SSHUser,
-		Auth: []cssh.AuthMethod{
-			auth,
-		},
+	closeMutex.Lock()
+	defer closeMutex.Unlock()
+
+	client.jumps = jumps
+	client.cryptoClient = c
+	if client.close == nil {
+		client.close = make(chan bool, 1)
 	}
+	if client.Options.KeepAlive > 0 {
+		go client.keepAlive(c, client.close)
+	}
+	return nil
+}
 
-	port := sshPort
-	if client.Port != 0 {
-		port = client.Port
+// dial connects to the server, through the jump hosts if any. The connection
+// keeps the host keys they presented, so that a Pool can check them with the
+// policies of the other clients it gives the connection to.
+func (client *SSHClient) dial() (*pooledConn, error) {
+	var seen seenHostKey
+	config, done, err := clientConfig(client.Creds, client.Options.HostKey, &seen)
+	if err != nil {
+		return nil, err
 	}
+	defer done()
 
-	c, err := dial("tcp", fmt.Sprintf("%s:%d", client.IP, port), config)
+	var (
+		c        *cssh.Client
+		jumps    []*cssh.Client
+		hostKeys []seenHostKey
+	)
+	if len(client.Options.JumpHosts) > 0 {
+		jumps, hostKeys, err = dialJumpHosts(client.Options.JumpHosts, client.Creds)
+		if err != nil {
+			return nil, err
+		}
+		c, err = dialVia(jumps[len(jumps)-1], client.addr(), config)
+		if err != nil {
+			closeClients(jumps)
+		}
+	} else {
+		c, err = dial("tcp", client.addr(), config)
+	}
+	if seen.err != nil {
+		return nil, seen.err
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &pooledConn{client: c, jumps: jumps, hostKeys: append(hostKeys, seen)}, nil
+}
 
-	client.cryptoClient = c
+// checkHostKeys verifies the host keys presented when conn was dialed with
+// the policies of client, as dialing again would.
+func (client *SSHClient) checkHostKeys(conn *pooledConn) error {
+	for i, j := range client.Options.JumpHosts {
+		if err := conn.hostKeys[i].check(j.HostKey); err != nil {
+			return fmt.Errorf("ssh: jump host %s: %w", j.addr(), err)
+		}
+	}
+	return conn.hostKeys[len(conn.hostKeys)-1].check(client.Options.HostKey)
+}
 
-	closeMutex.Lock()
-	defer closeMutex.Unlock()
+func (client *SSHClient) addr() string {
+	port := sshPort
+	if client.Port != 0 {
+		port = client.Port
+	}
+	return net.JoinHostPort(client.IP.String(), strconv.Itoa(port))
+}
 
-	if client.close == nil {
-		client.close = make(chan bool, 1)
+// newSession opens a session on the connection. If the connection of the
+// pool is broken, it connects again once.
+func (client *SSHClient) newSession() (*cssh.Session, error) {
+	session, err := client.cryptoClient.NewSession()
+	if err == nil || client.pooled == nil {
+		return session, err
 	}
-	if client.Options.KeepAlive > 0 {
-		go client.keepAlive()
+	client.Options.Pool.evict(client.pooled)
+	if err := client.Connect(); err != nil {
+		return nil, err
 	}
-	return nil
+	return client.cryptoClient.NewSession()
 }
 
-func (client *SSHClient) keepAlive() {
+func (client *SSHClient) keepAlive(c *cssh.Client, closing chan bool) {
 	t := time.NewTicker(time.Duration(client.Options.KeepAlive) * time.Second)
 	defer t.Stop()
 	for {
 		select {
 		case <-t.C:
 			// send a keep alive request on the underlying channel
-			client.cryptoClient.Conn.SendRequest("libretto-ssh", true, nil)
-		case <-client.close:
+			if _, _, err := c.Conn.SendRequest("libretto-ssh", true, nil); err != nil {
+				// The connection is gone, and so are the tunnels
+				// through it.
+				client.closeTunnels()
+				return
+			}
+		case <-closing:
 			// client is disconnecting, close it
 			return
 		}
 	}
 }
 
-// Disconnect should be called when the ssh client is no longer needed, and state can be cleaned up
-func (client *SSHClient) Disconnect() {
-	select {
-	case <-client.close:
-	default:
-		closeMutex.Lock()
-		defer closeMutex.Unlock()
+// Connected reports whether the client is connected, and so must be
+// disconnected once no longer needed.
+func (client *SSHClient) Connected() bool {
+	closeMutex.Lock()
+	defer closeMutex.Unlock()
+	return client.cryptoClient != nil
+}
 
-		if client.close != nil {
-			close(client.close)
-			client.close = nil
-		}
+// Disconnect should be called when the ssh client is no longer needed, and state can be cleaned up.
+// It closes the connection, and those to the jump hosts, or gives it back to
+// Options.Pool.
+func (client *SSHClient) Disconnect() {
+	closeMutex.Lock()
+	if client.close != nil {
+		close(client.close)
+		client.close = nil
 	}
+	c, jumps, pooled := client.cryptoClient, client.jumps, client.pooled
+	client.cryptoClient, client.jumps, client.pooled = nil, nil, nil
+	closeMutex.Unlock()
+
+	client.closeTunnels()
+	if pooled != nil {
+		client.Options.Pool.release(pooled)
+		return
+	}
+	if c != nil {
+		c.Close()
+	}
+	closeClients(jumps)
 }
 
-// Download downloads a file via SSH (SCP)
+// Download downloads a file via SSH, using SCP or SFTP as set in
+// Options.FileTransfer.
 func (client *SSHClient) Download(dst io.WriteCloser, remotePath string) error {
 	defer dst.Close()
 
-	session, err := client.cryptoClient.NewSession()
+	if client.Options.FileTransfer == TransferSFTP {
+		return client.sftpDownload(dst, remotePath)
+	}
+
+	session, err := client.newSession()
 	if err != nil {
 		return err
 	}
@@ -337,7 +535,7 @@ func (client *SSHClient) Download(dst io.WriteCloser, remotePath string) error {
 
 // Run runs a command via SSH.
 func (client *SSHClient) Run(command string, stdout io.Writer, stderr io.Writer) error {
-	session, err := client.cryptoClient.NewSession()
+	session, err := client.newSession()
 	if err != nil {
 		return err
 	}
@@ -348,13 +546,7 @@ func (client *SSHClient) Run(command string, stdout io.Writer, stderr io.Writer)
 	session.Stderr = stderr
 
 	if client.Options.Pty {
-		modes := cssh.TerminalModes{
-			cssh.ECHO:          0,
-			cssh.TTY_OP_ISPEED: 14400,
-			cssh.TTY_OP_OSPEED: 14400,
-		}
-		// Request pseudo terminal
-		if err := session.RequestPty(os.Getenv("TERM"), 80, 40, modes); err != nil {
+		if err := client.requestPty(session, 0, 0); err != nil {
 			return err
 		}
 	}
@@ -362,14 +554,82 @@ func (client *SSHClient) Run(command string, stdout io.Writer, stderr io.Writer)
 	return session.Run(command)
 }
 
-// Upload uploads a new file via SSH (SCP)
+// requestPty requests a pseudo terminal of width by height characters for
+// session, or of the size in Options if they are 0.
+func (client *SSHClient) requestPty(session *cssh.Session, width, height int) error {
+	width, height = client.ptySize(width, height)
+	modes := cssh.TerminalModes{
+		cssh.ECHO:          0,
+		cssh.TTY_OP_ISPEED: 14400,
+		cssh.TTY_OP_OSPEED: 14400,
+	}
+	// Request pseudo terminal
+	return session.RequestPty(os.Getenv("TERM"), height, width, modes)
+}
+
+// ptySize returns width and height, or the size in Options if they are 0,
+// or 80 by 40.
+func (client *SSHClient) ptySize(width, height int) (int, int) {
+	if width <= 0 {
+		width = client.Options.PtyWidth
+	}
+	if width <= 0 {
+		width = 80
+	}
+	if height <= 0 {
+		height = client.Options.PtyHeight
+	}
+	if height <= 0 {
+		height = 40
+	}
+	return width, height
+}
+
+// Upload uploads a new file via SSH, using SCP or SFTP as set in
+// Options.FileTransfer. It streams src like UploadStream, finding its size
+// the same way.
 func (client *SSHClient) Upload(src io.Reader, dst string, mode uint32) error {
-	fileContent, err := ioutil.ReadAll(src)
-	if err != nil {
-		return err
+	return client.UploadStream(src, -1, dst, mode, nil)
+}
+
+// UploadStream uploads size bytes read from src to the file dst without
+// holding them in memory. If size is negative, it is the size of src when
+// src is an *os.File, an io.Seeker or has a Len method, such as
+// *bytes.Buffer; SCP needs to know the size in advance, so other readers are
+// first copied to a temporary file. It fails if src ends before size bytes.
+// If progress is not nil, it is called as the data is sent.
+func (client *SSHClient) UploadStream(src io.Reader, size int64, dst string, mode uint32, progress ProgressFunc) error {
+	if size < 0 {
+		size = readerSize(src)
+	}
+	if client.Options.FileTransfer == TransferSFTP {
+		if size >= 0 {
+			src = &sizedReader{r: src, size: size}
+		}
+		return client.sftpUpload(newProgressReader(src, size, progress), dst, os.FileMode(mode))
 	}
 
-	session, err := client.cryptoClient.NewSession()
+	if size < 0 {
+		f, err := ioutil.TempFile("", "libretto-upload")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if size, err = io.Copy(f, src); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		src = f
+	}
+	return client.scpUpload(newProgressReader(src, size, progress), size, dst, mode)
+}
+
+// scpUpload uploads size bytes of src with SCP.
+func (client *SSHClient) scpUpload(src io.Reader, size int64, dst string, mode uint32) error {
+	session, err := client.newSession()
 	if err != nil {
 		return err
 	}
@@ -393,9 +653,12 @@ func (client *SSHClient) Upload(src io.Reader, dst string, mode uint32) error {
 		defer wg.Done()
 
 		// Signals to the SSH receiver that content is being passed.
-		fmt.Fprintf(w, "C%#o %d %s\n", mode, len(fileContent), remoteFileName)
-		_, err = io.Copy(w, bytes.NewReader(fileContent))
+		fmt.Fprintf(w, "C%#o %d %s\n", mode, size, remoteFileName)
+		n, err := io.CopyN(w, src, size)
 		if err != nil {
+			if err == io.EOF {
+				err = shortSourceError(n, size)
+			}
 			errorChan <- err
 			return
 		}
@@ -430,30 +693,63 @@ func (client *SSHClient) Validate() error {
 		return ErrInvalidUsername
 	}
 
-	if client.Creds.SSHPrivateKey == "" && client.Creds.SSHPassword == "" {
+	if !client.Creds.hasAuth() {
 		return ErrInvalidAuth
 	}
 
+	for _, j := range client.Options.JumpHosts {
+		if j.Creds == nil {
+			continue
+		}
+		if j.Creds.SSHUser == "" {
+			return ErrInvalidUsername
+		}
+		if !j.Creds.hasAuth() {
+			return ErrInvalidAuth
+		}
+	}
+
 	return nil
 }
 
 // WaitForSSH will try to connect to an SSH server. If it fails, then it'll
-// sleep for 5 seconds.
+// sleep for 5 seconds. The client stays connected once it succeeds, and
+// should be disconnected when no longer needed.
 func (client *SSHClient) WaitForSSH(maxWait time.Duration) error {
+	return client.WaitForSSHContext(context.Background(), maxWait)
+}
+
+// WaitForSSHContext is like WaitForSSH but gives up as soon as ctx is done,
+// returning ctx.Err().
+func (client *SSHClient) WaitForSSHContext(ctx context.Context, maxWait time.Duration) error {
 	start := time.Now()
 
 	for {
-		if err := client.Connect(); err == nil {
-			defer client.Disconnect()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := client.Connect()
+		if err == nil {
 			return nil
 		}
+		if errors.Is(err, ErrHostKeyMismatch) || errors.Is(err, ErrUnknownHostKey) {
+			// Retrying would not change the key.
+			return err
+		}
 
 		timePassed := time.Since(start)
 		if timePassed >= maxWait {
 			break
 		}
 
-		time.Sleep(5 * time.Second)
+		t := time.NewTimer(5 * time.Second)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
 	}
 
 	return ErrTimeout
@@ -14,7 +14,7 @@ func requireMockedClient() SSHClient {
 	dial = func(p string, a string, c *cssh.ClientConfig) (*cssh.Client, error) {
 		return nil, nil
 	}
-	readPrivateKey = func(path string) (cssh.AuthMethod, error) {
+	readPrivateKey = func(path, passphrase string) (cssh.Signer, error) {
 		return nil, nil
 	}
 	return c
@@ -52,7 +52,7 @@ func TestConnectAuthPrecedence(t *testing.T) {
 		SSHPrivateKey: "/foo",
 	}
 
-	readPrivateKey = func(path string) (cssh.AuthMethod, error) {
+	readPrivateKey = func(path, passphrase string) (cssh.Signer, error) {
 		count++
 		return nil, nil
 	}
@@ -0,0 +1,74 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package sshtest
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// signals are the signals clients can send to the commands run in the local
+// shell.
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
+
+// execLocal runs the command with sh -c on the local host, in the
+// environment the client set, and passes on the signals the client sends. A
+// command killed by a signal is reported as such.
+func execLocal(s *Session) int {
+	cmd := exec.Command("sh", "-c", s.Command)
+	if len(s.Env) > 0 {
+		cmd.Env = os.Environ()
+		for name, value := range s.Env {
+			cmd.Env = append(cmd.Env, name+"="+value)
+		}
+	}
+	cmd.Stdout, cmd.Stderr = s.Stdout, s.Stderr
+	// Wait would wait for the client to close stdin if it were given as is.
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		fmt.Fprintf(s.Stderr, "sh: %s\n", err)
+		return 127
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(s.Stderr, "sh: %s\n", err)
+		return 127
+	}
+	go func() {
+		io.Copy(stdin, s.Stdin)
+		stdin.Close()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case name := <-s.Signals:
+				if sig, ok := signals[name]; ok {
+					cmd.Process.Signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	cmd.Wait()
+	close(done)
+
+	ws := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if ws.Signaled() {
+		for name, sig := range signals {
+			if sig == ws.Signal() {
+				s.ExitSignal = name
+			}
+		}
+	}
+	return ws.ExitStatus()
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package sshtest
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	cssh "golang.org/x/crypto/ssh"
+)
+
+// serveDirect connects to the address a direct-tcpip channel asks for and
+// copies data both ways, as sshd does for ssh -L.
+func serveDirect(nc cssh.NewChannel) {
+	var m struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := cssh.Unmarshal(nc.ExtraData(), &m); err != nil {
+		nc.Reject(cssh.ConnectionFailed, err.Error())
+		return
+	}
+	c, err := net.Dial("tcp", net.JoinHostPort(m.Host, strconv.Itoa(int(m.Port))))
+	if err != nil {
+		nc.Reject(cssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		c.Close()
+		return
+	}
+	go cssh.DiscardRequests(reqs)
+	pipe(c, ch)
+}
+
+// forwards holds the ports a connection asked the server to listen on, as
+// sshd does for ssh -R.
+type forwards struct {
+	conn *cssh.ServerConn
+
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+// serveRequests answers the global requests of conn until it is closed,
+// and then stops listening on the forwarded ports.
+func serveRequests(conn *cssh.ServerConn, reqs <-chan *cssh.Request) {
+	f := &forwards{conn: conn, listeners: make(map[string]net.Listener)}
+	for req := range reqs {
+		var m struct {
+			Addr string
+			Port uint32
+		}
+		if (req.Type != "tcpip-forward" && req.Type != "cancel-tcpip-forward") || cssh.Unmarshal(req.Payload, &m) != nil {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+		if req.Type == "cancel-tcpip-forward" {
+			req.Reply(f.cancel(m.Addr, m.Port), nil)
+			continue
+		}
+		port, ok := f.listen(m.Addr, m.Port)
+		req.Reply(ok, cssh.Marshal(struct{ Port uint32 }{port}))
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, l := range f.listeners {
+		l.Close()
+	}
+}
+
+// listen listens on addr and port, and forwards the connections it accepts
+// to the client. It returns the port, which is chosen if port is 0.
+func (f *forwards) listen(addr string, port uint32) (uint32, bool) {
+	l, err := net.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(int(port))))
+	if err != nil {
+		return 0, false
+	}
+	port = uint32(l.Addr().(*net.TCPAddr).Port)
+	f.mu.Lock()
+	f.listeners[net.JoinHostPort(addr, strconv.Itoa(int(port)))] = l
+	f.mu.Unlock()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			origin := c.RemoteAddr().(*net.TCPAddr)
+			ch, reqs, err := f.conn.OpenChannel("forwarded-tcpip", cssh.Marshal(struct {
+				Addr       string
+				Port       uint32
+				OriginAddr string
+				OriginPort uint32
+			}{addr, port, origin.IP.String(), uint32(origin.Port)}))
+			if err != nil {
+				c.Close()
+				continue
+			}
+			go cssh.DiscardRequests(reqs)
+			go pipe(c, ch)
+		}
+	}()
+	return port, true
+}
+
+// cancel stops listening on addr and port.
+func (f *forwards) cancel(addr string, port uint32) bool {
+	key := net.JoinHostPort(addr, strconv.Itoa(int(port)))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, ok := f.listeners[key]
+	if ok {
+		l.Close()
+		delete(f.listeners, key)
+	}
+	return ok
+}
+
+// pipe copies data between c and ch, and closes c once ch is done.
+func pipe(c net.Conn, ch cssh.Channel) {
+	go func() {
+		io.Copy(ch, c)
+		ch.CloseWrite()
+	}()
+	io.Copy(c, ch)
+	c.Close()
+}
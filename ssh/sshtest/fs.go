@@ -0,0 +1,287 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package sshtest
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FS is an in-memory filesystem that scp on a Server reads and writes. Paths
+// are slash-separated, and relative paths are relative to the root. The
+// parent directories of files are created as needed. An FS is safe for
+// concurrent use.
+type FS struct {
+	mu    sync.Mutex
+	files map[string]*file
+	// listed maps the files to the names ReadDir lists them with.
+	listed map[string]string
+}
+
+type file struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// NewFS returns an FS with only a root and a /tmp directory.
+func NewFS() *FS {
+	now := time.Now()
+	return &FS{files: map[string]*file{
+		"/":    {mode: os.ModeDir | 0755, modTime: now},
+		"/tmp": {mode: os.ModeDir | 01777, modTime: now},
+	}}
+}
+
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+// WriteFile writes data to the file name, creating it with perm if needed.
+func (fs *FS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.writeFile(clean(name), data, perm)
+}
+
+func (fs *FS) writeFile(name string, data []byte, perm os.FileMode) error {
+	if f, ok := fs.files[name]; ok && f.mode.IsDir() {
+		return &os.PathError{Op: "write", Path: name, Err: errors.New("is a directory")}
+	}
+	if err := fs.mkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+	fs.files[name] = &file{
+		data:    append([]byte(nil), data...),
+		mode:    perm & os.ModePerm,
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+// ReadFile returns the content of the file name.
+func (fs *FS) ReadFile(name string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = clean(name)
+	f, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if f.mode.IsDir() {
+		return nil, &os.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	return append([]byte(nil), f.data...), nil
+}
+
+// MkdirAll creates the directory name and its parents with perm.
+func (fs *FS) MkdirAll(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.mkdirAll(clean(name), perm)
+}
+
+func (fs *FS) mkdirAll(name string, perm os.FileMode) error {
+	if f, ok := fs.files[name]; ok {
+		if !f.mode.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: errors.New("not a directory")}
+		}
+		return nil
+	}
+	if err := fs.mkdirAll(path.Dir(name), perm); err != nil {
+		return err
+	}
+	fs.files[name] = &file{mode: os.ModeDir | perm&os.ModePerm, modTime: time.Now()}
+	return nil
+}
+
+// Mkdir creates the directory name with perm. Its parent must exist.
+func (fs *FS) Mkdir(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = clean(name)
+	if _, ok := fs.files[name]; ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if f, ok := fs.files[path.Dir(name)]; !ok || !f.mode.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrNotExist}
+	}
+	fs.files[name] = &file{mode: os.ModeDir | perm&os.ModePerm, modTime: time.Now()}
+	return nil
+}
+
+// Remove removes the file or empty directory name.
+func (fs *FS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = clean(name)
+	if name == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: errors.New("cannot remove the root")}
+	}
+	if _, ok := fs.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	for p := range fs.files {
+		if strings.HasPrefix(p, name+"/") {
+			return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+// Rename moves oldname, and its content if it is a directory, to newname,
+// replacing the file newname if there is one.
+func (fs *FS) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	oldname, newname = clean(oldname), clean(newname)
+	if _, ok := fs.files[oldname]; !ok || oldname == "/" {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if f, ok := fs.files[path.Dir(newname)]; !ok || !f.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if f, ok := fs.files[newname]; ok && f.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	for p, f := range fs.files {
+		if p == oldname || strings.HasPrefix(p, oldname+"/") {
+			delete(fs.files, p)
+			fs.files[newname+strings.TrimPrefix(p, oldname)] = f
+		}
+	}
+	return nil
+}
+
+// Chmod sets the permission bits of name.
+func (fs *FS) Chmod(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = clean(name)
+	f, ok := fs.files[name]
+	if !ok {
+		return &os.PathError{Op: "chmod", Path: name, Err: os.ErrNotExist}
+	}
+	f.mode = f.mode&^os.ModePerm | perm&os.ModePerm
+	return nil
+}
+
+// writeAt writes data at off in the file name, which must exist, growing it
+// as needed.
+func (fs *FS) writeAt(name string, data []byte, off int64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[name]
+	if !ok {
+		return &os.PathError{Op: "write", Path: name, Err: os.ErrNotExist}
+	}
+	if f.mode.IsDir() {
+		return &os.PathError{Op: "write", Path: name, Err: errors.New("is a directory")}
+	}
+	if end := off + int64(len(data)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	copy(f.data[off:], data)
+	f.modTime = time.Now()
+	return nil
+}
+
+// RemoveAll removes name and, if it is a directory, its content.
+func (fs *FS) RemoveAll(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = clean(name)
+	if name == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: errors.New("cannot remove the root")}
+	}
+	for p := range fs.files {
+		if p == name || strings.HasPrefix(p, name+"/") {
+			delete(fs.files, p)
+		}
+	}
+	return nil
+}
+
+// Chtimes sets the modification time of name.
+func (fs *FS) Chtimes(name string, mtime time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = clean(name)
+	f, ok := fs.files[name]
+	if !ok {
+		return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrNotExist}
+	}
+	f.modTime = mtime
+	return nil
+}
+
+// Stat returns the FileInfo of name.
+func (fs *FS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = clean(name)
+	f, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return newFileInfo(path.Base(name), f), nil
+}
+
+// ReadDir returns the FileInfos of the content of the directory name, sorted
+// by name.
+func (fs *FS) ReadDir(name string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = clean(name)
+	if f, ok := fs.files[name]; !ok || !f.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	var infos []os.FileInfo
+	for p, f := range fs.files {
+		if p != "/" && path.Dir(p) == name {
+			base, ok := fs.listed[p]
+			if !ok {
+				base = path.Base(p)
+			}
+			infos = append(infos, newFileInfo(base, f))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// SetListedName makes ReadDir, and so scp and SFTP, list the file name as
+// listed, such as "../../.ssh/authorized_keys", as a hostile server would.
+func (fs *FS) SetListedName(name, listed string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.listed == nil {
+		fs.listed = make(map[string]string)
+	}
+	fs.listed[clean(name)] = listed
+}
+
+// fileInfo is a snapshot of a file, taken with the FS locked.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func newFileInfo(name string, f *file) fileInfo {
+	return fileInfo{name, int64(len(f.data)), f.mode, f.modTime}
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fileInfo) Sys() interface{}   { return nil }
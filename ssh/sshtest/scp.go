@@ -0,0 +1,348 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package sshtest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errProtocol = errors.New("protocol error")
+
+// scpCommand is a command line that runs scp, such as
+// "mkdir -p '/srv' && /usr/bin/scp -r -p -t '/srv'".
+type scpCommand struct {
+	mkdirs    []string
+	sink      bool
+	recursive bool
+	preserve  bool
+	target    string
+}
+
+// parseSCP parses command if it runs scp, possibly after mkdir -p.
+func parseSCP(command string) (*scpCommand, bool) {
+	segments, ok := splitCommand(command)
+	if !ok {
+		return nil, false
+	}
+	var (
+		scp    *scpCommand
+		mkdirs []string
+	)
+	for _, words := range segments {
+		switch {
+		case len(words) > 2 && words[0] == "mkdir" && words[1] == "-p":
+			if scp != nil {
+				return nil, false
+			}
+			mkdirs = append(mkdirs, words[2:]...)
+		case len(words) > 0 && path.Base(words[0]) == "scp" && scp == nil:
+			scp = &scpCommand{}
+			for _, w := range words[1:] {
+				switch {
+				case w == "-t":
+					scp.sink = true
+				case w == "-f":
+				case w == "-r":
+					scp.recursive = true
+				case w == "-p":
+					scp.preserve = true
+				case w == "-d" || w == "-v":
+				case strings.HasPrefix(w, "-") || scp.target != "":
+					return nil, false
+				default:
+					scp.target = w
+				}
+			}
+			if scp.target == "" {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+	if scp == nil {
+		return nil, false
+	}
+	scp.mkdirs = mkdirs
+	return scp, true
+}
+
+// splitCommand splits command into the words of the commands joined by &&.
+// It understands single quotes and backslashes, and nothing else of the
+// shell.
+func splitCommand(command string) ([][]string, bool) {
+	var (
+		segments [][]string
+		words    []string
+		word     strings.Builder
+		inWord   bool
+	)
+	endWord := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == '\'':
+			j := strings.IndexByte(command[i+1:], '\'')
+			if j < 0 {
+				return nil, false
+			}
+			word.WriteString(command[i+1 : i+1+j])
+			i += j + 1
+			inWord = true
+		case c == '\\' && i+1 < len(command):
+			word.WriteByte(command[i+1])
+			i++
+			inWord = true
+		case c == ' ' || c == '\t':
+			endWord()
+		case c == '&' && !inWord && strings.HasPrefix(command[i:], "&&"):
+			segments = append(segments, words)
+			words = nil
+			i++
+		case strings.IndexByte("\"$`;|&<>()*?\n", c) >= 0:
+			return nil, false
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	endWord()
+	return append(segments, words), true
+}
+
+// handler returns the Handler that runs the command on fs.
+func (scp *scpCommand) handler(fs *FS) Handler {
+	return func(s *Session) int {
+		for _, dir := range scp.mkdirs {
+			if err := fs.MkdirAll(dir, 0755); err != nil {
+				fmt.Fprintf(s.Stderr, "mkdir: %s\n", err)
+				return 1
+			}
+		}
+		w := s.Stdout
+		r := bufio.NewReader(s.Stdin)
+		var err error
+		if scp.sink {
+			err = scp.receive(fs, w, r)
+		} else {
+			err = scp.send(fs, w, r)
+		}
+		if err != nil {
+			fmt.Fprintf(w, "\x01scp: %s\n", err)
+			return 1
+		}
+		return 0
+	}
+}
+
+// receive runs scp -t: it writes what the client sends to fs.
+func (scp *scpCommand) receive(fs *FS, w io.Writer, r *bufio.Reader) error {
+	ack := func() error {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	target := clean(scp.target)
+	info, err := fs.Stat(target)
+	targetIsDir := err == nil && info.IsDir()
+
+	type dir struct {
+		path  string
+		mtime time.Time
+	}
+	var (
+		dirs  []dir
+		mtime time.Time
+	)
+	if err := ack(); err != nil {
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" && len(dirs) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return errProtocol
+		}
+
+		switch line[0] {
+		case 'T':
+			var sec, usec, asec, ausec int64
+			if _, err := fmt.Sscanf(line, "T%d %d %d %d", &sec, &usec, &asec, &ausec); err != nil {
+				return errProtocol
+			}
+			mtime = time.Unix(sec, 0)
+		case 'C', 'D':
+			mode, size, name, err := parseRecord(line)
+			if err != nil {
+				return err
+			}
+			var p string
+			switch {
+			case len(dirs) > 0:
+				p = path.Join(dirs[len(dirs)-1].path, name)
+			case targetIsDir:
+				p = path.Join(target, name)
+			default:
+				p = target
+			}
+
+			if line[0] == 'D' {
+				if !scp.recursive {
+					return fmt.Errorf("%s: is a directory", name)
+				}
+				if err := fs.MkdirAll(p, mode); err != nil {
+					return err
+				}
+				dirs = append(dirs, dir{p, mtime})
+				break
+			}
+
+			if err := ack(); err != nil {
+				return err
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if b, err := r.ReadByte(); err != nil || b != 0 {
+				return errProtocol
+			}
+			if err := fs.WriteFile(p, data, mode); err != nil {
+				return err
+			}
+			if scp.preserve && !mtime.IsZero() {
+				fs.Chtimes(p, mtime)
+			}
+		case 'E':
+			if len(dirs) == 0 {
+				return errProtocol
+			}
+			d := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if scp.preserve && !d.mtime.IsZero() {
+				fs.Chtimes(d.path, d.mtime)
+			}
+		default:
+			return errProtocol
+		}
+		if line[0] != 'T' {
+			mtime = time.Time{}
+		}
+		if err := ack(); err != nil {
+			return err
+		}
+	}
+}
+
+// parseRecord parses a C or D record, such as "C0644 14 somefile".
+func parseRecord(line string) (os.FileMode, int64, string, error) {
+	fields := strings.SplitN(line[1:], " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", errProtocol
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", errProtocol
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", errProtocol
+	}
+	name := fields[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", fmt.Errorf("%s: invalid file name", name)
+	}
+	return os.FileMode(mode) & os.ModePerm, size, name, nil
+}
+
+// send runs scp -f: it sends the target in fs to the client.
+func (scp *scpCommand) send(fs *FS, w io.Writer, r *bufio.Reader) error {
+	if err := readAck(r); err != nil {
+		return err
+	}
+	target := clean(scp.target)
+	info, err := fs.Stat(target)
+	if err != nil {
+		return fmt.Errorf("%s: No such file or directory", scp.target)
+	}
+	if info.IsDir() && !scp.recursive {
+		return fmt.Errorf("%s: not a regular file", scp.target)
+	}
+	return scp.sendEntry(fs, w, r, target, info)
+}
+
+func (scp *scpCommand) sendEntry(fs *FS, w io.Writer, r *bufio.Reader, p string, info os.FileInfo) error {
+	if scp.preserve {
+		t := info.ModTime().Unix()
+		if err := sendRecord(w, r, "T%d 0 %d 0\n", t, t); err != nil {
+			return err
+		}
+	}
+	mode := info.Mode() & os.ModePerm
+	if !info.IsDir() {
+		data, err := fs.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if err := sendRecord(w, r, "C%04o %d %s\n", mode, len(data), info.Name()); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		return sendRecord(w, r, "\x00")
+	}
+
+	if err := sendRecord(w, r, "D%04o 0 %s\n", mode, info.Name()); err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := scp.sendEntry(fs, w, r, path.Join(p, e.Name()), e); err != nil {
+			return err
+		}
+	}
+	return sendRecord(w, r, "E\n")
+}
+
+// sendRecord sends a record and waits for the client to acknowledge it.
+func sendRecord(w io.Writer, r *bufio.Reader, format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(w, format, args...); err != nil {
+		return err
+	}
+	return readAck(r)
+}
+
+func readAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b != 0 {
+		msg, _ := r.ReadString('\n')
+		return errors.New(strings.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,427 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// Package sshtest runs an SSH server on localhost for tests, so that clients
+// such as ssh.SSHClient can be exercised end to end without a VM. Commands are
+// run by scripted handlers, or by the local shell, and scp and SFTP
+// read and write an in-memory filesystem. Ports are forwarded as sshd does.
+package sshtest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	cssh "golang.org/x/crypto/ssh"
+)
+
+// Config sets up a Server. The zero Config accepts any client.
+type Config struct {
+	// HostKey is the key of the server. If nil, a new ECDSA key is
+	// generated.
+	HostKey cssh.Signer
+
+	// PasswordCallback, PublicKeyCallback and KeyboardInteractiveCallback
+	// authenticate clients, as in cssh.ServerConfig. If they are all nil,
+	// clients do not authenticate. See Password and PublicKeys.
+	PasswordCallback            func(conn cssh.ConnMetadata, password []byte) (*cssh.Permissions, error)
+	PublicKeyCallback           func(conn cssh.ConnMetadata, key cssh.PublicKey) (*cssh.Permissions, error)
+	KeyboardInteractiveCallback func(conn cssh.ConnMetadata, client cssh.KeyboardInteractiveChallenge) (*cssh.Permissions, error)
+
+	// FS is read and written by scp and SFTP. If nil, an empty FS is used.
+	FS *FS
+
+	// NotFound runs the commands that have no handler and are not scp. If
+	// nil, they fail with exit status 127.
+	NotFound Handler
+
+	// Exec runs the commands that have no handler, scp included, with the
+	// local shell, so that they read and write the local files instead of
+	// FS. Signals sent by clients are passed on to the commands.
+	Exec bool
+}
+
+// Session is a command run on a Server.
+type Session struct {
+	// User is the name the client logged in with.
+	User string
+	// Command is the command line, as the client sent it. It is empty
+	// when the client asked for a shell.
+	Command string
+	// Env holds the variables the client asked to set.
+	Env map[string]string
+	// Pty reports whether the client requested a pseudo terminal, of
+	// Width by Height characters, and Term is its type.
+	Pty           bool
+	Term          string
+	Width, Height int
+	// Resizes receives the sizes the client changes the pseudo terminal
+	// to.
+	Resizes <-chan WindowSize
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Signals receives the names of the signals the client sends, such as
+	// "TERM".
+	Signals <-chan string
+
+	// ExitSignal is set by handlers to the name of the signal that killed
+	// the command, which is then reported instead of the exit status.
+	ExitSignal string
+}
+
+// WindowSize is the size of a pseudo terminal, in characters.
+type WindowSize struct {
+	Width, Height int
+}
+
+// Handler runs a command and returns its exit status.
+type Handler func(s *Session) int
+
+// Reply returns a Handler that writes stdout and exits with status.
+func Reply(stdout string, status int) Handler {
+	return func(s *Session) int {
+		io.WriteString(s.Stdout, stdout)
+		return status
+	}
+}
+
+// Password returns a password callback that accepts user with password.
+func Password(user, password string) func(cssh.ConnMetadata, []byte) (*cssh.Permissions, error) {
+	return func(conn cssh.ConnMetadata, p []byte) (*cssh.Permissions, error) {
+		if conn.User() == user && string(p) == password {
+			return nil, nil
+		}
+		return nil, errors.New("sshtest: wrong password")
+	}
+}
+
+// PublicKeys returns a public key callback that accepts keys.
+func PublicKeys(keys ...cssh.PublicKey) func(cssh.ConnMetadata, cssh.PublicKey) (*cssh.Permissions, error) {
+	return func(conn cssh.ConnMetadata, key cssh.PublicKey) (*cssh.Permissions, error) {
+		for _, k := range keys {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				return nil, nil
+			}
+		}
+		return nil, errors.New("sshtest: unknown key")
+	}
+}
+
+// Server is an SSH server listening on localhost.
+type Server struct {
+	// FS is the filesystem of the server.
+	FS *FS
+	// HostKey is the public key of the server.
+	HostKey cssh.PublicKey
+
+	config   *cssh.ServerConfig
+	notFound Handler
+	exec     bool
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	conns    map[net.Conn]struct{}
+	accepted int
+	commands []string
+}
+
+// NewServer starts a Server configured by config, which may be nil.
+func NewServer(config *Config) (*Server, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	hostKey := config.HostKey
+	if hostKey == nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if hostKey, err = cssh.NewSignerFromKey(key); err != nil {
+			return nil, err
+		}
+	}
+	sc := &cssh.ServerConfig{
+		PasswordCallback:            config.PasswordCallback,
+		PublicKeyCallback:           config.PublicKeyCallback,
+		KeyboardInteractiveCallback: config.KeyboardInteractiveCallback,
+	}
+	sc.NoClientAuth = sc.PasswordCallback == nil && sc.PublicKeyCallback == nil && sc.KeyboardInteractiveCallback == nil
+	sc.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		FS:       config.FS,
+		HostKey:  hostKey.PublicKey(),
+		config:   sc,
+		notFound: config.NotFound,
+		exec:     config.Exec,
+		listener: l,
+		handlers: make(map[string]Handler),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	if s.FS == nil {
+		s.FS = NewFS()
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address of the server, such as "127.0.0.1:40022".
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// IP returns the IP address of the server.
+func (s *Server) IP() net.IP {
+	return s.listener.Addr().(*net.TCPAddr).IP
+}
+
+// Port returns the port of the server.
+func (s *Server) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Handle runs h for the command line command. It takes precedence over scp.
+// The handler of the empty command runs the shells clients ask for.
+func (s *Server) Handle(command string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[command] = h
+}
+
+// Connections returns the number of connections the server accepted.
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// Commands returns the command lines the server ran, in order.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// CloseConnections drops the connections of the clients, as a network
+// failure would, and keeps accepting new ones.
+func (s *Server) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// Close stops the server and drops the connections of the clients.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.CloseConnections()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.accepted++
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(c)
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+			c.Close()
+		}()
+	}
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	conn, chans, reqs, err := cssh.NewServerConn(c, s.config)
+	if err != nil {
+		return
+	}
+	go serveRequests(conn, reqs)
+
+	var wg sync.WaitGroup
+	for nc := range chans {
+		if nc.ChannelType() == "direct-tcpip" {
+			go serveDirect(nc)
+			continue
+		}
+		if nc.ChannelType() != "session" {
+			nc.Reject(cssh.UnknownChannelType, "only sessions and forwarding are supported")
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveSession(conn.User(), ch, chReqs)
+		}()
+	}
+	wg.Wait()
+}
+
+// serveSession handles the requests of a session until the client closes it.
+func (s *Server) serveSession(user string, ch cssh.Channel, reqs <-chan *cssh.Request) {
+	defer ch.Close()
+
+	signals := make(chan string, 8)
+	resizes := make(chan WindowSize, 8)
+	session := &Session{
+		User:    user,
+		Env:     make(map[string]string),
+		Stdin:   ch,
+		Stdout:  ch,
+		Stderr:  ch.Stderr(),
+		Signals: signals,
+		Resizes: resizes,
+	}
+	started := false
+	for req := range reqs {
+		ok := false
+		switch req.Type {
+		case "env":
+			var m struct{ Name, Value string }
+			if cssh.Unmarshal(req.Payload, &m) == nil && !started {
+				session.Env[m.Name] = m.Value
+				ok = true
+			}
+		case "pty-req":
+			var m struct {
+				Term          string
+				Width, Height uint32
+				PixelWidth    uint32
+				PixelHeight   uint32
+				Modes         string
+			}
+			if cssh.Unmarshal(req.Payload, &m) == nil && !started {
+				session.Pty = true
+				session.Term = m.Term
+				session.Width, session.Height = int(m.Width), int(m.Height)
+				ok = true
+			}
+		case "window-change":
+			var m struct {
+				Width, Height uint32
+				PixelWidth    uint32
+				PixelHeight   uint32
+			}
+			if cssh.Unmarshal(req.Payload, &m) == nil {
+				select {
+				case resizes <- WindowSize{int(m.Width), int(m.Height)}:
+				default:
+				}
+				ok = true
+			}
+		case "signal":
+			var m struct{ Signal string }
+			if cssh.Unmarshal(req.Payload, &m) == nil {
+				select {
+				case signals <- m.Signal:
+				default:
+				}
+				ok = true
+			}
+		case "exec":
+			var m struct{ Command string }
+			if cssh.Unmarshal(req.Payload, &m) == nil && !started {
+				started = true
+				session.Command = m.Command
+				go s.run(session, ch)
+				ok = true
+			}
+		case "shell":
+			if !started {
+				started = true
+				go s.run(session, ch)
+				ok = true
+			}
+		case "subsystem":
+			var m struct{ Name string }
+			if cssh.Unmarshal(req.Payload, &m) == nil && m.Name == "sftp" && !started {
+				started = true
+				go s.exit(ch, session, func(session *Session) int {
+					serveSFTP(s.FS, session.Stdin, session.Stdout)
+					return 0
+				})
+				ok = true
+			}
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+// run runs the command of session and sends its exit status.
+func (s *Server) run(session *Session, ch cssh.Channel) {
+	s.mu.Lock()
+	s.commands = append(s.commands, session.Command)
+	h, ok := s.handlers[session.Command]
+	s.mu.Unlock()
+
+	if !ok {
+		if s.exec {
+			h = execLocal
+		} else if scp, isSCP := parseSCP(session.Command); isSCP {
+			h = scp.handler(s.FS)
+		} else if s.notFound != nil {
+			h = s.notFound
+		} else {
+			h = func(session *Session) int {
+				fmt.Fprintf(session.Stderr, "sh: %s: command not found\n", session.Command)
+				return 127
+			}
+		}
+	}
+
+	s.exit(ch, session, h)
+}
+
+// exit runs h and sends the exit status, or the exit signal, of session.
+func (s *Server) exit(ch cssh.Channel, session *Session, h Handler) {
+	status := h(session)
+	ch.CloseWrite()
+	if session.ExitSignal != "" {
+		ch.SendRequest("exit-signal", false, cssh.Marshal(struct {
+			Signal     string
+			CoreDumped bool
+			Error      string
+			Lang       string
+		}{session.ExitSignal, false, "", ""}))
+	} else {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(status))
+		ch.SendRequest("exit-status", false, b)
+	}
+	ch.Close()
+}
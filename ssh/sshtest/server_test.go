@@ -0,0 +1,93 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package sshtest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	cssh "golang.org/x/crypto/ssh"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		words   [][]string
+	}{
+		{"/usr/bin/scp -t /tmp", [][]string{{"/usr/bin/scp", "-t", "/tmp"}}},
+		{`mkdir -p '/it'\''s' && scp -r -t '/a b'`, [][]string{{"mkdir", "-p", "/it's"}, {"scp", "-r", "-t", "/a b"}}},
+		{"echo a&&b", nil},
+		{"echo $HOME", nil},
+		{"echo 'open", nil},
+	}
+	for _, tt := range tests {
+		words, ok := splitCommand(tt.command)
+		if ok != (tt.words != nil) || !reflect.DeepEqual(words, tt.words) {
+			t.Errorf("splitCommand(%q) = %q, %v, want %q", tt.command, words, ok, tt.words)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	s, err := NewServer(&Config{PasswordCallback: Password("foo", "bar")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Handle("upper", func(session *Session) int {
+		b, _ := ioutil.ReadAll(session.Stdin)
+		io.WriteString(session.Stdout, strings.ToUpper(string(b)))
+		io.WriteString(session.Stderr, session.Env["LANG"])
+		return 3
+	})
+
+	config := &cssh.ClientConfig{User: "foo", Auth: []cssh.AuthMethod{cssh.Password("baz")}, HostKeyCallback: cssh.FixedHostKey(s.HostKey)}
+	if _, err := cssh.Dial("tcp", s.Addr(), config); err == nil {
+		t.Fatal("Expected the wrong password to be rejected")
+	}
+	config.Auth = []cssh.AuthMethod{cssh.Password("bar")}
+	c, err := cssh.Dial("tcp", s.Addr(), config)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer c.Close()
+
+	session, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	session.Stdin = strings.NewReader("hello")
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Setenv("LANG", "C"); err != nil {
+		t.Fatalf("Expected the variable to be set, got: %s", err)
+	}
+	err = session.Run("upper")
+	if e, ok := err.(*cssh.ExitError); !ok || e.ExitStatus() != 3 {
+		t.Fatalf("Expected exit status 3, got: %v", err)
+	}
+	if stdout.String() != "HELLO" || stderr.String() != "C" {
+		t.Fatalf("Unexpected output %q, %q", stdout.String(), stderr.String())
+	}
+
+	session, err = c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = session.Run("reboot")
+	if e, ok := err.(*cssh.ExitError); !ok || e.ExitStatus() != 127 {
+		t.Fatalf("Expected exit status 127, got: %v", err)
+	}
+
+	if got := s.Commands(); !reflect.DeepEqual(got, []string{"upper", "reboot"}) {
+		t.Fatalf("Unexpected commands %q", got)
+	}
+	if s.Connections() != 2 {
+		t.Fatalf("Expected 2 connections, got %d", s.Connections())
+	}
+}
@@ -0,0 +1,469 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package sshtest
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// The packet types of version 3 of the SFTP protocol, the one OpenSSH
+// speaks.
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpLstat    = 7
+	fxpFstat    = 8
+	fxpSetstat  = 9
+	fxpFsetstat = 10
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRmdir    = 15
+	fxpRealpath = 16
+	fxpStat     = 17
+	fxpRename   = 18
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	fxpAttrs    = 105
+)
+
+// The flags of SSH_FXP_OPEN.
+const (
+	fxfWrite = 0x02
+	fxfCreat = 0x08
+	fxfTrunc = 0x10
+	fxfExcl  = 0x20
+)
+
+// The flags of the file attributes.
+const (
+	attrSize        = 0x01
+	attrUIDGID      = 0x02
+	attrPermissions = 0x04
+	attrACModTime   = 0x08
+	attrExtended    = 0x80000000
+)
+
+// The status codes.
+const (
+	fxOK            = 0
+	fxEOF           = 1
+	fxNoSuchFile    = 2
+	fxFailure       = 4
+	fxBadMessage    = 5
+	fxOpUnsupported = 8
+)
+
+// The file types of the Unix mode.
+const (
+	modeDir     = 0040000
+	modeRegular = 0100000
+)
+
+// readdirBatch is the number of entries sent for each SSH_FXP_READDIR.
+const readdirBatch = 100
+
+var errBadMessage = errors.New("bad message")
+
+// sftpServer serves the SFTP subsystem from an FS.
+type sftpServer struct {
+	fs      *FS
+	handles map[string]*sftpHandle
+	next    int
+}
+
+// sftpHandle is an open file or directory.
+type sftpHandle struct {
+	name string
+	dir  bool
+	// entries are the directory entries not sent yet.
+	entries []os.FileInfo
+}
+
+// serveSFTP answers the SFTP requests read from r, on fs, until r is
+// closed.
+func serveSFTP(fs *FS, r io.Reader, w io.Writer) error {
+	srv := &sftpServer{fs: fs, handles: make(map[string]*sftpHandle)}
+	for {
+		var l [4]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		p := make([]byte, binary.BigEndian.Uint32(l[:]))
+		if len(p) == 0 {
+			return errBadMessage
+		}
+		if _, err := io.ReadFull(r, p); err != nil {
+			return err
+		}
+
+		var resp sftpPacket
+		if p[0] == fxpInit {
+			resp.byte(fxpVersion)
+			resp.uint32(3)
+		} else {
+			req := &sftpRequest{b: p[1:]}
+			id := req.uint32()
+			resp = srv.handle(p[0], id, req)
+		}
+		var out sftpPacket
+		out.uint32(uint32(len(resp)))
+		if _, err := w.Write(append(out, resp...)); err != nil {
+			return err
+		}
+	}
+}
+
+// handle answers the request typ whose fields are read from req.
+func (srv *sftpServer) handle(typ byte, id uint32, req *sftpRequest) sftpPacket {
+	var resp sftpPacket
+	switch typ {
+	case fxpStat, fxpLstat:
+		fi, err := srv.fs.Stat(req.path())
+		if req.err != nil || err != nil {
+			return status(id, req.err, err)
+		}
+		resp.byte(fxpAttrs)
+		resp.uint32(id)
+		resp.attrs(fi)
+	case fxpFstat:
+		h := srv.handles[req.string()]
+		if h == nil {
+			return status(id, errBadMessage)
+		}
+		fi, err := srv.fs.Stat(h.name)
+		if err != nil {
+			return status(id, err)
+		}
+		resp.byte(fxpAttrs)
+		resp.uint32(id)
+		resp.attrs(fi)
+	case fxpOpen:
+		name, flags, a := req.path(), req.uint32(), req.attrs()
+		if req.err != nil {
+			return status(id, req.err)
+		}
+		if err := srv.open(name, flags, a.perm(0644)); err != nil {
+			return status(id, err)
+		}
+		return srv.newHandle(id, &sftpHandle{name: name})
+	case fxpOpendir:
+		name := req.path()
+		entries, err := srv.fs.ReadDir(name)
+		if req.err != nil || err != nil {
+			return status(id, req.err, err)
+		}
+		return srv.newHandle(id, &sftpHandle{name: name, dir: true, entries: entries})
+	case fxpClose:
+		h := req.string()
+		if srv.handles[h] == nil {
+			return status(id, errBadMessage)
+		}
+		delete(srv.handles, h)
+		return status(id)
+	case fxpRead:
+		h, off, n := srv.handles[req.string()], req.uint64(), req.uint32()
+		if req.err != nil || h == nil {
+			return status(id, errBadMessage)
+		}
+		data, err := srv.fs.ReadFile(h.name)
+		if err != nil {
+			return status(id, err)
+		}
+		if off >= uint64(len(data)) {
+			return status(id, io.EOF)
+		}
+		data = data[off:]
+		if uint64(len(data)) > uint64(n) {
+			data = data[:n]
+		}
+		resp.byte(fxpData)
+		resp.uint32(id)
+		resp.string(string(data))
+	case fxpWrite:
+		h, off, data := srv.handles[req.string()], req.uint64(), req.string()
+		if req.err != nil || h == nil {
+			return status(id, errBadMessage)
+		}
+		return status(id, srv.fs.writeAt(h.name, []byte(data), int64(off)))
+	case fxpReaddir:
+		h := srv.handles[req.string()]
+		if h == nil || !h.dir {
+			return status(id, errBadMessage)
+		}
+		if len(h.entries) == 0 {
+			return status(id, io.EOF)
+		}
+		batch := h.entries
+		if len(batch) > readdirBatch {
+			batch = batch[:readdirBatch]
+		}
+		h.entries = h.entries[len(batch):]
+		resp.byte(fxpName)
+		resp.uint32(id)
+		resp.uint32(uint32(len(batch)))
+		for _, fi := range batch {
+			resp.string(fi.Name())
+			resp.string(fi.Name())
+			resp.attrs(fi)
+		}
+	case fxpSetstat, fxpFsetstat:
+		var name string
+		if typ == fxpSetstat {
+			name = req.path()
+		} else if h := srv.handles[req.string()]; h != nil {
+			name = h.name
+		}
+		a := req.attrs()
+		if req.err != nil || name == "" {
+			return status(id, errBadMessage)
+		}
+		return status(id, srv.setstat(name, a))
+	case fxpMkdir:
+		name, a := req.path(), req.attrs()
+		if req.err != nil {
+			return status(id, req.err)
+		}
+		return status(id, srv.fs.Mkdir(name, a.perm(0755)))
+	case fxpRemove, fxpRmdir:
+		name := req.path()
+		fi, err := srv.fs.Stat(name)
+		if req.err != nil || err != nil {
+			return status(id, req.err, err)
+		}
+		if fi.IsDir() != (typ == fxpRmdir) {
+			return status(id, errors.New("wrong file type"))
+		}
+		return status(id, srv.fs.Remove(name))
+	case fxpRename:
+		oldname, newname := req.path(), req.path()
+		if req.err != nil {
+			return status(id, req.err)
+		}
+		return status(id, srv.fs.Rename(oldname, newname))
+	case fxpRealpath:
+		name := req.path()
+		if req.err != nil {
+			return status(id, req.err)
+		}
+		resp.byte(fxpName)
+		resp.uint32(id)
+		resp.uint32(1)
+		resp.string(name)
+		resp.string(name)
+		resp.uint32(0)
+	default:
+		resp.byte(fxpStatus)
+		resp.uint32(id)
+		resp.uint32(fxOpUnsupported)
+		resp.string("unsupported request " + strconv.Itoa(int(typ)))
+		resp.string("")
+	}
+	return resp
+}
+
+// open checks that the file name can be opened with flags, creating or
+// truncating it as they ask.
+func (srv *sftpServer) open(name string, flags uint32, perm os.FileMode) error {
+	fi, err := srv.fs.Stat(name)
+	switch {
+	case err == nil && fi.IsDir():
+		return errors.New("is a directory")
+	case err == nil && flags&fxfCreat != 0 && flags&fxfExcl != 0:
+		return os.ErrExist
+	case err == nil && flags&fxfWrite != 0 && flags&fxfTrunc != 0:
+		return srv.fs.WriteFile(name, nil, fi.Mode())
+	case err == nil:
+		return nil
+	case flags&fxfCreat == 0:
+		return err
+	}
+	if dir, err := srv.fs.Stat(path.Dir(name)); err != nil || !dir.IsDir() {
+		return os.ErrNotExist
+	}
+	return srv.fs.WriteFile(name, nil, perm)
+}
+
+// setstat applies the permissions and times of a to name. Other attributes
+// are not supported.
+func (srv *sftpServer) setstat(name string, a fileAttrs) error {
+	if a.flags&(attrSize|attrUIDGID) != 0 {
+		return errors.New("unsupported attributes")
+	}
+	if a.flags&attrPermissions != 0 {
+		if err := srv.fs.Chmod(name, os.FileMode(a.mode)); err != nil {
+			return err
+		}
+	}
+	if a.flags&attrACModTime != 0 {
+		return srv.fs.Chtimes(name, time.Unix(int64(a.mtime), 0))
+	}
+	return nil
+}
+
+func (srv *sftpServer) newHandle(id uint32, h *sftpHandle) sftpPacket {
+	srv.next++
+	name := strconv.Itoa(srv.next)
+	srv.handles[name] = h
+	var resp sftpPacket
+	resp.byte(fxpHandle)
+	resp.uint32(id)
+	resp.string(name)
+	return resp
+}
+
+// status returns the status packet of the first non-nil error of errs, or
+// of success if there is none.
+func status(id uint32, errs ...error) sftpPacket {
+	var err error
+	for _, err = range errs {
+		if err != nil {
+			break
+		}
+	}
+	code, msg := uint32(fxOK), ""
+	if err != nil {
+		switch {
+		case err == io.EOF:
+			code = fxEOF
+		case err == errBadMessage:
+			code = fxBadMessage
+		case os.IsNotExist(err):
+			code = fxNoSuchFile
+		default:
+			code = fxFailure
+		}
+		msg = err.Error()
+	}
+	var resp sftpPacket
+	resp.byte(fxpStatus)
+	resp.uint32(id)
+	resp.uint32(code)
+	resp.string(msg)
+	resp.string("")
+	return resp
+}
+
+// sftpPacket builds a packet.
+type sftpPacket []byte
+
+func (p *sftpPacket) byte(v byte) {
+	*p = append(*p, v)
+}
+
+func (p *sftpPacket) uint32(v uint32) {
+	*p = binary.BigEndian.AppendUint32(*p, v)
+}
+
+func (p *sftpPacket) string(s string) {
+	p.uint32(uint32(len(s)))
+	*p = append(*p, s...)
+}
+
+// attrs writes the size, mode and times of fi.
+func (p *sftpPacket) attrs(fi os.FileInfo) {
+	mode := uint32(fi.Mode().Perm()) | modeRegular
+	if fi.IsDir() {
+		mode = uint32(fi.Mode().Perm()) | modeDir
+	}
+	p.uint32(attrSize | attrPermissions | attrACModTime)
+	*p = binary.BigEndian.AppendUint64(*p, uint64(fi.Size()))
+	p.uint32(mode)
+	p.uint32(uint32(fi.ModTime().Unix()))
+	p.uint32(uint32(fi.ModTime().Unix()))
+}
+
+// fileAttrs are the file attributes of a request, without those that are
+// not supported.
+type fileAttrs struct {
+	flags uint32
+	mode  uint32
+	mtime uint32
+}
+
+// perm returns the permission bits of a, or def if it has none.
+func (a fileAttrs) perm(def os.FileMode) os.FileMode {
+	if a.flags&attrPermissions == 0 {
+		return def
+	}
+	return os.FileMode(a.mode) & os.ModePerm
+}
+
+// sftpRequest reads the fields of a request. After a field is missing, err
+// is set and the next fields read as zero.
+type sftpRequest struct {
+	b   []byte
+	err error
+}
+
+func (r *sftpRequest) uint32() uint32 {
+	if len(r.b) < 4 {
+		r.err = errBadMessage
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *sftpRequest) uint64() uint64 {
+	return uint64(r.uint32())<<32 | uint64(r.uint32())
+}
+
+func (r *sftpRequest) string() string {
+	n := r.uint32()
+	if uint32(len(r.b)) < n {
+		r.err = errBadMessage
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+// path reads a path, relative to the root if it is not absolute.
+func (r *sftpRequest) path() string {
+	return clean(r.string())
+}
+
+// attrs reads file attributes.
+func (r *sftpRequest) attrs() fileAttrs {
+	a := fileAttrs{flags: r.uint32()}
+	if a.flags&attrSize != 0 {
+		r.uint64()
+	}
+	if a.flags&attrUIDGID != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if a.flags&attrPermissions != 0 {
+		a.mode = r.uint32()
+	}
+	if a.flags&attrACModTime != 0 {
+		r.uint32()
+		a.mtime = r.uint32()
+	}
+	if a.flags&attrExtended != 0 {
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			r.string()
+			r.string()
+		}
+	}
+	return a
+}
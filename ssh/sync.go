@@ -0,0 +1,361 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// syncBatch is the number of paths given to each mkdir or rm run by Sync,
+// to stay well below the limit on the length of command lines.
+const syncBatch = 100
+
+// errNoSHA256Sum is returned by remoteChecksums when the remote host has no
+// sha256sum.
+var errNoSHA256Sum = errors.New("sha256sum not found")
+
+// SyncOptions sets up a Sync.
+type SyncOptions struct {
+	// Delete removes the remote files that are not in the local
+	// directory. The directories they leave empty are kept.
+	Delete bool
+	// DryRun only reports what Sync would change.
+	DryRun bool
+}
+
+// SyncResult reports what Sync changed, as slash-separated paths relative to
+// the directories, in order.
+type SyncResult struct {
+	Added     []string
+	Updated   []string
+	Deleted   []string
+	Unchanged int
+}
+
+// Changed reports whether Sync changed, or would change, any file.
+func (r *SyncResult) Changed() bool {
+	return len(r.Added)+len(r.Updated)+len(r.Deleted) > 0
+}
+
+// localFile is a file Sync may upload.
+type localFile struct {
+	path string
+	mode os.FileMode
+	sum  string
+}
+
+// Sync makes the remote directory remoteDir a copy of localDir, uploading
+// only the files whose content differs. The files are compared by their
+// SHA-256 checksums, computed with sha256sum on the remote host, or by
+// reading the files over SFTP if it has no sha256sum or if
+// Options.FileTransfer is TransferSFTP.
+//
+// New files are created with the mode of the local ones; the modes of the
+// other files are left as they are. As with UploadDir, symbolic links to
+// files are synced as files, and other special files and links to
+// directories are skipped.
+//
+// The commands Sync runs on the remote host are canceled when ctx is done,
+// and no file is uploaded after that.
+func (client *SSHClient) Sync(ctx context.Context, localDir, remoteDir string, opts SyncOptions) (*SyncResult, error) {
+	local, err := localChecksums(localDir)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteDir = path.Clean(remoteDir)
+	var (
+		s      *SFTP
+		remote map[string]string
+	)
+	if client.Options.FileTransfer != TransferSFTP {
+		remote, err = client.remoteChecksums(ctx, remoteDir)
+	}
+	if client.Options.FileTransfer == TransferSFTP || err == errNoSHA256Sum {
+		if s, err = client.SFTP(); err != nil {
+			return nil, err
+		}
+		defer s.Close()
+		remote, err = sftpChecksums(s, remoteDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := diffChecksums(local, remote, opts.Delete)
+	if opts.DryRun {
+		return result, nil
+	}
+
+	dirs := map[string]bool{}
+	for _, name := range result.Added {
+		dirs[path.Join(remoteDir, path.Dir(name))] = true
+	}
+	if err := client.syncMkdirs(ctx, s, sortedKeys(dirs)); err != nil {
+		return nil, err
+	}
+
+	for _, name := range append(append([]string(nil), result.Added...), result.Updated...) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		f := local[name]
+		dst := path.Join(remoteDir, name)
+		if s != nil {
+			err = s.uploadFile(f.path, dst, f.mode)
+		} else {
+			err = client.uploadFile(f.path, dst, f.mode)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := client.syncRemove(ctx, s, remoteDir, result.Deleted); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// diffChecksums compares the local and remote files.
+func diffChecksums(local map[string]localFile, remote map[string]string, remove bool) *SyncResult {
+	result := &SyncResult{}
+	for name, f := range local {
+		sum, ok := remote[name]
+		switch {
+		case !ok:
+			result.Added = append(result.Added, name)
+		case sum != f.sum:
+			result.Updated = append(result.Updated, name)
+		default:
+			result.Unchanged++
+		}
+	}
+	if remove {
+		for name := range remote {
+			if _, ok := local[name]; !ok {
+				result.Deleted = append(result.Deleted, name)
+			}
+		}
+	}
+	sort.Strings(result.Added)
+	sort.Strings(result.Updated)
+	sort.Strings(result.Deleted)
+	return result
+}
+
+// localChecksums returns the files under dir by their slash-separated path
+// relative to it.
+func localChecksums(dir string) (map[string]localFile, error) {
+	files := map[string]localFile{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(p); err != nil {
+				return nil
+			}
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		sum, err := fileChecksum(p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = localFile{path: p, mode: info.Mode() & os.ModePerm, sum: sum}
+		return nil
+	})
+	return files, err
+}
+
+func fileChecksum(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return readerChecksum(f)
+}
+
+func readerChecksum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// remoteChecksums runs sha256sum on the files under dir. A missing directory
+// has no files.
+func (client *SSHClient) remoteChecksums(ctx context.Context, dir string) (map[string]string, error) {
+	script := fmt.Sprintf(`cd %s 2>/dev/null || exit 0
+command -v sha256sum >/dev/null 2>&1 || exit 127
+find . -type f -exec sha256sum -- {} +`, shellQuote(dir))
+	var stdout bytes.Buffer
+	result, err := client.Command(ctx, script, RunOptions{Stdout: &stdout})
+	if err != nil {
+		return nil, err
+	}
+	if result.ExitStatus == 127 {
+		return nil, errNoSHA256Sum
+	}
+	if !result.Success() {
+		return nil, fmt.Errorf("sha256sum exited with status %d", result.ExitStatus)
+	}
+	return parseChecksums(&stdout)
+}
+
+// parseChecksums parses the output of sha256sum, such as
+// "e3b0c442...b855  ./conf/app.conf". A line starts with a backslash when
+// the name has backslashes or newlines, which are then escaped.
+func parseChecksums(r io.Reader) (map[string]string, error) {
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		escaped := strings.HasPrefix(line, `\`)
+		if escaped {
+			line = line[1:]
+		}
+		if len(line) < 66 || (line[64:66] != "  " && line[64:66] != " *") {
+			return nil, fmt.Errorf("Invalid sha256sum output: %q", line)
+		}
+		name := line[66:]
+		if escaped {
+			name = strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(name)
+		}
+		sums[strings.TrimPrefix(name, "./")] = line[:64]
+	}
+	return sums, scanner.Err()
+}
+
+// sftpChecksums reads the files under dir over SFTP. A missing directory has
+// no files.
+func sftpChecksums(s *SFTP, dir string) (map[string]string, error) {
+	sums := map[string]string{}
+	if _, err := s.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return sums, nil
+	}
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		entries, err := s.ReadDir(path.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			name := path.Join(rel, e.Name())
+			switch {
+			case e.IsDir():
+				if err := walk(name); err != nil {
+					return err
+				}
+			case e.Mode().IsRegular():
+				f, err := s.Open(path.Join(dir, name))
+				if err != nil {
+					return err
+				}
+				sum, err := readerChecksum(f)
+				f.Close()
+				if err != nil {
+					return err
+				}
+				sums[name] = sum
+			}
+		}
+		return nil
+	}
+	return sums, walk("")
+}
+
+// uploadFile uploads the local file src to dst.
+func (client *SSHClient) uploadFile(src, dst string, mode os.FileMode) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return client.Upload(f, dst, uint32(mode))
+}
+
+// syncMkdirs creates the remote directories dirs, over SFTP if s is set.
+func (client *SSHClient) syncMkdirs(ctx context.Context, s *SFTP, dirs []string) error {
+	if s != nil {
+		for _, dir := range dirs {
+			if err := s.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return client.runBatches(ctx, "mkdir -p --", dirs)
+}
+
+// syncRemove removes the files names under dir, over SFTP if s is set.
+func (client *SSHClient) syncRemove(ctx context.Context, s *SFTP, dir string, names []string) error {
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = path.Join(dir, name)
+	}
+	if s != nil {
+		for _, p := range paths {
+			if err := s.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	}
+	return client.runBatches(ctx, "rm -f --", paths)
+}
+
+// runBatches runs command with args, syncBatch of them at a time.
+func (client *SSHClient) runBatches(ctx context.Context, command string, args []string) error {
+	for len(args) > 0 {
+		n := len(args)
+		if n > syncBatch {
+			n = syncBatch
+		}
+		quoted := make([]string, n)
+		for i, arg := range args[:n] {
+			quoted[i] = shellQuote(arg)
+		}
+		args = args[n:]
+
+		var stderr bytes.Buffer
+		line := command + " " + strings.Join(quoted, " ")
+		result, err := client.Command(ctx, line, RunOptions{Stderr: &stderr})
+		if err != nil {
+			return err
+		}
+		if !result.Success() {
+			return fmt.Errorf("%s exited with status %d: %s", strings.Fields(command)[0], result.ExitStatus, strings.TrimSpace(stderr.String()))
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package ssh
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files, by slash-separated path, under dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	for _, name := range []string{"/usr/bin/scp", "sha256sum"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s is needed to run the remote end of the test", name)
+		}
+	}
+	s := startLocalServer(t)
+	defer s.Close()
+	client := dialServer(t, s)
+	defer client.Disconnect()
+
+	root, err := ioutil.TempDir("", "libretto-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	local, remote := filepath.Join(root, "local"), filepath.Join(root, "remote", "app")
+	writeFiles(t, local, map[string]string{
+		"app.conf":       "port 80",
+		"conf.d/a.conf":  "a",
+		"it's here.conf": "quoted",
+	})
+
+	result, err := client.Sync(context.Background(), local, remote, SyncOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	want := &SyncResult{Added: []string{"app.conf", "conf.d/a.conf", "it's here.conf"}}
+	if !reflect.DeepEqual(result, want) {
+		t.Fatalf("Expected %+v, got: %+v", want, result)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(remote, "conf.d", "a.conf")); err != nil || string(b) != "a" {
+		t.Fatalf("Expected the file to be uploaded, got %q: %v", b, err)
+	}
+
+	writeFiles(t, local, map[string]string{"app.conf": "port 8080", "conf.d/b.conf": "b"})
+	writeFiles(t, remote, map[string]string{"stale.conf": "old"})
+	result, err = client.Sync(context.Background(), local, remote, SyncOptions{Delete: true, DryRun: true})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	want = &SyncResult{
+		Added:     []string{"conf.d/b.conf"},
+		Updated:   []string{"app.conf"},
+		Deleted:   []string{"stale.conf"},
+		Unchanged: 2,
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Fatalf("Expected %+v, got: %+v", want, result)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "conf.d", "b.conf")); !os.IsNotExist(err) {
+		t.Fatal("Expected a dry run to leave the files alone")
+	}
+
+	if result, err = client.Sync(context.Background(), local, remote, SyncOptions{Delete: true}); err != nil || !reflect.DeepEqual(result, want) {
+		t.Fatalf("Expected %+v, got %+v: %v", want, result, err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(remote, "app.conf")); err != nil || string(b) != "port 8080" {
+		t.Fatalf("Expected the file to be updated, got %q: %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "stale.conf")); !os.IsNotExist(err) {
+		t.Fatal("Expected the extraneous file to be deleted")
+	}
+
+	if result, err = client.Sync(context.Background(), local, remote, SyncOptions{Delete: true}); err != nil || result.Changed() {
+		t.Fatalf("Expected nothing to change, got %+v: %v", result, err)
+	}
+
+	// Nothing is synced once ctx is done.
+	writeFiles(t, local, map[string]string{"late.conf": "late"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Sync(ctx, local, remote, SyncOptions{}); err != context.Canceled {
+		t.Fatalf("Expected the sync to be canceled, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "late.conf")); !os.IsNotExist(err) {
+		t.Fatal("Expected a canceled sync to upload nothing")
+	}
+}
+
+func TestParseChecksums(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	out := sum + "  ./app.conf\n" + sum + " *./bin/tool\n\\" + sum + `  ./odd\\name\nline` + "\n"
+	sums, err := parseChecksums(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	want := map[string]string{"app.conf": sum, "bin/tool": sum, "odd\\name\nline": sum}
+	if !reflect.DeepEqual(sums, want) {
+		t.Fatalf("Expected %q, got: %q", want, sums)
+	}
+	if _, err := parseChecksums(strings.NewReader("sha256sum: ./x: Permission denied\n")); err == nil {
+		t.Fatal("Expected invalid output to be rejected")
+	}
+}
+
+func TestSFTPChecksums(t *testing.T) {
+	root, err := ioutil.TempDir("", "libretto-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{"app/app.conf": "port 80", "app/conf.d/a.conf": "a"}
+	writeFiles(t, root, files)
+
+	srv, s := startSFTP(t)
+	defer srv.Close()
+	defer s.Close()
+	for name, data := range files {
+		if err := srv.FS.WriteFile("/"+name, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sums, err := sftpChecksums(s, "/app")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	local, err := localChecksums(filepath.Join(root, "app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sums) != 2 || sums["app.conf"] != local["app.conf"].sum || sums["conf.d/a.conf"] != local["conf.d/a.conf"].sum {
+		t.Fatalf("Unexpected checksums %q", sums)
+	}
+	if sums, err := sftpChecksums(s, "/missing"); err != nil || len(sums) != 0 {
+		t.Fatalf("Expected a missing directory to be empty, got %q: %v", sums, err)
+	}
+}
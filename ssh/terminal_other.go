@@ -0,0 +1,24 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package ssh
+
+// Terminals are not supported on this system: Shell leaves them as they are.
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (func(), error) {
+	return func() {}, nil
+}
+
+func terminalSize(fd int) (int, int, bool) {
+	return 0, 0, false
+}
+
+func watchResize(resize func()) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,55 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package ssh
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func isTerminal(fd int) bool {
+	return terminal.IsTerminal(fd)
+}
+
+// makeRaw puts the terminal fd in raw mode and returns a function that
+// restores its previous state.
+func makeRaw(fd int) (func(), error) {
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	return func() { terminal.Restore(fd, state) }, nil
+}
+
+func terminalSize(fd int) (int, int, bool) {
+	width, height, err := terminal.GetSize(fd)
+	return width, height, err == nil
+}
+
+// watchResize calls resize whenever the terminal window changes size, until
+// stop is called.
+func watchResize(resize func()) (stop func()) {
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, syscall.SIGWINCH)
+	go func() {
+		for {
+			select {
+			case <-c:
+				resize()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+//go:build windows
+// +build windows
+
+package ssh
+
+import "golang.org/x/crypto/ssh/terminal"
+
+func isTerminal(fd int) bool {
+	return terminal.IsTerminal(fd)
+}
+
+// makeRaw puts the console fd in raw mode and returns a function that
+// restores its previous state.
+func makeRaw(fd int) (func(), error) {
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	return func() { terminal.Restore(fd, state) }, nil
+}
+
+func terminalSize(fd int) (int, int, bool) {
+	width, height, err := terminal.GetSize(fd)
+	return width, height, err == nil
+}
+
+// watchResize does nothing: Windows has no signal for window changes.
+func watchResize(resize func()) (stop func()) {
+	return func() {}
+}
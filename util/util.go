@@ -3,10 +3,10 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net"
-	"strings"
 	"time"
 
 	"github.com/apcera/libretto/ssh"
@@ -32,12 +32,17 @@ func Random(min, max int) int {
 // get the list of IPs. An error is returned if the API call fails or returns
 // nothing.
 func GetVMIPs(vm lvm.VirtualMachine, options ssh.Options) ([]net.IP, error) {
+	return GetVMIPsContext(context.Background(), lvm.AsContext(vm), options)
+}
+
+// GetVMIPsContext is like GetVMIPs but the API call, if any, is bound to ctx.
+func GetVMIPsContext(ctx context.Context, vm lvm.VirtualMachineContext, options ssh.Options) ([]net.IP, error) {
 	ips := options.IPs
 	if len(ips) == 0 {
 		var err error
-		ips, err = vm.GetIPs()
+		ips, err = vm.GetIPsContext(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("Error getting IPs for the VM: %s", err)
+			return nil, fmt.Errorf("Error getting IPs for the VM: %w", err)
 		}
 		if len(ips) == 0 {
 			return nil, lvm.ErrVMNoIP
@@ -46,16 +51,39 @@ func GetVMIPs(vm lvm.VirtualMachine, options ssh.Options) ([]net.IP, error) {
 	return ips, nil
 }
 
-// CombineErrors converts all the errors from slice into a single error
-func CombineErrors(delimiter string, errs ...error) error {
-	var formatStrs = []string{}
-
-	for _, e := range errs {
-		if e == nil {
-			continue
+// SSHIP returns the IP to connect to over SSH among ips, which holds the
+// public IP at index public and the private one at index private, as GetIPs
+// returns them. The public IP is used, or the private one when options has
+// jump hosts, since they usually reach the VM on its private network. The
+// other IP is used if the preferred one is missing.
+func SSHIP(ips []net.IP, options ssh.Options, public, private int) net.IP {
+	first, second := public, private
+	if len(options.JumpHosts) > 0 {
+		first, second = private, public
+	}
+	for _, i := range []int{first, second} {
+		if i < len(ips) && ips[i] != nil {
+			return ips[i]
 		}
-		formatStrs = append(formatStrs, e.Error())
 	}
+	return nil
+}
 
-	return fmt.Errorf(strings.Join(formatStrs, delimiter))
+// CombineErrors converts all the errors from slice into a single error.
+// errors.Is and errors.As see every one of errs.
+func CombineErrors(delimiter string, errs ...error) error {
+	return lvm.JoinErrors(delimiter, errs...)
+}
+
+// Sleep pauses for d or until ctx is done, whichever happens first. It returns
+// ctx.Err() if the context ended the sleep early.
+func Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -2,7 +2,12 @@
 
 package util
 
-import "testing"
+import (
+	"net"
+	"testing"
+
+	"github.com/apcera/libretto/ssh"
+)
 
 const (
 	maxSamplingSize = 100000
@@ -92,6 +97,29 @@ func TestRandomSet(t *testing.T) {
 	}
 }
 
+// TestSSHIP makes sure the private IP is preferred with jump hosts only.
+func TestSSHIP(t *testing.T) {
+	public, private := net.ParseIP("203.0.113.1"), net.ParseIP("10.0.0.1")
+	jump := ssh.Options{JumpHosts: []ssh.JumpHost{{Host: "bastion"}}}
+
+	tests := []struct {
+		ips     []net.IP
+		options ssh.Options
+		want    net.IP
+	}{
+		{[]net.IP{public, private}, ssh.Options{}, public},
+		{[]net.IP{public, private}, jump, private},
+		{[]net.IP{nil, private}, ssh.Options{}, private},
+		{[]net.IP{public}, jump, public},
+		{nil, jump, nil},
+	}
+	for i, tt := range tests {
+		if got := SSHIP(tt.ips, tt.options, 0, 1); !got.Equal(tt.want) {
+			t.Fatalf("%d: expected %s, got %s\n", i, tt.want, got)
+		}
+	}
+}
+
 func sampleRandom(min int, max int, s int) map[int]interface{} {
 	m := make(map[int]interface{})
 
@@ -0,0 +1,60 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package aws
+
+import (
+	"github.com/apcera/libretto/virtualmachine"
+)
+
+var _ virtualmachine.Handler = (*VM)(nil)
+
+// handle holds what is needed to manage an instance from another process.
+type handle struct {
+	Name                         string `json:"name,omitempty"`
+	Region                       string `json:"region"`
+	InstanceID                   string `json:"instance_id"`
+	SpotRequestID                string `json:"spot_request_id,omitempty"`
+	KeyPair                      string `json:"key_pair,omitempty"`
+	KeepRootVolumeOnDestroy      bool   `json:"keep_root_volume_on_destroy,omitempty"`
+	DeleteNonRootVolumeOnDestroy bool   `json:"delete_non_root_volume_on_destroy,omitempty"`
+	DeleteKeysOnDestroy          bool   `json:"delete_keys_on_destroy,omitempty"`
+}
+
+// MarshalHandle serializes the instance ID and region of the VM, along with
+// the settings Destroy depends on. AWS credentials are not included.
+func (vm *VM) MarshalHandle() ([]byte, error) {
+	if vm.InstanceID == "" {
+		return nil, ErrNoInstanceID
+	}
+	return virtualmachine.EncodeHandle(providerName, handle{
+		Name:                         vm.Name,
+		Region:                       vm.Region,
+		InstanceID:                   vm.InstanceID,
+		SpotRequestID:                vm.SpotRequestID,
+		KeyPair:                      vm.KeyPair,
+		KeepRootVolumeOnDestroy:      vm.KeepRootVolumeOnDestroy,
+		DeleteNonRootVolumeOnDestroy: vm.DeleteNonRootVolumeOnDestroy,
+		DeleteKeysOnDestroy:          vm.DeleteKeysOnDestroy,
+	})
+}
+
+// UnmarshalHandle restores a handle written by MarshalHandle into the VM.
+func (vm *VM) UnmarshalHandle(data []byte) error {
+	var h handle
+	if err := virtualmachine.DecodeHandle(providerName, data, &h); err != nil {
+		return err
+	}
+	if h.InstanceID == "" {
+		return ErrNoInstanceID
+	}
+
+	vm.Name = h.Name
+	vm.Region = h.Region
+	vm.InstanceID = h.InstanceID
+	vm.SpotRequestID = h.SpotRequestID
+	vm.KeyPair = h.KeyPair
+	vm.KeepRootVolumeOnDestroy = h.KeepRootVolumeOnDestroy
+	vm.DeleteNonRootVolumeOnDestroy = h.DeleteNonRootVolumeOnDestroy
+	vm.DeleteKeysOnDestroy = h.DeleteKeysOnDestroy
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package aws
+
+import (
+	"github.com/apcera/libretto/ssh"
+	"github.com/apcera/libretto/virtualmachine"
+	lwait "github.com/apcera/libretto/virtualmachine/wait"
+)
+
+// providerName is the name the provider is registered under.
+const providerName = "aws"
+
+func init() {
+	virtualmachine.Register(providerName, FromSpec)
+	lwait.SetLimiter(providerName, ProvisionLimiter)
+}
+
+// Provider returns the name the provider is registered under.
+func (vm *VM) Provider() string {
+	return providerName
+}
+
+// FromSpec builds an AWS VM from a provider-neutral spec. Image is the AMI,
+// Size the instance type and Region the AWS region. Each disk becomes an EBS
+// volume, and the first network's subnet and the security groups of all
+// networks are used. AWS credentials come from the environment as usual. The
+// following options are read:
+//
+//	key_pair                           name of the EC2 key pair (required)
+//	iam_instance_profile               name of the IAM instance profile
+//	private_ip                         private IP address of the instance
+//	vpc                                VPC ID
+//	keep_root_volume_on_destroy        "true" to keep the root volume
+//	delete_non_root_volume_on_destroy  "true" to delete the other volumes
+//	delete_keys_on_destroy             "true" to delete the key pair
+func FromSpec(spec *virtualmachine.Spec) (virtualmachine.VirtualMachine, error) {
+	vm := &VM{
+		Name:                   spec.Name,
+		Region:                 spec.Region,
+		AMI:                    spec.Image,
+		InstanceType:           spec.Size,
+		KeyPair:                spec.Option("key_pair"),
+		IamInstanceProfileName: spec.Option("iam_instance_profile"),
+		PrivateIPAddress:       spec.Option("private_ip"),
+		VPC:                    spec.Option("vpc"),
+		UserData:               spec.UserData,
+		Tags:                   spec.Tags,
+		SSHCreds: ssh.Credentials{
+			SSHUser:       spec.SSH.User,
+			SSHPassword:   spec.SSH.Password,
+			SSHPrivateKey: spec.SSH.PrivateKey,
+		},
+		KeepOnFailure: spec.KeepOnFailure,
+	}
+
+	var err error
+	if vm.KeepRootVolumeOnDestroy, err = spec.BoolOption("keep_root_volume_on_destroy"); err != nil {
+		return nil, err
+	}
+	if vm.DeleteNonRootVolumeOnDestroy, err = spec.BoolOption("delete_non_root_volume_on_destroy"); err != nil {
+		return nil, err
+	}
+	if vm.DeleteKeysOnDestroy, err = spec.BoolOption("delete_keys_on_destroy"); err != nil {
+		return nil, err
+	}
+
+	for _, d := range spec.Disks {
+		vm.Volumes = append(vm.Volumes, EBSVolume{
+			DeviceName: d.Device,
+			VolumeSize: d.SizeGB,
+			VolumeType: d.Type,
+		})
+	}
+	for i, n := range spec.Networks {
+		if i == 0 {
+			vm.Subnet = n.Subnet
+		}
+		vm.SecurityGroups = append(vm.SecurityGroups, n.SecurityGroups...)
+	}
+	return vm, nil
+}
@@ -0,0 +1,294 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/apcera/libretto/virtualmachine"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// What EC2 does with a spot instance when it takes the capacity back.
+const (
+	// InterruptTerminate terminates the instance. It is the default.
+	InterruptTerminate = "terminate"
+	// InterruptStop stops the instance, which is started again when
+	// capacity is back. It needs a persistent request.
+	InterruptStop = "stop"
+	// InterruptHibernate hibernates the instance, which is resumed when
+	// capacity is back. It needs a persistent request and an AMI and
+	// instance type that support hibernation.
+	InterruptHibernate = "hibernate"
+)
+
+// Some of the status codes of spot requests. The full list is in the EC2
+// documentation on spot request status.
+const (
+	// SpotFulfilled means the instance was launched.
+	SpotFulfilled = "fulfilled"
+	// SpotCapacityNotAvailable means there is not enough spare capacity for
+	// the instance type in the availability zone.
+	SpotCapacityNotAvailable = "capacity-not-available"
+	// SpotCapacityOversubscribed means the spare capacity is taken by
+	// requests with the same or a higher maximum price.
+	SpotCapacityOversubscribed = "capacity-oversubscribed"
+	// SpotPriceTooLow means the maximum price is below the spot price.
+	SpotPriceTooLow = "price-too-low"
+	// SpotBadParameters means the request is invalid, such as an unknown
+	// AMI.
+	SpotBadParameters = "bad-parameters"
+	// SpotSystemError means EC2 failed to process the request.
+	SpotSystemError = "system-error"
+)
+
+var (
+	// ErrSpotNoCapacity is in the chain of the error returned when EC2 has no
+	// spot capacity for the instance, or took it back.
+	ErrSpotNoCapacity = virtualmachine.NewError(virtualmachine.Transient, errors.New("No spot capacity available"))
+	// ErrSpotPriceTooLow is in the chain of the error returned when the
+	// maximum price of a spot request is below the spot price.
+	ErrSpotPriceTooLow = virtualmachine.NewError(virtualmachine.QuotaExceeded, errors.New("Spot price too low"))
+	// ErrSpotRequestFailed is in the chain of the error returned when a spot
+	// request fails for another reason.
+	ErrSpotRequestFailed = errors.New("Spot request failed")
+	// ErrSpotInterruption is returned by Provision when the interruption
+	// behavior of SpotMarket is unknown, or is stop or hibernate for a
+	// one-time request.
+	ErrSpotInterruption = errors.New("Invalid spot interruption behavior")
+	// ErrNoSpotRequest is returned by GetSpotStatus when the instance is not
+	// a spot instance.
+	ErrNoSpotRequest = virtualmachine.NewError(virtualmachine.NotFound, errors.New("Instance is not a spot instance"))
+)
+
+// spotFailures maps the status codes that stop a spot request from being
+// fulfilled, or that explain why a spot instance went away, to the error in
+// their chain.
+var spotFailures = map[string]error{
+	SpotCapacityNotAvailable:                      ErrSpotNoCapacity,
+	SpotCapacityOversubscribed:                    ErrSpotNoCapacity,
+	"instance-stopped-no-capacity":                ErrSpotNoCapacity,
+	"instance-terminated-no-capacity":             ErrSpotNoCapacity,
+	"instance-terminated-capacity-oversubscribed": ErrSpotNoCapacity,
+	SpotPriceTooLow:                               ErrSpotPriceTooLow,
+	"instance-stopped-by-price":                   ErrSpotPriceTooLow,
+	"instance-terminated-by-price":                ErrSpotPriceTooLow,
+	SpotBadParameters:                             ErrSpotRequestFailed,
+	SpotSystemError:                               ErrSpotRequestFailed,
+	"constraint-not-fulfillable":                  ErrSpotRequestFailed,
+	"launch-group-constraint":                     ErrSpotRequestFailed,
+	"az-group-constraint":                         ErrSpotRequestFailed,
+	"placement-group-constraint":                  ErrSpotRequestFailed,
+	"schedule-expired":                            ErrSpotRequestFailed,
+	"canceled-before-fulfillment":                 ErrSpotRequestFailed,
+}
+
+// SpotMarket launches the instance on the spot market, at a discount, for as
+// long as EC2 does not need the capacity back.
+type SpotMarket struct {
+	// MaxPrice is the most to pay per hour, in USD, such as "0.05". It
+	// defaults to the on-demand price.
+	MaxPrice string
+	// Persistent keeps the request open after an interruption, so that the
+	// instance is relaunched, or started again, when capacity is back. By
+	// default the request is one-time and closes once fulfilled.
+	Persistent bool
+	// InterruptionBehavior is InterruptTerminate, InterruptStop or
+	// InterruptHibernate. It defaults to InterruptTerminate.
+	InterruptionBehavior string
+}
+
+// validate checks the interruption behavior against the request type, which
+// EC2 would only do once the request is evaluated.
+func (s *SpotMarket) validate() error {
+	switch s.InterruptionBehavior {
+	case "", InterruptTerminate:
+		return nil
+	case InterruptStop, InterruptHibernate:
+		if s.Persistent {
+			return nil
+		}
+		return fmt.Errorf("%w: %s needs a persistent request", ErrSpotInterruption, s.InterruptionBehavior)
+	}
+	return fmt.Errorf("%w: %q", ErrSpotInterruption, s.InterruptionBehavior)
+}
+
+// SpotStatus is the status of a spot request.
+type SpotStatus struct {
+	RequestID string
+	// State is open, active, closed, cancelled or failed.
+	State string
+	// Code is the status code, such as SpotFulfilled or SpotPriceTooLow,
+	// and Message its explanation.
+	Code       string
+	Message    string
+	UpdateTime time.Time
+	// InstanceID is the instance launched for the request, if any.
+	InstanceID string
+}
+
+// failed reports whether the request will not be fulfilled as it is.
+func (s SpotStatus) failed() bool {
+	switch s.State {
+	case ec2.SpotInstanceStateFailed, ec2.SpotInstanceStateCancelled, ec2.SpotInstanceStateClosed:
+		return true
+	}
+	_, ok := spotFailures[s.Code]
+	return ok
+}
+
+// err returns the error for the status code of a failed request.
+func (s SpotStatus) err() error {
+	failure, ok := spotFailures[s.Code]
+	if !ok {
+		failure = ErrSpotRequestFailed
+	}
+	if s.Message == "" {
+		return fmt.Errorf("%w: %s", failure, s.Code)
+	}
+	return fmt.Errorf("%w: %s: %s", failure, s.Code, s.Message)
+}
+
+// GetSpotStatus returns the status of the spot request of the VM, such as
+// SpotCapacityNotAvailable while it waits for capacity or
+// "instance-terminated-by-price" once the instance was interrupted. It returns
+// ErrNoSpotRequest for on-demand instances.
+func (vm *VM) GetSpotStatus(ctx context.Context) (SpotStatus, error) {
+	svc, err := getService(vm.Region)
+	if err != nil {
+		return SpotStatus{}, fmt.Errorf("failed to get AWS service: %w", err)
+	}
+
+	requestID := vm.SpotRequestID
+	if requestID == "" {
+		if vm.InstanceID == "" {
+			// Probably need to call Provision first.
+			return SpotStatus{}, ErrNoInstanceID
+		}
+		req, resp := svc.DescribeInstancesRequest(&ec2.DescribeInstancesInput{
+			InstanceIds: []*string{aws.String(vm.InstanceID)},
+		})
+		if err := send(ctx, req); err != nil {
+			return SpotStatus{}, fmt.Errorf("Failed to describe instance: %w", err)
+		}
+		if len(resp.Reservations) < 1 || len(resp.Reservations[0].Instances) < 1 {
+			return SpotStatus{}, ErrNoInstance
+		}
+		id := resp.Reservations[0].Instances[0].SpotInstanceRequestId
+		if id == nil || *id == "" {
+			return SpotStatus{}, ErrNoSpotRequest
+		}
+		requestID = *id
+	}
+	return describeSpotRequest(ctx, svc, requestID)
+}
+
+// describeSpotRequest returns the status of the spot request requestID.
+func describeSpotRequest(ctx context.Context, svc *ec2.EC2, requestID string) (SpotStatus, error) {
+	req, resp := svc.DescribeSpotInstanceRequestsRequest(&ec2.DescribeSpotInstanceRequestsInput{
+		SpotInstanceRequestIds: []*string{aws.String(requestID)},
+	})
+	if err := send(ctx, req); err != nil {
+		return SpotStatus{}, fmt.Errorf("Failed to describe spot request: %w", err)
+	}
+	if len(resp.SpotInstanceRequests) < 1 {
+		return SpotStatus{}, ErrNoSpotRequest
+	}
+
+	r := resp.SpotInstanceRequests[0]
+	status := SpotStatus{
+		RequestID:  requestID,
+		State:      aws.StringValue(r.State),
+		InstanceID: aws.StringValue(r.InstanceId),
+	}
+	if r.Status != nil {
+		status.Code = aws.StringValue(r.Status.Code)
+		status.Message = aws.StringValue(r.Status.Message)
+		status.UpdateTime = aws.TimeValue(r.Status.UpdateTime)
+	}
+	if status.Message == "" && r.Fault != nil {
+		status.Message = aws.StringValue(r.Fault.Message)
+	}
+	return status, nil
+}
+
+// requestSpotInstance asks for a spot instance configured as vm and returns
+// the ID of the spot request.
+func requestSpotInstance(ctx context.Context, svc *ec2.EC2, vm *VM) (string, error) {
+	req, resp := svc.RequestSpotInstancesRequest(spotInstanceInfo(vm))
+	if err := send(ctx, req); err != nil {
+		return "", err
+	}
+
+	if len(resp.SpotInstanceRequests) < 1 || resp.SpotInstanceRequests[0].SpotInstanceRequestId == nil {
+		return "", errors.New("Missing spot request ID")
+	}
+	return *resp.SpotInstanceRequests[0].SpotInstanceRequestId, nil
+}
+
+// spotInstanceInfo returns the spot request for the instance that
+// instanceInfo describes.
+func spotInstanceInfo(vm *VM) *ec2.RequestSpotInstancesInput {
+	info := instanceInfo(vm)
+	spec := &ec2.RequestSpotLaunchSpecification{
+		ImageId:             info.ImageId,
+		InstanceType:        info.InstanceType,
+		KeyName:             info.KeyName,
+		BlockDeviceMappings: info.BlockDeviceMappings,
+		Monitoring:          info.Monitoring,
+		SubnetId:            info.SubnetId,
+		SecurityGroupIds:    info.SecurityGroupIds,
+		IamInstanceProfile:  info.IamInstanceProfile,
+		UserData:            info.UserData,
+	}
+	if info.PrivateIpAddress != nil {
+		// Spot requests only take a private IP address on a network
+		// interface, which then holds the subnet and security groups.
+		spec.NetworkInterfaces = []*ec2.InstanceNetworkInterfaceSpecification{{
+			DeviceIndex:      aws.Int64(0),
+			SubnetId:         info.SubnetId,
+			Groups:           info.SecurityGroupIds,
+			PrivateIpAddress: info.PrivateIpAddress,
+		}}
+		spec.SubnetId = nil
+		spec.SecurityGroupIds = nil
+	}
+
+	requestType := ec2.SpotInstanceTypeOneTime
+	if vm.Spot.Persistent {
+		requestType = ec2.SpotInstanceTypePersistent
+	}
+	input := &ec2.RequestSpotInstancesInput{
+		InstanceCount:       aws.Int64(instanceCount),
+		LaunchSpecification: spec,
+		Type:                aws.String(requestType),
+	}
+	// EC2 defaults the price to the on-demand one.
+	if vm.Spot.MaxPrice != "" {
+		input.SpotPrice = aws.String(vm.Spot.MaxPrice)
+	}
+	if vm.Spot.InterruptionBehavior != "" {
+		input.InstanceInterruptionBehavior = aws.String(vm.Spot.InterruptionBehavior)
+	}
+	return input
+}
+
+// cancelSpotRequest cancels the spot request of the VM, if any, so that a
+// persistent request does not relaunch the instance. Cancelling a request
+// leaves its instance running.
+func (vm *VM) cancelSpotRequest(ctx context.Context, svc *ec2.EC2) error {
+	if vm.SpotRequestID == "" {
+		return nil
+	}
+	req, _ := svc.CancelSpotInstanceRequestsRequest(&ec2.CancelSpotInstanceRequestsInput{
+		SpotInstanceRequestIds: []*string{aws.String(vm.SpotRequestID)},
+	})
+	if err := send(ctx, req); err != nil && !errors.Is(err, virtualmachine.NotFound) {
+		return fmt.Errorf("Failed to cancel spot request: %w", err)
+	}
+	return nil
+}
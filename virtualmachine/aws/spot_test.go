@@ -0,0 +1,130 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package aws
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/apcera/libretto/virtualmachine"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestSpotMarketValidate(t *testing.T) {
+	tests := []struct {
+		market SpotMarket
+		valid  bool
+	}{
+		{SpotMarket{}, true},
+		{SpotMarket{InterruptionBehavior: InterruptTerminate}, true},
+		{SpotMarket{InterruptionBehavior: InterruptStop, Persistent: true}, true},
+		{SpotMarket{InterruptionBehavior: InterruptHibernate, Persistent: true}, true},
+		{SpotMarket{InterruptionBehavior: InterruptStop}, false},
+		{SpotMarket{InterruptionBehavior: InterruptHibernate}, false},
+		{SpotMarket{InterruptionBehavior: "pause", Persistent: true}, false},
+	}
+	for _, tt := range tests {
+		err := tt.market.validate()
+		if tt.valid && err != nil {
+			t.Errorf("%+v: expected no error, got: %s", tt.market, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrSpotInterruption) {
+			t.Errorf("%+v: expected ErrSpotInterruption, got: %v", tt.market, err)
+		}
+	}
+}
+
+func TestSpotFailures(t *testing.T) {
+	tests := []struct {
+		code string
+		want error
+		kind virtualmachine.Kind
+	}{
+		{SpotCapacityNotAvailable, ErrSpotNoCapacity, virtualmachine.Transient},
+		{SpotCapacityOversubscribed, ErrSpotNoCapacity, virtualmachine.Transient},
+		{"instance-terminated-no-capacity", ErrSpotNoCapacity, virtualmachine.Transient},
+		{SpotPriceTooLow, ErrSpotPriceTooLow, virtualmachine.QuotaExceeded},
+		{"instance-terminated-by-price", ErrSpotPriceTooLow, virtualmachine.QuotaExceeded},
+		{SpotBadParameters, ErrSpotRequestFailed, ""},
+		{"schedule-expired", ErrSpotRequestFailed, ""},
+	}
+	for _, tt := range tests {
+		err := SpotStatus{State: ec2.SpotInstanceStateOpen, Code: tt.code}.err()
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v in the chain, got: %v", tt.code, tt.want, err)
+		}
+		if tt.kind != "" && virtualmachine.KindOf(err) != tt.kind {
+			t.Errorf("%s: expected kind %s, got %s", tt.code, tt.kind, virtualmachine.KindOf(err))
+		}
+	}
+}
+
+func TestSpotStatus(t *testing.T) {
+	tests := []struct {
+		status SpotStatus
+		failed bool
+	}{
+		{SpotStatus{State: ec2.SpotInstanceStateActive, Code: SpotFulfilled}, false},
+		{SpotStatus{State: ec2.SpotInstanceStateOpen, Code: "pending-evaluation"}, false},
+		{SpotStatus{State: ec2.SpotInstanceStateOpen, Code: SpotCapacityNotAvailable}, true},
+		{SpotStatus{State: ec2.SpotInstanceStateFailed, Code: SpotBadParameters}, true},
+		{SpotStatus{State: ec2.SpotInstanceStateCancelled, Code: "request-canceled-and-instance-running"}, true},
+		{SpotStatus{State: ec2.SpotInstanceStateClosed, Code: "marked-for-termination"}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.status.failed(); got != tt.failed {
+			t.Errorf("%+v: expected failed to be %v, got %v", tt.status, tt.failed, got)
+		}
+	}
+
+	// Unknown codes are still reported as a failed request.
+	err := SpotStatus{Code: "request-canceled-and-instance-running", Message: "Canceled by the user"}.err()
+	if !errors.Is(err, ErrSpotRequestFailed) || !strings.Contains(err.Error(), "Canceled by the user") {
+		t.Fatalf("Expected ErrSpotRequestFailed with the message, got: %v", err)
+	}
+}
+
+func TestSpotInstanceInfo(t *testing.T) {
+	vm := &VM{
+		Name:           "spot",
+		AMI:            "ami-1234",
+		InstanceType:   "m5.large",
+		Subnet:         "subnet-1",
+		SecurityGroups: []string{"sg-1"},
+		Spot:           &SpotMarket{},
+	}
+	input := spotInstanceInfo(vm)
+	if err := input.Validate(); err != nil {
+		t.Fatalf("Expected the request to validate without a price, got: %s", err)
+	}
+	if input.SpotPrice != nil || input.InstanceInterruptionBehavior != nil {
+		t.Fatalf("Expected no price or interruption behavior, got %v and %v", input.SpotPrice, input.InstanceInterruptionBehavior)
+	}
+	if aws.StringValue(input.Type) != ec2.SpotInstanceTypeOneTime {
+		t.Fatalf("Expected a one-time request, got %s", aws.StringValue(input.Type))
+	}
+	spec := input.LaunchSpecification
+	if aws.StringValue(spec.ImageId) != "ami-1234" || aws.StringValue(spec.SubnetId) != "subnet-1" || len(spec.NetworkInterfaces) != 0 {
+		t.Fatalf("Unexpected launch specification %v", spec)
+	}
+
+	vm.PrivateIPAddress = "10.0.0.10"
+	vm.Spot = &SpotMarket{MaxPrice: "0.05", Persistent: true, InterruptionBehavior: InterruptStop}
+	input = spotInstanceInfo(vm)
+	if aws.StringValue(input.SpotPrice) != "0.05" || aws.StringValue(input.InstanceInterruptionBehavior) != InterruptStop {
+		t.Fatalf("Expected the price and interruption behavior, got %v and %v", input.SpotPrice, input.InstanceInterruptionBehavior)
+	}
+	if aws.StringValue(input.Type) != ec2.SpotInstanceTypePersistent {
+		t.Fatalf("Expected a persistent request, got %s", aws.StringValue(input.Type))
+	}
+	spec = input.LaunchSpecification
+	if spec.SubnetId != nil || spec.SecurityGroupIds != nil || len(spec.NetworkInterfaces) != 1 {
+		t.Fatalf("Expected the subnet and security groups on the network interface, got %v", spec)
+	}
+	nic := spec.NetworkInterfaces[0]
+	if aws.StringValue(nic.PrivateIpAddress) != "10.0.0.10" || aws.StringValue(nic.SubnetId) != "subnet-1" || len(nic.Groups) != 1 {
+		t.Fatalf("Unexpected network interface %v", nic)
+	}
+}
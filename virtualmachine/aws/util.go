@@ -3,23 +3,30 @@
 package aws
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	lvm "github.com/apcera/libretto/virtualmachine"
 	"github.com/apcera/util/uuid"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	cssh "golang.org/x/crypto/ssh"
 )
 
 const (
-	noCredsCode  = "NoCredentialProviders"
-	noRegionCode = "MissingRegion"
+	noCredsCode          = "NoCredentialProviders"
+	noRegionCode         = "MissingRegion"
+	instanceNotFoundCode = "InvalidInstanceID.NotFound"
 
 	instanceCount       = 1
 	defaultInstanceType = "t2.micro"
@@ -36,7 +43,7 @@ const (
 func ValidCredentials(region string) error {
 	svc, err := getService(region)
 	if err != nil {
-		return fmt.Errorf("failed to get AWS service: %v", err)
+		return fmt.Errorf("failed to get AWS service: %w", err)
 	}
 
 	_, err = svc.DescribeInstances(nil)
@@ -55,14 +62,56 @@ func ValidCredentials(region string) error {
 	return nil
 }
 
-func getInstanceVolumeIDs(svc *ec2.EC2, instID string) ([]string, error) {
-	resp, err := svc.DescribeVolumes(&ec2.DescribeVolumesInput{
+// send sends req with its HTTP request bound to ctx, so that the call is
+// aborted, and not retried, once ctx is done.
+func send(ctx context.Context, req *request.Request) error {
+	req.HTTPRequest = req.HTTPRequest.WithContext(ctx)
+	if err := req.Send(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return classify(err)
+	}
+	return nil
+}
+
+// classify gives err the lvm.Kind that matches its AWS error code, keeping
+// the AWS error in the chain.
+func classify(err error) error {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return err
+	}
+
+	code := awsErr.Code()
+	switch {
+	case strings.HasSuffix(code, ".NotFound"):
+		return lvm.NewError(lvm.NotFound, err)
+	case strings.HasSuffix(code, ".Duplicate"):
+		return lvm.NewError(lvm.AlreadyExists, err)
+	case code == "RequestLimitExceeded", code == "InsufficientInstanceCapacity",
+		code == "InternalError", code == "Unavailable", code == "RequestError":
+		return lvm.NewError(lvm.Transient, err)
+	case strings.HasSuffix(code, "LimitExceeded"):
+		return lvm.NewError(lvm.QuotaExceeded, err)
+	case code == "AuthFailure", code == "UnauthorizedOperation", code == noCredsCode:
+		return lvm.NewError(lvm.AuthFailed, err)
+	}
+
+	if reqErr, ok := awsErr.(awserr.RequestFailure); ok {
+		return lvm.NewError(lvm.KindForStatus(reqErr.StatusCode()), err)
+	}
+	return err
+}
+
+func getInstanceVolumeIDs(ctx context.Context, svc *ec2.EC2, instID string) ([]string, error) {
+	req, resp := svc.DescribeVolumesRequest(&ec2.DescribeVolumesInput{
 		Filters: []*ec2.Filter{
 			{Name: aws.String("attachment.instance-id"),
 				Values: []*string{aws.String(instID)}},
 		},
 	})
-	if err != nil {
+	if err := send(ctx, req); err != nil {
 		return nil, err
 	}
 
@@ -78,12 +127,12 @@ func getInstanceVolumeIDs(svc *ec2.EC2, instID string) ([]string, error) {
 	return ids, nil
 }
 
-func getNonRootDeviceNames(svc *ec2.EC2, instID string) ([]string, error) {
-	resp, err := svc.DescribeInstanceAttribute(&ec2.DescribeInstanceAttributeInput{
+func getNonRootDeviceNames(ctx context.Context, svc *ec2.EC2, instID string) ([]string, error) {
+	req, resp := svc.DescribeInstanceAttributeRequest(&ec2.DescribeInstanceAttributeInput{
 		Attribute:  aws.String("blockDeviceMapping"),
 		InstanceId: aws.String(instID),
 	})
-	if err != nil {
+	if err := send(ctx, req); err != nil {
 		return nil, err
 	}
 
@@ -108,10 +157,10 @@ func getNonRootDeviceNames(svc *ec2.EC2, instID string) ([]string, error) {
 	return names, nil
 }
 
-func setNonRootDeleteOnDestroy(svc *ec2.EC2, instID string, delOnTerm bool) error {
-	devNames, err := getNonRootDeviceNames(svc, instID)
+func setNonRootDeleteOnDestroy(ctx context.Context, svc *ec2.EC2, instID string, delOnTerm bool) error {
+	devNames, err := getNonRootDeviceNames(ctx, svc, instID)
 	if err != nil {
-		return fmt.Errorf("DescribeInstanceAttribute: %s", err)
+		return fmt.Errorf("DescribeInstanceAttribute: %w", err)
 	}
 
 	devices := make([]*ec2.InstanceBlockDeviceMappingSpecification, 0, len(devNames))
@@ -124,12 +173,12 @@ func setNonRootDeleteOnDestroy(svc *ec2.EC2, instID string, delOnTerm bool) erro
 		})
 	}
 
-	_, err = svc.ModifyInstanceAttribute(&ec2.ModifyInstanceAttributeInput{
+	req, _ := svc.ModifyInstanceAttributeRequest(&ec2.ModifyInstanceAttributeInput{
 		InstanceId:          aws.String(instID),
 		BlockDeviceMappings: devices,
 	})
-	if err != nil {
-		return fmt.Errorf("ModifyInstanceAttribute: %s", err)
+	if err := send(ctx, req); err != nil {
+		return fmt.Errorf("ModifyInstanceAttribute: %w", err)
 	}
 
 	return nil
@@ -157,7 +206,7 @@ func getService(region string) (*ec2.EC2, error) {
 		HTTPClient:                    &http.Client{Timeout: 30 * time.Second},
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+		return nil, fmt.Errorf("failed to create AWS session: %w", err)
 	}
 
 	return ec2.New(s), nil
@@ -217,6 +266,11 @@ func instanceInfo(vm *VM) *ec2.RunInstancesInput {
 		privateIPAddress = aws.String(vm.PrivateIPAddress)
 	}
 
+	var userData *string
+	if vm.UserData != "" {
+		userData = aws.String(base64.StdEncoding.EncodeToString([]byte(vm.UserData)))
+	}
+
 	return &ec2.RunInstancesInput{
 		ImageId:             aws.String(vm.AMI),
 		InstanceType:        aws.String(vm.InstanceType),
@@ -231,9 +285,37 @@ func instanceInfo(vm *VM) *ec2.RunInstancesInput {
 		SecurityGroupIds:   sgid,
 		IamInstanceProfile: iamInstance,
 		PrivateIpAddress:   privateIPAddress,
+		UserData:           userData,
 	}
 }
 
+// translateState maps an EC2 instance state name, or instanceNotFoundCode
+// for an unknown instance, to a lvm.VM* state.
+func translateState(state string) string {
+	switch state {
+	case StatePending:
+		return lvm.VMStarting
+	case StateStarted:
+		return lvm.VMRunning
+	case StateStopping, StateShuttingDown:
+		return lvm.VMPending
+	case StateHalted:
+		return lvm.VMHalted
+	case StateDestroyed:
+		return lvm.VMTerminated
+	case instanceNotFoundCode:
+		return lvm.VMNotFound
+	default:
+		return lvm.VMUnknown
+	}
+}
+
+// isNotFound returns true if err is AWS reporting an unknown instance ID.
+func isNotFound(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == instanceNotFoundCode
+}
+
 func hasInstanceID(instance *ec2.Instance) bool {
 	if instance == nil || instance.InstanceId == nil {
 		return false
@@ -242,17 +324,32 @@ func hasInstanceID(instance *ec2.Instance) bool {
 	return true
 }
 
-// UploadKeyPair uploads the public key to AWS with a given name.
-// If the public key already exists, then no error is returned.
+// importableKeyTypes are the types of the public keys EC2 imports.
+var importableKeyTypes = map[string]bool{
+	cssh.KeyAlgoRSA:     true,
+	cssh.KeyAlgoED25519: true,
+}
+
+// UploadKeyPair uploads the public key, in the authorized_keys format, to AWS
+// with a given name. RSA and Ed25519 keys are supported; EC2 does not import
+// ECDSA keys. If the public key already exists, then no error is returned.
 func UploadKeyPair(publicKey []byte, name string, region string) error {
+	pub, _, _, _, err := cssh.ParseAuthorizedKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+	if !importableKeyTypes[pub.Type()] {
+		return lvm.NewError(lvm.NotSupported, fmt.Errorf("%s keys cannot be imported into EC2", pub.Type()))
+	}
+
 	svc, err := getService(region)
 	if err != nil {
-		return fmt.Errorf("failed to get AWS service: %v", err)
+		return fmt.Errorf("failed to get AWS service: %w", err)
 	}
 
 	_, err = svc.ImportKeyPair(&ec2.ImportKeyPairInput{
 		KeyName:           aws.String(name),
-		PublicKeyMaterial: publicKey,
+		PublicKeyMaterial: cssh.MarshalAuthorizedKey(pub),
 		DryRun:            aws.Bool(false),
 	})
 	if awsErr, isAWS := err.(awserr.Error); isAWS {
@@ -270,7 +367,7 @@ func UploadKeyPair(publicKey []byte, name string, region string) error {
 func DeleteKeyPair(name string, region string) error {
 	svc, err := getService(region)
 	if err != nil {
-		return fmt.Errorf("failed to get AWS service: %v", err)
+		return fmt.Errorf("failed to get AWS service: %w", err)
 	}
 
 	if name == "" {
@@ -282,7 +379,7 @@ func DeleteKeyPair(name string, region string) error {
 		DryRun:  aws.Bool(false),
 	})
 	if err != nil {
-		return fmt.Errorf("Failed to delete key pair: %s", err)
+		return fmt.Errorf("Failed to delete key pair: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,51 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestTranslateState(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"pending", lvm.VMStarting},
+		{"running", lvm.VMRunning},
+		{"stopping", lvm.VMPending},
+		{"shutting-down", lvm.VMPending},
+		{"stopped", lvm.VMHalted},
+		{"terminated", lvm.VMTerminated},
+		{"InvalidInstanceID.NotFound", lvm.VMNotFound},
+		{"rebooting", lvm.VMUnknown},
+		{"", lvm.VMUnknown},
+	}
+	for _, tt := range tests {
+		if got := translateState(tt.raw); got != tt.want {
+			t.Errorf("translateState(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	notFound := awserr.New(instanceNotFoundCode, "The instance ID 'i-1234' does not exist", nil)
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{notFound, true},
+		{fmt.Errorf("Failed to describe instance: %w", notFound), true},
+		{awserr.New("InvalidInstanceID.Malformed", "Invalid id: i-1", nil), false},
+		{errors.New(instanceNotFoundCode), false},
+	}
+	for _, tt := range tests {
+		if got := isNotFound(tt.err); got != tt.want {
+			t.Errorf("isNotFound(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -4,17 +4,21 @@
 package aws
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
-	"sync"
 	"time"
 
+	"github.com/apcera/libretto/remote"
 	"github.com/apcera/libretto/ssh"
 	"github.com/apcera/libretto/util"
 	"github.com/apcera/libretto/virtualmachine"
+	lwait "github.com/apcera/libretto/virtualmachine/wait"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	cssh "golang.org/x/crypto/ssh"
 )
 
 const (
@@ -31,6 +35,11 @@ const (
 	StateDestroyed = "terminated"
 	// StatePending is the state AWS reports when the VM is pending.
 	StatePending = "pending"
+	// StateStopping is the state AWS reports when the VM is stopping.
+	StateStopping = "stopping"
+	// StateShuttingDown is the state AWS reports when the VM is being
+	// terminated.
+	StateShuttingDown = "shutting-down"
 )
 
 var (
@@ -38,36 +47,38 @@ var (
 	// not thread-safe.
 	SSHTimeout = 5 * time.Minute
 
-	// This ensures that aws.VM implements the virtualmachine.VirtualMachine
-	// interface at compile time.
-	_ virtualmachine.VirtualMachine = (*VM)(nil)
+	// This ensures that aws.VM implements the
+	// virtualmachine.VirtualMachineContext interface at compile time.
+	_ virtualmachine.VirtualMachineContext = (*VM)(nil)
+	_ virtualmachine.StateDetailer         = (*VM)(nil)
+	_ virtualmachine.Capabler              = (*VM)(nil)
+	_ virtualmachine.HostKeyer             = (*VM)(nil)
 
-	// nextProvision is the wall time when the next call to Provision will be
-	// allowed to proceed. This is part of the rate limiting system.
-	nextProvision time.Time
-	mu            sync.Mutex
+	// ProvisionLimiter keeps calls to Provision under the AWS rate limit by
+	// letting one through every 0.5s. Callers are delayed by at most 1m.
+	ProvisionLimiter = lwait.NewLimiter(500*time.Millisecond, time.Minute)
 )
 
 var (
 	// ErrNoCreds is returned when no credentials are found in environment or
 	// home directory.
-	ErrNoCreds = errors.New("Missing AWS credentials")
+	ErrNoCreds = virtualmachine.NewError(virtualmachine.AuthFailed, errors.New("Missing AWS credentials"))
 	// ErrNoRegion is returned when a request was sent without a region.
 	ErrNoRegion = errors.New("Missing AWS region")
 	// ErrNoInstance is returned querying an instance, but none is found.
-	ErrNoInstance = errors.New("Missing VM instance")
+	ErrNoInstance = virtualmachine.NewError(virtualmachine.NotFound, errors.New("Missing VM instance"))
 	// ErrNoInstanceID is returned when attempting to perform an operation on
-	// an instance, but the ID is missing.
-	ErrNoInstanceID = errors.New("Missing instance ID")
+	// an instance, but the ID is missing. It is virtualmachine.ErrNoInstanceID.
+	ErrNoInstanceID = virtualmachine.ErrNoInstanceID
 	// ErrProvisionTimeout is returned when the EC2 instance takes too long to
 	// enter "running" state.
-	ErrProvisionTimeout = errors.New("AWS provision timeout")
+	ErrProvisionTimeout = virtualmachine.NewError(virtualmachine.Timeout, errors.New("AWS provision timeout"))
 	// ErrNoIPs is returned when no IP addresses are found for an instance.
 	ErrNoIPs = errors.New("Missing IPs for instance")
 	// ErrNoSupportSuspend is returned when vm.Suspend() is called.
-	ErrNoSupportSuspend = errors.New("Suspend action not supported by AWS")
+	ErrNoSupportSuspend = virtualmachine.NewError(virtualmachine.NotSupported, errors.New("Suspend action not supported by AWS"))
 	// ErrNoSupportResume is returned when vm.Resume() is called.
-	ErrNoSupportResume = errors.New("Resume action not supported by AWS")
+	ErrNoSupportResume = virtualmachine.NewError(virtualmachine.NotSupported, errors.New("Resume action not supported by AWS"))
 )
 
 // VM represents an AWS EC2 virtual machine.
@@ -89,8 +100,24 @@ type VM struct {
 	Subnet         string
 	SecurityGroups []string
 
+	UserData string            // optional, passed to the instance unencoded
+	Tags     map[string]string // optional, set on the instance after Name
+
+	// Spot launches a spot instance rather than an on-demand one. The ID of
+	// its spot request is set in SpotRequestID by Provision.
+	Spot          *SpotMarket
+	SpotRequestID string
+
 	SSHCreds            ssh.Credentials // required
 	DeleteKeysOnDestroy bool
+
+	// KeepOnFailure keeps the instance if Provision fails after creating it,
+	// so that it can be inspected. By default it is terminated.
+	KeepOnFailure bool
+
+	// Observer receives the events of this VM, in addition to the observers
+	// registered with virtualmachine.AddObserver. It may be nil.
+	Observer virtualmachine.Observer
 }
 
 // EBSVolume represents an EBS Volume
@@ -105,20 +132,31 @@ func (vm *VM) GetName() string {
 	return vm.Name
 }
 
+// events returns the Events of the VM, sent to its Observer and the global
+// observers.
+func (vm *VM) events() virtualmachine.Events {
+	return virtualmachine.Events{Provider: providerName, Name: vm.Name, VM: vm, Observer: vm.Observer}
+}
+
 // SetTag adds a tag to the VM and its attached volumes.
 func (vm *VM) SetTag(key, value string) error {
+	return vm.SetTagContext(context.Background(), key, value)
+}
+
+// SetTagContext is like SetTag but the AWS calls are bound to ctx.
+func (vm *VM) SetTagContext(ctx context.Context, key, value string) error {
 	svc, err := getService(vm.Region)
 	if err != nil {
-		return fmt.Errorf("failed to get AWS service: %v", err)
+		return fmt.Errorf("failed to get AWS service: %w", err)
 	}
 
 	if vm.InstanceID == "" {
 		return ErrNoInstanceID
 	}
 
-	volIDs, err := getInstanceVolumeIDs(svc, vm.InstanceID)
+	volIDs, err := getInstanceVolumeIDs(ctx, svc, vm.InstanceID)
 	if err != nil {
-		return fmt.Errorf("Failed to get instance's volumes IDs: %s", err)
+		return fmt.Errorf("Failed to get instance's volumes IDs: %w", err)
 	}
 
 	ids := make([]*string, 0, len(volIDs)+1)
@@ -127,15 +165,15 @@ func (vm *VM) SetTag(key, value string) error {
 		ids = append(ids, aws.String(v))
 	}
 
-	_, err = svc.CreateTags(&ec2.CreateTagsInput{
+	req, _ := svc.CreateTagsRequest(&ec2.CreateTagsInput{
 		Resources: ids,
 		Tags: []*ec2.Tag{
 			{Key: aws.String(key),
 				Value: aws.String(value)},
 		},
 	})
-	if err != nil {
-		return fmt.Errorf("Failed to create tag on VM: %v", err)
+	if err := send(ctx, req); err != nil {
+		return fmt.Errorf("Failed to create tag on VM: %w", err)
 	}
 
 	return nil
@@ -144,8 +182,13 @@ func (vm *VM) SetTag(key, value string) error {
 // SetTags takes in a map of tags to set to the provisioned instance. This is
 // essentially a shorter way than calling SetTag many times.
 func (vm *VM) SetTags(tags map[string]string) error {
+	return vm.SetTagsContext(context.Background(), tags)
+}
+
+// SetTagsContext is like SetTags but the AWS calls are bound to ctx.
+func (vm *VM) SetTagsContext(ctx context.Context, tags map[string]string) error {
 	for k, v := range tags {
-		if err := vm.SetTag(k, v); err != nil {
+		if err := vm.SetTagContext(ctx, k, v); err != nil {
 			return err
 		}
 	}
@@ -154,94 +197,137 @@ func (vm *VM) SetTags(tags map[string]string) error {
 
 // Provision creates a virtual machine on AWS. It returns an error if
 // there was a problem during creation, if there was a problem adding a tag, or
-// if the VM takes too long to enter "running" state.
+// if the VM takes too long to enter "running" state. If it fails after the
+// instance is created, the instance is terminated unless KeepOnFailure is set.
+//
+// If Spot is set, it waits for a spot request to be fulfilled instead, and
+// fails with a ReadyError holding the status of the request, such as
+// SpotCapacityNotAvailable or SpotPriceTooLow, if it will not be. The request
+// is then cancelled unless KeepOnFailure is set.
 func (vm *VM) Provision() error {
-	wait() // Avoid the AWS rate limit.
+	return vm.ProvisionContext(context.Background())
+}
 
-	svc, err := getService(vm.Region)
-	if err != nil {
-		return fmt.Errorf("failed to get AWS service: %v", err)
+// ProvisionContext is like Provision but stops waiting for the instance, and
+// aborts any in-flight AWS call, when ctx is done.
+func (vm *VM) ProvisionContext(ctx context.Context) (err error) {
+	var out virtualmachine.Outcome
+	defer vm.events().BeginWith(ctx, virtualmachine.OpProvision, &out)(&err)
+	if vm.Spot != nil {
+		if err := vm.Spot.validate(); err != nil {
+			return err
+		}
 	}
 
-	resp, err := svc.RunInstances(instanceInfo(vm))
+	// Avoid the AWS rate limit.
+	if err := ProvisionLimiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	svc, err := getService(vm.Region)
 	if err != nil {
-		return fmt.Errorf("Failed to create instance: %v", err)
+		return fmt.Errorf("failed to get AWS service: %w", err)
 	}
 
-	if hasInstanceID(resp.Instances[0]) {
-		vm.InstanceID = *resp.Instances[0].InstanceId
+	rb := virtualmachine.NewRollback(vm.KeepOnFailure)
+	rb.Events = vm.events()
+	defer rb.Finish(&err)
+
+	if vm.Spot != nil {
+		if vm.SpotRequestID, err = requestSpotInstance(ctx, svc, vm); err != nil {
+			return fmt.Errorf("Failed to request spot instance: %w", err)
+		}
+
+		// An open request may still launch an instance, so cancel it, and
+		// terminate the instance if it was launched in the meantime.
+		rb.Add("spot request "+vm.SpotRequestID, func(ctx context.Context) error {
+			if vm.SpotRequestID == "" {
+				// Cancelled along with the instance.
+				return nil
+			}
+			if err := vm.cancelSpotRequest(ctx, svc); err != nil {
+				return err
+			}
+			if vm.InstanceID == "" {
+				if status, err := describeSpotRequest(ctx, svc, vm.SpotRequestID); err == nil && status.InstanceID != "" {
+					req, _ := svc.TerminateInstancesRequest(&ec2.TerminateInstancesInput{
+						InstanceIds: []*string{aws.String(status.InstanceID)},
+					})
+					if err := send(ctx, req); err != nil {
+						return err
+					}
+				}
+			}
+			vm.SpotRequestID = ""
+			return nil
+		})
+
+		if vm.InstanceID, err = waitUntilFulfilled(ctx, svc, vm.SpotRequestID); err != nil {
+			return err
+		}
 	} else {
-		return ErrNoInstanceID
+		req, resp := svc.RunInstancesRequest(instanceInfo(vm))
+		if err := send(ctx, req); err != nil {
+			return fmt.Errorf("Failed to create instance: %w", err)
+		}
+
+		if hasInstanceID(resp.Instances[0]) {
+			vm.InstanceID = *resp.Instances[0].InstanceId
+		} else {
+			return ErrNoInstanceID
+		}
 	}
 
-	if err := waitUntilReady(svc, vm.InstanceID); err != nil {
+	// From here on a failure leaves a running instance behind, so terminate
+	// it unless asked to keep it. A persistent spot request would relaunch
+	// it, so the request is cancelled first.
+	rb.Add("instance "+vm.InstanceID, func(ctx context.Context) error {
+		if err := vm.cancelSpotRequest(ctx, svc); err != nil {
+			return err
+		}
+		req, _ := svc.TerminateInstancesRequest(&ec2.TerminateInstancesInput{
+			InstanceIds: []*string{aws.String(vm.InstanceID)},
+		})
+		if err := send(ctx, req); err != nil {
+			return err
+		}
+		vm.InstanceID = ""
+		vm.SpotRequestID = ""
+		return nil
+	})
+
+	if err := waitUntilReady(ctx, svc, vm.InstanceID, vm.SpotRequestID); err != nil {
 		return err
 	}
+	out.State = virtualmachine.VMRunning
 
 	if vm.DeleteNonRootVolumeOnDestroy {
-		return setNonRootDeleteOnDestroy(svc, vm.InstanceID, true)
+		if err := setNonRootDeleteOnDestroy(ctx, svc, vm.InstanceID, true); err != nil {
+			return err
+		}
 	}
 
 	if vm.Name != "" {
-		if err := vm.SetTag("Name", vm.GetName()); err != nil {
+		if err := vm.SetTagContext(ctx, "Name", vm.GetName()); err != nil {
 			return err
 		}
 	}
 
-	return nil
-}
-
-// wait implements a rate limiter that prevents more than one call every
-// 0.5s. The maximum time that the caller can be delayed is 1m.
-func wait() {
-	const maxWait = 1 * time.Minute
-
-	now := time.Now().UTC()
-	mu.Lock()
-	wait := getWaitTime(now, maxWait)
-	mu.Unlock()
-
-	time.Sleep(wait)
-
-	interval := 500 * time.Millisecond
-	if wait == maxWait {
-		interval = maxWait
-	}
-
-	mu.Lock()
-	defer mu.Unlock()
-	if now.Before(nextProvision) {
-		nextProvision = nextProvision.Add(interval)
-		return
-	}
-	now = time.Now().UTC()
-	nextProvision = now.Add(interval)
-}
-
-// getWaitTime computes the duration to sleep before the caller of wait() is
-// allowed to proceed. Every concurrent call adds 0.5s to the time the
-// subsequent caller must wait, up to a maximum of 1 minute.
-func getWaitTime(now time.Time, maxWait time.Duration) time.Duration {
-	wait := nextProvision.Sub(now) // might be negative
-
-	// When the system clock falls back an hour, the wait time might be an hour.
-	// This sanity check prevents this error.
-	if wait > maxWait {
-		return maxWait
-	}
-	if wait < 0 {
-		return 0
-	}
-	return wait
+	return vm.SetTagsContext(ctx, vm.Tags)
 }
 
 // GetIPs returns a slice of IP addresses assigned to the VM. The PublicIP or
 // PrivateIP consts can be used to retrieve respective IP address type. It
 // returns nil if there was an error obtaining the IPs.
 func (vm *VM) GetIPs() ([]net.IP, error) {
+	return vm.GetIPsContext(context.Background())
+}
+
+// GetIPsContext is like GetIPs but the AWS call is bound to ctx.
+func (vm *VM) GetIPsContext(ctx context.Context) ([]net.IP, error) {
 	svc, err := getService(vm.Region)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get AWS service: %v", err)
+		return nil, fmt.Errorf("failed to get AWS service: %w", err)
 	}
 
 	if vm.InstanceID == "" {
@@ -249,13 +335,13 @@ func (vm *VM) GetIPs() ([]net.IP, error) {
 		return nil, ErrNoInstanceID
 	}
 
-	inst, err := svc.DescribeInstances(&ec2.DescribeInstancesInput{
+	req, inst := svc.DescribeInstancesRequest(&ec2.DescribeInstancesInput{
 		InstanceIds: []*string{
 			aws.String(vm.InstanceID),
 		},
 	})
-	if err != nil {
-		return nil, fmt.Errorf("Failed to describe instance: %s", err)
+	if err := send(ctx, req); err != nil {
+		return nil, fmt.Errorf("Failed to describe instance: %w", err)
 	}
 
 	if len(inst.Reservations) < 1 {
@@ -277,23 +363,33 @@ func (vm *VM) GetIPs() ([]net.IP, error) {
 }
 
 // Destroy terminates the VM on AWS. It returns an error if AWS credentials are
-// missing or if there is no instance ID.
+// missing or if there is no instance ID. The spot request of a spot instance
+// is cancelled first, so that a persistent one does not relaunch it.
 func (vm *VM) Destroy() error {
+	return vm.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but the AWS call is bound to ctx.
+func (vm *VM) DestroyContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, virtualmachine.OpDestroy)(&err)
 	svc, err := getService(vm.Region)
 	if err != nil {
-		return fmt.Errorf("failed to get AWS service: %v", err)
+		return fmt.Errorf("failed to get AWS service: %w", err)
 	}
 
 	if vm.InstanceID == "" {
 		// Probably need to call Provision first.
 		return ErrNoInstanceID
 	}
-	_, err = svc.TerminateInstances(&ec2.TerminateInstancesInput{
+	if err := vm.cancelSpotRequest(ctx, svc); err != nil {
+		return err
+	}
+	req, _ := svc.TerminateInstancesRequest(&ec2.TerminateInstancesInput{
 		InstanceIds: []*string{
 			aws.String(vm.InstanceID),
 		},
 	})
-	if err != nil {
+	if err := send(ctx, req); err != nil {
 		return err
 	}
 
@@ -308,61 +404,128 @@ func (vm *VM) Destroy() error {
 // GetSSH returns an SSH client that can be used to connect to a VM. An error
 // is returned if the VM has no IPs.
 func (vm *VM) GetSSH(options ssh.Options) (ssh.Client, error) {
-	ips, err := util.GetVMIPs(vm, options)
+	return vm.GetSSHContext(context.Background(), options)
+}
+
+// GetSSHContext is like GetSSH but stops waiting for sshd when ctx is done.
+func (vm *VM) GetSSHContext(ctx context.Context, options ssh.Options) (ssh.Client, error) {
+	ips, err := util.GetVMIPsContext(ctx, vm, options)
 	if err != nil {
 		return nil, err
 	}
 
 	client := &ssh.SSHClient{
 		Creds:   &vm.SSHCreds,
-		IP:      ips[PublicIP],
+		IP:      util.SSHIP(ips, options, PublicIP, PrivateIP),
 		Options: options,
 		Port:    22,
 	}
-	if err := client.WaitForSSH(SSHTimeout); err != nil {
+	if err := client.WaitForSSHContext(ctx, SSHTimeout); err != nil {
 		return nil, err
 	}
+	client.Disconnect()
 	return client, nil
 }
 
-// GetState returns the state of the VM, such as "running". An error is
-// returned if the instance ID is missing, if there was a problem querying AWS,
-// or if there are no instances.
+// GetRemote returns a Remote for the instance: over SSH, as GetSSH does, or
+// over WinRM for Windows instances. WinRM logs in with the user and password
+// of SSHCreds unless options.WinRM sets them.
+func (vm *VM) GetRemote(options remote.Options) (remote.Remote, error) {
+	return virtualmachine.NewRemote(vm, options, &vm.SSHCreds, func() (net.IP, error) {
+		ips, err := util.GetVMIPs(vm, options.SSH)
+		if err != nil {
+			return nil, err
+		}
+		return util.SSHIP(ips, options.SSH, PublicIP, PrivateIP), nil
+	})
+}
+
+// GetHostKeys returns the SSH host keys cloud-init printed on the console of
+// the instance. AWS makes the console output available a few minutes after
+// boot; ssh.ErrNoHostKeys is returned until then.
+func (vm *VM) GetHostKeys(ctx context.Context) ([]cssh.PublicKey, error) {
+	if vm.InstanceID == "" {
+		return nil, ErrNoInstanceID
+	}
+
+	svc, err := getService(vm.Region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get AWS service: %w", err)
+	}
+
+	req, out := svc.GetConsoleOutputRequest(&ec2.GetConsoleOutputInput{
+		InstanceId: aws.String(vm.InstanceID),
+	})
+	if err := send(ctx, req); err != nil {
+		return nil, fmt.Errorf("failed to get console output: %w", err)
+	}
+	if out.Output == nil {
+		return nil, ssh.ErrNoHostKeys
+	}
+	console, err := base64.StdEncoding.DecodeString(*out.Output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode console output: %w", err)
+	}
+	return ssh.ParseHostKeys(console)
+}
+
+// GetState returns the state of the VM, such as lvm.VMRunning. An error is
+// returned if the instance ID is missing or if there was a problem querying
+// AWS. lvm.VMNotFound is returned if AWS does not know the instance.
 func (vm *VM) GetState() (string, error) {
+	return vm.GetStateContext(context.Background())
+}
+
+// GetStateContext is like GetState but the AWS call is bound to ctx.
+func (vm *VM) GetStateContext(ctx context.Context) (string, error) {
+	d, err := vm.GetStateDetail(ctx)
+	return d.State, err
+}
+
+// GetStateDetail is like GetStateContext but also returns the EC2 state name,
+// such as "stopping".
+func (vm *VM) GetStateDetail(ctx context.Context) (virtualmachine.StateDetail, error) {
 	svc, err := getService(vm.Region)
 	if err != nil {
-		return "", fmt.Errorf("failed to get AWS service: %v", err)
+		return virtualmachine.StateDetail{}, fmt.Errorf("failed to get AWS service: %w", err)
 	}
 
 	if vm.InstanceID == "" {
 		// Probably need to call Provision first.
-		return "", ErrNoInstanceID
+		return virtualmachine.StateDetail{}, ErrNoInstanceID
 	}
 
-	stat, err := svc.DescribeInstances(&ec2.DescribeInstancesInput{
+	req, stat := svc.DescribeInstancesRequest(&ec2.DescribeInstancesInput{
 		InstanceIds: []*string{
 			aws.String(vm.InstanceID),
 		},
 	})
-	if err != nil {
-		return "", fmt.Errorf("Failed to describe instance: %s", err)
+	if err := send(ctx, req); err != nil {
+		if isNotFound(err) {
+			return virtualmachine.StateDetail{State: translateState(instanceNotFoundCode), Raw: instanceNotFoundCode}, nil
+		}
+		return virtualmachine.StateDetail{}, fmt.Errorf("Failed to describe instance: %w", err)
 	}
 
-	if n := len(stat.Reservations); n < 1 {
-		return "", ErrNoInstance
-	}
-	if n := len(stat.Reservations[0].Instances); n < 1 {
-		return "", ErrNoInstance
+	if len(stat.Reservations) < 1 || len(stat.Reservations[0].Instances) < 1 {
+		return virtualmachine.StateDetail{State: virtualmachine.VMNotFound}, nil
 	}
 
-	return *stat.Reservations[0].Instances[0].State.Name, nil
+	raw := *stat.Reservations[0].Instances[0].State.Name
+	return virtualmachine.StateDetail{State: translateState(raw), Raw: raw}, nil
 }
 
 // Halt shuts down the VM on AWS.
 func (vm *VM) Halt() error {
+	return vm.HaltContext(context.Background())
+}
+
+// HaltContext is like Halt but the AWS call is bound to ctx.
+func (vm *VM) HaltContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, virtualmachine.OpHalt)(&err)
 	svc, err := getService(vm.Region)
 	if err != nil {
-		return fmt.Errorf("failed to get AWS service: %v", err)
+		return fmt.Errorf("failed to get AWS service: %w", err)
 	}
 
 	if vm.InstanceID == "" {
@@ -370,15 +533,15 @@ func (vm *VM) Halt() error {
 		return ErrNoInstanceID
 	}
 
-	_, err = svc.StopInstances(&ec2.StopInstancesInput{
+	req, _ := svc.StopInstancesRequest(&ec2.StopInstancesInput{
 		InstanceIds: []*string{
 			aws.String(vm.InstanceID),
 		},
 		DryRun: aws.Bool(false),
 		Force:  aws.Bool(true),
 	})
-	if err != nil {
-		return fmt.Errorf("Failed to stop instance: %v", err)
+	if err := send(ctx, req); err != nil {
+		return fmt.Errorf("Failed to stop instance: %w", err)
 	}
 
 	return nil
@@ -386,9 +549,15 @@ func (vm *VM) Halt() error {
 
 // Start boots a stopped VM.
 func (vm *VM) Start() error {
+	return vm.StartContext(context.Background())
+}
+
+// StartContext is like Start but the AWS call is bound to ctx.
+func (vm *VM) StartContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, virtualmachine.OpStart)(&err)
 	svc, err := getService(vm.Region)
 	if err != nil {
-		return fmt.Errorf("failed to get AWS service: %v", err)
+		return fmt.Errorf("failed to get AWS service: %w", err)
 	}
 
 	if vm.InstanceID == "" {
@@ -396,19 +565,25 @@ func (vm *VM) Start() error {
 		return ErrNoInstanceID
 	}
 
-	_, err = svc.StartInstances(&ec2.StartInstancesInput{
+	req, _ := svc.StartInstancesRequest(&ec2.StartInstancesInput{
 		InstanceIds: []*string{
 			aws.String(vm.InstanceID),
 		},
 		DryRun: aws.Bool(false),
 	})
-	if err != nil {
-		return fmt.Errorf("Failed to start instance: %v", err)
+	if err := send(ctx, req); err != nil {
+		return fmt.Errorf("Failed to start instance: %w", err)
 	}
 
 	return nil
 }
 
+// Capabilities reports that AWS VMs can be tagged and have extra EBS
+// volumes attached.
+func (vm *VM) Capabilities() virtualmachine.Capabilities {
+	return virtualmachine.Capabilities{Tags: true, Volumes: true}
+}
+
 // Suspend always returns an error because this isn't supported by AWS.
 func (vm *VM) Suspend() error {
 	return ErrNoSupportSuspend
@@ -419,6 +594,16 @@ func (vm *VM) Resume() error {
 	return ErrNoSupportResume
 }
 
+// SuspendContext always returns an error because this isn't supported by AWS.
+func (vm *VM) SuspendContext(ctx context.Context) error {
+	return ErrNoSupportSuspend
+}
+
+// ResumeContext always returns an error because this isn't supported by AWS.
+func (vm *VM) ResumeContext(ctx context.Context) error {
+	return ErrNoSupportResume
+}
+
 // SetKeyPair sets the given private key and AWS key name for this vm
 func (vm *VM) SetKeyPair(privateKey string, name string) {
 	vm.SSHCreds.SSHPrivateKey = privateKey
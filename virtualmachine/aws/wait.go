@@ -1,11 +1,15 @@
 package aws
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"math"
 	"time"
 
+	"github.com/apcera/libretto/util"
+	"github.com/apcera/libretto/virtualmachine"
+	lwait "github.com/apcera/libretto/virtualmachine/wait"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
@@ -24,16 +28,38 @@ type ReadyError struct {
 	StateTransitionReason string
 	SubnetID              string
 	VPCID                 string
+
+	// The spot request of a spot instance, and its status.
+	SpotRequestID     string
+	SpotState         string
+	SpotStatusCode    string
+	SpotStatusMessage string
 }
 
 // Error returns a summarized string version of ReadyError. More details about
 // the failed instance can be accessed through the struct.
 func (e ReadyError) Error() string {
-	return fmt.Sprintf(
+	if e.InstanceID == "" && e.SpotRequestID != "" {
+		return fmt.Sprintf(
+			"failed waiting for spot request (%s) to be fulfilled, status was: %s",
+			e.SpotRequestID,
+			e.SpotStatusCode,
+		)
+	}
+	msg := fmt.Sprintf(
 		"failed waiting for instance (%s) to be ready, reason was: %s",
 		e.InstanceID,
 		e.StateReason,
 	)
+	if e.SpotStatusCode != "" {
+		msg += fmt.Sprintf(", spot request (%s) status was: %s", e.SpotRequestID, e.SpotStatusCode)
+	}
+	return msg
+}
+
+// Unwrap returns the error that stopped the wait.
+func (e ReadyError) Unwrap() error {
+	return e.Err
 }
 
 func newReadyError(out *ec2.DescribeInstancesOutput) ReadyError {
@@ -84,49 +110,128 @@ func newReadyError(out *ec2.DescribeInstancesOutput) ReadyError {
 	return rerr
 }
 
-func waitUntilReady(svc *ec2.EC2, instanceID string) error {
-	// With 10 retries, total timeout is about 17 minutes.
-	const maxRetries = 10
+// setSpot fills in the spot request fields from status.
+func (e *ReadyError) setSpot(status SpotStatus) {
+	e.SpotRequestID = status.RequestID
+	e.SpotState = status.State
+	e.SpotStatusCode = status.Code
+	e.SpotStatusMessage = status.Message
+}
+
+// readyWaiter sleeps 2, 4, 8, 16... seconds between polls. With the second
+// slept before the first poll and 10 attempts, the total timeout is about 17
+// minutes.
+var readyWaiter = lwait.Waiter{
+	Backoff:     lwait.Exponential{Initial: 2 * time.Second, Multiplier: 2},
+	MaxAttempts: 10,
+}
+
+// errNotComingUp stops polling when the instance has entered a state from
+// which it will not become ready.
+var errNotComingUp = errors.New("instance is not coming up")
+
+// waitUntilFulfilled waits for the spot request requestID to launch an
+// instance and returns its ID. It gives up as soon as the status of the
+// request says it will not be fulfilled, such as for lack of capacity or a
+// maximum price below the spot price, even if the request stays open.
+func waitUntilFulfilled(ctx context.Context, svc *ec2.EC2, requestID string) (string, error) {
+	status := SpotStatus{RequestID: requestID}
+	var err error
+
+	// Give EC2 a second to evaluate the request before the first poll.
+	if err := util.Sleep(ctx, time.Second); err != nil {
+		return "", err
+	}
 
+	werr := readyWaiter.Until(ctx, func(ctx context.Context) (bool, error) {
+		var s SpotStatus
+		if s, err = describeSpotRequest(ctx, svc, requestID); err != nil {
+			return false, nil
+		}
+		status = s
+		if status.InstanceID != "" {
+			return true, nil
+		}
+		if status.failed() {
+			return false, errNotComingUp
+		}
+		return false, nil
+	})
+	if werr == nil {
+		return status.InstanceID, nil
+	}
+	if werr != errNotComingUp && werr != lwait.ErrTimeout {
+		// ctx is done.
+		return "", werr
+	}
+
+	var rerr ReadyError
+	rerr.setSpot(status)
+
+	switch {
+	case werr == errNotComingUp:
+		rerr.Err = status.err()
+	case err != nil:
+		rerr.Err = err
+	default:
+		rerr.Err = virtualmachine.NewError(virtualmachine.Timeout, errors.New("wait until spot request fulfilled timeout"))
+	}
+
+	return "", rerr
+}
+
+// waitUntilReady waits for the instance to be running. If it is a spot
+// instance, spotRequestID is its request, whose status is added to the
+// ReadyError.
+func waitUntilReady(ctx context.Context, svc *ec2.EC2, instanceID, spotRequestID string) error {
 	var resp *ec2.DescribeInstancesOutput
 	var err error
 
-	for i := 0; i < maxRetries; i++ {
-		// Sleep will be 1, 2, 4, 8, 16...
-		// time.Sleep(2ⁱ * time.Second)
-		time.Sleep(time.Duration(math.Exp2(float64(i))) * time.Second)
+	// Give the instance a second before the first poll.
+	if err := util.Sleep(ctx, time.Second); err != nil {
+		return err
+	}
 
-		resp, err = svc.DescribeInstances(&ec2.DescribeInstancesInput{
+	werr := readyWaiter.Until(ctx, func(ctx context.Context) (bool, error) {
+		var req *request.Request
+		req, resp = svc.DescribeInstancesRequest(&ec2.DescribeInstancesInput{
 			InstanceIds: []*string{&instanceID},
 		})
-		if err != nil {
-			continue
+		if err = send(ctx, req); err != nil {
+			return false, nil
 		}
 
 		if len(resp.Reservations) < 1 {
-			continue
+			return false, nil
 		}
 		if len(resp.Reservations[0].Instances) < 1 {
-			continue
+			return false, nil
 		}
 		if resp.Reservations[0].Instances[0].State == nil {
-			continue
+			return false, nil
 		}
 		if resp.Reservations[0].Instances[0].State.Name == nil {
-			continue
+			return false, nil
 		}
 
 		state := *resp.Reservations[0].Instances[0].State.Name
 		switch state {
 		case ec2.InstanceStateNameRunning:
 			// We're ready!
-			return nil
+			return true, nil
 		case ec2.InstanceStateNameTerminated, ec2.InstanceStateNameStopped,
 			ec2.InstanceStateNameStopping, ec2.InstanceStateNameShuttingDown:
-			// Polling is useless. This instance isn't coming up. Break the
-			// loop.
-			i = maxRetries
+			// Polling is useless. This instance isn't coming up.
+			return false, errNotComingUp
 		}
+		return false, nil
+	})
+	if werr == nil {
+		return nil
+	}
+	if werr != errNotComingUp && werr != lwait.ErrTimeout {
+		// ctx is done.
+		return werr
 	}
 
 	rerr := newReadyError(resp)
@@ -134,7 +239,17 @@ func waitUntilReady(svc *ec2.EC2, instanceID string) error {
 	if err != nil {
 		rerr.Err = err
 	} else {
-		rerr.Err = errors.New("wait until instance ready timeout")
+		rerr.Err = virtualmachine.NewError(virtualmachine.Timeout, errors.New("wait until instance ready timeout"))
+	}
+
+	if spotRequestID != "" {
+		// The request tells why EC2 took a spot instance back.
+		if status, err := describeSpotRequest(ctx, svc, spotRequestID); err == nil {
+			rerr.setSpot(status)
+			if _, ok := spotFailures[status.Code]; ok && werr == errNotComingUp {
+				rerr.Err = status.err()
+			}
+		}
 	}
 
 	return rerr
@@ -0,0 +1,64 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package arm
+
+import (
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+var _ lvm.Handler = (*VM)(nil)
+
+// handle holds what is needed to manage a VM from another process.
+type handle struct {
+	Name             string `json:"name"`
+	ResourceGroup    string `json:"resource_group"`
+	StorageAccount   string `json:"storage_account"`
+	StorageContainer string `json:"storage_container"`
+	OsFile           string `json:"os_file"`
+	DiskFile         string `json:"disk_file,omitempty"`
+	Nic              string `json:"nic"`
+	PublicIP         string `json:"public_ip"`
+	DeploymentName   string `json:"deployment_name"`
+}
+
+// MarshalHandle serializes the names of the VM and of the resources deployed
+// with it, so that Destroy can delete them. The OAuth credentials are not
+// included.
+func (vm *VM) MarshalHandle() ([]byte, error) {
+	if vm.Name == "" || vm.DeploymentName == "" {
+		return nil, lvm.ErrHandleIncomplete
+	}
+	return lvm.EncodeHandle(providerName, handle{
+		Name:             vm.Name,
+		ResourceGroup:    vm.ResourceGroup,
+		StorageAccount:   vm.StorageAccount,
+		StorageContainer: vm.StorageContainer,
+		OsFile:           vm.OsFile,
+		DiskFile:         vm.DiskFile,
+		Nic:              vm.Nic,
+		PublicIP:         vm.PublicIP,
+		DeploymentName:   vm.DeploymentName,
+	})
+}
+
+// UnmarshalHandle restores a handle written by MarshalHandle into the VM.
+func (vm *VM) UnmarshalHandle(data []byte) error {
+	var h handle
+	if err := lvm.DecodeHandle(providerName, data, &h); err != nil {
+		return err
+	}
+	if h.Name == "" || h.DeploymentName == "" {
+		return lvm.ErrHandleIncomplete
+	}
+
+	vm.Name = h.Name
+	vm.ResourceGroup = h.ResourceGroup
+	vm.StorageAccount = h.StorageAccount
+	vm.StorageContainer = h.StorageContainer
+	vm.OsFile = h.OsFile
+	vm.DiskFile = h.DiskFile
+	vm.Nic = h.Nic
+	vm.PublicIP = h.PublicIP
+	vm.DeploymentName = h.DeploymentName
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package arm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apcera/libretto/ssh"
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+// providerName is the name the provider is registered under.
+const providerName = "azure-arm"
+
+func init() {
+	lvm.Register(providerName, FromSpec)
+}
+
+// Provider returns the name the provider is registered under.
+func (vm *VM) Provider() string {
+	return providerName
+}
+
+// FromSpec builds an Azure VM from a provider-neutral spec. Image is
+// "publisher:offer:sku" and Size the VM size. The first disk sets the size of
+// the additional data disk and the first network gives the virtual network
+// (Name) and subnet. The following options are read:
+//
+//	client_id               OAuth client ID
+//	client_secret           OAuth client secret
+//	tenant_id               OAuth tenant ID
+//	subscription_id         subscription ID
+//	resource_group          resource group to deploy to
+//	storage_account         storage account for the disks
+//	storage_container       storage container for the disks
+//	network_security_group  network security group of the VM
+func FromSpec(spec *lvm.Spec) (lvm.VirtualMachine, error) {
+	vm := &VM{
+		Creds: OAuthCredentials{
+			ClientID:       spec.Option("client_id"),
+			ClientSecret:   spec.Option("client_secret"),
+			TenantID:       spec.Option("tenant_id"),
+			SubscriptionID: spec.Option("subscription_id"),
+		},
+		Size: spec.Size,
+		Name: spec.Name,
+		SSHCreds: ssh.Credentials{
+			SSHUser:       spec.SSH.User,
+			SSHPassword:   spec.SSH.Password,
+			SSHPrivateKey: spec.SSH.PrivateKey,
+		},
+		SSHPublicKey:         spec.SSH.PublicKey,
+		ResourceGroup:        spec.Option("resource_group"),
+		StorageAccount:       spec.Option("storage_account"),
+		StorageContainer:     spec.Option("storage_container"),
+		NetworkSecurityGroup: spec.Option("network_security_group"),
+		KeepOnFailure:        spec.KeepOnFailure,
+	}
+
+	if spec.Image != "" {
+		parts := strings.Split(spec.Image, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("image must be publisher:offer:sku, got %q", spec.Image)
+		}
+		vm.ImagePublisher, vm.ImageOffer, vm.ImageSku = parts[0], parts[1], parts[2]
+	}
+	if len(spec.Disks) > 0 {
+		vm.DiskSize = spec.Disks[0].SizeGB
+	}
+	if len(spec.Networks) > 0 {
+		vm.VirtualNetwork = spec.Networks[0].Name
+		vm.Subnet = spec.Networks[0].Subnet
+	}
+	return vm, nil
+}
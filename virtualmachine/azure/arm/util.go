@@ -3,19 +3,25 @@
 package arm
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	armStorage "github.com/Azure/azure-sdk-for-go/arm/storage"
 	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/wait"
 
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
 	"github.com/Azure/azure-sdk-for-go/arm/network"
 	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
 	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure"
 )
 
@@ -144,8 +150,9 @@ func validateVM(vm *VM) error {
 }
 
 // deploy deploys the given VM based on the default Linux arm template over the
-// VM's resource group.
-func (vm *VM) deploy() error {
+// VM's resource group. It stops waiting for the deployment when ctx is done.
+// The resources the deployment creates are added to rb.
+func (vm *VM) deploy(ctx context.Context, rb *lvm.Rollback) error {
 	// Set up the authorizer
 	authorizer, err := getServicePrincipalToken(&vm.Creds, azure.PublicCloud.ResourceManagerEndpoint)
 	if err != nil {
@@ -163,27 +170,187 @@ func (vm *VM) deploy() error {
 	deploymentsClient := resources.NewDeploymentsClient(vm.Creds.SubscriptionID)
 	deploymentsClient.Authorizer = authorizer
 
-	_, err = deploymentsClient.CreateOrUpdate(vm.ResourceGroup, vm.DeploymentName, *deployment, nil)
+	// CreateOrUpdate updates the resources of the template that already
+	// exist, so a failed deployment only removes the ones it may have
+	// created, ignoring those it did not get to.
+	existing, err := vm.existingResources(authorizer)
 	if err != nil {
 		return err
 	}
 
+	_, err = deploymentsClient.CreateOrUpdate(vm.ResourceGroup, vm.DeploymentName, *deployment, ctx.Done())
+	// The resources are recorded once the deployment call returns, failed or
+	// not, since a failed deployment may have created some of them.
+	vm.addRollbackSteps(rb, authorizer, existing)
+	if err != nil {
+		return contextErr(ctx, err)
+	}
+
 	// Make sure the deployment is succeeded
-	for i := 0; i < actionTimeout; i++ {
+	return waitErr(actionWaiter.Until(ctx, func(ctx context.Context) (bool, error) {
 		result, err := deploymentsClient.Get(vm.ResourceGroup, vm.DeploymentName)
 		if err != nil {
-			return err
+			return false, err
 		}
 		if result.Properties != nil && result.Properties.ProvisioningState != nil {
 			if *result.Properties.ProvisioningState == succeeded {
-				return nil
+				return true, nil
+			}
+		}
+		return false, nil
+	}))
+}
+
+// existingResources records which of the resources of the template existed
+// before the deployment.
+type existingResources struct {
+	deployment bool
+	publicIP   bool
+	nic        bool
+	osFile     bool
+	diskFile   bool
+	vm         bool
+}
+
+// existingResources checks which of the resources of the template already
+// exist in the VM's resource group and storage container.
+func (vm *VM) existingResources(authorizer *azure.ServicePrincipalToken) (existingResources, error) {
+	var e existingResources
+
+	deploymentsClient := resources.NewDeploymentsClient(vm.Creds.SubscriptionID)
+	deploymentsClient.Authorizer = authorizer
+	_, err := deploymentsClient.Get(vm.ResourceGroup, vm.DeploymentName)
+	if e.deployment, err = found(err); err != nil {
+		return e, err
+	}
+
+	publicIPAddressesClient := network.NewPublicIPAddressesClient(vm.Creds.SubscriptionID)
+	publicIPAddressesClient.Authorizer = authorizer
+	_, err = publicIPAddressesClient.Get(vm.ResourceGroup, vm.PublicIP, "")
+	if e.publicIP, err = found(err); err != nil {
+		return e, err
+	}
+
+	interfaceClient := network.NewInterfacesClient(vm.Creds.SubscriptionID)
+	interfaceClient.Authorizer = authorizer
+	_, err = interfaceClient.Get(vm.ResourceGroup, vm.Nic, "")
+	if e.nic, err = found(err); err != nil {
+		return e, err
+	}
+
+	virtualMachinesClient := compute.NewVirtualMachinesClient(vm.Creds.SubscriptionID)
+	virtualMachinesClient.Authorizer = authorizer
+	_, err = virtualMachinesClient.Get(vm.ResourceGroup, vm.Name, "")
+	if e.vm, err = found(err); err != nil {
+		return e, err
+	}
+
+	blobs, err := vm.blobService(authorizer)
+	if err != nil {
+		return e, err
+	}
+	if e.osFile, err = blobs.BlobExists(vm.StorageContainer, vm.OsFile); err != nil {
+		return e, err
+	}
+	if vm.DiskSize > 0 {
+		if e.diskFile, err = blobs.BlobExists(vm.StorageContainer, vm.DiskFile); err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+// found reports whether the Get call that returned err found its resource.
+func found(err error) (bool, error) {
+	if err == nil {
+		return true, nil
+	}
+	if ignoreNotFound(err) == nil {
+		return false, nil
+	}
+	return false, err
+}
+
+// addRollbackSteps adds the removal of the resources the deployment may
+// create, that is those not in existing, to rb, so that the VM is deleted
+// first and the deployment last.
+func (vm *VM) addRollbackSteps(rb *lvm.Rollback, authorizer *azure.ServicePrincipalToken, existing existingResources) {
+	if !existing.deployment {
+		rb.Add("deployment "+vm.DeploymentName, func(ctx context.Context) error {
+			return ignoreNotFound(vm.deleteDeployment(authorizer))
+		})
+	}
+	if !existing.publicIP {
+		rb.Add("public IP "+vm.PublicIP, func(ctx context.Context) error {
+			return ignoreNotFound(vm.deletePublicIP(authorizer))
+		})
+	}
+	if !existing.nic {
+		rb.Add("network interface "+vm.Nic, func(ctx context.Context) error {
+			return ignoreNotFound(vm.deleteNic(authorizer))
+		})
+	}
+
+	var vhds []string
+	if !existing.osFile {
+		vhds = append(vhds, vm.OsFile)
+	}
+	if vm.DiskSize > 0 && !existing.diskFile {
+		vhds = append(vhds, vm.DiskFile)
+	}
+	if len(vhds) > 0 {
+		rb.Add("VHDs "+strings.Join(vhds, ", "), func(ctx context.Context) error {
+			blobs, err := vm.blobService(authorizer)
+			if err != nil {
+				return err
+			}
+			for _, name := range vhds {
+				if _, err := blobs.DeleteBlobIfExists(vm.StorageContainer, name, nil); err != nil {
+					return err
+				}
 			}
+			return nil
+		})
+	}
+
+	if existing.vm {
+		return
+	}
+	rb.Add("VM "+vm.Name, func(ctx context.Context) error {
+		virtualMachinesClient := compute.NewVirtualMachinesClient(vm.Creds.SubscriptionID)
+		virtualMachinesClient.Authorizer = authorizer
+
+		_, err := virtualMachinesClient.Delete(vm.ResourceGroup, vm.Name, ctx.Done())
+		if err != nil {
+			return ignoreNotFound(contextErr(ctx, err))
 		}
+		// The NIC and VHDs stay in use until the VM is gone.
+		_, err = actionWaiter.ForState(ctx, vm, lvm.VMNotFound)
+		return waitErr(err)
+	})
+}
 
-		time.Sleep(1 * time.Second)
+// ignoreNotFound returns nil if err is Azure reporting that a resource does
+// not exist.
+func ignoreNotFound(err error) error {
+	if err != nil && lvm.KindOf(classify(err)) == lvm.NotFound {
+		return nil
 	}
+	return err
+}
 
-	return ErrActionTimeout
+// actionWaiter polls once a second for up to actionTimeout seconds.
+var actionWaiter = wait.Waiter{
+	Backoff: wait.Constant(time.Second),
+	Timeout: actionTimeout * time.Second,
+}
+
+// waitErr translates the errors of package wait to this package's errors.
+func waitErr(err error) error {
+	if err == wait.ErrTimeout {
+		return ErrActionTimeout
+	}
+	return err
 }
 
 // getPublicIP returns the public IP of the given VM, if exists one.
@@ -227,20 +394,11 @@ func (vm *VM) getPrivateIP(authorizer *azure.ServicePrincipalToken) (net.IP, err
 // deleteOSFile deletes the OS file from the VM's storage account, returns an error if the operation
 // does not succeed.
 func (vm *VM) deleteVMFiles(authorizer *azure.ServicePrincipalToken) error {
-	storageAccountsClient := armStorage.NewAccountsClient(vm.Creds.SubscriptionID)
-	storageAccountsClient.Authorizer = authorizer
-
-	accountKeys, err := storageAccountsClient.ListKeys(vm.ResourceGroup, vm.StorageAccount)
-	if err != nil {
-		return err
-	}
-
-	storageClient, err := storage.NewBasicClient(vm.StorageAccount, *accountKeys.Key1)
+	blobStorageClient, err := vm.blobService(authorizer)
 	if err != nil {
 		return err
 	}
 
-	blobStorageClient := storageClient.GetBlobService()
 	err = blobStorageClient.DeleteBlob(vm.StorageContainer, vm.OsFile, nil)
 	if err != nil {
 		return err
@@ -252,6 +410,23 @@ func (vm *VM) deleteVMFiles(authorizer *azure.ServicePrincipalToken) error {
 	return blobStorageClient.DeleteBlob(vm.StorageContainer, vm.DiskFile, nil)
 }
 
+// blobService returns a client for the blobs of the VM's storage account.
+func (vm *VM) blobService(authorizer *azure.ServicePrincipalToken) (storage.BlobStorageClient, error) {
+	storageAccountsClient := armStorage.NewAccountsClient(vm.Creds.SubscriptionID)
+	storageAccountsClient.Authorizer = authorizer
+
+	accountKeys, err := storageAccountsClient.ListKeys(vm.ResourceGroup, vm.StorageAccount)
+	if err != nil {
+		return storage.BlobStorageClient{}, err
+	}
+
+	storageClient, err := storage.NewBasicClient(vm.StorageAccount, *accountKeys.Key1)
+	if err != nil {
+		return storage.BlobStorageClient{}, err
+	}
+	return storageClient.GetBlobService(), nil
+}
+
 // deleteNic deletes the network interface for the given VM from the VM's resource group, returns an error
 // if the operation does not succeed.
 func (vm *VM) deleteNic(authorizer *azure.ServicePrincipalToken) error {
@@ -330,18 +505,57 @@ func unmarshalParameters(params armParameters) (*map[string]interface{}, error)
 	return &t, nil
 }
 
+// contextErr returns ctx.Err() in place of err if ctx is done. The Azure SDK
+// reports an abandoned long-running operation with an error of its own.
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
 // translateState converts an Azure state to a libretto state.
 func translateState(azureState string) string {
 	switch azureState {
+	case starting:
+		return lvm.VMStarting
 	case running:
 		return lvm.VMRunning
-	case stopped:
+	case stopping, deallocating:
+		return lvm.VMPending
+	case stopped, deallocated:
 		return lvm.VMHalted
 	default:
 		return lvm.VMUnknown
 	}
 }
 
+// isNotFound returns true if err is Azure reporting that a resource does not
+// exist.
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), `Code="ResourceNotFound"`) ||
+		strings.Contains(err.Error(), `Code="NotFound"`)
+}
+
+// classify gives err the lvm.Kind that matches the HTTP status of the Azure
+// error in its chain, if any.
+func classify(err error) error {
+	var derr autorest.DetailedError
+	if errors.As(err, &derr) && derr.StatusCode != 0 {
+		return lvm.NewError(lvm.KindForStatus(derr.StatusCode), err)
+	}
+	if err != nil && isNotFound(err) {
+		return lvm.NewError(lvm.NotFound, err)
+	}
+	return err
+}
+
+// classifyErr replaces *err with classify(*err). It is deferred by the
+// exported methods of VM.
+func classifyErr(err *error) {
+	*err = classify(*err)
+}
+
 func randStringRunes(n int) string {
 	var letterRunes = []rune("abcdefghijklmnopqrstuvwxyz")
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
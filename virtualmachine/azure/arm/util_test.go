@@ -0,0 +1,46 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package arm
+
+import (
+	"errors"
+	"testing"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+func TestTranslateState(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"VM starting", lvm.VMStarting},
+		{"VM running", lvm.VMRunning},
+		{"VM stopping", lvm.VMPending},
+		{"VM deallocating", lvm.VMPending},
+		{"VM stopped", lvm.VMHalted},
+		{"VM deallocated", lvm.VMHalted},
+		{"Provisioning succeeded", lvm.VMUnknown},
+		{"", lvm.VMUnknown},
+	}
+	for _, tt := range tests {
+		if got := translateState(tt.raw); got != tt.want {
+			t.Errorf("translateState(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New(`compute.VirtualMachinesClient#Get: Failure responding to request: StatusCode=404 -- Original Error: Code="ResourceNotFound" Message="The Resource 'Microsoft.Compute/virtualMachines/vm' was not found."`), true},
+		{errors.New(`StatusCode=404 -- Original Error: Code="NotFound" Message="Not found"`), true},
+		{errors.New(`StatusCode=403 -- Original Error: Code="AuthorizationFailed"`), false},
+	}
+	for _, tt := range tests {
+		if got := isNotFound(tt.err); got != tt.want {
+			t.Errorf("isNotFound(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
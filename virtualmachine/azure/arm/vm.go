@@ -4,12 +4,13 @@
 package arm
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
-	"strings"
 	"time"
 
+	"github.com/apcera/libretto/remote"
 	"github.com/apcera/libretto/ssh"
 	"github.com/apcera/libretto/util"
 	lvm "github.com/apcera/libretto/virtualmachine"
@@ -20,7 +21,7 @@ import (
 
 var (
 	// ErrActionTimeout is returned when the Azure instance takes too long to enter waited state.
-	ErrActionTimeout = errors.New("Azure action timeout")
+	ErrActionTimeout = lvm.NewError(lvm.Timeout, errors.New("Azure action timeout"))
 )
 
 const (
@@ -37,9 +38,23 @@ const (
 	// running is the status returned when the VM is running
 	running = "VM running"
 
+	// starting is the status returned when the VM is starting
+	starting = "VM starting"
+
+	// stopping is the status returned when the VM is stopping
+	stopping = "VM stopping"
+
 	// stopped is the status returned when the VM is halted
 	stopped = "VM stopped"
 
+	// deallocating is the status returned when the VM is releasing its
+	// compute resources
+	deallocating = "VM deallocating"
+
+	// deallocated is the status returned when the VM is halted and its
+	// compute resources are released
+	deallocated = "VM deallocated"
+
 	// succeeded is the status returned when a deployment ends successfully
 	succeeded = "Succeeded"
 )
@@ -48,7 +63,10 @@ const (
 // thread-safe.
 var SSHTimeout = 180 * time.Second
 
-var _ lvm.VirtualMachine = (*VM)(nil)
+var _ lvm.VirtualMachineContext = (*VM)(nil)
+
+var _ lvm.StateDetailer = (*VM)(nil)
+var _ lvm.Capabler = (*VM)(nil)
 
 // OAuthCredentials is the struct that stors OAUTH credentials
 type OAuthCredentials struct {
@@ -97,6 +115,14 @@ type VM struct {
 
 	// deployment
 	DeploymentName string
+
+	// KeepOnFailure keeps the VM, NIC, public IP and VHDs if Provision fails,
+	// so that they can be inspected.
+	KeepOnFailure bool
+
+	// Observer receives the events of this VM, in addition to the observers
+	// registered with lvm.AddObserver. It may be nil.
+	Observer lvm.Observer
 }
 
 // GetName returns the name of the VM.
@@ -104,11 +130,27 @@ func (vm *VM) GetName() string {
 	return vm.Name
 }
 
+// events returns the Events of the VM, sent to its Observer and the global
+// observers.
+func (vm *VM) events() lvm.Events {
+	return lvm.Events{Provider: providerName, Name: vm.Name, VM: vm, Observer: vm.Observer}
+}
+
 // Provision creates a new VM instance on Azure. It returns an error if there
-// was a problem during creation.
+// was a problem during creation, in which case the VM and the NIC, public IP
+// and VHDs created for it are removed unless KeepOnFailure is set. Those that
+// already existed, which the deployment only updates, are left in place.
 func (vm *VM) Provision() error {
+	return vm.ProvisionContext(context.Background())
+}
+
+// ProvisionContext is like Provision but stops waiting for the deployment and
+// for SSH when ctx is done.
+func (vm *VM) ProvisionContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpProvision)(&err)
+	defer classifyErr(&err)
 	// Validate VM
-	err := validateVM(vm)
+	err = validateVM(vm)
 	if err != nil {
 		return err
 	}
@@ -131,21 +173,41 @@ func (vm *VM) Provision() error {
 		vm.DeploymentName = tempName + "-deploy"
 	}
 
+	rb := lvm.NewRollback(vm.KeepOnFailure)
+	rb.Events = vm.events()
+	defer rb.Finish(&err)
+
 	// Create and send the deployment
-	vm.deploy()
+	if err := vm.deploy(ctx, rb); err != nil {
+		return err
+	}
 
 	// Use GetSSH to try to connect to machine
-	cli, err := vm.GetSSH(ssh.Options{KeepAlive: 2})
+	cli, err := vm.GetSSHContext(ctx, ssh.Options{KeepAlive: 2})
 	if err != nil {
 		return err
 	}
 
-	return cli.WaitForSSH(SSHTimeout)
+	if err := cli.WaitForSSHContext(ctx, SSHTimeout); err != nil {
+		return err
+	}
+	cli.Disconnect()
+	return nil
 }
 
 // GetIPs returns the IP addresses of the Azure VM instance.
 func (vm *VM) GetIPs() ([]net.IP, error) {
-	ips := make([]net.IP, 2)
+	return vm.GetIPsContext(context.Background())
+}
+
+// GetIPsContext is like GetIPs but returns ctx.Err() once ctx is done.
+func (vm *VM) GetIPsContext(ctx context.Context) (ips []net.IP, err error) {
+	defer classifyErr(&err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ips = make([]net.IP, 2)
 
 	// Set up the authorizer
 	authorizer, err := getServicePrincipalToken(&vm.Creds, azure.PublicCloud.ResourceManagerEndpoint)
@@ -173,29 +235,67 @@ func (vm *VM) GetIPs() ([]net.IP, error) {
 // GetSSH returns an SSH client that can be used to connect to the VM. An error
 // is returned if the VM has no IPs.
 func (vm *VM) GetSSH(options ssh.Options) (ssh.Client, error) {
-	ips, err := util.GetVMIPs(vm, options)
+	return vm.GetSSHContext(context.Background(), options)
+}
+
+// GetSSHContext is like GetSSH but the IP lookup is bound to ctx.
+func (vm *VM) GetSSHContext(ctx context.Context, options ssh.Options) (ssh.Client, error) {
+	ips, err := util.GetVMIPsContext(ctx, vm, options)
 	if err != nil {
 		return nil, err
 	}
 
 	client := ssh.SSHClient{
 		Creds:   &vm.SSHCreds,
-		IP:      ips[PublicIP],
+		IP:      util.SSHIP(ips, options, PublicIP, PrivateIP),
 		Options: options,
 		Port:    22,
 	}
 	return &client, nil
 }
 
+// GetRemote returns a Remote for the VM: over SSH, as GetSSH does, or
+// over WinRM for Windows guests. WinRM logs in with the user and password
+// of SSHCreds unless options.WinRM sets them.
+func (vm *VM) GetRemote(options remote.Options) (remote.Remote, error) {
+	return lvm.NewRemote(vm, options, &vm.SSHCreds, func() (net.IP, error) {
+		ips, err := util.GetVMIPs(vm, options.SSH)
+		if err != nil {
+			return nil, err
+		}
+		return util.SSHIP(ips, options.SSH, PublicIP, PrivateIP), nil
+	})
+}
+
 // GetState returns the status of the Azure VM. The status will be one of the
 // following:
+//     "starting"
 //     "running"
-//     "stopped"
+//     "pending"
+//     "halted"
+//     "not_found"
 func (vm *VM) GetState() (string, error) {
+	return vm.GetStateContext(context.Background())
+}
+
+// GetStateContext is like GetState but returns ctx.Err() once ctx is done.
+func (vm *VM) GetStateContext(ctx context.Context) (string, error) {
+	d, err := vm.GetStateDetail(ctx)
+	return d.State, err
+}
+
+// GetStateDetail is like GetStateContext but also returns the power state
+// displayed by Azure, such as "VM deallocated".
+func (vm *VM) GetStateDetail(ctx context.Context) (d lvm.StateDetail, err error) {
+	defer classifyErr(&err)
+	if err := ctx.Err(); err != nil {
+		return lvm.StateDetail{}, err
+	}
+
 	// Set up the authorizer
 	authorizer, err := getServicePrincipalToken(&vm.Creds, azure.PublicCloud.ResourceManagerEndpoint)
 	if err != nil {
-		return "", err
+		return lvm.StateDetail{}, err
 	}
 
 	virtualMachinesClient := compute.NewVirtualMachinesClient(vm.Creds.SubscriptionID)
@@ -203,19 +303,30 @@ func (vm *VM) GetState() (string, error) {
 
 	r, e := virtualMachinesClient.Get(vm.ResourceGroup, vm.Name, "InstanceView")
 	if e != nil {
-		return "", e
+		if isNotFound(e) {
+			return lvm.StateDetail{State: lvm.VMNotFound}, nil
+		}
+		return lvm.StateDetail{}, e
 	}
 
 	if r.Properties != nil && r.Properties.InstanceView != nil && len(*r.Properties.InstanceView.Statuses) > 1 {
 		state := *(*r.Properties.InstanceView.Statuses)[1].DisplayStatus
-		return translateState(state), e
+		return lvm.StateDetail{State: translateState(state), Raw: state}, nil
 	}
 
-	return "", errors.New("failed to get VM status")
+	return lvm.StateDetail{}, errors.New("failed to get VM status")
 }
 
 // Destroy deletes the VM on Azure.
 func (vm *VM) Destroy() error {
+	return vm.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but abandons the delete operation and stops
+// polling when ctx is done.
+func (vm *VM) DestroyContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpDestroy)(&err)
+	defer classifyErr(&err)
 	// Set up the authorizer
 	authorizer, err := getServicePrincipalToken(&vm.Creds, azure.PublicCloud.ResourceManagerEndpoint)
 	if err != nil {
@@ -226,29 +337,14 @@ func (vm *VM) Destroy() error {
 	virtualMachinesClient := compute.NewVirtualMachinesClient(vm.Creds.SubscriptionID)
 	virtualMachinesClient.Authorizer = authorizer
 
-	_, err = virtualMachinesClient.Delete(vm.ResourceGroup, vm.Name, nil)
+	_, err = virtualMachinesClient.Delete(vm.ResourceGroup, vm.Name, ctx.Done())
 	if err != nil {
-		return err
+		return contextErr(ctx, err)
 	}
 
 	// Make sure VM is deleted
-	deleted := false
-	for i := 0; i < actionTimeout; i++ {
-		_, err := vm.GetState()
-		if err != nil {
-			if strings.Contains(err.Error(), `Code="ResourceNotFound"`) ||
-				strings.Contains(err.Error(), `Code="NotFound"`) {
-				deleted = true
-				break
-			}
-			return err
-		}
-
-		time.Sleep(1 * time.Second)
-	}
-
-	if !deleted {
-		return ErrActionTimeout
+	if _, err := actionWaiter.ForState(ctx, vm, lvm.VMNotFound); err != nil {
+		return waitErr(err)
 	}
 
 	var errors []error
@@ -294,6 +390,14 @@ func (vm *VM) Destroy() error {
 
 // Halt shuts down the VM.
 func (vm *VM) Halt() error {
+	return vm.HaltContext(context.Background())
+}
+
+// HaltContext is like Halt but abandons the power off operation and stops
+// polling when ctx is done.
+func (vm *VM) HaltContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpHalt)(&err)
+	defer classifyErr(&err)
 	// Set up the authorizer
 	authorizer, err := getServicePrincipalToken(&vm.Creds, azure.PublicCloud.ResourceManagerEndpoint)
 	if err != nil {
@@ -304,28 +408,26 @@ func (vm *VM) Halt() error {
 	virtualMachinesClient := compute.NewVirtualMachinesClient(vm.Creds.SubscriptionID)
 	virtualMachinesClient.Authorizer = authorizer
 
-	_, err = virtualMachinesClient.PowerOff(vm.ResourceGroup, vm.Name, nil)
+	_, err = virtualMachinesClient.PowerOff(vm.ResourceGroup, vm.Name, ctx.Done())
 	if err != nil {
-		return err
+		return contextErr(ctx, err)
 	}
 
 	// Make sure the VM is stopped
-	for i := 0; i < actionTimeout; i++ {
-		state, err := vm.GetState()
-		if err != nil {
-			return err
-		}
-		if state == lvm.VMHalted {
-			return nil
-		}
-
-		time.Sleep(1 * time.Second)
-	}
-	return ErrActionTimeout
+	_, err = actionWaiter.ForState(ctx, vm, lvm.VMHalted)
+	return waitErr(err)
 }
 
 // Start boots a stopped VM.
 func (vm *VM) Start() error {
+	return vm.StartContext(context.Background())
+}
+
+// StartContext is like Start but abandons the start operation and stops
+// polling when ctx is done.
+func (vm *VM) StartContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpStart)(&err)
+	defer classifyErr(&err)
 	// Set up the authorizer
 	authorizer, err := getServicePrincipalToken(&vm.Creds, azure.PublicCloud.ResourceManagerEndpoint)
 	if err != nil {
@@ -336,24 +438,20 @@ func (vm *VM) Start() error {
 	virtualMachinesClient := compute.NewVirtualMachinesClient(vm.Creds.SubscriptionID)
 	virtualMachinesClient.Authorizer = authorizer
 
-	_, err = virtualMachinesClient.Start(vm.ResourceGroup, vm.Name, nil)
+	_, err = virtualMachinesClient.Start(vm.ResourceGroup, vm.Name, ctx.Done())
 	if err != nil {
-		return err
+		return contextErr(ctx, err)
 	}
 
 	// Make sure the VM is running
-	for i := 0; i < actionTimeout; i++ {
-		state, err := vm.GetState()
-		if err != nil {
-			return err
-		}
-		if state == lvm.VMRunning {
-			return nil
-		}
+	_, err = actionWaiter.ForState(ctx, vm, lvm.VMRunning)
+	return waitErr(err)
+}
 
-		time.Sleep(1 * time.Second)
-	}
-	return ErrActionTimeout
+// Capabilities reports that Azure VMs support none of the optional
+// features.
+func (vm *VM) Capabilities() lvm.Capabilities {
+	return lvm.Capabilities{}
 }
 
 // Suspend returns an error because it is not supported on Azure.
@@ -365,3 +463,13 @@ func (vm *VM) Suspend() error {
 func (vm *VM) Resume() error {
 	return lvm.ErrResumeNotSupported
 }
+
+// SuspendContext returns an error because it is not supported on Azure.
+func (vm *VM) SuspendContext(ctx context.Context) error {
+	return lvm.ErrSuspendNotSupported
+}
+
+// ResumeContext returns an error because it is not supported on Azure.
+func (vm *VM) ResumeContext(ctx context.Context) error {
+	return lvm.ErrResumeNotSupported
+}
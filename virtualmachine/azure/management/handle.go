@@ -0,0 +1,48 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package management
+
+import (
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+var _ lvm.Handler = (*VM)(nil)
+
+// handle holds what is needed to manage a VM from another process.
+type handle struct {
+	Name               string `json:"name"`
+	ServiceName        string `json:"service_name"`
+	Location           string `json:"location,omitempty"`
+	VirtualNetworkName string `json:"virtual_network_name,omitempty"`
+}
+
+// MarshalHandle serializes the hosted service and name of the VM. The
+// publishsettings file, which holds the account credentials, is not included.
+func (vm *VM) MarshalHandle() ([]byte, error) {
+	if vm.Name == "" || vm.ServiceName == "" {
+		return nil, lvm.ErrHandleIncomplete
+	}
+	return lvm.EncodeHandle(providerName, handle{
+		Name:               vm.Name,
+		ServiceName:        vm.ServiceName,
+		Location:           vm.Location,
+		VirtualNetworkName: vm.DeployOptions.VirtualNetworkName,
+	})
+}
+
+// UnmarshalHandle restores a handle written by MarshalHandle into the VM.
+func (vm *VM) UnmarshalHandle(data []byte) error {
+	var h handle
+	if err := lvm.DecodeHandle(providerName, data, &h); err != nil {
+		return err
+	}
+	if h.Name == "" || h.ServiceName == "" {
+		return lvm.ErrHandleIncomplete
+	}
+
+	vm.Name = h.Name
+	vm.ServiceName = h.ServiceName
+	vm.Location = h.Location
+	vm.DeployOptions.VirtualNetworkName = h.VirtualNetworkName
+	return nil
+}
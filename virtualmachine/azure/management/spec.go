@@ -0,0 +1,64 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package management
+
+import (
+	"github.com/apcera/libretto/ssh"
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+// providerName is the name the provider is registered under.
+const providerName = "azure-management"
+
+func init() {
+	lvm.Register(providerName, FromSpec)
+}
+
+// Provider returns the name the provider is registered under.
+func (vm *VM) Provider() string {
+	return providerName
+}
+
+// FromSpec builds an Azure VM using the classic management API from a
+// provider-neutral spec. Image is the source VHD, Size the VM size and Region
+// the location. The first network names the virtual network. The following
+// options are read:
+//
+//	publish_settings   path to the publishsettings file of the account
+//	service_name       hosted service name
+//	label              hosted service label
+//	storage_account    storage account for the disks
+//	storage_container  storage container for the disks
+//	reserved_ip        name of a reserved IP to use
+//	configure_http     "true" to open an HTTP endpoint on the VM
+func FromSpec(spec *lvm.Spec) (lvm.VirtualMachine, error) {
+	vm := &VM{
+		PublishSettings:  spec.Option("publish_settings"),
+		ServiceName:      spec.Option("service_name"),
+		Label:            spec.Option("label"),
+		Name:             spec.Name,
+		Size:             spec.Size,
+		SourceImage:      spec.Image,
+		StorageAccount:   spec.Option("storage_account"),
+		StorageContainer: spec.Option("storage_container"),
+		Location:         spec.Region,
+		SSHCreds: ssh.Credentials{
+			SSHUser:       spec.SSH.User,
+			SSHPassword:   spec.SSH.Password,
+			SSHPrivateKey: spec.SSH.PrivateKey,
+		},
+		DeployOptions: DeploymentOptions{
+			ReservedIPName: spec.Option("reserved_ip"),
+		},
+		KeepOnFailure: spec.KeepOnFailure,
+	}
+
+	var err error
+	if vm.ConfigureHTTP, err = spec.BoolOption("configure_http"); err != nil {
+		return nil, err
+	}
+	if len(spec.Networks) > 0 {
+		vm.DeployOptions.VirtualNetworkName = spec.Networks[0].Name
+	}
+	return vm, nil
+}
@@ -3,7 +3,9 @@
 package management
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -40,6 +42,61 @@ func (vm *VM) getClient() (management.Client, error) {
 	return client, nil
 }
 
+// waitForOperation waits for the Azure operation to finish, abandoning it
+// when ctx is done.
+func waitForOperation(ctx context.Context, id management.OperationID) error {
+	cancel := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(cancel)
+		case <-done:
+		}
+	}()
+
+	return client.WaitForOperation(id, cancel)
+}
+
+// azureErrorKinds maps the codes of Azure errors to their kinds.
+var azureErrorKinds = map[string]lvm.Kind{
+	"ResourceNotFound":     lvm.NotFound,
+	"ConflictError":        lvm.AlreadyExists,
+	"AuthenticationFailed": lvm.AuthFailed,
+	"ForbiddenError":       lvm.AuthFailed,
+	"SubscriptionDisabled": lvm.AuthFailed,
+	"TooManyRequests":      lvm.Transient,
+	"InternalError":        lvm.Transient,
+	"ServiceUnavailable":   lvm.Transient,
+	"OperationTimedOut":    lvm.Timeout,
+}
+
+// classify gives err the lvm.Kind that matches the code of the Azure error
+// in its chain, if any.
+func classify(err error) error {
+	var aerr management.AzureError
+	if errors.As(err, &aerr) {
+		return lvm.NewError(azureErrorKinds[aerr.Code], err)
+	}
+	return err
+}
+
+// classifyErr replaces *err with classify(*err). It is deferred by the
+// exported methods of VM.
+func classifyErr(err *error) {
+	*err = classify(*err)
+}
+
+// contextErr returns ctx.Err() in place of err if ctx is done.
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
 // getVMClient returns a new Azure virtual machine client.
 func (vm *VM) getVMClient() (virtualmachine.VirtualMachineClient, error) {
 	c, err := vm.getClient()
@@ -163,7 +220,7 @@ func (vm *VM) getFirstSubnet() (string, error) {
 
 	nc, err := vc.GetVirtualNetworkConfiguration()
 	if err != nil {
-		return "", fmt.Errorf("Error to get VirtualNetwork Configuration : %s", err)
+		return "", fmt.Errorf("Error to get VirtualNetwork Configuration : %w", err)
 	}
 
 	for _, vns := range nc.Configuration.VirtualNetworkSites {
@@ -188,7 +245,7 @@ func (vm *VM) translateState(azureState string) string {
 		return lvm.VMRunning
 	case "Suspended":
 		return lvm.VMHalted
-	case "Deleting", "Suspending", "RunningTransitioning":
+	case "Deleting", "Suspending", "RunningTransitioning", "SuspendedTransitioning":
 		return lvm.VMPending
 	default:
 		return lvm.VMUnknown
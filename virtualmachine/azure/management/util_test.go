@@ -0,0 +1,32 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package management
+
+import (
+	"testing"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+func TestTranslateState(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"Starting", lvm.VMStarting},
+		{"Deploying", lvm.VMStarting},
+		{"Running", lvm.VMRunning},
+		{"Suspended", lvm.VMHalted},
+		{"Deleting", lvm.VMPending},
+		{"Suspending", lvm.VMPending},
+		{"RunningTransitioning", lvm.VMPending},
+		{"SuspendedTransitioning", lvm.VMPending},
+		{"Unavailable", lvm.VMUnknown},
+		{"", lvm.VMUnknown},
+	}
+	vm := &VM{}
+	for _, tt := range tests {
+		if got := vm.translateState(tt.raw); got != tt.want {
+			t.Errorf("translateState(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
@@ -4,10 +4,12 @@
 package management
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/management"
 	"github.com/Azure/azure-sdk-for-go/management/virtualmachine"
 	"github.com/Azure/azure-sdk-for-go/management/vmutils"
 	"github.com/apcera/libretto/util"
@@ -32,7 +34,10 @@ const (
 // thread-safe.
 var SSHTimeout = 800 * time.Second
 
-var _ lvm.VirtualMachine = (*VM)(nil)
+var _ lvm.VirtualMachineContext = (*VM)(nil)
+
+var _ lvm.StateDetailer = (*VM)(nil)
+var _ lvm.Capabler = (*VM)(nil)
 
 // VM represents an Azure virtual machine.
 type VM struct {
@@ -48,6 +53,8 @@ type VM struct {
 	SSHCreds         ssh.Credentials   // required
 	DeployOptions    DeploymentOptions // optional
 	ConfigureHTTP    bool              // Flag to configure HTTP endpoint for the VM
+	KeepOnFailure    bool              // Keep the deployment and hosted service if Provision fails
+	Observer         lvm.Observer      // Receives the events of this VM; may be nil
 	Cert             Certificated
 }
 
@@ -69,14 +76,33 @@ func (vm *VM) GetName() string {
 	return vm.Name
 }
 
+// events returns the Events of the VM, sent to its Observer and the global
+// observers.
+func (vm *VM) events() lvm.Events {
+	return lvm.Events{Provider: providerName, Name: vm.Name, VM: vm, Observer: vm.Observer}
+}
+
 // Provision creates a new VM instance on Azure. It returns an error if there
-// was a problem during creation.
+// was a problem during creation, in which case the deployment, and the hosted
+// service if it was created for the VM, are deleted unless KeepOnFailure is set.
 func (vm *VM) Provision() error {
+	return vm.ProvisionContext(context.Background())
+}
+
+// ProvisionContext is like Provision but stops waiting for the deployment and
+// for SSH when ctx is done.
+func (vm *VM) ProvisionContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpProvision)(&err)
+	defer classifyErr(&err)
 	services, err := vm.listHostedServices()
 	if err != nil {
 		return fmt.Errorf(errGetListService, err)
 	}
 
+	rb := lvm.NewRollback(vm.KeepOnFailure)
+	rb.Events = vm.events()
+	defer rb.Finish(&err)
+
 	// Always try to reuse the existing hosted service. Create a new one if it
 	// doesn't exist
 	if !vm.serviceExist(services) {
@@ -84,6 +110,9 @@ func (vm *VM) Provision() error {
 		if err != nil {
 			return err
 		}
+		rb.Add("hosted service "+vm.ServiceName, func(ctx context.Context) error {
+			return vm.deleteHostedService()
+		})
 	}
 
 	// Create the VM
@@ -132,22 +161,43 @@ func (vm *VM) Provision() error {
 	if err != nil {
 		return fmt.Errorf(errProvisionVM, err)
 	}
+	rb.Add("deployment "+vm.Name, func(ctx context.Context) error {
+		reqID, err := vmclient.DeleteDeployment(vm.ServiceName, vm.Name)
+		if err != nil {
+			return err
+		}
+		return waitForOperation(ctx, reqID)
+	})
 
-	if err := client.WaitForOperation(operationID, nil); err != nil {
-		return fmt.Errorf(errProvisionVM, err)
+	if err := waitForOperation(ctx, operationID); err != nil {
+		return contextErr(ctx, fmt.Errorf(errProvisionVM, err))
 	}
 
 	// Use GetSSH to pull the VM status now
-	cli, err := vm.GetSSH(ssh.Options{KeepAlive: 2})
+	cli, err := vm.GetSSHContext(ctx, ssh.Options{KeepAlive: 2})
 	if err != nil {
 		return err
 	}
 
-	return cli.WaitForSSH(SSHTimeout)
+	if err := cli.WaitForSSHContext(ctx, SSHTimeout); err != nil {
+		return err
+	}
+	cli.Disconnect()
+	return nil
 }
 
 // GetIPs returns the IP addresses of the Azure VM instance.
 func (vm *VM) GetIPs() ([]net.IP, error) {
+	return vm.GetIPsContext(context.Background())
+}
+
+// GetIPsContext is like GetIPs but returns ctx.Err() once ctx is done.
+func (vm *VM) GetIPsContext(ctx context.Context) (ips []net.IP, err error) {
+	defer classifyErr(&err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	vmclient, err := vm.getVMClient()
 	if err != nil {
 		return nil, err
@@ -158,7 +208,7 @@ func (vm *VM) GetIPs() ([]net.IP, error) {
 		return nil, err
 	}
 
-	ips := make([]net.IP, 2)
+	ips = make([]net.IP, 2)
 	if ip := resp.VirtualIPs[0].Address; ip != "" {
 		ips[PublicIP] = net.ParseIP(ip)
 	}
@@ -172,22 +222,28 @@ func (vm *VM) GetIPs() ([]net.IP, error) {
 // GetSSH returns an SSH client that can be used to connect to the VM. An error
 // is returned if the VM has no IPs.
 func (vm *VM) GetSSH(options ssh.Options) (ssh.Client, error) {
-	ips, err := util.GetVMIPs(vm, options)
+	return vm.GetSSHContext(context.Background(), options)
+}
+
+// GetSSHContext is like GetSSH but the IP lookup is bound to ctx.
+func (vm *VM) GetSSHContext(ctx context.Context, options ssh.Options) (ssh.Client, error) {
+	ips, err := util.GetVMIPsContext(ctx, vm, options)
 	if err != nil {
 		return nil, err
 	}
 
 	client := ssh.SSHClient{
 		Creds:   &vm.SSHCreds,
-		IP:      ips[PublicIP],
+		IP:      util.SSHIP(ips, options, PublicIP, PrivateIP),
 		Options: options,
 		Port:    22,
 	}
 	return &client, nil
 }
 
-// GetState returns the status of the Azure VM. The status will be one of the
-// following:
+// GetState returns the status of the Azure VM as one of the lvm.VM* states.
+// The deployment status reported by Azure is available from GetStateDetail and
+// will be one of the following:
 //     "Running"
 //     "Suspended"
 //     "RunningTransitioning"
@@ -197,21 +253,50 @@ func (vm *VM) GetSSH(options ssh.Options) (ssh.Client, error) {
 //     "Deploying"
 //     "Deleting"
 func (vm *VM) GetState() (string, error) {
+	return vm.GetStateContext(context.Background())
+}
+
+// GetStateContext is like GetState but returns ctx.Err() once ctx is done.
+func (vm *VM) GetStateContext(ctx context.Context) (string, error) {
+	d, err := vm.GetStateDetail(ctx)
+	return d.State, err
+}
+
+// GetStateDetail is like GetStateContext but also returns the deployment
+// status reported by Azure.
+func (vm *VM) GetStateDetail(ctx context.Context) (d lvm.StateDetail, err error) {
+	defer classifyErr(&err)
+	if err := ctx.Err(); err != nil {
+		return lvm.StateDetail{}, err
+	}
+
 	vmclient, err := vm.getVMClient()
 	if err != nil {
-		return "", fmt.Errorf(errGetClient, err)
+		return lvm.StateDetail{}, fmt.Errorf(errGetClient, err)
 	}
 
 	resp, err := vmclient.GetDeployment(vm.ServiceName, vm.Name)
 	if err != nil {
-		return "", lvm.ErrVMInfoFailed
+		if management.IsResourceNotFoundError(err) {
+			return lvm.StateDetail{State: lvm.VMNotFound}, nil
+		}
+		return lvm.StateDetail{}, lvm.ErrVMInfoFailed
 	}
 
-	return vm.translateState(string(resp.Status)), nil
+	raw := string(resp.Status)
+	return lvm.StateDetail{State: vm.translateState(raw), Raw: raw}, nil
 }
 
 // Destroy deletes the VM on Azure.
 func (vm *VM) Destroy() error {
+	return vm.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but stops waiting for the deletion when ctx
+// is done.
+func (vm *VM) DestroyContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpDestroy)(&err)
+	defer classifyErr(&err)
 	vmclient, err := vm.getVMClient()
 	if err != nil {
 		return fmt.Errorf(errGetClient, err)
@@ -223,9 +308,9 @@ func (vm *VM) Destroy() error {
 	}
 
 	// and wait for the deletion:
-	if err := client.WaitForOperation(reqID, nil); err != nil {
-		return fmt.Errorf("Error waiting for instance %s to be deleted off the hosted service %s: %s",
-			vm.Name, vm.Name, err)
+	if err := waitForOperation(ctx, reqID); err != nil {
+		return contextErr(ctx, fmt.Errorf("Error waiting for instance %s to be deleted off the hosted service %s: %s",
+			vm.Name, vm.Name, err))
 	}
 
 	return vm.deleteHostedService()
@@ -233,6 +318,14 @@ func (vm *VM) Destroy() error {
 
 // Halt shuts down the VM.
 func (vm *VM) Halt() error {
+	return vm.HaltContext(context.Background())
+}
+
+// HaltContext is like Halt but stops waiting for the shutdown when ctx is
+// done.
+func (vm *VM) HaltContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpHalt)(&err)
+	defer classifyErr(&err)
 	vmclient, err := vm.getVMClient()
 	if err != nil {
 		return fmt.Errorf(errGetClient, err)
@@ -245,15 +338,23 @@ func (vm *VM) Halt() error {
 	}
 
 	// Wait for the shutdown
-	if err := client.WaitForOperation(reqID, nil); err != nil {
-		return fmt.Errorf("Error waiting for instance %s to be shutting down the hosted service %s: %s",
-			vm.Name, vm.Name, err)
+	if err := waitForOperation(ctx, reqID); err != nil {
+		return contextErr(ctx, fmt.Errorf("Error waiting for instance %s to be shutting down the hosted service %s: %s",
+			vm.Name, vm.Name, err))
 	}
 	return nil
 }
 
 // Start boots a stopped VM.
 func (vm *VM) Start() error {
+	return vm.StartContext(context.Background())
+}
+
+// StartContext is like Start but stops waiting for the VM to start when ctx
+// is done.
+func (vm *VM) StartContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpStart)(&err)
+	defer classifyErr(&err)
 	vmclient, err := vm.getVMClient()
 	if err != nil {
 		return fmt.Errorf(errGetClient, err)
@@ -265,13 +366,19 @@ func (vm *VM) Start() error {
 	}
 
 	// Wait for the shutdown
-	if err := client.WaitForOperation(reqID, nil); err != nil {
-		return fmt.Errorf("Error waiting for instance %s to be starting the hosted service %s: %s",
-			vm.Name, vm.Name, err)
+	if err := waitForOperation(ctx, reqID); err != nil {
+		return contextErr(ctx, fmt.Errorf("Error waiting for instance %s to be starting the hosted service %s: %s",
+			vm.Name, vm.Name, err))
 	}
 	return nil
 }
 
+// Capabilities reports that Azure VMs support none of the optional
+// features.
+func (vm *VM) Capabilities() lvm.Capabilities {
+	return lvm.Capabilities{}
+}
+
 // Suspend returns an error because it is not supported on Azure.
 func (vm *VM) Suspend() error {
 	return lvm.ErrSuspendNotSupported
@@ -281,3 +388,13 @@ func (vm *VM) Suspend() error {
 func (vm *VM) Resume() error {
 	return lvm.ErrResumeNotSupported
 }
+
+// SuspendContext returns an error because it is not supported on Azure.
+func (vm *VM) SuspendContext(ctx context.Context) error {
+	return lvm.ErrSuspendNotSupported
+}
+
+// ResumeContext returns an error because it is not supported on Azure.
+func (vm *VM) ResumeContext(ctx context.Context) error {
+	return lvm.ErrResumeNotSupported
+}
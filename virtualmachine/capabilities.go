@@ -0,0 +1,75 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine
+
+// Capabilities lists the optional features a provider supports. The
+// operations of VirtualMachine that depend on a feature the provider lacks,
+// such as Suspend, fail with an error like ErrSuspendNotSupported.
+type Capabilities struct {
+	// Suspend is set if Suspend and Resume are supported.
+	Suspend bool
+	// Snapshots is set if the VM's disks can be snapshotted.
+	Snapshots bool
+	// Resize is set if the VM's size can be changed after it was created.
+	Resize bool
+	// Tags is set if Spec.Tags are applied to the VM.
+	Tags bool
+	// MultipleNICs is set if the VM can be attached to more than one of
+	// Spec.Networks.
+	MultipleNICs bool
+	// Volumes is set if Spec.Disks beyond the boot disk are created and
+	// attached to the VM.
+	Volumes bool
+	// ConsoleOutput is set if the VM's console output can be read.
+	ConsoleOutput bool
+}
+
+// Capabler is implemented by VMs that report the features of their provider.
+// The capabilities depend only on the provider, not on how the VM is
+// configured or on whether it was provisioned.
+type Capabler interface {
+	Capabilities() Capabilities
+}
+
+// GetCapabilities returns the capabilities of vm's provider. A VM that does
+// not implement Capabler is assumed to support none of the optional features.
+func GetCapabilities(vm VirtualMachine) Capabilities {
+	if c, ok := vm.(Capabler); ok {
+		return c.Capabilities()
+	}
+	return Capabilities{}
+}
+
+// ProviderCapabilities returns the capabilities of the provider registered
+// under name, without having to configure a VM.
+func ProviderCapabilities(name string) (Capabilities, error) {
+	vm, err := New(&Spec{Provider: name})
+	if err != nil {
+		return Capabilities{}, err
+	}
+	return GetCapabilities(vm), nil
+}
+
+// Missing returns the names of the features set in need that c lacks, or nil
+// if c supports all of them.
+func (c Capabilities) Missing(need Capabilities) []string {
+	features := []struct {
+		name       string
+		have, want bool
+	}{
+		{"suspend", c.Suspend, need.Suspend},
+		{"snapshots", c.Snapshots, need.Snapshots},
+		{"resize", c.Resize, need.Resize},
+		{"tags", c.Tags, need.Tags},
+		{"multiple NICs", c.MultipleNICs, need.MultipleNICs},
+		{"volumes", c.Volumes, need.Volumes},
+		{"console output", c.ConsoleOutput, need.ConsoleOutput},
+	}
+	var missing []string
+	for _, f := range features {
+		if f.want && !f.have {
+			missing = append(missing, f.name)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/mockprovider"
+)
+
+// capableProvider is registered by the tests with the capabilities below.
+const capableProvider = "test-capable"
+
+var capable = lvm.Capabilities{Suspend: true, Tags: true, Volumes: true}
+
+func init() {
+	lvm.Register(capableProvider, func(spec *lvm.Spec) (lvm.VirtualMachine, error) {
+		return &mockprovider.VM{MockCapabilities: func() lvm.Capabilities { return capable }}, nil
+	})
+}
+
+// TestMissing makes sure Missing lists the features needed but not
+// supported, in a stable order.
+func TestMissing(t *testing.T) {
+	all := lvm.Capabilities{
+		Suspend:       true,
+		Snapshots:     true,
+		Resize:        true,
+		Tags:          true,
+		MultipleNICs:  true,
+		Volumes:       true,
+		ConsoleOutput: true,
+	}
+	tests := []struct {
+		have, need lvm.Capabilities
+		want       []string
+	}{
+		{lvm.Capabilities{}, lvm.Capabilities{}, nil},
+		{all, all, nil},
+		{capable, lvm.Capabilities{Suspend: true, Tags: true}, nil},
+		{capable, lvm.Capabilities{Suspend: true, Snapshots: true}, []string{"snapshots"}},
+		{lvm.Capabilities{}, all, []string{"suspend", "snapshots", "resize", "tags", "multiple NICs", "volumes", "console output"}},
+	}
+	for _, tt := range tests {
+		if got := tt.have.Missing(tt.need); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v.Missing(%+v) = %q, want %q", tt.have, tt.need, got, tt.want)
+		}
+	}
+}
+
+// TestProviderCapabilities makes sure ProviderCapabilities reports the
+// capabilities of a registered provider and fails for an unknown one.
+func TestProviderCapabilities(t *testing.T) {
+	c, err := lvm.ProviderCapabilities(capableProvider)
+	if err != nil {
+		t.Fatalf("ProviderCapabilities returned %s", err)
+	}
+	if c != capable {
+		t.Fatalf("ProviderCapabilities() = %+v, want %+v", c, capable)
+	}
+
+	_, err = lvm.ProviderCapabilities("no-such-provider")
+	if err == nil || !strings.Contains(err.Error(), `unknown provider "no-such-provider"`) {
+		t.Fatalf("ProviderCapabilities returned %v, want an unknown provider error", err)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package digitalocean
+
+import (
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+var _ lvm.Handler = (*VM)(nil)
+
+// handle holds what is needed to manage a droplet from another process.
+type handle struct {
+	Name      string `json:"name,omitempty"`
+	DropletID int    `json:"droplet_id"`
+}
+
+// MarshalHandle serializes the droplet ID of the VM. The API token is not
+// included.
+func (vm *VM) MarshalHandle() ([]byte, error) {
+	if vm.Droplet == nil || vm.Droplet.ID == 0 {
+		return nil, ErrNoInstanceID
+	}
+	return lvm.EncodeHandle(providerName, handle{
+		Name:      vm.Config.Name,
+		DropletID: vm.Droplet.ID,
+	})
+}
+
+// UnmarshalHandle restores a handle written by MarshalHandle into the VM. The
+// rest of the droplet is fetched by the next call to Update.
+func (vm *VM) UnmarshalHandle(data []byte) error {
+	var h handle
+	if err := lvm.DecodeHandle(providerName, data, &h); err != nil {
+		return err
+	}
+	if h.DropletID == 0 {
+		return ErrNoInstanceID
+	}
+
+	vm.Config.Name = h.Name
+	vm.Droplet = &Droplet{ID: h.DropletID, Name: h.Name}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package digitalocean
+
+import (
+	"strings"
+
+	libssh "github.com/apcera/libretto/ssh"
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+// providerName is the name the provider is registered under.
+const providerName = "digitalocean"
+
+func init() {
+	lvm.Register(providerName, FromSpec)
+}
+
+// Provider returns the name the provider is registered under.
+func (vm *VM) Provider() string {
+	return providerName
+}
+
+// FromSpec builds a DigitalOcean droplet from a provider-neutral spec. Image,
+// Size and Region are the droplet's image, size and region slugs. The
+// following options are read:
+//
+//	api_token           DigitalOcean API token (required)
+//	ssh_keys            comma-separated IDs or fingerprints of account SSH keys
+//	backups             "true" to enable backups
+//	ipv6                "true" to enable IPv6
+//	private_networking  "true" to enable private networking
+func FromSpec(spec *lvm.Spec) (lvm.VirtualMachine, error) {
+	vm := &VM{
+		APIToken: spec.Option("api_token"),
+		Credentials: libssh.Credentials{
+			SSHUser:       spec.SSH.User,
+			SSHPassword:   spec.SSH.Password,
+			SSHPrivateKey: spec.SSH.PrivateKey,
+		},
+		Config: Config{
+			Name:     spec.Name,
+			Region:   spec.Region,
+			Size:     spec.Size,
+			Image:    spec.Image,
+			UserData: spec.UserData,
+		},
+	}
+
+	if keys := spec.Option("ssh_keys"); keys != "" {
+		for _, k := range strings.Split(keys, ",") {
+			vm.Config.SSHKeys = append(vm.Config.SSHKeys, strings.TrimSpace(k))
+		}
+	}
+
+	var err error
+	if vm.Config.Backups, err = spec.BoolOption("backups"); err != nil {
+		return nil, err
+	}
+	if vm.Config.IPv6, err = spec.BoolOption("ipv6"); err != nil {
+		return nil, err
+	}
+	if vm.Config.PrivateNetworking, err = spec.BoolOption("private_networking"); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
@@ -3,11 +3,14 @@
 package digitalocean
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
 )
 
 // BuildRequest builds an http request for this provider.
@@ -22,10 +25,21 @@ func BuildRequest(token, method, url string, body io.Reader) (*http.Request, err
 	return req, nil
 }
 
+// statusError returns the error for a response with a non-2xx status and
+// body b, with the lvm.Kind matching the status.
+func statusError(rsp *http.Response, b []byte) error {
+	return lvm.NewError(lvm.KindForStatus(rsp.StatusCode), fmt.Errorf("Error: %s: %s", rsp.Status, string(b)))
+}
+
 // Update vm.Droplet values. This occurs in GetState(), so we call that and
 // ignore the state string.
 func (vm *VM) Update() error {
-	_, err := vm.GetState()
+	return vm.UpdateContext(context.Background())
+}
+
+// UpdateContext is like Update but the API request is bound to ctx.
+func (vm *VM) UpdateContext(ctx context.Context) error {
+	_, err := vm.GetStateContext(ctx)
 	return err
 }
 
@@ -46,7 +60,7 @@ func GetDroplet(token, id string) (*Droplet, error) {
 		return nil, err
 	}
 	if rsp.Status[0] != StatusOk {
-		return nil, fmt.Errorf("Error: %s: %s", rsp.Status, string(b))
+		return nil, statusError(rsp, b)
 	}
 
 	r := &DropletResponse{}
@@ -74,7 +88,7 @@ func GetDroplets(token string) (*DropletsResponse, error) {
 		return nil, err
 	}
 	if rsp.Status[0] != StatusOk {
-		return nil, fmt.Errorf("Error: %s: %s", rsp.Status, string(b))
+		return nil, statusError(rsp, b)
 	}
 
 	r := &DropletsResponse{}
@@ -4,8 +4,8 @@ package digitalocean
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -20,7 +20,8 @@ import (
 
 var (
 	// ErrNoInstanceID is returned when attempting to perform an operation on an instance, but the ID is missing.
-	ErrNoInstanceID = errors.New("Missing droplet ID")
+	// It is lvm.ErrNoInstanceID.
+	ErrNoInstanceID = lvm.ErrNoInstanceID
 )
 
 // Base API URL strings
@@ -37,9 +38,13 @@ type VM struct {
 	Credentials libssh.Credentials
 	Config      Config
 	Droplet     *Droplet
+	Observer    lvm.Observer // Receives the events of this VM; may be nil
 }
 
-var _ lvm.VirtualMachine = (*VM)(nil)
+var _ lvm.VirtualMachineContext = (*VM)(nil)
+
+var _ lvm.StateDetailer = (*VM)(nil)
+var _ lvm.Capabler = (*VM)(nil)
 
 // Config is the new droplet payload
 type Config struct {
@@ -161,8 +166,20 @@ func (vm *VM) GetName() string {
 	return vm.Config.Name
 }
 
+// events returns the Events of the VM, sent to its Observer and the global
+// observers.
+func (vm *VM) events() lvm.Events {
+	return lvm.Events{Provider: providerName, Name: vm.Config.Name, VM: vm, Observer: vm.Observer}
+}
+
 // Provision creates a new VM
 func (vm *VM) Provision() error {
+	return vm.ProvisionContext(context.Background())
+}
+
+// ProvisionContext is like Provision but the API request is bound to ctx.
+func (vm *VM) ProvisionContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpProvision)(&err)
 	b, err := json.Marshal(vm.Config)
 	if err != nil {
 		return err
@@ -173,6 +190,7 @@ func (vm *VM) Provision() error {
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
 	rsp, err := client.Do(req)
 	if err != nil {
 		return err
@@ -183,7 +201,7 @@ func (vm *VM) Provision() error {
 		return err
 	}
 	if rsp.Status[0] != StatusOk {
-		return fmt.Errorf("Error: %s: %s", rsp.Status, string(b))
+		return statusError(rsp, b)
 	}
 
 	// Fill out vm.Droplet with data on new droplet
@@ -198,8 +216,13 @@ func (vm *VM) Provision() error {
 
 // GetIPs returns a list of ip addresses associated with the VM
 func (vm *VM) GetIPs() ([]net.IP, error) {
+	return vm.GetIPsContext(context.Background())
+}
+
+// GetIPsContext is like GetIPs but the API request is bound to ctx.
+func (vm *VM) GetIPsContext(ctx context.Context) ([]net.IP, error) {
 	var ips []net.IP
-	if err := vm.Update(); err != nil {
+	if err := vm.UpdateContext(ctx); err != nil {
 		return nil, err
 	}
 	for _, ip := range vm.Droplet.Networks.V4 {
@@ -213,7 +236,12 @@ func (vm *VM) GetIPs() ([]net.IP, error) {
 
 // GetSSH returns an ssh client for the the vm.
 func (vm *VM) GetSSH(options libssh.Options) (libssh.Client, error) {
-	ips, err := util.GetVMIPs(vm, options)
+	return vm.GetSSHContext(context.Background(), options)
+}
+
+// GetSSHContext is like GetSSH but the IP lookup is bound to ctx.
+func (vm *VM) GetSSHContext(ctx context.Context, options libssh.Options) (libssh.Client, error) {
+	ips, err := util.GetVMIPsContext(ctx, vm, options)
 	if err != nil {
 		return nil, err
 	}
@@ -224,6 +252,12 @@ func (vm *VM) GetSSH(options libssh.Options) (libssh.Client, error) {
 
 // Destroy powers off the VM and deletes its files from disk
 func (vm *VM) Destroy() error {
+	return vm.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but the API request is bound to ctx.
+func (vm *VM) DestroyContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpDestroy)(&err)
 	id := fmt.Sprintf("%v", vm.Droplet.ID)
 	if id == "" {
 		return ErrNoInstanceID
@@ -234,6 +268,7 @@ func (vm *VM) Destroy() error {
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
 	rsp, err := client.Do(req)
 	if err != nil {
 		return err
@@ -244,53 +279,91 @@ func (vm *VM) Destroy() error {
 		return err
 	}
 	if rsp.Status[0] != StatusOk {
-		return fmt.Errorf("Error: %s: %s", rsp.Status, string(b))
+		return statusError(rsp, b)
 	}
 
 	return nil
 }
 
-// GetState gets the running state of the VM through the DigitalOcean API
-// Returns droplet state if available and 'not_found' if ID could not be located.
+// GetState gets the running state of the VM through the DigitalOcean API.
+// Returns lvm.VMNotFound if the ID could not be located.
 func (vm *VM) GetState() (string, error) {
+	return vm.GetStateContext(context.Background())
+}
+
+// GetStateContext is like GetState but the API request is bound to ctx.
+func (vm *VM) GetStateContext(ctx context.Context) (string, error) {
+	d, err := vm.GetStateDetail(ctx)
+	return d.State, err
+}
+
+// GetStateDetail is like GetStateContext but also returns the droplet status,
+// such as "active", or "not_found" if the ID could not be located.
+func (vm *VM) GetStateDetail(ctx context.Context) (lvm.StateDetail, error) {
 	id := fmt.Sprintf("%v", vm.Droplet.ID)
 	if id == "" {
-		return "", ErrNoInstanceID
+		return lvm.StateDetail{}, ErrNoInstanceID
 	}
 
 	client := &http.Client{}
 	req, err := BuildRequest(vm.APIToken, "GET", apiBaseURL+apiDropletURL+"/"+id, nil)
 	if err != nil {
-		return "", err
+		return lvm.StateDetail{}, err
 	}
+	req = req.WithContext(ctx)
 	rsp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return lvm.StateDetail{}, err
 	}
 	defer rsp.Body.Close()
 	b, err := ioutil.ReadAll(rsp.Body)
 	if err != nil {
-		return "", err
+		return lvm.StateDetail{}, err
 	}
 	if rsp.StatusCode == StatusNotFound {
-		return "not_found", nil
+		return lvm.StateDetail{State: translateState("not_found"), Raw: "not_found"}, nil
 	}
 	if rsp.Status[0] != StatusOk {
-		return "", fmt.Errorf("Error: %s: %s", rsp.Status, string(b))
+		return lvm.StateDetail{}, statusError(rsp, b)
 	}
 
 	// Fill out vm.Droplet with data on droplet
 	r := &DropletResponse{}
 	err = json.Unmarshal(b, r)
 	if err != nil {
-		return "", err
+		return lvm.StateDetail{}, err
 	}
 	vm.Droplet = r.Droplet
-	return vm.Droplet.Status, nil
+	return lvm.StateDetail{State: translateState(vm.Droplet.Status), Raw: vm.Droplet.Status}, nil
+}
+
+// translateState maps a droplet status, or "not_found" for an unknown
+// droplet, to a lvm.VM* state.
+func translateState(status string) string {
+	switch status {
+	case "new":
+		return lvm.VMStarting
+	case "active":
+		return lvm.VMRunning
+	case "off":
+		return lvm.VMHalted
+	case "archive":
+		return lvm.VMTerminated
+	case "not_found":
+		return lvm.VMNotFound
+	default:
+		return lvm.VMUnknown
+	}
 }
 
 // Start powers on the VM
 func (vm *VM) Start() error {
+	return vm.StartContext(context.Background())
+}
+
+// StartContext is like Start but the API request is bound to ctx.
+func (vm *VM) StartContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpStart)(&err)
 	id := fmt.Sprintf("%v", vm.Droplet.ID)
 	if id == "" {
 		return ErrNoInstanceID
@@ -301,6 +374,7 @@ func (vm *VM) Start() error {
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
 	rsp, err := client.Do(req)
 	if err != nil {
 		return err
@@ -311,7 +385,7 @@ func (vm *VM) Start() error {
 		return err
 	}
 	if rsp.Status[0] != StatusOk {
-		return fmt.Errorf("Error: %s: %s", rsp.Status, string(b))
+		return statusError(rsp, b)
 	}
 
 	return nil
@@ -319,6 +393,12 @@ func (vm *VM) Start() error {
 
 // Halt powers off the VM without destroying it
 func (vm *VM) Halt() error {
+	return vm.HaltContext(context.Background())
+}
+
+// HaltContext is like Halt but the API request is bound to ctx.
+func (vm *VM) HaltContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpHalt)(&err)
 	id := fmt.Sprintf("%v", vm.Droplet.ID)
 	if id == "" {
 		return ErrNoInstanceID
@@ -329,6 +409,7 @@ func (vm *VM) Halt() error {
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
 	rsp, err := client.Do(req)
 	if err != nil {
 		return err
@@ -339,12 +420,18 @@ func (vm *VM) Halt() error {
 		return err
 	}
 	if rsp.Status[0] != StatusOk {
-		return fmt.Errorf("Error: %s: %s", rsp.Status, string(b))
+		return statusError(rsp, b)
 	}
 
 	return nil
 }
 
+// Capabilities reports that DigitalOcean droplets support none of the
+// optional features.
+func (vm *VM) Capabilities() lvm.Capabilities {
+	return lvm.Capabilities{}
+}
+
 // Suspend always returns an error because this isn't supported by DigitalOcean
 func (vm *VM) Suspend() error {
 	return lvm.ErrSuspendNotSupported
@@ -354,3 +441,13 @@ func (vm *VM) Suspend() error {
 func (vm *VM) Resume() error {
 	return lvm.ErrResumeNotSupported
 }
+
+// SuspendContext always returns an error because this isn't supported by DigitalOcean
+func (vm *VM) SuspendContext(ctx context.Context) error {
+	return lvm.ErrSuspendNotSupported
+}
+
+// ResumeContext always returns an error because this isn't supported by DigitalOcean
+func (vm *VM) ResumeContext(ctx context.Context) error {
+	return lvm.ErrResumeNotSupported
+}
@@ -0,0 +1,28 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package digitalocean
+
+import (
+	"testing"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+func TestTranslateState(t *testing.T) {
+	tests := []struct {
+		status, want string
+	}{
+		{"new", lvm.VMStarting},
+		{"active", lvm.VMRunning},
+		{"off", lvm.VMHalted},
+		{"archive", lvm.VMTerminated},
+		{"not_found", lvm.VMNotFound},
+		{"locked", lvm.VMUnknown},
+		{"", lvm.VMUnknown},
+	}
+	for _, tt := range tests {
+		if got := translateState(tt.status); got != tt.want {
+			t.Errorf("translateState(%q) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
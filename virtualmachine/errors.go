@@ -0,0 +1,152 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Kind classifies an error so that callers can decide whether to retry, give
+// up or ask for different settings. A Kind is itself an error, so callers
+// test for it with errors.Is:
+//
+//	if errors.Is(err, lvm.NotFound) {
+//		// The VM is gone.
+//	}
+type Kind string
+
+// The kinds of errors returned by providers.
+const (
+	// NotFound means the VM, or a resource it depends on, does not exist.
+	NotFound Kind = "not found"
+	// AlreadyExists means a resource with the same name already exists.
+	AlreadyExists Kind = "already exists"
+	// QuotaExceeded means the account has run out of some resource.
+	QuotaExceeded Kind = "quota exceeded"
+	// AuthFailed means the credentials are missing, invalid or lack the
+	// permissions for the operation.
+	AuthFailed Kind = "authentication failed"
+	// Timeout means an operation did not complete in time.
+	Timeout Kind = "timeout"
+	// NotSupported means the provider does not support the operation.
+	NotSupported Kind = "not supported"
+	// Transient means the operation failed for a reason that may go away,
+	// such as throttling or a server error, and can be retried.
+	Transient Kind = "transient"
+)
+
+// Error returns the name of the kind.
+func (k Kind) Error() string {
+	return string(k)
+}
+
+// Error is an error of a known Kind. It wraps the underlying error, usually
+// the one returned by a provider's SDK, which errors.As can still reach.
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+// Error returns the message of the underlying error.
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return string(e.Kind)
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the Kind of e.
+func (e *Error) Is(target error) bool {
+	k, ok := target.(Kind)
+	return ok && k == e.Kind
+}
+
+// NewError wraps err in an Error of the given kind. It returns err unchanged
+// if err is nil, kind is empty or err already has a kind.
+func NewError(kind Kind, err error) error {
+	if err == nil || kind == "" || KindOf(err) != "" {
+		return err
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// kinds lists every Kind, in the order KindOf tries them.
+var kinds = []Kind{NotFound, AlreadyExists, QuotaExceeded, AuthFailed, Timeout, NotSupported, Transient}
+
+// KindOf returns the Kind of err, or "" if err has none. Errors other than
+// Error can have a kind by implementing an Is method that reports it.
+func KindOf(err error) Kind {
+	if err == nil {
+		return ""
+	}
+	for _, k := range kinds {
+		if errors.Is(err, k) {
+			return k
+		}
+	}
+	return ""
+}
+
+// IsRetryable reports whether err is Transient or a Timeout, so that
+// retrying the operation may succeed.
+func IsRetryable(err error) bool {
+	return errors.Is(err, Transient) || errors.Is(err, Timeout)
+}
+
+// KindForStatus returns the Kind of an HTTP error status code, or "" if the
+// code does not map to one.
+func KindForStatus(code int) Kind {
+	switch {
+	case code == http.StatusUnauthorized, code == http.StatusForbidden:
+		return AuthFailed
+	case code == http.StatusNotFound, code == http.StatusGone:
+		return NotFound
+	case code == http.StatusConflict:
+		return AlreadyExists
+	case code == http.StatusRequestTimeout, code == http.StatusGatewayTimeout:
+		return Timeout
+	case code == http.StatusTooManyRequests, code >= 500:
+		return Transient
+	}
+	return ""
+}
+
+// joinedErrors is an error made of several errors. Its message joins theirs
+// with sep, and errors.Is and errors.As look through all of them.
+type joinedErrors struct {
+	errs []error
+	sep  string
+}
+
+func (j *joinedErrors) Error() string {
+	s := make([]string, len(j.errs))
+	for i, e := range j.errs {
+		s[i] = e.Error()
+	}
+	return strings.Join(s, j.sep)
+}
+
+func (j *joinedErrors) Unwrap() []error {
+	return j.errs
+}
+
+// JoinErrors combines errs, skipping nil ones, into a single error whose
+// message joins theirs with sep. errors.Is and errors.As see every one of
+// errs. Unlike errors.Join, it returns an empty error rather than nil if all
+// of errs are nil.
+func JoinErrors(sep string, errs ...error) error {
+	j := &joinedErrors{sep: sep}
+	for _, e := range errs {
+		if e != nil {
+			j.errs = append(j.errs, e)
+		}
+	}
+	return j
+}
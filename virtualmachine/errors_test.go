@@ -0,0 +1,124 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+// sdkError stands for an error returned by a provider's SDK.
+type sdkError struct {
+	code string
+}
+
+func (e *sdkError) Error() string {
+	return "sdk error " + e.code
+}
+
+// TestKinds makes sure errors.Is and KindOf see the kind of wrapped errors,
+// and errors.As still reaches the SDK error.
+func TestKinds(t *testing.T) {
+	sdkErr := &sdkError{code: "NotFound"}
+	tests := []struct {
+		name      string
+		err       error
+		kind      lvm.Kind
+		retryable bool
+	}{
+		{"nil", nil, "", false},
+		{"plain", errors.New("boom"), "", false},
+		{"kind", lvm.NewError(lvm.NotFound, sdkErr), lvm.NotFound, false},
+		{"wrapped", fmt.Errorf("describing instance: %w", lvm.NewError(lvm.Transient, sdkErr)), lvm.Transient, true},
+		{"timeout", lvm.NewError(lvm.Timeout, sdkErr), lvm.Timeout, true},
+		{"first kind wins", lvm.NewError(lvm.QuotaExceeded, lvm.NewError(lvm.AuthFailed, sdkErr)), lvm.AuthFailed, false},
+		{"empty kind", lvm.NewError("", sdkErr), "", false},
+	}
+	for _, tt := range tests {
+		if k := lvm.KindOf(tt.err); k != tt.kind {
+			t.Fatalf("%s: KindOf = %q, want %q", tt.name, k, tt.kind)
+		}
+		if tt.kind != "" && !errors.Is(tt.err, tt.kind) {
+			t.Fatalf("%s: errors.Is(err, %q) = false", tt.name, tt.kind)
+		}
+		if r := lvm.IsRetryable(tt.err); r != tt.retryable {
+			t.Fatalf("%s: IsRetryable = %v, want %v", tt.name, r, tt.retryable)
+		}
+		var target *sdkError
+		if tt.kind != "" && (!errors.As(tt.err, &target) || target != sdkErr) {
+			t.Fatalf("%s: errors.As did not find the SDK error", tt.name)
+		}
+	}
+
+	if err := lvm.NewError(lvm.NotFound, nil); err != nil {
+		t.Fatalf("NewError(NotFound, nil) = %v, want nil", err)
+	}
+	if err := lvm.NewError(lvm.NotFound, sdkErr); err.Error() != sdkErr.Error() {
+		t.Fatalf("Error() = %q, want the SDK message", err)
+	}
+}
+
+// TestKindForStatus makes sure HTTP status codes map to their kinds.
+func TestKindForStatus(t *testing.T) {
+	tests := []struct {
+		code int
+		kind lvm.Kind
+	}{
+		{http.StatusOK, ""},
+		{http.StatusBadRequest, ""},
+		{http.StatusUnauthorized, lvm.AuthFailed},
+		{http.StatusForbidden, lvm.AuthFailed},
+		{http.StatusNotFound, lvm.NotFound},
+		{http.StatusGone, lvm.NotFound},
+		{http.StatusConflict, lvm.AlreadyExists},
+		{http.StatusRequestTimeout, lvm.Timeout},
+		{http.StatusGatewayTimeout, lvm.Timeout},
+		{http.StatusTooManyRequests, lvm.Transient},
+		{http.StatusInternalServerError, lvm.Transient},
+		{http.StatusServiceUnavailable, lvm.Transient},
+	}
+	for _, tt := range tests {
+		if k := lvm.KindForStatus(tt.code); k != tt.kind {
+			t.Fatalf("KindForStatus(%d) = %q, want %q", tt.code, k, tt.kind)
+		}
+	}
+}
+
+// TestJoinErrors makes sure joined errors keep every error in the chain and
+// skip nil ones.
+func TestJoinErrors(t *testing.T) {
+	notFound := lvm.NewError(lvm.NotFound, errors.New("disk not found"))
+	pathErr := &os.PathError{Op: "open", Path: "disk.vmdk", Err: os.ErrNotExist}
+
+	err := lvm.JoinErrors("; ", notFound, nil, pathErr)
+	if msg := err.Error(); msg != "disk not found; open disk.vmdk: file does not exist" {
+		t.Fatalf("Error() = %q", msg)
+	}
+	if !errors.Is(err, lvm.NotFound) || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("errors.Is does not see the joined errors")
+	}
+	var target *os.PathError
+	if !errors.As(err, &target) || target != pathErr {
+		t.Fatalf("errors.As does not find the *os.PathError")
+	}
+	if lvm.KindOf(err) != lvm.NotFound {
+		t.Fatalf("KindOf = %q, want %q", lvm.KindOf(err), lvm.NotFound)
+	}
+
+	wrapped := lvm.WrapErrors(errors.New("provisioning failed"), notFound)
+	if msg := wrapped.Error(); msg != "provisioning failed: disk not found" {
+		t.Fatalf("WrapErrors message = %q", msg)
+	}
+	if !errors.Is(wrapped, lvm.NotFound) {
+		t.Fatalf("errors.Is does not see the wrapped error")
+	}
+
+	if err := lvm.JoinErrors("; ", nil, nil); err == nil || err.Error() != "" {
+		t.Fatalf("JoinErrors of nil errors = %v, want an empty error", err)
+	}
+}
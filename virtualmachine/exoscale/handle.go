@@ -0,0 +1,50 @@
+package exoscale
+
+import (
+	"github.com/apcera/libretto/virtualmachine"
+)
+
+var _ virtualmachine.Handler = (*VM)(nil)
+
+// handle holds what is needed to manage a virtual machine from another
+// process.
+type handle struct {
+	Name     string `json:"name,omitempty"`
+	ID       string `json:"id"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Zone     Zone   `json:"zone"`
+}
+
+// MarshalHandle serializes the ID and zone of the virtual machine. The API
+// key and secret are not included.
+func (vm *VM) MarshalHandle() ([]byte, error) {
+	if vm.ID == "" {
+		return nil, virtualmachine.ErrHandleIncomplete
+	}
+	return virtualmachine.EncodeHandle(providerName, handle{
+		Name:     vm.Name,
+		ID:       vm.ID,
+		Endpoint: vm.Config.Endpoint,
+		Zone:     vm.Zone,
+	})
+}
+
+// UnmarshalHandle restores a handle written by MarshalHandle into the VM. An
+// endpoint already set on the VM takes precedence over the recorded one.
+func (vm *VM) UnmarshalHandle(data []byte) error {
+	var h handle
+	if err := virtualmachine.DecodeHandle(providerName, data, &h); err != nil {
+		return err
+	}
+	if h.ID == "" {
+		return virtualmachine.ErrHandleIncomplete
+	}
+
+	vm.Name = h.Name
+	vm.ID = h.ID
+	vm.Zone = h.Zone
+	if vm.Config.Endpoint == "" {
+		vm.Config.Endpoint = h.Endpoint
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package exoscale
+
+import (
+	"github.com/apcera/libretto/ssh"
+	"github.com/apcera/libretto/virtualmachine"
+)
+
+// providerName is the name the provider is registered under.
+const providerName = "exoscale"
+
+func init() {
+	virtualmachine.Register(providerName, FromSpec)
+}
+
+// Provider returns the name the provider is registered under.
+func (vm *VM) Provider() string {
+	return providerName
+}
+
+// FromSpec builds an Exoscale VM from a provider-neutral spec. Image is the
+// template name, Size the service offering and Region the zone. The first
+// disk sets the template storage size, and the security groups of all
+// networks are looked up by name. The following options are read:
+//
+//	endpoint    Exoscale API endpoint
+//	api_key     Exoscale API key
+//	api_secret  Exoscale API secret
+//	keypair     name of the SSH keypair to install
+func FromSpec(spec *virtualmachine.Spec) (virtualmachine.VirtualMachine, error) {
+	vm := &VM{
+		Config: Config{
+			Endpoint:  spec.Option("endpoint"),
+			APIKey:    spec.Option("api_key"),
+			APISecret: spec.Option("api_secret"),
+		},
+		Name: spec.Name,
+		Template: Template{
+			Name:     spec.Image,
+			ZoneName: spec.Region,
+		},
+		ServiceOffering: ServiceOffering{
+			Name: ServiceOfferingType(spec.Size),
+		},
+		KeypairName: spec.Option("keypair"),
+		Userdata:    spec.UserData,
+		Zone: Zone{
+			Name: spec.Region,
+		},
+		SSHCreds: ssh.Credentials{
+			SSHUser:       spec.SSH.User,
+			SSHPassword:   spec.SSH.Password,
+			SSHPrivateKey: spec.SSH.PrivateKey,
+		},
+		KeepOnFailure: spec.KeepOnFailure,
+	}
+
+	if len(spec.Disks) > 0 {
+		vm.Template.StorageGB = spec.Disks[0].SizeGB
+	}
+	for _, n := range spec.Networks {
+		for _, sg := range n.SecurityGroups {
+			vm.SecurityGroups = append(vm.SecurityGroups, SecurityGroup{Name: sg})
+		}
+	}
+	return vm, nil
+}
@@ -1,7 +1,9 @@
 package exoscale
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
@@ -9,81 +11,164 @@ import (
 	"time"
 
 	"github.com/pyr/egoscale/src/egoscale"
+
+	"github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/wait"
 )
 
+// errNotFound is returned by updateInfo when Exoscale lists no virtual
+// machine with the VM's ID.
+var errNotFound = virtualmachine.NewError(virtualmachine.NotFound, errors.New("virtual machine not found"))
+
+// rollbackPollSeconds is how often destroyCreated polls the job creating the
+// VM.
+const rollbackPollSeconds = 5
+
 func (vm *VM) getExoClient() *egoscale.Client {
 	return egoscale.NewClient(vm.Config.Endpoint, vm.Config.APIKey, vm.Config.APISecret)
 }
 
+// call runs fn, returning early with ctx.Err() if ctx is done first. The
+// egoscale client cannot cancel a request, so an abandoned fn is left to
+// finish in the background; callers must not read what fn writes unless call
+// returns nil. It is only meant for calls that are safe to abandon, which
+// creating a VM is not.
+func call(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fn()
+	}()
+
+	select {
+	case err := <-errCh:
+		return classify(err)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// apiErrorKinds maps the CloudStack error codes returned by the Exoscale API
+// to their kinds.
+var apiErrorKinds = map[int]virtualmachine.Kind{
+	401: virtualmachine.AuthFailed,
+	432: virtualmachine.NotSupported,
+	436: virtualmachine.Transient,
+	530: virtualmachine.Transient,
+	532: virtualmachine.QuotaExceeded,
+	533: virtualmachine.Transient,
+	534: virtualmachine.Transient,
+	537: virtualmachine.AlreadyExists,
+}
+
+// classify gives err the virtualmachine.Kind that matches its Exoscale API
+// error code. egoscale only returns the code as part of the message.
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	var code int
+	if _, serr := fmt.Sscanf(err.Error(), "exoscale API error %d", &code); serr != nil {
+		return err
+	}
+	return virtualmachine.NewError(apiErrorKinds[code], err)
+}
+
+// request sends an API command, giving up when ctx is done.
+func (vm *VM) request(ctx context.Context, command string, params url.Values) (json.RawMessage, error) {
+	var resp json.RawMessage
+	err := call(ctx, func() (err error) {
+		resp, err = vm.getExoClient().Request(command, params)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
 // WaitVMCreation waits for the virtual machine to be created, and stores the virtual machine ID
 // VM structure must contain a valid JobID.
 func (vm *VM) WaitVMCreation(timeoutSeconds int, pollIntervalSeconds int) error {
+	return vm.WaitVMCreationContext(context.Background(), timeoutSeconds, pollIntervalSeconds)
+}
+
+// WaitVMCreationContext is like WaitVMCreation but also gives up when ctx is
+// done, returning ctx.Err().
+func (vm *VM) WaitVMCreationContext(ctx context.Context, timeoutSeconds int, pollIntervalSeconds int) error {
 
 	if vm.JobID == "" {
 		return fmt.Errorf("No JobID informed. Cannot poll machine creation state")
 	}
 
-	jobCh := make(chan *egoscale.QueryAsyncJobResultResponse, 1)
-	errCh := make(chan error, 1)
+	params := url.Values{}
+	params.Set("jobid", vm.JobID)
 
-	go func() {
-		params := url.Values{}
-		params.Set("jobid", vm.JobID)
-
-		for {
-			client := vm.getExoClient()
-			resp, err := client.Request("queryAsyncJobResult", params)
-			if err != nil {
-				errCh <- err
-			}
+	w := wait.Waiter{
+		Backoff: wait.Constant(time.Duration(pollIntervalSeconds) * time.Second),
+		Timeout: time.Duration(timeoutSeconds) * time.Second,
+	}
+	err := w.Until(ctx, func(ctx context.Context) (bool, error) {
+		resp, err := vm.request(ctx, "queryAsyncJobResult", params)
+		if err != nil {
+			return false, err
+		}
 
-			jobResult := &egoscale.QueryAsyncJobResultResponse{}
-			err = json.Unmarshal(resp, jobResult)
-			if err != nil {
-				errCh <- err
-			}
+		jobResult := &egoscale.QueryAsyncJobResultResponse{}
+		if err := json.Unmarshal(resp, jobResult); err != nil {
+			return false, err
+		}
 
-			if jobResult.Jobstatus == 1 {
-				jobCh <- jobResult
-				break
+		if jobResult.Jobstatus == 1 {
+			var vmWrap egoscale.DeployVirtualMachineWrappedResponse
+			if err := json.Unmarshal(jobResult.Jobresult, &vmWrap); err != nil {
+				return false, err
 			}
-			time.Sleep(time.Duration(pollIntervalSeconds) * time.Second)
+			vm.ID = vmWrap.Wrapped.Id
+			return true, nil
 		}
-	}()
+		return false, nil
+	})
+	if err == wait.ErrTimeout {
+		return fmt.Errorf("Create VM Job has not completed after %d seconds", timeoutSeconds)
+	}
+	return err
+}
 
-	select {
-	case jobResult := <-jobCh:
-		var vmWrap egoscale.DeployVirtualMachineWrappedResponse
-		if err := json.Unmarshal(jobResult.Jobresult, &vmWrap); err != nil {
-			return err
-		}
-		vm.ID = vmWrap.Wrapped.Id
-	case err := <-errCh:
+// destroyCreated waits for the job creating the VM to finish and destroys the
+// VM it created. It undoes a Provision abandoned by its caller.
+func (vm *VM) destroyCreated(ctx context.Context) error {
+	timeout := int(virtualmachine.RollbackTimeout / time.Second)
+	if err := vm.WaitVMCreationContext(ctx, timeout, rollbackPollSeconds); err != nil {
 		return err
-	case <-time.After(time.Duration(timeoutSeconds) * time.Second):
-		return fmt.Errorf("Create VM Job has not completed after %d seconds", timeoutSeconds)
 	}
 
-	return nil
+	params := url.Values{}
+	params.Set("id", vm.ID)
+
+	_, err := vm.request(ctx, "destroyVirtualMachine", params)
+	return err
 }
 
 // fillTemplateID fills the template identifier based on name, storage and zone name.
 // If no matching template is found, ID remains unchanged and an error is returned.
-func (vm *VM) fillTemplateID() error {
+func (vm *VM) fillTemplateID(ctx context.Context) error {
 
 	params := url.Values{}
 	params.Set("Name", vm.Template.Name)
 	params.Set("templatefilter", "featured")
 
-	client := vm.getExoClient()
-	resp, err := client.Request("listTemplates", params)
+	resp, err := vm.request(ctx, "listTemplates", params)
 	if err != nil {
-		return fmt.Errorf("Getting template ID for '%s/%d/%s': %s", vm.Template.Name, vm.Template.StorageGB, vm.Template.ZoneName, err)
+		return fmt.Errorf("Getting template ID for '%s/%d/%s': %w", vm.Template.Name, vm.Template.StorageGB, vm.Template.ZoneName, err)
 	}
 
 	templates := &egoscale.ListTemplatesResponse{}
 	if err := json.Unmarshal(resp, templates); err != nil {
-		return fmt.Errorf("Decoding response for template '%s/%d/%s': %s", vm.Template.Name, vm.Template.StorageGB, vm.Template.ZoneName, err)
+		return fmt.Errorf("Decoding response for template '%s/%d/%s': %w", vm.Template.Name, vm.Template.StorageGB, vm.Template.ZoneName, err)
 	}
 
 	// iterate templates to get ID matching size and zone name
@@ -104,20 +189,19 @@ func (vm *VM) fillTemplateID() error {
 
 // fillServiceOfferingID fills the service offering identifier based on name.
 // If no matching service offering is found, ID remains unchanged and an error is returned.
-func (vm *VM) fillServiceOfferingID() error {
+func (vm *VM) fillServiceOfferingID(ctx context.Context) error {
 
 	params := url.Values{}
 	params.Set("name", strings.ToLower(string(vm.ServiceOffering.Name)))
 
-	client := vm.getExoClient()
-	resp, err := client.Request("listServiceOfferings", params)
+	resp, err := vm.request(ctx, "listServiceOfferings", params)
 	if err != nil {
-		return fmt.Errorf("Getting service offering ID for %q: %s", vm.ServiceOffering.Name, err)
+		return fmt.Errorf("Getting service offering ID for %q: %w", vm.ServiceOffering.Name, err)
 	}
 
 	so := &egoscale.ListServiceOfferingsResponse{}
 	if err := json.Unmarshal(resp, so); err != nil {
-		return fmt.Errorf("Decoding response for service offering %q: %s", vm.ServiceOffering.Name, err)
+		return fmt.Errorf("Decoding response for service offering %q: %w", vm.ServiceOffering.Name, err)
 	}
 
 	if so.Count != 1 {
@@ -132,19 +216,18 @@ func (vm *VM) fillServiceOfferingID() error {
 // fillSecurityGroupsID fills the security group identifiers based on name.
 // If a security group already has the ID, it will remain unchanged.
 // If any of the security groups is not founds error is returned.
-func (vm *VM) fillSecurityGroupsID() error {
+func (vm *VM) fillSecurityGroupsID(ctx context.Context) error {
 
 	params := url.Values{}
 
-	client := vm.getExoClient()
-	resp, err := client.Request("listSecurityGroups", params)
+	resp, err := vm.request(ctx, "listSecurityGroups", params)
 	if err != nil {
-		return fmt.Errorf("Getting security groups: %s", err)
+		return fmt.Errorf("Getting security groups: %w", err)
 	}
 
 	sgRemotes := &egoscale.ListSecurityGroupsResponse{}
 	if err := json.Unmarshal(resp, sgRemotes); err != nil {
-		return fmt.Errorf("Decoding response for security groups: %s", err)
+		return fmt.Errorf("Decoding response for security groups: %w", err)
 	}
 
 	for i, sg := range vm.SecurityGroups {
@@ -172,20 +255,19 @@ func (vm *VM) fillSecurityGroupsID() error {
 
 // fillZoneID fills the zone identifier based on name.
 // If no matching zone is found, ID remains unchanged and an error is returned.
-func (vm *VM) fillZoneID() error {
+func (vm *VM) fillZoneID(ctx context.Context) error {
 
 	params := url.Values{}
 	params.Set("name", strings.ToLower(string(vm.Zone.Name)))
 
-	client := vm.getExoClient()
-	resp, err := client.Request("listZones", params)
+	resp, err := vm.request(ctx, "listZones", params)
 	if err != nil {
-		return fmt.Errorf("Getting zones ID for %q: %s", vm.ServiceOffering.Name, err)
+		return fmt.Errorf("Getting zones ID for %q: %w", vm.ServiceOffering.Name, err)
 	}
 
 	zones := &egoscale.ListZonesResponse{}
 	if err := json.Unmarshal(resp, zones); err != nil {
-		return fmt.Errorf("Decoding response for zones list: %s", err)
+		return fmt.Errorf("Decoding response for zones list: %w", err)
 	}
 
 	for _, zone := range zones.Zones {
@@ -198,7 +280,7 @@ func (vm *VM) fillZoneID() error {
 	return fmt.Errorf("Zone ID for %q could not be found", vm.Zone.Name)
 }
 
-func (vm *VM) updateInfo() error {
+func (vm *VM) updateInfo(ctx context.Context) error {
 
 	if vm.ID == "" {
 		return fmt.Errorf("Need an ID to retrieve virtual machine Info")
@@ -207,17 +289,19 @@ func (vm *VM) updateInfo() error {
 	params := url.Values{}
 	params.Set("id", vm.ID)
 
-	client := vm.getExoClient()
-	resp, err := client.Request("listVirtualMachines", params)
+	resp, err := vm.request(ctx, "listVirtualMachines", params)
 	if err != nil {
-		return fmt.Errorf("Listing virtual machine %q to update info: %s", vm.ID, err)
+		return fmt.Errorf("Listing virtual machine %q to update info: %w", vm.ID, err)
 	}
 
 	listVM := &egoscale.ListVirtualMachinesResponse{}
 	if err := json.Unmarshal(resp, listVM); err != nil {
-		return fmt.Errorf("Listing virtual machine %q to update info: %s", vm.ID, err)
+		return fmt.Errorf("Listing virtual machine %q to update info: %w", vm.ID, err)
 	}
 
+	if listVM.Count == 0 {
+		return errNotFound
+	}
 	if listVM.Count != 1 {
 		return fmt.Errorf("Expected 1 virtual machine in listing matching %q, but returned %d", vm.ID, listVM.Count)
 	}
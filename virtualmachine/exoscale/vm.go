@@ -2,6 +2,7 @@
 package exoscale
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -31,6 +32,9 @@ type VM struct {
 
 	SSHCreds ssh.Credentials // SSH credentials required to connect to machine
 
+	Observer      virtualmachine.Observer // Receives the events of this VM; may be nil
+	KeepOnFailure bool                    // Keep the VM if Provision is canceled while creating it
+
 	ips   []net.IP // IP addresses
 	state string   // machine state
 }
@@ -86,46 +90,64 @@ const (
 // thread-safe.
 var SSHTimeout = 30 * time.Second
 
-// This ensures that exoscale.VM implements the virtualmachine.VirtualMachine
-// interface at compile time.
-var _ virtualmachine.VirtualMachine = (*VM)(nil)
+// This ensures that exoscale.VM implements the
+// virtualmachine.VirtualMachineContext interface at compile time.
+var _ virtualmachine.VirtualMachineContext = (*VM)(nil)
+
+var _ virtualmachine.StateDetailer = (*VM)(nil)
+var _ virtualmachine.Capabler = (*VM)(nil)
 
 // GetName returns the name of the virtual machine
 // If an error occurs, an empty string is returned
 func (vm *VM) GetName() string {
 
-	if err := vm.updateInfo(); err != nil {
+	if err := vm.updateInfo(context.Background()); err != nil {
 		return ""
 	}
 
 	return vm.Name
 }
 
+// events returns the Events of the VM, sent to its Observer and the global
+// observers.
+func (vm *VM) events() virtualmachine.Events {
+	return virtualmachine.Events{Provider: providerName, Name: vm.Name, VM: vm, Observer: vm.Observer}
+}
+
 // Provision creates a virtual machine on exoscale.
 // A JobID is informed that can be used to poll the VM creation process (see WaitVMCreation)
 func (vm *VM) Provision() error {
+	return vm.ProvisionContext(context.Background())
+}
+
+// ProvisionContext is like Provision but gives up on the API calls when ctx
+// is done. The call creating the VM cannot be abandoned, since it goes on to
+// create the VM anyway: if ctx is done during it, ctx.Err() is returned and
+// the VM is destroyed once created, unless KeepOnFailure is set.
+func (vm *VM) ProvisionContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, virtualmachine.OpProvision)(&err)
 
 	if vm.Template.ID == "" {
-		if err := vm.fillTemplateID(); err != nil {
+		if err := vm.fillTemplateID(ctx); err != nil {
 			return err
 		}
 	}
 
 	if vm.ServiceOffering.ID == "" {
-		if err := vm.fillServiceOfferingID(); err != nil {
+		if err := vm.fillServiceOfferingID(ctx); err != nil {
 			return err
 		}
 	}
 
 	for _, sg := range vm.SecurityGroups {
 		if sg.ID == "" {
-			vm.fillSecurityGroupsID()
+			vm.fillSecurityGroupsID(ctx)
 			break
 		}
 	}
 
 	if vm.Zone.ID == "" {
-		if err := vm.fillZoneID(); err != nil {
+		if err := vm.fillZoneID(ctx); err != nil {
 			return err
 		}
 	}
@@ -145,21 +167,38 @@ func (vm *VM) Provision() error {
 		Name:            vm.Name,
 	}
 
-	client := vm.getExoClient()
-	jobID, err := client.CreateVirtualMachine(profile)
-	if err != nil {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
+	rb := virtualmachine.NewRollback(vm.KeepOnFailure)
+	rb.Events = vm.events()
+	defer rb.Finish(&err)
+
+	jobID, err := vm.getExoClient().CreateVirtualMachine(profile)
+	if err != nil {
+		return classify(err)
+	}
+
 	vm.JobID = jobID
 
+	if err := ctx.Err(); err != nil {
+		rb.Add("virtual machine job "+jobID, vm.destroyCreated)
+		return err
+	}
+
 	return nil
 }
 
 // GetIPs returns the list of ip addresses associated with the VM
 func (vm *VM) GetIPs() ([]net.IP, error) {
+	return vm.GetIPsContext(context.Background())
+}
 
-	if err := vm.updateInfo(); err != nil {
+// GetIPsContext is like GetIPs but gives up on the API call when ctx is done.
+func (vm *VM) GetIPsContext(ctx context.Context) ([]net.IP, error) {
+
+	if err := vm.updateInfo(ctx); err != nil {
 		return nil, err
 	}
 
@@ -168,6 +207,12 @@ func (vm *VM) GetIPs() ([]net.IP, error) {
 
 // Destroy removes virtual machine and all storage associated
 func (vm *VM) Destroy() error {
+	return vm.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but gives up on the API call when ctx is done.
+func (vm *VM) DestroyContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, virtualmachine.OpDestroy)(&err)
 
 	if vm.ID == "" {
 		return fmt.Errorf("Need an ID to destroy the virtual machine")
@@ -176,15 +221,14 @@ func (vm *VM) Destroy() error {
 	params := url.Values{}
 	params.Set("id", vm.ID)
 
-	client := vm.getExoClient()
-	resp, err := client.Request("destroyVirtualMachine", params)
+	resp, err := vm.request(ctx, "destroyVirtualMachine", params)
 	if err != nil {
-		return fmt.Errorf("Destroying virtual machine %q: %s", vm.ID, err)
+		return fmt.Errorf("Destroying virtual machine %q: %w", vm.ID, err)
 	}
 
 	destroy := &egoscale.DestroyVirtualMachineResponse{}
 	if err := json.Unmarshal(resp, destroy); err != nil {
-		return fmt.Errorf("Destroying virtual machine %q: %s", vm.ID, err)
+		return fmt.Errorf("Destroying virtual machine %q: %w", vm.ID, err)
 	}
 
 	vm.JobID = destroy.JobID
@@ -194,16 +238,59 @@ func (vm *VM) Destroy() error {
 
 // GetState returns virtual machine state
 func (vm *VM) GetState() (string, error) {
+	return vm.GetStateContext(context.Background())
+}
+
+// GetStateContext is like GetState but gives up on the API call when ctx is
+// done.
+func (vm *VM) GetStateContext(ctx context.Context) (string, error) {
+	d, err := vm.GetStateDetail(ctx)
+	return d.State, err
+}
+
+// GetStateDetail is like GetStateContext but also returns the CloudStack
+// state, such as "Stopping".
+func (vm *VM) GetStateDetail(ctx context.Context) (virtualmachine.StateDetail, error) {
 
 	if vm.ID == "" {
-		return "", fmt.Errorf("Need an ID to get virtual machine state")
+		return virtualmachine.StateDetail{}, fmt.Errorf("Need an ID to get virtual machine state")
+	}
+
+	if err := vm.updateInfo(ctx); err != nil {
+		if err == errNotFound {
+			return virtualmachine.StateDetail{State: virtualmachine.VMNotFound}, nil
+		}
+		return virtualmachine.StateDetail{}, err
 	}
 
-	if err := vm.updateInfo(); err != nil {
-		return "", err
+	return virtualmachine.StateDetail{State: translateState(vm.state), Raw: vm.state}, nil
+}
+
+// translateState maps a CloudStack virtual machine state to a
+// virtualmachine.VM* state.
+func translateState(state string) string {
+	switch state {
+	case "Starting":
+		return virtualmachine.VMStarting
+	case "Running":
+		return virtualmachine.VMRunning
+	case "Stopping", "Migrating", "Expunging":
+		return virtualmachine.VMPending
+	case "Stopped", "Shutdowned":
+		return virtualmachine.VMHalted
+	case "Destroyed":
+		return virtualmachine.VMTerminated
+	case "Error":
+		return virtualmachine.VMError
+	default:
+		return virtualmachine.VMUnknown
 	}
+}
 
-	return vm.state, nil
+// Capabilities reports that Exoscale VMs support none of the optional
+// features.
+func (vm *VM) Capabilities() virtualmachine.Capabilities {
+	return virtualmachine.Capabilities{}
 }
 
 // Suspend pauses the virtual machine. Not supported
@@ -216,8 +303,24 @@ func (vm *VM) Resume() error {
 	return virtualmachine.ErrResumeNotSupported
 }
 
+// SuspendContext pauses the virtual machine. Not supported
+func (vm *VM) SuspendContext(ctx context.Context) error {
+	return virtualmachine.ErrSuspendNotSupported
+}
+
+// ResumeContext resumes a suspended virtual machine. Not supported
+func (vm *VM) ResumeContext(ctx context.Context) error {
+	return virtualmachine.ErrResumeNotSupported
+}
+
 // Halt stop a virtual machine
 func (vm *VM) Halt() error {
+	return vm.HaltContext(context.Background())
+}
+
+// HaltContext is like Halt but gives up on the API call when ctx is done.
+func (vm *VM) HaltContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, virtualmachine.OpHalt)(&err)
 
 	if vm.ID == "" {
 		return fmt.Errorf("Need an ID to stop the virtual machine")
@@ -226,15 +329,14 @@ func (vm *VM) Halt() error {
 	params := url.Values{}
 	params.Set("id", vm.ID)
 
-	client := vm.getExoClient()
-	resp, err := client.Request("stopVirtualMachine", params)
+	resp, err := vm.request(ctx, "stopVirtualMachine", params)
 	if err != nil {
-		return fmt.Errorf("Stopping virtual machine %q: %s", vm.ID, err)
+		return fmt.Errorf("Stopping virtual machine %q: %w", vm.ID, err)
 	}
 
 	stop := &egoscale.StopVirtualMachineResponse{}
 	if err := json.Unmarshal(resp, stop); err != nil {
-		return fmt.Errorf("Stopping virtual machine %q: %s", vm.ID, err)
+		return fmt.Errorf("Stopping virtual machine %q: %w", vm.ID, err)
 	}
 
 	vm.JobID = stop.JobID
@@ -245,6 +347,12 @@ func (vm *VM) Halt() error {
 
 // Start starts virtual machine
 func (vm *VM) Start() error {
+	return vm.StartContext(context.Background())
+}
+
+// StartContext is like Start but gives up on the API call when ctx is done.
+func (vm *VM) StartContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, virtualmachine.OpStart)(&err)
 
 	if vm.ID == "" {
 		return fmt.Errorf("Need an ID to start the virtual machine")
@@ -253,15 +361,14 @@ func (vm *VM) Start() error {
 	params := url.Values{}
 	params.Set("id", vm.ID)
 
-	client := vm.getExoClient()
-	resp, err := client.Request("startVirtualMachine", params)
+	resp, err := vm.request(ctx, "startVirtualMachine", params)
 	if err != nil {
-		return fmt.Errorf("Starting virtual machine %q: %s", vm.ID, err)
+		return fmt.Errorf("Starting virtual machine %q: %w", vm.ID, err)
 	}
 
 	start := &egoscale.StartVirtualMachineResponse{}
 	if err := json.Unmarshal(resp, start); err != nil {
-		return fmt.Errorf("Starting virtual machine %q: %s", vm.ID, err)
+		return fmt.Errorf("Starting virtual machine %q: %w", vm.ID, err)
 	}
 
 	vm.JobID = start.JobID
@@ -271,8 +378,13 @@ func (vm *VM) Start() error {
 
 // GetSSH returns SSH keys to access the virtual machine
 func (vm *VM) GetSSH(options ssh.Options) (ssh.Client, error) {
+	return vm.GetSSHContext(context.Background(), options)
+}
+
+// GetSSHContext is like GetSSH but stops waiting for sshd when ctx is done.
+func (vm *VM) GetSSHContext(ctx context.Context, options ssh.Options) (ssh.Client, error) {
 
-	ips, err := util.GetVMIPs(vm, options)
+	ips, err := util.GetVMIPsContext(ctx, vm, options)
 	if err != nil {
 		return nil, err
 	}
@@ -283,9 +395,10 @@ func (vm *VM) GetSSH(options ssh.Options) (ssh.Client, error) {
 		Options: options,
 		Port:    22,
 	}
-	if err := client.WaitForSSH(SSHTimeout); err != nil {
+	if err := client.WaitForSSHContext(ctx, SSHTimeout); err != nil {
 		return nil, err
 	}
+	client.Disconnect()
 
 	return client, nil
 
@@ -0,0 +1,63 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package exoscale
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apcera/libretto/virtualmachine"
+)
+
+func TestTranslateState(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"Starting", virtualmachine.VMStarting},
+		{"Running", virtualmachine.VMRunning},
+		{"Stopping", virtualmachine.VMPending},
+		{"Migrating", virtualmachine.VMPending},
+		{"Expunging", virtualmachine.VMPending},
+		{"Stopped", virtualmachine.VMHalted},
+		{"Shutdowned", virtualmachine.VMHalted},
+		{"Destroyed", virtualmachine.VMTerminated},
+		{"Error", virtualmachine.VMError},
+		{"Unknown", virtualmachine.VMUnknown},
+		{"", virtualmachine.VMUnknown},
+	}
+	for _, tt := range tests {
+		if got := translateState(tt.raw); got != tt.want {
+			t.Errorf("translateState(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestGetStateDetail(t *testing.T) {
+	tests := []struct {
+		listing string
+		want    virtualmachine.StateDetail
+	}{
+		{`{"count":0}`, virtualmachine.StateDetail{State: virtualmachine.VMNotFound}},
+		{`{"count":1,"virtualmachine":[{"id":"vm-1","state":"Destroyed"}]}`, virtualmachine.StateDetail{State: virtualmachine.VMTerminated, Raw: "Destroyed"}},
+		{`{"count":1,"virtualmachine":[{"id":"vm-1","state":"Running"}]}`, virtualmachine.StateDetail{State: virtualmachine.VMRunning, Raw: "Running"}},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if cmd := r.URL.Query().Get("command"); cmd != "listVirtualMachines" {
+				t.Errorf("Expected listVirtualMachines, got %q", cmd)
+			}
+			w.Write([]byte(`{"listvirtualmachinesresponse":` + tt.listing + `}`))
+		}))
+		vm := &VM{Config: Config{Endpoint: srv.URL}, ID: "vm-1"}
+		d, err := vm.GetStateDetail(context.Background())
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: expected no error, got: %s", tt.listing, err)
+		}
+		if d != tt.want {
+			t.Errorf("%s: GetStateDetail() = %+v, want %+v", tt.listing, d, tt.want)
+		}
+	}
+}
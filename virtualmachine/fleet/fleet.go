@@ -0,0 +1,238 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// Package fleet runs an operation, such as Provision or Destroy, on many VMs
+// at once. It bounds the number of operations in flight, spaces out the calls
+// made to each provider, and reports the outcome for every VM.
+package fleet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/wait"
+)
+
+// DefaultParallelism is the number of operations run at once when
+// Options.Parallelism is not set.
+const DefaultParallelism = 10
+
+// ErrSkipped is the error reported for the VMs that a FailFast run did not get
+// to after an operation failed.
+var ErrSkipped = errors.New("skipped after an earlier failure")
+
+// Op is an operation run on each VM of a fleet.
+type Op func(ctx context.Context, vm lvm.VirtualMachine) error
+
+// Mode decides what Run does when an operation fails.
+type Mode int
+
+const (
+	// BestEffort runs the operation on every VM regardless of failures.
+	BestEffort Mode = iota
+	// FailFast cancels the operations in flight after the first failure and
+	// skips the VMs not started yet.
+	FailFast
+)
+
+// Options control how Run goes through a fleet.
+type Options struct {
+	// Parallelism is the maximum number of operations in flight. If zero,
+	// DefaultParallelism is used.
+	Parallelism int
+	// Mode decides what happens after an operation fails.
+	Mode Mode
+	// Limiters space out the operations started on the VMs of a provider,
+	// keyed by the provider name reported by virtualmachine.ProviderOf. For
+	// ProvisionAll, a provider without an entry uses the Limiter it set with
+	// wait.SetLimiter, such as aws.ProvisionLimiter, if any, since providers
+	// only rate limit Provision with it. The operation does not wait for the
+	// same Limiter again.
+	Limiters map[string]*wait.Limiter
+}
+
+// Result is the outcome of the operation on one VM.
+type Result struct {
+	// Index is the position of the VM in the slice given to Run.
+	Index int
+	VM    lvm.VirtualMachine
+	// Err is the error returned by the operation, ErrSkipped, or the
+	// context's error if it was done before the operation started.
+	Err error
+	// Duration is the time the operation took, rate limiting included.
+	Duration time.Duration
+}
+
+// Report holds the results of Run, in the order of the VMs given to it.
+type Report struct {
+	Results []Result
+}
+
+// Failed returns the results whose operation did not succeed.
+func (r *Report) Failed() []Result {
+	var failed []Result
+	for _, res := range r.Results {
+		if res.Err != nil {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// Err returns an error combining the errors of the failed operations, or nil
+// if all of them succeeded. VMs skipped by a FailFast run are left out.
+func (r *Report) Err() error {
+	var errs []error
+	for _, res := range r.Failed() {
+		if res.Err == ErrSkipped {
+			continue
+		}
+		errs = append(errs, fmt.Errorf("VM %d: %w", res.Index, res.Err))
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return lvm.JoinErrors("; ", errs...)
+}
+
+// Run runs op on every VM in vms and waits for all of them to finish.
+func Run(ctx context.Context, vms []lvm.VirtualMachine, op Op, opts Options) *Report {
+	return runAll(ctx, vms, op, opts, false)
+}
+
+// runAll is Run, also waiting for the Limiters set with wait.SetLimiter if
+// provision is set.
+func runAll(ctx context.Context, vms []lvm.VirtualMachine, op Op, opts Options, provision bool) *Report {
+	n := opts.Parallelism
+	if n <= 0 {
+		n = DefaultParallelism
+	}
+	if n > len(vms) {
+		n = len(vms)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	report := &Report{Results: make([]Result, len(vms))}
+	var (
+		mu     sync.Mutex
+		failed bool
+	)
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				vm := vms[i]
+				start := time.Now()
+				mu.Lock()
+				skip := failed
+				mu.Unlock()
+
+				var err error
+				switch {
+				case skip:
+					err = ErrSkipped
+				case ctx.Err() != nil:
+					err = ctx.Err()
+				default:
+					err = run(ctx, vm, op, opts.Limiters, provision)
+				}
+				report.Results[i] = Result{Index: i, VM: vm, Err: err, Duration: time.Since(start)}
+
+				if err != nil && !skip && opts.Mode == FailFast {
+					mu.Lock()
+					failed = true
+					mu.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+	for i := range vms {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return report
+}
+
+// run waits for the Limiter of vm's provider, if any, and runs op on vm. The
+// Limiter set with wait.SetLimiter is only used if provision is set.
+func run(ctx context.Context, vm lvm.VirtualMachine, op Op, limiters map[string]*wait.Limiter, provision bool) error {
+	provider := lvm.ProviderOf(vm)
+	l := limiters[provider]
+	if l == nil && provision {
+		l = wait.LimiterOf(provider)
+	}
+	if l != nil {
+		if err := l.Wait(ctx); err != nil {
+			return err
+		}
+		ctx = l.Waited(ctx)
+	}
+	return op(ctx, vm)
+}
+
+// ProvisionAll runs Provision on every VM in vms.
+func ProvisionAll(ctx context.Context, vms []lvm.VirtualMachine, opts Options) *Report {
+	return runAll(ctx, vms, Provision, opts, true)
+}
+
+// DestroyAll runs Destroy on every VM in vms.
+func DestroyAll(ctx context.Context, vms []lvm.VirtualMachine, opts Options) *Report {
+	return Run(ctx, vms, Destroy, opts)
+}
+
+// HaltAll runs Halt on every VM in vms.
+func HaltAll(ctx context.Context, vms []lvm.VirtualMachine, opts Options) *Report {
+	return Run(ctx, vms, Halt, opts)
+}
+
+// StartAll runs Start on every VM in vms.
+func StartAll(ctx context.Context, vms []lvm.VirtualMachine, opts Options) *Report {
+	return Run(ctx, vms, Start, opts)
+}
+
+// Provision is an Op that provisions vm, bound to ctx if vm implements
+// virtualmachine.VirtualMachineContext.
+func Provision(ctx context.Context, vm lvm.VirtualMachine) error {
+	if c, ok := vm.(lvm.VirtualMachineContext); ok {
+		return c.ProvisionContext(ctx)
+	}
+	return vm.Provision()
+}
+
+// Destroy is an Op that destroys vm, bound to ctx if vm implements
+// virtualmachine.VirtualMachineContext.
+func Destroy(ctx context.Context, vm lvm.VirtualMachine) error {
+	if c, ok := vm.(lvm.VirtualMachineContext); ok {
+		return c.DestroyContext(ctx)
+	}
+	return vm.Destroy()
+}
+
+// Halt is an Op that halts vm, bound to ctx if vm implements
+// virtualmachine.VirtualMachineContext.
+func Halt(ctx context.Context, vm lvm.VirtualMachine) error {
+	if c, ok := vm.(lvm.VirtualMachineContext); ok {
+		return c.HaltContext(ctx)
+	}
+	return vm.Halt()
+}
+
+// Start is an Op that starts vm, bound to ctx if vm implements
+// virtualmachine.VirtualMachineContext.
+func Start(ctx context.Context, vm lvm.VirtualMachine) error {
+	if c, ok := vm.(lvm.VirtualMachineContext); ok {
+		return c.StartContext(ctx)
+	}
+	return vm.Start()
+}
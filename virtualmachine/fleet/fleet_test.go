@@ -0,0 +1,171 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package fleet
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/mockprovider"
+	"github.com/apcera/libretto/virtualmachine/wait"
+)
+
+// mockFleet returns n mock VMs whose Provision calls provision.
+func mockFleet(n int, provision func(i int) error) []lvm.VirtualMachine {
+	vms := make([]lvm.VirtualMachine, n)
+	for i := range vms {
+		i := i
+		vms[i] = &mockprovider.VM{MockProvision: func() error { return provision(i) }}
+	}
+	return vms
+}
+
+// TestRunParallelism makes sure no more than Parallelism operations are in
+// flight and that every VM gets a result.
+func TestRunParallelism(t *testing.T) {
+	var inFlight, peak int32
+	vms := mockFleet(20, func(int) error {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		return nil
+	})
+
+	r := ProvisionAll(context.Background(), vms, Options{Parallelism: 3})
+	if err := r.Err(); err != nil {
+		t.Fatalf("Err() = %s, want nil", err)
+	}
+	if peak > 3 {
+		t.Fatalf("%d operations in flight, want at most 3", peak)
+	}
+	for i, res := range r.Results {
+		if res.Index != i || res.VM != vms[i] {
+			t.Fatalf("result %d is for VM %d", i, res.Index)
+		}
+	}
+}
+
+// TestRunBestEffort makes sure a failure does not stop the other VMs.
+func TestRunBestEffort(t *testing.T) {
+	errBoom := errors.New("boom")
+	var calls int32
+	vms := mockFleet(10, func(i int) error {
+		atomic.AddInt32(&calls, 1)
+		if i == 0 {
+			return errBoom
+		}
+		return nil
+	})
+
+	r := Run(context.Background(), vms, Provision, Options{Parallelism: 1})
+	if calls != 10 {
+		t.Fatalf("%d VMs provisioned, want 10", calls)
+	}
+	if failed := r.Failed(); len(failed) != 1 || failed[0].Index != 0 {
+		t.Fatalf("Failed() = %v, want VM 0 only", failed)
+	}
+	if !errors.Is(r.Err(), errBoom) {
+		t.Fatalf("Err() = %v, want it to wrap %v", r.Err(), errBoom)
+	}
+}
+
+// TestRunFailFast makes sure the VMs after a failure are skipped.
+func TestRunFailFast(t *testing.T) {
+	errBoom := errors.New("boom")
+	vms := mockFleet(10, func(i int) error {
+		if i == 2 {
+			return errBoom
+		}
+		return nil
+	})
+
+	r := Run(context.Background(), vms, Provision, Options{Parallelism: 1, Mode: FailFast})
+	for i, res := range r.Results {
+		switch {
+		case i < 2 && res.Err != nil:
+			t.Fatalf("VM %d: %v, want nil", i, res.Err)
+		case i == 2 && res.Err != errBoom:
+			t.Fatalf("VM %d: %v, want %v", i, res.Err, errBoom)
+		case i > 2 && res.Err != ErrSkipped:
+			t.Fatalf("VM %d: %v, want %v", i, res.Err, ErrSkipped)
+		}
+	}
+	if err := r.Err(); !errors.Is(err, errBoom) || errors.Is(err, ErrSkipped) {
+		t.Fatalf("Err() = %v, want only %v", err, errBoom)
+	}
+}
+
+// TestRunLimiter makes sure the provider's Limiter spaces out operations.
+func TestRunLimiter(t *testing.T) {
+	var starts []time.Time
+	vms := mockFleet(3, func(int) error {
+		starts = append(starts, time.Now())
+		return nil
+	})
+
+	limiters := map[string]*wait.Limiter{"mock": wait.NewLimiter(20*time.Millisecond, 0)}
+	Run(context.Background(), vms, Provision, Options{Parallelism: 1, Limiters: limiters})
+	for i := 1; i < len(starts); i++ {
+		if d := starts[i].Sub(starts[i-1]); d < 15*time.Millisecond {
+			t.Fatalf("operations %d and %d started %s apart, want 20ms", i-1, i, d)
+		}
+	}
+}
+
+// TestRunProviderLimiter makes sure the Limiter set by the provider is used
+// to provision when Limiters has none, and that the operation does not wait
+// for it again.
+func TestRunProviderLimiter(t *testing.T) {
+	l := wait.NewLimiter(20*time.Millisecond, 0)
+	wait.SetLimiter("mock", l)
+	defer wait.SetLimiter("mock", nil)
+
+	var starts []time.Time
+	op := func(ctx context.Context, vm lvm.VirtualMachine) error {
+		waitStart := time.Now()
+		if err := l.Wait(ctx); err != nil {
+			return err
+		}
+		if d := time.Since(waitStart); d > 10*time.Millisecond {
+			t.Errorf("operation waited %s for the Limiter again", d)
+		}
+		starts = append(starts, time.Now())
+		return nil
+	}
+	runAll(context.Background(), mockFleet(3, nil), op, Options{Parallelism: 1}, true)
+	if len(starts) != 3 {
+		t.Fatalf("%d operations ran, want 3", len(starts))
+	}
+	for i := 1; i < len(starts); i++ {
+		if d := starts[i].Sub(starts[i-1]); d < 15*time.Millisecond {
+			t.Fatalf("operations %d and %d started %s apart, want 20ms", i-1, i, d)
+		}
+	}
+}
+
+// TestRunProviderLimiterProvisionOnly makes sure the Limiter set by the
+// provider does not space out other operations.
+func TestRunProviderLimiterProvisionOnly(t *testing.T) {
+	wait.SetLimiter("mock", wait.NewLimiter(time.Hour, 0))
+	defer wait.SetLimiter("mock", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	vms := make([]lvm.VirtualMachine, 3)
+	for i := range vms {
+		vms[i] = &mockprovider.VM{MockHalt: func() error { return nil }}
+	}
+	if err := HaltAll(ctx, vms, Options{Parallelism: 1}).Err(); err != nil {
+		t.Fatalf("Err() = %s, want nil", err)
+	}
+}
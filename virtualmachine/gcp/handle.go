@@ -0,0 +1,57 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package gcp
+
+import (
+	"github.com/apcera/libretto/virtualmachine"
+)
+
+var _ virtualmachine.Handler = (*VM)(nil)
+
+// handle holds what is needed to manage an instance from another process.
+type handle struct {
+	Name          string   `json:"name"`
+	Project       string   `json:"project"`
+	Zone          string   `json:"zone"`
+	Disks         []string `json:"disks,omitempty"`
+	UseInternalIP bool     `json:"use_internal_ip,omitempty"`
+}
+
+// MarshalHandle serializes the name, project and zone of the instance and the
+// names of its disks. The account file is not included.
+func (vm *VM) MarshalHandle() ([]byte, error) {
+	if vm.Name == "" || vm.Zone == "" {
+		return nil, virtualmachine.ErrHandleIncomplete
+	}
+	h := handle{
+		Name:          vm.Name,
+		Project:       vm.Project,
+		Zone:          vm.Zone,
+		UseInternalIP: vm.UseInternalIP,
+	}
+	for _, d := range vm.Disks {
+		h.Disks = append(h.Disks, d.Name)
+	}
+	return virtualmachine.EncodeHandle(providerName, h)
+}
+
+// UnmarshalHandle restores a handle written by MarshalHandle into the VM.
+func (vm *VM) UnmarshalHandle(data []byte) error {
+	var h handle
+	if err := virtualmachine.DecodeHandle(providerName, data, &h); err != nil {
+		return err
+	}
+	if h.Name == "" || h.Zone == "" {
+		return virtualmachine.ErrHandleIncomplete
+	}
+
+	vm.Name = h.Name
+	vm.Project = h.Project
+	vm.Zone = h.Zone
+	vm.UseInternalIP = h.UseInternalIP
+	vm.Disks = nil
+	for _, name := range h.Disks {
+		vm.Disks = append(vm.Disks, Disk{Name: name})
+	}
+	return nil
+}
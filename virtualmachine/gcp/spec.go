@@ -0,0 +1,96 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package gcp
+
+import (
+	"strings"
+
+	"github.com/apcera/libretto/ssh"
+	"github.com/apcera/libretto/virtualmachine"
+)
+
+// providerName is the name the provider is registered under.
+const providerName = "gcp"
+
+func init() {
+	virtualmachine.Register(providerName, FromSpec)
+}
+
+// Provider returns the name the provider is registered under.
+func (vm *VM) Provider() string {
+	return providerName
+}
+
+// FromSpec builds a GCE VM from a provider-neutral spec. Image is the source
+// image, Size the machine type and Region the zone. Disks are created in
+// order, the first one being the boot disk, and the first network gives the
+// network (Name) and subnetwork. The following options are read:
+//
+//	project                GCE project (required)
+//	account_file           path to, or contents of, the account JSON file
+//	image_projects         comma-separated projects to look the image up in
+//	scopes                 comma-separated access scopes
+//	network_tags           comma-separated instance tags
+//	private_ip             private IP address of the instance
+//	use_internal_ip        "true" to connect over the private IP
+//	preemptible            "true" for a preemptible instance
+//	keep_disks_on_destroy  "true" to keep the disks when the VM is deleted
+func FromSpec(spec *virtualmachine.Spec) (virtualmachine.VirtualMachine, error) {
+	vm := &VM{
+		Name:             spec.Name,
+		Zone:             spec.Region,
+		MachineType:      spec.Size,
+		SourceImage:      spec.Image,
+		ImageProjects:    splitOption(spec.Option("image_projects")),
+		PrivateIPAddress: spec.Option("private_ip"),
+		Scopes:           splitOption(spec.Option("scopes")),
+		Project:          spec.Option("project"),
+		Tags:             splitOption(spec.Option("network_tags")),
+		AccountFile:      spec.Option("account_file"),
+		SSHCreds: ssh.Credentials{
+			SSHUser:       spec.SSH.User,
+			SSHPassword:   spec.SSH.Password,
+			SSHPrivateKey: spec.SSH.PrivateKey,
+		},
+		SSHPublicKey:  spec.SSH.PublicKey,
+		KeepOnFailure: spec.KeepOnFailure,
+	}
+
+	var err error
+	if vm.UseInternalIP, err = spec.BoolOption("use_internal_ip"); err != nil {
+		return nil, err
+	}
+	if vm.Preemptible, err = spec.BoolOption("preemptible"); err != nil {
+		return nil, err
+	}
+	keepDisks, err := spec.BoolOption("keep_disks_on_destroy")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range spec.Disks {
+		vm.Disks = append(vm.Disks, Disk{
+			Name:       d.Name,
+			DiskType:   d.Type,
+			DiskSizeGb: d.SizeGB,
+			AutoDelete: !keepDisks,
+		})
+	}
+	if len(spec.Networks) > 0 {
+		vm.Network = spec.Networks[0].Name
+		vm.Subnetwork = spec.Networks[0].Subnet
+	}
+	return vm, nil
+}
+
+// splitOption splits a comma-separated option, returning nil if it is empty.
+func splitOption(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var parts []string
+	for _, p := range strings.Split(s, ",") {
+		parts = append(parts, strings.TrimSpace(p))
+	}
+	return parts
+}
@@ -14,11 +14,14 @@ import (
 	"strings"
 	"time"
 
+	"github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/wait"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
 
 	googlecloud "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 )
 
 var (
@@ -73,43 +76,88 @@ func (vm *VM) getService() (*googleService, error) {
 }
 
 // get instance from current VM definition.
-func (svc *googleService) getInstance() (*googlecloud.Instance, error) {
-	return svc.service.Instances.Get(svc.vm.Project, svc.vm.Zone, svc.vm.Name).Do()
+func (svc *googleService) getInstance(ctx context.Context) (*googlecloud.Instance, error) {
+	return svc.service.Instances.Get(svc.vm.Project, svc.vm.Zone, svc.vm.Name).Context(ctx).Do()
 }
 
-// waitForOperation pulls to wait for the operation to finish.
-func waitForOperation(timeout int, funcOperation func() (*googlecloud.Operation, error)) error {
+// waitForOperation pulls to wait for the operation to finish, or until ctx
+// is done.
+func waitForOperation(ctx context.Context, timeout int, funcOperation func(ctx context.Context) (*googlecloud.Operation, error)) error {
 	var op *googlecloud.Operation
-	var err error
-
-	for i := 0; i < timeout; i++ {
-		op, err = funcOperation()
+	w := wait.Waiter{
+		Backoff: wait.Constant(time.Second),
+		Timeout: time.Duration(timeout) * time.Second,
+	}
+	err := w.Until(ctx, func(ctx context.Context) (bool, error) {
+		var err error
+		op, err = funcOperation(ctx)
 		if err != nil {
-			return err
+			return false, err
 		}
 
 		if op.Status == "DONE" {
 			if op.Error != nil {
-				return fmt.Errorf("operation error: %v", *op.Error.Errors[0])
+				err := fmt.Errorf("operation error: %v", *op.Error.Errors[0])
+				return false, virtualmachine.NewError(operationErrorKinds[op.Error.Errors[0].Code], err)
 			}
-			return nil
+			return true, nil
+		}
+		return false, nil
+	})
+	if err == wait.ErrTimeout {
+		status := ""
+		if op != nil {
+			status = op.Status
 		}
-		time.Sleep(1 * time.Second)
+		return virtualmachine.NewError(virtualmachine.Timeout, fmt.Errorf("operation timeout, operations status: %v", status))
 	}
+	return err
+}
 
-	return fmt.Errorf("operation timeout, operations status: %v", op.Status)
+// operationErrorKinds maps the codes of failed operations to their kinds.
+var operationErrorKinds = map[string]virtualmachine.Kind{
+	"RESOURCE_NOT_FOUND":           virtualmachine.NotFound,
+	"RESOURCE_ALREADY_EXISTS":      virtualmachine.AlreadyExists,
+	"QUOTA_EXCEEDED":               virtualmachine.QuotaExceeded,
+	"ZONE_RESOURCE_POOL_EXHAUSTED": virtualmachine.Transient,
+}
+
+// classify gives err the virtualmachine.Kind that matches its GCE error
+// reason or HTTP status, keeping the GCE error in the chain.
+func classify(err error) error {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return err
+	}
+	for _, e := range gerr.Errors {
+		switch e.Reason {
+		case "quotaExceeded":
+			return virtualmachine.NewError(virtualmachine.QuotaExceeded, err)
+		case "rateLimitExceeded", "userRateLimitExceeded", "backendError":
+			return virtualmachine.NewError(virtualmachine.Transient, err)
+		}
+	}
+	return virtualmachine.NewError(virtualmachine.KindForStatus(gerr.Code), err)
+}
+
+// ignoreNotFound returns nil if err means the resource does not exist.
+func ignoreNotFound(err error) error {
+	if virtualmachine.KindOf(classify(err)) == virtualmachine.NotFound {
+		return nil
+	}
+	return err
 }
 
 // waitForOperationReady waits for the regional operation to finish.
-func (svc *googleService) waitForOperationReady(operation string) error {
-	return waitForOperation(OperationTimeout, func() (*googlecloud.Operation, error) {
-		return svc.service.ZoneOperations.Get(svc.vm.Project, svc.vm.Zone, operation).Do()
+func (svc *googleService) waitForOperationReady(ctx context.Context, operation string) error {
+	return waitForOperation(ctx, OperationTimeout, func(ctx context.Context) (*googlecloud.Operation, error) {
+		return svc.service.ZoneOperations.Get(svc.vm.Project, svc.vm.Zone, operation).Context(ctx).Do()
 	})
 }
 
-func (svc *googleService) getImage() (*googlecloud.Image, error) {
+func (svc *googleService) getImage(ctx context.Context) (*googlecloud.Image, error) {
 	for _, img := range svc.vm.ImageProjects {
-		image, err := svc.service.Images.Get(img, svc.vm.SourceImage).Do()
+		image, err := svc.service.Images.Get(img, svc.vm.SourceImage).Context(ctx).Do()
 		if err == nil && image != nil && image.SelfLink != "" {
 			return image, nil
 		}
@@ -120,13 +168,13 @@ func (svc *googleService) getImage() (*googlecloud.Image, error) {
 	return nil, err
 }
 
-// createDisks creates non-booted disk.
-func (svc *googleService) createDisks() (disks []*googlecloud.AttachedDisk, err error) {
+// createDisks creates non-booted disk. The disks it creates are added to rb.
+func (svc *googleService) createDisks(ctx context.Context, rb *virtualmachine.Rollback) (disks []*googlecloud.AttachedDisk, err error) {
 	if len(svc.vm.Disks) == 0 {
 		return nil, errors.New("no disks were found")
 	}
 
-	image, err := svc.getImage()
+	image, err := svc.getImage(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -150,7 +198,7 @@ func (svc *googleService) createDisks() (disks []*googlecloud.AttachedDisk, err
 		}
 
 		// Reuse the existing disk, create non-booted devices if it does not exist
-		searchDisk, _ := svc.getDisk(disk.Name)
+		searchDisk, _ := svc.getDisk(ctx, disk.Name)
 		if searchDisk == nil {
 			d := &googlecloud.Disk{
 				Name:   disk.Name,
@@ -158,12 +206,16 @@ func (svc *googleService) createDisks() (disks []*googlecloud.AttachedDisk, err
 				Type:   fmt.Sprintf("zones/%s/diskTypes/%s", svc.vm.Zone, disk.DiskType),
 			}
 
-			op, err := svc.service.Disks.Insert(svc.vm.Project, svc.vm.Zone, d).Do()
+			op, err := svc.service.Disks.Insert(svc.vm.Project, svc.vm.Zone, d).Context(ctx).Do()
 			if err != nil {
 				return disks, fmt.Errorf("error while creating disk %s: %v", disk.Name, err)
 			}
+			name := disk.Name
+			rb.Add("disk "+name, func(ctx context.Context) error {
+				return ignoreNotFound(svc.deleteDisk(ctx, name))
+			})
 
-			err = svc.waitForOperationReady(op.Name)
+			err = svc.waitForOperationReady(ctx, op.Name)
 			if err != nil {
 				return disks, fmt.Errorf("error while waiting for the disk %s ready, error: %v", disk.Name, err)
 			}
@@ -183,24 +235,24 @@ func (svc *googleService) createDisks() (disks []*googlecloud.AttachedDisk, err
 }
 
 // getDisk retrieves the Disk object.
-func (svc *googleService) getDisk(name string) (*googlecloud.Disk, error) {
-	return svc.service.Disks.Get(svc.vm.Project, svc.vm.Zone, name).Do()
+func (svc *googleService) getDisk(ctx context.Context, name string) (*googlecloud.Disk, error) {
+	return svc.service.Disks.Get(svc.vm.Project, svc.vm.Zone, name).Context(ctx).Do()
 }
 
 // deleteDisk deletes the persistent disk.
-func (svc *googleService) deleteDisk(name string) error {
-	op, err := svc.service.Disks.Delete(svc.vm.Project, svc.vm.Zone, name).Do()
+func (svc *googleService) deleteDisk(ctx context.Context, name string) error {
+	op, err := svc.service.Disks.Delete(svc.vm.Project, svc.vm.Zone, name).Context(ctx).Do()
 	if err != nil {
 		return err
 	}
 
-	return svc.waitForOperationReady(op.Name)
+	return svc.waitForOperationReady(ctx, op.Name)
 }
 
 // deleteDisks deletes all the persistent disk.
-func (svc *googleService) deleteDisks() (errs []error) {
+func (svc *googleService) deleteDisks(ctx context.Context) (errs []error) {
 	for _, disk := range svc.vm.Disks {
-		err := svc.deleteDisk(disk.Name)
+		err := svc.deleteDisk(ctx, disk.Name)
 		if err != nil {
 			errs = append(errs, err)
 		}
@@ -209,8 +261,8 @@ func (svc *googleService) deleteDisks() (errs []error) {
 }
 
 // getIPs returns the IP addresses of the GCE instance.
-func (svc *googleService) getIPs() ([]net.IP, error) {
-	instance, err := svc.service.Instances.Get(svc.vm.Project, svc.vm.Zone, svc.vm.Name).Do()
+func (svc *googleService) getIPs(ctx context.Context) ([]net.IP, error) {
+	instance, err := svc.service.Instances.Get(svc.vm.Project, svc.vm.Zone, svc.vm.Name).Context(ctx).Do()
 	if err != nil {
 		return nil, err
 	}
@@ -234,19 +286,20 @@ func (svc *googleService) getIPs() ([]net.IP, error) {
 	return ips, nil
 }
 
-// provision a new googlecloud VM instance.
-func (svc *googleService) provision() error {
-	zone, err := svc.service.Zones.Get(svc.vm.Project, svc.vm.Zone).Do()
+// provision a new googlecloud VM instance. The disks and instance it creates
+// are deleted again if it fails, unless the VM has KeepOnFailure set.
+func (svc *googleService) provision(ctx context.Context) (err error) {
+	zone, err := svc.service.Zones.Get(svc.vm.Project, svc.vm.Zone).Context(ctx).Do()
 	if err != nil {
 		return err
 	}
 
-	machineType, err := svc.service.MachineTypes.Get(svc.vm.Project, zone.Name, svc.vm.MachineType).Do()
+	machineType, err := svc.service.MachineTypes.Get(svc.vm.Project, zone.Name, svc.vm.MachineType).Context(ctx).Do()
 	if err != nil {
 		return err
 	}
 
-	network, err := svc.service.Networks.Get(svc.vm.Project, svc.vm.Network).Do()
+	network, err := svc.service.Networks.Get(svc.vm.Project, svc.vm.Network).Context(ctx).Do()
 	if err != nil {
 		return err
 	}
@@ -262,7 +315,7 @@ func (svc *googleService) provision() error {
 
 	subnetworkSelfLink := ""
 	if svc.vm.Subnetwork != "" {
-		subnetwork, err := svc.service.Subnetworks.Get(svc.vm.Project, svc.vm.region(), svc.vm.Subnetwork).Do()
+		subnetwork, err := svc.service.Subnetworks.Get(svc.vm.Project, svc.vm.region(), svc.vm.Subnetwork).Context(ctx).Do()
 		if err != nil {
 			return err
 		}
@@ -274,9 +327,13 @@ func (svc *googleService) provision() error {
 		Type: "ONE_TO_ONE_NAT",
 	}
 
-	md := svc.getSSHKey()
+	md := svc.getSSHKey(svc.vm.SSHPublicKey)
 
-	disks, err := svc.createDisks()
+	rb := virtualmachine.NewRollback(svc.vm.KeepOnFailure)
+	rb.Events = svc.vm.events()
+	defer rb.Finish(&err)
+
+	disks, err := svc.createDisks(ctx, rb)
 	if err != nil {
 		return err
 	}
@@ -318,22 +375,27 @@ func (svc *googleService) provision() error {
 		},
 	}
 
-	op, err := svc.service.Instances.Insert(svc.vm.Project, zone.Name, instance).Do()
+	op, err := svc.service.Instances.Insert(svc.vm.Project, zone.Name, instance).Context(ctx).Do()
 	if err != nil {
 		return err
 	}
+	// Deleting the instance also deletes its auto-delete disks, which is why
+	// the disk steps ignore disks that are already gone.
+	rb.Add("instance "+svc.vm.Name, func(ctx context.Context) error {
+		return ignoreNotFound(svc.delete(ctx))
+	})
 
-	if err = svc.waitForOperationReady(op.Name); err != nil {
+	if err = svc.waitForOperationReady(ctx, op.Name); err != nil {
 		return err
 	}
 
-	_, err = svc.getInstance()
+	_, err = svc.getInstance(ctx)
 	return err
 }
 
 // start starts a stopped GCE instance.
-func (svc *googleService) start() error {
-	instance, err := svc.getInstance()
+func (svc *googleService) start(ctx context.Context) error {
+	instance, err := svc.getInstance(ctx)
 	if err != nil {
 		if !strings.Contains(err.Error(), "no instance found") {
 			return err
@@ -344,40 +406,40 @@ func (svc *googleService) start() error {
 		return errors.New("no instance found")
 	}
 
-	op, err := svc.service.Instances.Start(svc.vm.Project, svc.vm.Zone, svc.vm.Name).Do()
+	op, err := svc.service.Instances.Start(svc.vm.Project, svc.vm.Zone, svc.vm.Name).Context(ctx).Do()
 	if err != nil {
 		return err
 	}
 
-	return svc.waitForOperationReady(op.Name)
+	return svc.waitForOperationReady(ctx, op.Name)
 }
 
 // stop halts a GCE instance.
-func (svc *googleService) stop() error {
-	_, err := svc.getInstance()
+func (svc *googleService) stop(ctx context.Context) error {
+	_, err := svc.getInstance(ctx)
 	if err != nil {
 		if !strings.Contains(err.Error(), "no instance found") {
 			return err
 		}
-		return fmt.Errorf("no instance found, %v", err)
+		return fmt.Errorf("no instance found, %w", err)
 	}
 
-	op, err := svc.service.Instances.Stop(svc.vm.Project, svc.vm.Zone, svc.vm.Name).Do()
+	op, err := svc.service.Instances.Stop(svc.vm.Project, svc.vm.Zone, svc.vm.Name).Context(ctx).Do()
 	if err != nil {
 		return err
 	}
 
-	return svc.waitForOperationReady(op.Name)
+	return svc.waitForOperationReady(ctx, op.Name)
 }
 
 // deletes the GCE instance.
-func (svc *googleService) delete() error {
-	op, err := svc.service.Instances.Delete(svc.vm.Project, svc.vm.Zone, svc.vm.Name).Do()
+func (svc *googleService) delete(ctx context.Context) error {
+	op, err := svc.service.Instances.Delete(svc.vm.Project, svc.vm.Zone, svc.vm.Name).Context(ctx).Do()
 	if err != nil {
 		return err
 	}
 
-	return svc.waitForOperationReady(op.Name)
+	return svc.waitForOperationReady(ctx, op.Name)
 }
 
 // extract the region from zone name.
@@ -403,20 +465,20 @@ func parseAccountFile(file *accountFile, account string) error {
 
 		err = parseAccountJSON(file, string(bytes))
 		if err != nil {
-			return fmt.Errorf("error parsing account file: %s", err)
+			return fmt.Errorf("error parsing account file: %w", err)
 		}
 	}
 
 	return nil
 }
 
-func (svc *googleService) getSSHKey() string {
-	return fmt.Sprintf("%s:%s\n", svc.vm.SSHCreds.SSHUser, svc.vm.SSHPublicKey)
+func (svc *googleService) getSSHKey(publicKey string) string {
+	return fmt.Sprintf("%s:%s\n", svc.vm.SSHCreds.SSHUser, publicKey)
 }
 
-func (svc *googleService) insertSSHKey() error {
-	md := svc.getSSHKey()
-	instance, err := svc.getInstance()
+func (svc *googleService) insertSSHKey(ctx context.Context, publicKey string) error {
+	md := svc.getSSHKey(publicKey)
+	instance, err := svc.getInstance(ctx)
 	if err != nil {
 		return err
 	}
@@ -429,10 +491,10 @@ func (svc *googleService) insertSSHKey() error {
 				Value: &md,
 			},
 		},
-	}).Do()
+	}).Context(ctx).Do()
 	if err != nil {
 		return err
 	}
 
-	return svc.waitForOperationReady(op.Name)
+	return svc.waitForOperationReady(ctx, op.Name)
 }
@@ -3,13 +3,19 @@
 package gcp
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/apcera/libretto/ssh"
 	"github.com/apcera/libretto/util"
 	"github.com/apcera/libretto/virtualmachine"
+	cssh "golang.org/x/crypto/ssh"
+	"google.golang.org/api/googleapi"
 )
 
 const (
@@ -28,8 +34,11 @@ const (
 var SSHTimeout = 3 * time.Minute
 
 var (
-	// Compiler will complain if google.VM doesn't implement VirtualMachine interface.
-	_ virtualmachine.VirtualMachine = (*VM)(nil)
+	// Compiler will complain if google.VM doesn't implement VirtualMachineContext interface.
+	_ virtualmachine.VirtualMachineContext = (*VM)(nil)
+	_ virtualmachine.StateDetailer         = (*VM)(nil)
+	_ virtualmachine.Capabler              = (*VM)(nil)
+	_ virtualmachine.HostKeyer             = (*VM)(nil)
 )
 
 // VM defines a GCE virtual machine.
@@ -58,6 +67,9 @@ type VM struct {
 	account      accountFile
 	SSHCreds     ssh.Credentials // privateKey is required for GCE
 	SSHPublicKey string
+
+	KeepOnFailure bool                    // Keep the disks and instance if Provision fails
+	Observer      virtualmachine.Observer // Receives the events of this VM; may be nil
 }
 
 // Disk represents the GCP Disk.
@@ -74,120 +86,227 @@ func (vm *VM) GetName() string {
 	return vm.Name
 }
 
+// events returns the Events of the VM, sent to its Observer and the global
+// observers.
+func (vm *VM) events() virtualmachine.Events {
+	return virtualmachine.Events{Provider: providerName, Name: vm.Name, VM: vm, Observer: vm.Observer}
+}
+
 // Provision creates a virtual machine on GCE. It returns an error if
-// there was a problem during creation.
+// there was a problem during creation, in which case the disks and instance
+// it created are deleted unless KeepOnFailure is set.
 func (vm *VM) Provision() error {
+	return vm.ProvisionContext(context.Background())
+}
+
+// ProvisionContext is like Provision but the API calls and operation polling
+// are bound to ctx.
+func (vm *VM) ProvisionContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, virtualmachine.OpProvision)(&err)
 	s, err := vm.getService()
 	if err != nil {
 		return err
 	}
 
-	return s.provision()
+	return classify(s.provision(ctx))
 }
 
 // GetIPs returns a slice of IP addresses assigned to the VM.
 func (vm *VM) GetIPs() ([]net.IP, error) {
+	return vm.GetIPsContext(context.Background())
+}
+
+// GetIPsContext is like GetIPs but the API call is bound to ctx.
+func (vm *VM) GetIPsContext(ctx context.Context) ([]net.IP, error) {
 	s, err := vm.getService()
 	if err != nil {
 		return nil, err
 	}
 
-	return s.getIPs()
+	ips, err := s.getIPs(ctx)
+	return ips, classify(err)
 }
 
 // Destroy deletes the VM on GCE.
 func (vm *VM) Destroy() error {
+	return vm.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but the API calls and operation polling are
+// bound to ctx.
+func (vm *VM) DestroyContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, virtualmachine.OpDestroy)(&err)
 	s, err := vm.getService()
 	if err != nil {
 		return err
 	}
 
-	return s.delete()
+	return classify(s.delete(ctx))
 }
 
 // GetState retrieve the instance status.
 func (vm *VM) GetState() (string, error) {
+	return vm.GetStateContext(context.Background())
+}
+
+// GetStateContext is like GetState but the API call is bound to ctx.
+func (vm *VM) GetStateContext(ctx context.Context) (string, error) {
+	d, err := vm.GetStateDetail(ctx)
+	return d.State, err
+}
+
+// GetStateDetail is like GetStateContext but also returns the GCE instance
+// status, such as "STAGING".
+func (vm *VM) GetStateDetail(ctx context.Context) (virtualmachine.StateDetail, error) {
 	s, err := vm.getService()
 	if err != nil {
-		return "", err
+		return virtualmachine.StateDetail{}, err
 	}
 
-	instance, err := s.getInstance()
+	instance, err := s.getInstance(ctx)
 	if err != nil {
-		return "", err
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+			return virtualmachine.StateDetail{State: virtualmachine.VMNotFound}, nil
+		}
+		return virtualmachine.StateDetail{}, classify(err)
 	}
 
+	d := virtualmachine.StateDetail{Raw: instance.Status}
 	switch instance.Status {
 	case "PROVISIONING", "STAGING":
-		return virtualmachine.VMStarting, nil
+		d.State = virtualmachine.VMStarting
 	case "RUNNING":
-		return virtualmachine.VMRunning, nil
+		d.State = virtualmachine.VMRunning
 	case "STOPPING", "STOPPED", "TERMINATED":
-		return virtualmachine.VMHalted, nil
+		d.State = virtualmachine.VMHalted
+	case "SUSPENDING", "SUSPENDED":
+		d.State = virtualmachine.VMSuspended
 	default:
-		return virtualmachine.VMUnknown, nil
+		d.State = virtualmachine.VMUnknown
 	}
+	return d, nil
+}
+
+// Capabilities reports that GCE instances can have extra disks
+// attached.
+func (vm *VM) Capabilities() virtualmachine.Capabilities {
+	return virtualmachine.Capabilities{Volumes: true}
 }
 
 // Suspend is not supported, return the error.
 func (vm *VM) Suspend() error {
-	return errors.New("Suspend action not supported by GCE")
+	return virtualmachine.NewError(virtualmachine.NotSupported, errors.New("Suspend action not supported by GCE"))
 }
 
 // Resume is not supported, return the error.
 func (vm *VM) Resume() error {
-	return errors.New("Resume action not supported by GCE")
+	return virtualmachine.NewError(virtualmachine.NotSupported, errors.New("Resume action not supported by GCE"))
+}
+
+// SuspendContext is not supported, return the error.
+func (vm *VM) SuspendContext(ctx context.Context) error {
+	return vm.Suspend()
+}
+
+// ResumeContext is not supported, return the error.
+func (vm *VM) ResumeContext(ctx context.Context) error {
+	return vm.Resume()
 }
 
 // Halt stops a GCE instance.
 func (vm *VM) Halt() error {
+	return vm.HaltContext(context.Background())
+}
+
+// HaltContext is like Halt but the API calls and operation polling are bound
+// to ctx.
+func (vm *VM) HaltContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, virtualmachine.OpHalt)(&err)
 	s, err := vm.getService()
 	if err != nil {
 		return err
 	}
 
-	return s.stop()
+	return classify(s.stop(ctx))
 }
 
 // Start a stopped GCE instance.
 func (vm *VM) Start() error {
+	return vm.StartContext(context.Background())
+}
+
+// StartContext is like Start but the API calls and operation polling are
+// bound to ctx.
+func (vm *VM) StartContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, virtualmachine.OpStart)(&err)
 	s, err := vm.getService()
 	if err != nil {
 		return err
 	}
 
-	return s.start()
+	return classify(s.start(ctx))
 }
 
 // GetSSH returns an SSH client connected to the instance.
 func (vm *VM) GetSSH(options ssh.Options) (ssh.Client, error) {
-	ips, err := vm.GetIPs()
+	return vm.GetSSHContext(context.Background(), options)
+}
+
+// GetSSHContext is like GetSSH but stops waiting for sshd when ctx is done.
+func (vm *VM) GetSSHContext(ctx context.Context, options ssh.Options) (ssh.Client, error) {
+	ips, err := vm.GetIPsContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	client := &ssh.SSHClient{
 		Creds:   &vm.SSHCreds,
-		IP:      ips[PublicIP],
+		IP:      util.SSHIP(ips, options, PublicIP, PrivateIP),
 		Options: options,
 		Port:    22,
 	}
 
-	if err := client.WaitForSSH(SSHTimeout); err != nil {
+	if err := client.WaitForSSHContext(ctx, SSHTimeout); err != nil {
 		return nil, err
 	}
+	client.Disconnect()
 
 	return client, nil
 }
 
-// InsertSSHKey uploads new ssh key into the GCE instance.
+// GetHostKeys returns the SSH host keys the guest printed on the instance's
+// first serial port, as cloud-init and the GCE guest environment do at boot.
+func (vm *VM) GetHostKeys(ctx context.Context) ([]cssh.PublicKey, error) {
+	s, err := vm.getService()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := s.service.Instances.GetSerialPortOutput(vm.Project, vm.Zone, vm.Name).Context(ctx).Do()
+	if err != nil {
+		return nil, classify(err)
+	}
+	return ssh.ParseHostKeys([]byte(out.Contents))
+}
+
+// InsertSSHKey uploads new ssh key into the GCE instance. The key is in the
+// authorized_keys format and may be an RSA, ECDSA or Ed25519 key.
 func (vm *VM) InsertSSHKey(publicKey string) error {
+	pub, comment, _, _, err := cssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+	key := strings.TrimSpace(string(cssh.MarshalAuthorizedKey(pub)))
+	if comment != "" {
+		key += " " + comment
+	}
+
 	s, err := vm.getService()
 	if err != nil {
 		return err
 	}
 
-	return s.insertSSHKey()
+	return s.insertSSHKey(context.Background(), key)
 }
 
 // DeleteDisks cleans up all the disks attached to the GCE instance.
@@ -197,7 +316,7 @@ func (vm *VM) DeleteDisks() error {
 		return err
 	}
 
-	errs := s.deleteDisks()
+	errs := s.deleteDisks(context.Background())
 	if len(errs) > 0 {
 		err = util.CombineErrors(": ", errs...)
 		return err
@@ -0,0 +1,131 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// handleVersion is the version of the handle envelope written by
+// EncodeHandle. DecodeHandle rejects handles with a newer version.
+const handleVersion = 1
+
+// Handler is implemented by VMs that can be serialized after Provision and
+// reattached in another process. MarshalHandle records the provider name and
+// the identifiers needed to call GetState, GetIPs and Destroy, but never
+// secrets such as API credentials, passwords or private keys; those have to
+// be supplied again when reattaching. UnmarshalHandle restores the
+// identifiers into a VM that already holds those credentials.
+type Handler interface {
+	MarshalHandle() ([]byte, error)
+	UnmarshalHandle(data []byte) error
+}
+
+// Handle is the envelope shared by all providers' serialized handles.
+type Handle struct {
+	Version  int             `json:"version"`
+	Provider string          `json:"provider"`
+	Data     json.RawMessage `json:"data"`
+}
+
+var (
+	// ErrHandleNotSupported is returned when a VM does not implement Handler.
+	ErrHandleNotSupported = NewError(NotSupported, errors.New("VM does not support handles"))
+
+	// ErrHandleIncomplete is returned when a handle cannot be written because
+	// the VM was not provisioned, or cannot be read because it lacks the VM's
+	// identifiers.
+	ErrHandleIncomplete = errors.New("handle does not identify a VM")
+)
+
+// EncodeHandle wraps the provider-specific identifiers in v, which must
+// marshal to JSON, in a Handle for provider. Providers use it to implement
+// MarshalHandle.
+func EncodeHandle(provider string, v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Handle{
+		Version:  handleVersion,
+		Provider: provider,
+		Data:     data,
+	})
+}
+
+// DecodeHandle unwraps a Handle written by EncodeHandle into v. It returns an
+// error if the handle was written by a different provider. Providers use it
+// to implement UnmarshalHandle.
+func DecodeHandle(provider string, data []byte, v interface{}) error {
+	h, err := ParseHandle(data)
+	if err != nil {
+		return err
+	}
+	if h.Provider != provider {
+		return fmt.Errorf("handle is for provider %q, not %q", h.Provider, provider)
+	}
+	if err := json.Unmarshal(h.Data, v); err != nil {
+		return fmt.Errorf("error decoding %s handle: %w", provider, err)
+	}
+	return nil
+}
+
+// ParseHandle parses the envelope of a serialized handle.
+func ParseHandle(data []byte) (*Handle, error) {
+	h := &Handle{}
+	if err := json.Unmarshal(data, h); err != nil {
+		return nil, fmt.Errorf("error decoding handle: %w", err)
+	}
+	if h.Version > handleVersion {
+		return nil, fmt.Errorf("unsupported handle version %d", h.Version)
+	}
+	if h.Provider == "" {
+		return nil, ErrNoProvider
+	}
+	return h, nil
+}
+
+// MarshalHandle serializes vm if it implements Handler.
+func MarshalHandle(vm VirtualMachine) ([]byte, error) {
+	h, ok := vm.(Handler)
+	if !ok {
+		return nil, ErrHandleNotSupported
+	}
+	return h.MarshalHandle()
+}
+
+// Reattach rebuilds the VM described by a serialized handle. The VM is first
+// built from spec with the factory of the handle's provider, which is how
+// credentials are supplied, and then the handle is restored into it. spec may
+// be nil when the provider needs no settings, for example when it takes its
+// credentials from the environment.
+func Reattach(data []byte, spec *Spec) (VirtualMachine, error) {
+	h, err := ParseHandle(data)
+	if err != nil {
+		return nil, err
+	}
+
+	s := Spec{}
+	if spec != nil {
+		s = *spec
+	}
+	if s.Provider != "" && s.Provider != h.Provider {
+		return nil, fmt.Errorf("handle is for provider %q, not %q", h.Provider, s.Provider)
+	}
+	s.Provider = h.Provider
+
+	vm, err := New(&s)
+	if err != nil {
+		return nil, err
+	}
+	handler, ok := vm.(Handler)
+	if !ok {
+		return nil, ErrHandleNotSupported
+	}
+	if err := handler.UnmarshalHandle(data); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
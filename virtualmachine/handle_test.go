@@ -0,0 +1,107 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/mockprovider"
+)
+
+// noHandleProvider builds VMs that do not implement lvm.Handler.
+const noHandleProvider = "test-no-handle"
+
+type noHandleVM struct {
+	lvm.VirtualMachine
+}
+
+func init() {
+	lvm.Register(noHandleProvider, func(*lvm.Spec) (lvm.VirtualMachine, error) {
+		return noHandleVM{}, nil
+	})
+}
+
+// TestReattach makes sure a handle written by MarshalHandle reattaches to an
+// equivalent VM.
+func TestReattach(t *testing.T) {
+	vm, err := lvm.New(&lvm.Spec{Provider: "mock", Name: "test-vm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := lvm.MarshalHandle(vm)
+	if err != nil {
+		t.Fatalf("MarshalHandle returned %s", err)
+	}
+
+	h, err := lvm.ParseHandle(data)
+	if err != nil {
+		t.Fatalf("ParseHandle returned %s", err)
+	}
+	if h.Provider != "mock" || h.Version != 1 {
+		t.Fatalf("handle is for %q version %d, want mock version 1", h.Provider, h.Version)
+	}
+
+	for _, spec := range []*lvm.Spec{nil, {Provider: "mock"}} {
+		reattached, err := lvm.Reattach(data, spec)
+		if err != nil {
+			t.Fatalf("Reattach returned %s", err)
+		}
+		if name := reattached.GetName(); name != "test-vm" {
+			t.Fatalf("reattached VM is named %q, want test-vm", name)
+		}
+	}
+}
+
+// TestHandleErrors makes sure invalid handles are rejected.
+func TestHandleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		spec *lvm.Spec
+		err  string
+	}{
+		{"invalid", `{`, nil, "error decoding handle"},
+		{"newer version", `{"version": 2, "provider": "mock", "data": {}}`, nil, "unsupported handle version 2"},
+		{"no provider", `{"version": 1, "data": {}}`, nil, lvm.ErrNoProvider.Error()},
+		{"unknown provider", `{"version": 1, "provider": "no-such-provider", "data": {}}`, nil, `unknown provider "no-such-provider"`},
+		{"other provider", `{"version": 1, "provider": "mock", "data": {}}`, &lvm.Spec{Provider: "aws"}, `handle is for provider "mock", not "aws"`},
+		{"no handler", `{"version": 1, "provider": "` + noHandleProvider + `", "data": {}}`, nil, lvm.ErrHandleNotSupported.Error()},
+	}
+	for _, tt := range tests {
+		_, err := lvm.Reattach([]byte(tt.data), tt.spec)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("%s: Reattach returned %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// TestDecodeHandle makes sure DecodeHandle only accepts handles of its
+// provider.
+func TestDecodeHandle(t *testing.T) {
+	data, err := lvm.EncodeHandle("mock", map[string]string{"id": "i-1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v struct{ ID string }
+	if err := lvm.DecodeHandle("mock", data, &v); err != nil || v.ID != "i-1234" {
+		t.Fatalf("DecodeHandle returned %+v, %v", v, err)
+	}
+	if err := lvm.DecodeHandle("aws", data, &v); err == nil {
+		t.Fatalf("DecodeHandle accepted a handle of another provider")
+	}
+}
+
+// TestMarshalHandleNotSupported makes sure VMs without handles are reported
+// as such.
+func TestMarshalHandleNotSupported(t *testing.T) {
+	if _, err := lvm.MarshalHandle(noHandleVM{}); !errors.Is(err, lvm.NotSupported) {
+		t.Fatalf("MarshalHandle returned %v, want a NotSupported error", err)
+	}
+	if _, err := lvm.MarshalHandle(&mockprovider.VM{}); err != nil {
+		t.Fatalf("MarshalHandle returned %s", err)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine
+
+import (
+	"context"
+	"errors"
+
+	"github.com/apcera/libretto/ssh"
+	cssh "golang.org/x/crypto/ssh"
+)
+
+// HostKeyer is implemented by VMs whose provider can tell their SSH host keys
+// without connecting to them, usually from the console output cloud-init
+// writes at first boot. The keys are only available once the VM has booted
+// and printed them; ssh.ErrNoHostKeys is returned until then.
+type HostKeyer interface {
+	GetHostKeys(ctx context.Context) ([]cssh.PublicKey, error)
+}
+
+// ErrHostKeysNotSupported is returned when a VM does not implement HostKeyer.
+var ErrHostKeysNotSupported = NewError(NotSupported, errors.New("VM does not report its host keys"))
+
+// PinHostKeys returns options whose HostKey accepts only the host keys the
+// provider reports for vm, so that GetSSH cannot be intercepted even on the
+// first connection:
+//
+//	options, err := lvm.PinHostKeys(ctx, vm, ssh.Options{})
+//	if err != nil {
+//		return err
+//	}
+//	client, err := vm.GetSSH(options)
+func PinHostKeys(ctx context.Context, vm VirtualMachine, options ssh.Options) (ssh.Options, error) {
+	h, ok := vm.(HostKeyer)
+	if !ok {
+		return options, ErrHostKeysNotSupported
+	}
+	keys, err := h.GetHostKeys(ctx)
+	if err != nil {
+		return options, err
+	}
+	options.HostKey = ssh.HostKeys(keys...)
+	return options, nil
+}
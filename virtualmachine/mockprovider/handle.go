@@ -0,0 +1,32 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package mockprovider
+
+import (
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+var _ lvm.Handler = (*VM)(nil)
+
+// handle holds the name of a mock VM.
+type handle struct {
+	Name string `json:"name"`
+}
+
+// MarshalHandle serializes the name of the VM.
+func (vm *VM) MarshalHandle() ([]byte, error) {
+	return lvm.EncodeHandle(providerName, handle{Name: vm.GetName()})
+}
+
+// UnmarshalHandle restores a handle written by MarshalHandle, replacing
+// MockGetName with one that returns the recorded name.
+func (vm *VM) UnmarshalHandle(data []byte) error {
+	var h handle
+	if err := lvm.DecodeHandle(providerName, data, &h); err != nil {
+		return err
+	}
+	vm.MockGetName = func() string {
+		return h.Name
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package mockprovider
+
+import (
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+// providerName is the name the provider is registered under.
+const providerName = "mock"
+
+func init() {
+	lvm.Register(providerName, FromSpec)
+}
+
+// Provider returns the name the provider is registered under.
+func (vm *VM) Provider() string {
+	return providerName
+}
+
+// FromSpec returns a mock VM named after the spec. Every other method returns
+// lvm.ErrNotImplemented until its Mock function is set.
+func FromSpec(spec *lvm.Spec) (lvm.VirtualMachine, error) {
+	name := spec.Name
+	return &VM{
+		MockGetName: func() string {
+			return name
+		},
+	}, nil
+}
@@ -3,6 +3,7 @@
 package mockprovider
 
 import (
+	"context"
 	"net"
 
 	libssh "github.com/apcera/libretto/ssh"
@@ -11,19 +12,21 @@ import (
 
 // VM represents a Mock VM wrapper.
 type VM struct {
-	MockGetSSH    func(options libssh.Options) (libssh.Client, error)
-	MockDestroy   func() error
-	MockHalt      func() error
-	MockSuspend   func() error
-	MockResume    func() error
-	MockStart     func() error
-	MockGetIPs    func() ([]net.IP, error)
-	MockGetName   func() string
-	MockGetState  func() (string, error)
-	MockProvision func() error
+	MockGetSSH       func(options libssh.Options) (libssh.Client, error)
+	MockDestroy      func() error
+	MockHalt         func() error
+	MockSuspend      func() error
+	MockResume       func() error
+	MockStart        func() error
+	MockGetIPs       func() ([]net.IP, error)
+	MockGetName      func() string
+	MockGetState     func() (string, error)
+	MockProvision    func() error
+	MockCapabilities func() lvm.Capabilities
 }
 
-var _ lvm.VirtualMachine = (*VM)(nil)
+var _ lvm.VirtualMachineContext = (*VM)(nil)
+var _ lvm.Capabler = (*VM)(nil)
 
 // GetName returns the name of the virtual machine
 func (vm *VM) GetName() string {
@@ -57,6 +60,15 @@ func (vm *VM) Halt() error {
 	return lvm.ErrNotImplemented
 }
 
+// Capabilities returns the mocked capabilities, or none if they are not
+// mocked.
+func (vm *VM) Capabilities() lvm.Capabilities {
+	if vm.MockCapabilities != nil {
+		return vm.MockCapabilities()
+	}
+	return lvm.Capabilities{}
+}
+
 // Suspend suspends the active state of the VM.
 func (vm *VM) Suspend() error {
 	if vm.MockSuspend != nil {
@@ -104,3 +116,78 @@ func (vm *VM) Provision() error {
 	}
 	return lvm.ErrNotImplemented
 }
+
+// The Context variants below return ctx.Err() if ctx is already done and
+// otherwise call the corresponding mocked method.
+
+// GetSSHContext calls the mocked GetSSH unless ctx is done.
+func (vm *VM) GetSSHContext(ctx context.Context, options libssh.Options) (libssh.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return vm.GetSSH(options)
+}
+
+// DestroyContext calls the mocked Destroy unless ctx is done.
+func (vm *VM) DestroyContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return vm.Destroy()
+}
+
+// HaltContext calls the mocked Halt unless ctx is done.
+func (vm *VM) HaltContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return vm.Halt()
+}
+
+// SuspendContext calls the mocked Suspend unless ctx is done.
+func (vm *VM) SuspendContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return vm.Suspend()
+}
+
+// ResumeContext calls the mocked Resume unless ctx is done.
+func (vm *VM) ResumeContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return vm.Resume()
+}
+
+// StartContext calls the mocked Start unless ctx is done.
+func (vm *VM) StartContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return vm.Start()
+}
+
+// GetIPsContext calls the mocked GetIPs unless ctx is done.
+func (vm *VM) GetIPsContext(ctx context.Context) ([]net.IP, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return vm.GetIPs()
+}
+
+// GetStateContext calls the mocked GetState unless ctx is done.
+func (vm *VM) GetStateContext(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return vm.GetState()
+}
+
+// ProvisionContext calls the mocked Provision unless ctx is done.
+func (vm *VM) ProvisionContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return vm.Provision()
+}
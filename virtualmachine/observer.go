@@ -0,0 +1,308 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// EventType identifies what an Event reports.
+type EventType string
+
+const (
+	// ProvisionStarted is sent when Provision starts.
+	ProvisionStarted EventType = "provision-started"
+	// ProvisionFinished is sent when Provision succeeds.
+	ProvisionFinished EventType = "provision-finished"
+	// OperationStarted is sent when an operation other than Provision, such
+	// as Destroy or Halt, starts.
+	OperationStarted EventType = "operation-started"
+	// OperationFinished is sent when an operation other than Provision
+	// succeeds.
+	OperationFinished EventType = "operation-finished"
+	// OperationFailed is sent when any operation, Provision included, fails.
+	OperationFailed EventType = "operation-failed"
+	// ResourceCreated is sent when a provider creates a resource for a VM,
+	// such as a disk or a NIC.
+	ResourceCreated EventType = "resource-created"
+	// ResourceDeleted is sent when a resource created for a VM is removed
+	// because Provision failed.
+	ResourceDeleted EventType = "resource-deleted"
+	// StateChanged is sent when an operation brought the VM to a new state.
+	StateChanged EventType = "state-changed"
+	// IPAssigned is sent when a provisioned VM got its IP addresses.
+	IPAssigned EventType = "ip-assigned"
+	// UploadProgress is sent while a provider uploads an image or template.
+	UploadProgress EventType = "upload-progress"
+)
+
+// The operations reported in Event.Op.
+const (
+	OpProvision = "provision"
+	OpDestroy   = "destroy"
+	OpHalt      = "halt"
+	OpStart     = "start"
+	OpSuspend   = "suspend"
+	OpResume    = "resume"
+)
+
+// opStates are the states a VM is in after a successful operation.
+var opStates = map[string]string{
+	OpProvision: VMRunning,
+	OpDestroy:   VMNotFound,
+	OpHalt:      VMHalted,
+	OpStart:     VMRunning,
+	OpSuspend:   VMSuspended,
+	OpResume:    VMRunning,
+}
+
+// Event is something that happened to a VM. Only the fields that make sense
+// for its Type are set.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Provider is the name the VM's provider is registered under.
+	Provider string
+	// Name is the name of the VM, if it has one.
+	Name string
+	// VM is the VM the event is about.
+	VM VirtualMachine
+	// Op is the operation the event belongs to, such as OpDestroy.
+	Op string
+	// Duration is how long the operation took, for ProvisionFinished,
+	// OperationFinished and OperationFailed.
+	Duration time.Duration
+	// Err is the error of OperationFailed.
+	Err error
+	// Resource describes the resource of ResourceCreated, ResourceDeleted
+	// and UploadProgress.
+	Resource string
+	// State is the new state of StateChanged.
+	State string
+	// IPs are the addresses of IPAssigned.
+	IPs []net.IP
+	// Percent is the progress of UploadProgress, from 0 to 100.
+	Percent int
+}
+
+// Observer receives the events of VMs. Observe is called synchronously by the
+// goroutine running the operation, so it must be fast and, when observing
+// several VMs, safe for concurrent use.
+type Observer interface {
+	Observe(e Event)
+}
+
+// ObserverFunc adapts a function to the Observer interface.
+type ObserverFunc func(e Event)
+
+// Observe calls f(e).
+func (f ObserverFunc) Observe(e Event) {
+	f(e)
+}
+
+// registeredObserver is an observer added with AddObserver.
+type registeredObserver struct {
+	id int
+	o  Observer
+}
+
+var (
+	observersMu sync.RWMutex
+	observers   []registeredObserver // in the order they were added
+	observerID  int
+)
+
+// AddObserver registers o to receive the events of every VM. It returns a
+// function that unregisters it. Observers may add or remove observers from
+// Observe; the change applies from the next event.
+func AddObserver(o Observer) (remove func()) {
+	observersMu.Lock()
+	defer observersMu.Unlock()
+	observerID++
+	id := observerID
+	observers = append(observers, registeredObserver{id, o})
+	return func() {
+		observersMu.Lock()
+		defer observersMu.Unlock()
+		for i, r := range observers {
+			if r.id == id {
+				observers = append(observers[:i:i], observers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// globalObservers returns the observers registered with AddObserver. The
+// lock is not held while they are called, so that they can register or
+// unregister observers. This is safe since AddObserver only appends and
+// remove copies, leaving the returned slice untouched.
+func globalObservers() []registeredObserver {
+	observersMu.RLock()
+	defer observersMu.RUnlock()
+	return observers
+}
+
+// Events sends the events of one VM to its own Observer and to the observers
+// registered with AddObserver. Providers build one from the VM's fields when
+// they need to send an event; the zero value sends to the global observers
+// only.
+type Events struct {
+	Provider string
+	Name     string
+	VM       VirtualMachine
+	// Observer receives the events of this VM only. It may be nil.
+	Observer Observer
+}
+
+// Active reports whether anyone observes the events, so that providers can
+// skip work done only to report an event.
+func (e Events) Active() bool {
+	if e.Observer != nil {
+		return true
+	}
+	observersMu.RLock()
+	defer observersMu.RUnlock()
+	return len(observers) > 0
+}
+
+// Emit fills in the VM fields and the time of ev and sends it.
+func (e Events) Emit(ev Event) {
+	ev.Provider, ev.Name, ev.VM = e.Provider, e.Name, e.VM
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if e.Observer != nil {
+		e.Observer.Observe(ev)
+	}
+	for _, r := range globalObservers() {
+		r.o.Observe(ev)
+	}
+}
+
+// Outcome is what an operation already knows about the VM when it ends. An
+// operation passing one to BeginWith fills it in before returning, so that
+// the VM is not queried again for the ending events.
+type Outcome struct {
+	// State is the state the VM is in, such as VMRunning, or "" if unknown.
+	State string
+	// IPs are the addresses of the VM after Provision, or nil if unknown.
+	IPs []net.IP
+}
+
+// Begin sends the event starting op and returns a function that sends the
+// event ending it. The function is meant to be deferred with the operation's
+// named error result:
+//
+//	func (vm *VM) HaltContext(ctx context.Context) (err error) {
+//		defer vm.events().Begin(ctx, lvm.OpHalt)(&err)
+//
+// On success, it also sends StateChanged and, for Provision, IPAssigned with
+// the VM's addresses if it can get them before ctx is done. Nothing is sent,
+// and the VM is not queried, if no one observes the events.
+func (e Events) Begin(ctx context.Context, op string) func(err *error) {
+	return e.BeginWith(ctx, op, nil)
+}
+
+// BeginWith is like Begin but takes the state and IPs of the VM from out
+// when they are set, instead of asking the provider for them:
+//
+//	var out lvm.Outcome
+//	defer vm.events().BeginWith(ctx, lvm.OpProvision, &out)(&err)
+//	...
+//	out.State, out.IPs = lvm.VMRunning, ips
+func (e Events) BeginWith(ctx context.Context, op string, out *Outcome) func(err *error) {
+	if !e.Active() {
+		return func(*error) {}
+	}
+	if out == nil {
+		out = &Outcome{}
+	}
+	start := time.Now()
+	started, finished := OperationStarted, OperationFinished
+	if op == OpProvision {
+		started, finished = ProvisionStarted, ProvisionFinished
+	}
+	e.Emit(Event{Type: started, Op: op, Time: start})
+
+	return func(err *error) {
+		if *err != nil {
+			e.Emit(Event{Type: OperationFailed, Op: op, Err: *err, Duration: time.Since(start)})
+			return
+		}
+		e.Emit(Event{Type: finished, Op: op, Duration: time.Since(start)})
+		state := out.State
+		if state == "" {
+			state = e.state(ctx, op)
+		}
+		if state != "" {
+			e.Emit(Event{Type: StateChanged, Op: op, State: state})
+		}
+		if op == OpProvision && (out.IPs != nil || e.VM != nil) {
+			e.reportIPs(ctx, out.IPs)
+		}
+	}
+}
+
+// state returns the state of the VM after op succeeded. It asks the provider,
+// since some of them return before the VM reached its new state, and falls
+// back to the state op normally leads to.
+func (e Events) state(ctx context.Context, op string) string {
+	if e.VM != nil {
+		var state string
+		var err error
+		if c, ok := e.VM.(VirtualMachineContext); ok {
+			state, err = c.GetStateContext(ctx)
+		} else {
+			state, err = e.VM.GetState()
+		}
+		if err == nil && state != "" {
+			return state
+		}
+	}
+	return opStates[op]
+}
+
+// reportIPs sends IPAssigned if the VM has IP addresses. The VM is asked for
+// them unless ips is set.
+func (e Events) reportIPs(ctx context.Context, ips []net.IP) {
+	if ips == nil {
+		if c, ok := e.VM.(VirtualMachineContext); ok {
+			ips, _ = c.GetIPsContext(ctx)
+		} else {
+			ips, _ = e.VM.GetIPs()
+		}
+	}
+	var assigned []net.IP
+	for _, ip := range ips {
+		if ip != nil {
+			assigned = append(assigned, ip)
+		}
+	}
+	if len(assigned) > 0 {
+		e.Emit(Event{Type: IPAssigned, Op: OpProvision, IPs: assigned})
+	}
+}
+
+// ResourceCreated sends ResourceCreated for resource.
+func (e Events) ResourceCreated(resource string) {
+	e.Emit(Event{Type: ResourceCreated, Resource: resource})
+}
+
+// ResourceDeleted sends ResourceDeleted for resource.
+func (e Events) ResourceDeleted(resource string) {
+	e.Emit(Event{Type: ResourceDeleted, Resource: resource})
+}
+
+// IPAssigned sends IPAssigned with ips.
+func (e Events) IPAssigned(ips []net.IP) {
+	e.Emit(Event{Type: IPAssigned, IPs: ips})
+}
+
+// UploadProgress sends UploadProgress for resource.
+func (e Events) UploadProgress(resource string, percent int) {
+	e.Emit(Event{Type: UploadProgress, Resource: resource, Percent: percent})
+}
@@ -0,0 +1,197 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/mockprovider"
+)
+
+// recorder is an Observer that keeps the types of the events it gets.
+type recorder struct {
+	types  []lvm.EventType
+	events []lvm.Event
+}
+
+func (r *recorder) Observe(e lvm.Event) {
+	r.types = append(r.types, e.Type)
+	r.events = append(r.events, e)
+}
+
+// TestBegin makes sure Begin reports the start and the outcome of operations.
+func TestBegin(t *testing.T) {
+	errBoom := errors.New("boom")
+	ip := net.ParseIP("10.0.0.1")
+	vm := &mockprovider.VM{
+		MockGetState: func() (string, error) { return lvm.VMHalted, nil },
+		MockGetIPs:   func() ([]net.IP, error) { return []net.IP{nil, ip}, nil },
+	}
+
+	tests := []struct {
+		name string
+		vm   lvm.VirtualMachine
+		op   string
+		err  error
+		want []lvm.EventType
+	}{
+		{"provision", vm, lvm.OpProvision, nil, []lvm.EventType{lvm.ProvisionStarted, lvm.ProvisionFinished, lvm.StateChanged, lvm.IPAssigned}},
+		{"halt", vm, lvm.OpHalt, nil, []lvm.EventType{lvm.OperationStarted, lvm.OperationFinished, lvm.StateChanged}},
+		{"failure", vm, lvm.OpDestroy, errBoom, []lvm.EventType{lvm.OperationStarted, lvm.OperationFailed}},
+		{"no VM", nil, lvm.OpStart, nil, []lvm.EventType{lvm.OperationStarted, lvm.OperationFinished, lvm.StateChanged}},
+	}
+	for _, tt := range tests {
+		r := &recorder{}
+		events := lvm.Events{Provider: "mock", Name: "test-vm", VM: tt.vm, Observer: r}
+		err := tt.err
+		events.Begin(context.Background(), tt.op)(&err)
+
+		if !reflect.DeepEqual(r.types, tt.want) {
+			t.Fatalf("%s: got events %v, want %v", tt.name, r.types, tt.want)
+		}
+		for _, e := range r.events {
+			if e.Provider != "mock" || e.Name != "test-vm" || e.Op != tt.op || e.Time.IsZero() {
+				t.Fatalf("%s: event %s is missing fields: %+v", tt.name, e.Type, e)
+			}
+		}
+		last := r.events[len(r.events)-1]
+		switch last.Type {
+		case lvm.OperationFailed:
+			if last.Err != errBoom {
+				t.Fatalf("%s: OperationFailed has error %v", tt.name, last.Err)
+			}
+		case lvm.IPAssigned:
+			if len(last.IPs) != 1 || !last.IPs[0].Equal(ip) {
+				t.Fatalf("%s: IPAssigned has IPs %v", tt.name, last.IPs)
+			}
+		}
+		if tt.name == "halt" && r.events[2].State != lvm.VMHalted {
+			t.Fatalf("%s: StateChanged has state %q, want the provider's", tt.name, r.events[2].State)
+		}
+		if tt.name == "no VM" && r.events[2].State != lvm.VMRunning {
+			t.Fatalf("%s: StateChanged has state %q, want %q", tt.name, r.events[2].State, lvm.VMRunning)
+		}
+	}
+}
+
+// TestBeginInactive makes sure Begin neither sends events nor queries the VM
+// when no one observes them.
+func TestBeginInactive(t *testing.T) {
+	vm := &mockprovider.VM{MockGetState: func() (string, error) {
+		t.Fatalf("GetState called without observers")
+		return "", nil
+	}}
+	events := lvm.Events{VM: vm}
+	if events.Active() {
+		t.Fatalf("Active returned true without observers")
+	}
+	var err error
+	events.Begin(context.Background(), lvm.OpHalt)(&err)
+}
+
+// TestBeginWith makes sure the state and IPs an operation reports are used
+// instead of querying the VM, which is still asked for the ones left unset.
+func TestBeginWith(t *testing.T) {
+	ip := net.ParseIP("10.0.0.1")
+	vm := &mockprovider.VM{
+		MockGetState: func() (string, error) {
+			t.Fatalf("GetState called although the operation reported the state")
+			return "", nil
+		},
+		MockGetIPs: func() ([]net.IP, error) {
+			t.Fatalf("GetIPs called although the operation reported the IPs")
+			return nil, nil
+		},
+	}
+	r := &recorder{}
+	events := lvm.Events{VM: vm, Observer: r}
+	var err error
+	var out lvm.Outcome
+	end := events.BeginWith(context.Background(), lvm.OpProvision, &out)
+	out.State, out.IPs = lvm.VMRunning, []net.IP{ip}
+	end(&err)
+
+	want := []lvm.EventType{lvm.ProvisionStarted, lvm.ProvisionFinished, lvm.StateChanged, lvm.IPAssigned}
+	if !reflect.DeepEqual(r.types, want) {
+		t.Fatalf("Got events %v, want %v", r.types, want)
+	}
+	if r.events[2].State != lvm.VMRunning || !reflect.DeepEqual(r.events[3].IPs, out.IPs) {
+		t.Fatalf("Expected the reported state and IPs, got %q and %v", r.events[2].State, r.events[3].IPs)
+	}
+
+	queried := false
+	vm.MockGetIPs = func() ([]net.IP, error) {
+		queried = true
+		return []net.IP{ip}, nil
+	}
+	r = &recorder{}
+	events.Observer = r
+	out = lvm.Outcome{State: lvm.VMRunning}
+	events.BeginWith(context.Background(), lvm.OpProvision, &out)(&err)
+	if !queried || !reflect.DeepEqual(r.types, want) {
+		t.Fatalf("Expected the IPs to be queried, got events %v", r.types)
+	}
+}
+
+// TestAddObserver makes sure global observers get the events of every VM
+// until they are removed.
+func TestAddObserver(t *testing.T) {
+	r := &recorder{}
+	remove := lvm.AddObserver(r)
+	events := lvm.Events{Provider: "mock"}
+	if !events.Active() {
+		t.Fatalf("Active returned false with a global observer")
+	}
+	events.ResourceCreated("disk")
+	remove()
+	events.ResourceDeleted("disk")
+
+	if !reflect.DeepEqual(r.types, []lvm.EventType{lvm.ResourceCreated}) {
+		t.Fatalf("got events %v, want [%s]", r.types, lvm.ResourceCreated)
+	}
+	if r.events[0].Resource != "disk" {
+		t.Fatalf("ResourceCreated has resource %q", r.events[0].Resource)
+	}
+}
+
+// TestObserverRegisters makes sure observers can add and remove observers
+// while they are called.
+func TestObserverRegisters(t *testing.T) {
+	inner := &recorder{}
+	var removeInner func()
+	var removeOuter func()
+	removeOuter = lvm.AddObserver(lvm.ObserverFunc(func(e lvm.Event) {
+		if removeInner == nil {
+			removeInner = lvm.AddObserver(inner)
+		} else {
+			removeInner()
+			removeOuter()
+		}
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		events := lvm.Events{}
+		events.UploadProgress("template", 50)
+		events.UploadProgress("template", 100)
+		events.UploadProgress("template", 100)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Emit deadlocked when an observer registered another")
+	}
+
+	// The inner observer only saw the event sent between its registration
+	// and its removal.
+	if len(inner.events) != 1 || inner.events[0].Percent != 100 {
+		t.Fatalf("inner observer got %+v", inner.events)
+	}
+}
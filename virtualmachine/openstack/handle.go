@@ -0,0 +1,86 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package openstack
+
+import (
+	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/rackspace/gophercloud/openstack/compute/v2/extensions/floatingip"
+)
+
+var _ lvm.Handler = (*VM)(nil)
+
+// handle holds what is needed to manage an instance from another process.
+type handle struct {
+	Name             string `json:"name,omitempty"`
+	IdentityEndpoint string `json:"identity_endpoint"`
+	Region           string `json:"region"`
+	TenantName       string `json:"tenant_name,omitempty"`
+	InstanceID       string `json:"instance_id"`
+	ImageID          string `json:"image_id,omitempty"`
+	FloatingIPID     string `json:"floating_ip_id,omitempty"`
+	FloatingIP       string `json:"floating_ip,omitempty"`
+	FloatingIPPool   string `json:"floating_ip_pool,omitempty"`
+	VolumeID         string `json:"volume_id,omitempty"`
+	VolumeName       string `json:"volume_name,omitempty"`
+	VolumeDevice     string `json:"volume_device,omitempty"`
+}
+
+// MarshalHandle serializes the instance ID of the VM together with its
+// floating IP and volume, so that Destroy can release them. The Openstack
+// username and password are not included.
+func (vm *VM) MarshalHandle() ([]byte, error) {
+	if vm.InstanceID == "" {
+		return nil, ErrNoInstanceID
+	}
+	h := handle{
+		Name:             vm.Name,
+		IdentityEndpoint: vm.IdentityEndpoint,
+		Region:           vm.Region,
+		TenantName:       vm.TenantName,
+		InstanceID:       vm.InstanceID,
+		ImageID:          vm.ImageID,
+		FloatingIPPool:   vm.FloatingIPPool,
+		VolumeID:         vm.Volume.ID,
+		VolumeName:       vm.Volume.Name,
+		VolumeDevice:     vm.Volume.Device,
+	}
+	if vm.FloatingIP != nil {
+		h.FloatingIPID = vm.FloatingIP.ID
+		h.FloatingIP = vm.FloatingIP.IP
+	}
+	return lvm.EncodeHandle(providerName, h)
+}
+
+// UnmarshalHandle restores a handle written by MarshalHandle into the VM. The
+// compute client is created again on first use.
+func (vm *VM) UnmarshalHandle(data []byte) error {
+	var h handle
+	if err := lvm.DecodeHandle(providerName, data, &h); err != nil {
+		return err
+	}
+	if h.InstanceID == "" {
+		return ErrNoInstanceID
+	}
+
+	vm.Name = h.Name
+	vm.IdentityEndpoint = h.IdentityEndpoint
+	vm.Region = h.Region
+	vm.TenantName = h.TenantName
+	vm.InstanceID = h.InstanceID
+	vm.ImageID = h.ImageID
+	vm.FloatingIPPool = h.FloatingIPPool
+	vm.FloatingIP = nil
+	if h.FloatingIPID != "" {
+		vm.FloatingIP = &floatingip.FloatingIP{
+			ID:         h.FloatingIPID,
+			IP:         h.FloatingIP,
+			InstanceID: h.InstanceID,
+			Pool:       h.FloatingIPPool,
+		}
+	}
+	vm.Volume.ID = h.VolumeID
+	vm.Volume.Name = h.VolumeName
+	vm.Volume.Device = h.VolumeDevice
+	vm.computeClient = nil
+	return nil
+}
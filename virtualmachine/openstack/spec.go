@@ -0,0 +1,85 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package openstack
+
+import (
+	"github.com/apcera/libretto/ssh"
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+// providerName is the name the provider is registered under.
+const providerName = "openstack"
+
+func init() {
+	lvm.Register(providerName, FromSpec)
+}
+
+// Provider returns the name the provider is registered under.
+func (vm *VM) Provider() string {
+	return providerName
+}
+
+// FromSpec builds an Openstack VM from a provider-neutral spec. Image is the
+// ID of an existing image, Size the flavor name and Region the Openstack
+// region. The first disk becomes the attached volume. Each network's Name is
+// a network UUID and the first security group found is used. The following
+// options are read:
+//
+//	identity_endpoint  Openstack identity endpoint (required)
+//	username           Openstack username (required)
+//	password           Openstack password (required)
+//	tenant_name        Openstack tenant name
+//	floating_ip_pool   pool to pick the external IP from
+//	admin_password     root password of the VM
+//	image_path         image file to upload when Image is empty
+//	image_name         name of the uploaded image
+//	container_format   container format of the uploaded image
+//	disk_format        disk format of the uploaded image
+func FromSpec(spec *lvm.Spec) (lvm.VirtualMachine, error) {
+	vm := &VM{
+		IdentityEndpoint: spec.Option("identity_endpoint"),
+		Username:         spec.Option("username"),
+		Password:         spec.Option("password"),
+		Region:           spec.Region,
+		TenantName:       spec.Option("tenant_name"),
+		FlavorName:       spec.Size,
+		ImageID:          spec.Image,
+		ImageMetadata: ImageMetadata{
+			ContainerFormat: spec.Option("container_format"),
+			DiskFormat:      spec.Option("disk_format"),
+			Name:            spec.Option("image_name"),
+		},
+		ImagePath:      spec.Option("image_path"),
+		Name:           spec.Name,
+		FloatingIPPool: spec.Option("floating_ip_pool"),
+		AdminPassword:  spec.Option("admin_password"),
+		Credentials: ssh.Credentials{
+			SSHUser:       spec.SSH.User,
+			SSHPassword:   spec.SSH.Password,
+			SSHPrivateKey: spec.SSH.PrivateKey,
+		},
+		KeepOnFailure: spec.KeepOnFailure,
+	}
+
+	if spec.UserData != "" {
+		vm.UserData = []byte(spec.UserData)
+	}
+	if len(spec.Disks) > 0 {
+		d := spec.Disks[0]
+		vm.Volume = Volume{
+			Device: d.Device,
+			Name:   d.Name,
+			Size:   d.SizeGB,
+			Type:   d.Type,
+		}
+	}
+	for _, n := range spec.Networks {
+		if n.Name != "" {
+			vm.Networks = append(vm.Networks, n.Name)
+		}
+		if vm.SecurityGroup == "" && len(n.SecurityGroups) > 0 {
+			vm.SecurityGroup = n.SecurityGroups[0]
+		}
+	}
+	return vm, nil
+}
@@ -4,7 +4,9 @@ package openstack
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -23,6 +25,7 @@ import (
 
 	"github.com/apcera/libretto/ssh"
 	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/wait"
 )
 
 func getProviderClient(vm *VM) (*gophercloud.ProviderClient, error) {
@@ -114,7 +117,7 @@ func getBlockStorageClient(vm *VM) (*gophercloud.ServiceClient, error) {
 // imageEndpoint has version info. If it is not, then a Get request is sent to imageEndpoint to
 // fetch supported APIs. If any V2 api is supported then it returns 2, else If any V1 api is
 // supported then it returns 1. Otherwise, it returns an error.
-func findImageAPIVersion(tokenID string, imageEndpoint string) (int, error) {
+func findImageAPIVersion(ctx context.Context, tokenID string, imageEndpoint string) (int, error) {
 	// Try to fetch image API version from the imageEndpoint
 	if strings.HasSuffix(imageEndpoint, "/v1/") {
 		return 1, nil
@@ -129,6 +132,7 @@ func findImageAPIVersion(tokenID string, imageEndpoint string) (int, error) {
 		return 0, fmt.Errorf("unable to get image API version")
 	}
 
+	versionReq = versionReq.WithContext(ctx)
 	versionReq.Header.Add("X-Auth-Token", tokenID)
 	versionClient := &http.Client{}
 
@@ -166,7 +170,7 @@ func imageVersionEncoded(imageEndpoint string) bool {
 // Reserves an Image ID at the specified image endpoint using the information in given imageMetadata
 // Returns the reserved Image ID if reservation is successful, otherwise returns an error.
 // Requires client's token to reserve the image.
-func reserveImage(tokenID string, imageEndpoint string, imageMetadata ImageMetadata, imageApiVersion int) (string, error) {
+func reserveImage(ctx context.Context, tokenID string, imageEndpoint string, imageMetadata ImageMetadata, imageApiVersion int) (string, error) {
 	// Form the URI to create the image
 	imagesURI := ""
 	if imageVersionEncoded(imageEndpoint) {
@@ -192,6 +196,7 @@ func reserveImage(tokenID string, imageEndpoint string, imageMetadata ImageMetad
 		return "", err
 	}
 
+	createReq = createReq.WithContext(ctx)
 	createReq.Header.Add("X-Auth-Token", tokenID)
 	if imageApiVersion == 1 {
 		createReq.Header.Add("Content-Type", "application/octet-stream")
@@ -243,7 +248,7 @@ func reserveImage(tokenID string, imageEndpoint string, imageMetadata ImageMetad
 // Uploads the image to an reserved image location at the imageEndpoint using the reserved image ID and imageMetadata.
 // Returns nil error if the upload is successful, otherwise returns an error.
 // Requires client's token to upload the image.
-func uploadImage(tokenID string, imageEndpoint string, imageID string, imagePath string, imageApiVersion int) error {
+func uploadImage(ctx context.Context, tokenID string, imageEndpoint string, imageID string, imagePath string, imageApiVersion int) error {
 	// Read the image file
 	file, err := os.Open(imagePath)
 	if err != nil {
@@ -253,7 +258,7 @@ func uploadImage(tokenID string, imageEndpoint string, imageID string, imagePath
 
 	stat, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("unable to get the stats of the image file: %s", err)
+		return fmt.Errorf("unable to get the stats of the image file: %w", err)
 	}
 	imageFileSize := stat.Size()
 
@@ -273,6 +278,7 @@ func uploadImage(tokenID string, imageEndpoint string, imageID string, imagePath
 		return fmt.Errorf("unable to upload image to the openstack")
 	}
 
+	uploadReq = uploadReq.WithContext(ctx)
 	uploadReq.Header.Add("Content-Type", "application/octet-stream")
 	uploadReq.Header.Add("X-Auth-Token", tokenID)
 	uploadReq.Header.Add("Content-Length", fmt.Sprintf("%d", imageFileSize))
@@ -295,8 +301,9 @@ func uploadImage(tokenID string, imageEndpoint string, imageID string, imagePath
 	return nil
 }
 
-// Creates an Image based on the given FilePath and returns the UUID of the image
-func createImage(vm *VM) (string, error) {
+// Creates an Image based on the given FilePath and returns the UUID of the image.
+// The reserved image is added to rb so that it is deleted if provisioning fails.
+func createImage(ctx context.Context, vm *VM, rb *lvm.Rollback) (string, error) {
 	// Get the openstack provider
 	provider, err := getProviderClient(vm)
 	if err != nil {
@@ -313,19 +320,32 @@ func createImage(vm *VM) (string, error) {
 	}
 
 	// Find the Image API version number
-	version, err := findImageAPIVersion(provider.TokenID, imageEndpoint)
+	version, err := findImageAPIVersion(ctx, provider.TokenID, imageEndpoint)
 	if err != nil {
 		return "", err
 	}
 
 	// Reserve an ImageID at imageEndpoint using the given image metadata
-	imageID, err := reserveImage(provider.TokenID, imageEndpoint, vm.ImageMetadata, version)
+	imageID, err := reserveImage(ctx, provider.TokenID, imageEndpoint, vm.ImageMetadata, version)
 	if err != nil {
 		return "", err
 	}
+	rb.Add("image "+imageID, func(ctx context.Context) error {
+		client, err := getComputeClient(vm)
+		if err != nil {
+			return err
+		}
+		if err := images.Delete(client, imageID).ExtractErr(); err != nil {
+			return err
+		}
+		if vm.ImageID == imageID {
+			vm.ImageID = ""
+		}
+		return nil
+	})
 
 	// Upload the image to the imageEndpoint with reserved ImageID using the given image path
-	err = uploadImage(provider.TokenID, imageEndpoint, imageID, vm.ImagePath, version)
+	err = uploadImage(ctx, provider.TokenID, imageEndpoint, imageID, vm.ImagePath, version)
 	if err != nil {
 		return "", err
 	}
@@ -365,43 +385,52 @@ func findImageEndpoint(client *gophercloud.ProviderClient, eo gophercloud.Endpoi
 	return url, nil
 }
 
-// Waits until the given VM becomes in requested state in given ActionTimeout seconds
-func waitUntil(vm *VM, state string) error {
-	var curState string
-	var err error
-	for i := 0; i < ActionTimeout; i++ {
-		curState, err = vm.GetState()
-		if err != nil {
-			return err
-		}
-
-		if curState == state {
-			break
-		}
+// actionWaiter polls once a second for up to ActionTimeout seconds.
+var actionWaiter = wait.Waiter{
+	Backoff: wait.Constant(time.Second),
+	Timeout: ActionTimeout * time.Second,
+}
 
-		if curState == lvm.VMError {
-			return fmt.Errorf("failed to bring the VM to state: %s", state)
-		}
+// volumeWaiter polls once a second for up to VolumeActionTimeout seconds.
+var volumeWaiter = wait.Waiter{
+	Backoff: wait.Constant(time.Second),
+	Timeout: VolumeActionTimeout * time.Second,
+}
 
-		time.Sleep(1 * time.Second)
-	}
-	if curState != state {
+// waitErr translates the errors of package wait to this package's errors.
+func waitErr(err error) error {
+	if err == wait.ErrTimeout {
 		return ErrActionTimeout
 	}
-	return nil
+	return err
+}
+
+// Waits until the given VM becomes in requested state in given ActionTimeout
+// seconds, or until ctx is done.
+func waitUntil(ctx context.Context, vm *VM, state string) error {
+	_, err := actionWaiter.ForState(ctx, vm, state)
+	if err == wait.ErrVMError {
+		return fmt.Errorf("failed to bring the VM to state: %s", state)
+	}
+	return waitErr(err)
 }
 
 // Waits until the given VM becomes ready. Basically, waits until vm can be sshed.
-func waitUntilSSHReady(vm *VM) error {
-	client, err := vm.GetSSH(ssh.Options{})
+func waitUntilSSHReady(ctx context.Context, vm *VM) error {
+	client, err := vm.GetSSHContext(ctx, ssh.Options{})
 	if err != nil {
 		return err
 	}
-	return client.WaitForSSH(SSHTimeout)
+	if err := client.WaitForSSHContext(ctx, SSHTimeout); err != nil {
+		return err
+	}
+	client.Disconnect()
+	return nil
 }
 
 // createAndAttachVolume creates a new volume with the given volume specs and then attaches this volume to the given VM.
-func createAndAttachVolume(vm *VM) error {
+// The volume and its attachment are added to rb.
+func createAndAttachVolume(ctx context.Context, vm *VM, rb *lvm.Rollback) error {
 	if vm.InstanceID == "" {
 		// Probably need to call Provision first.
 		return ErrNoInstanceID
@@ -409,7 +438,7 @@ func createAndAttachVolume(vm *VM) error {
 
 	cClient, err := getComputeClient(vm)
 	if err != nil {
-		return fmt.Errorf("compute client is not set for the VM, %s", err)
+		return fmt.Errorf("compute client is not set for the VM, %w", err)
 	}
 
 	bsClient, err := getBlockStorageClient(vm)
@@ -422,37 +451,39 @@ func createAndAttachVolume(vm *VM) error {
 	vOpts := volumes.CreateOpts{Size: volume.Size, Name: volume.Name, VolumeType: volume.Type}
 	vol, err := volumes.Create(bsClient, vOpts).Extract()
 	if err != nil {
-		return fmt.Errorf("failed to create a new volume for the VM: %s", err)
+		return fmt.Errorf("failed to create a new volume for the VM: %w", err)
 	}
-
-	// Cleanup the volume if something goes wrong
-	var cleanup = func(err error) error {
-		if errDeleteVolume := volumes.Delete(bsClient, vol.ID).ExtractErr(); errDeleteVolume != nil {
-			return fmt.Errorf("%s %s", err, errDeleteVolume)
+	rb.Add("volume "+vol.ID, func(ctx context.Context) error {
+		if err := volumes.Delete(bsClient, vol.ID).ExtractErr(); err != nil {
+			return err
 		}
-
-		return err
-	}
+		return waitUntilVolume(ctx, bsClient, vol.ID, volumeStateDeleted)
+	})
 
 	// Wait until Volume becomes available
-	err = waitUntilVolume(bsClient, vol.ID, volumeStateAvailable)
+	err = waitUntilVolume(ctx, bsClient, vol.ID, volumeStateAvailable)
 	if err != nil {
-		return cleanup(fmt.Errorf("failed to create a new volume for the VM: %s", err))
+		return fmt.Errorf("failed to create a new volume for the VM: %w", err)
 	}
 
 	// Attach the new volume to this VM
 	vaOpts := volumeattach.CreateOpts{Device: volume.Device, VolumeID: vol.ID}
 	va, err := volumeattach.Create(cClient, vm.InstanceID, vaOpts).Extract()
 	if err != nil {
-		return cleanup(fmt.Errorf("failed to attach the volume to the VM: %s", err))
+		return fmt.Errorf("failed to attach the volume to the VM: %w", err)
 	}
+	instanceID := vm.InstanceID
+	rb.Add("volume attachment "+vol.ID, func(ctx context.Context) error {
+		if err := volumeattach.Delete(cClient, instanceID, vol.ID).ExtractErr(); err != nil {
+			return err
+		}
+		return waitUntilVolume(ctx, bsClient, vol.ID, volumeStateAvailable)
+	})
 
 	// Wait until Volume is attached to the VM
-	err = waitUntilVolume(bsClient, vol.ID, volumeStateInUse)
+	err = waitUntilVolume(ctx, bsClient, vol.ID, volumeStateInUse)
 	if err != nil {
-		errVaDelete := volumeattach.Delete(cClient, vm.InstanceID, vol.ID).ExtractErr()
-		err = fmt.Errorf("%s %s", err, errVaDelete)
-		return cleanup(fmt.Errorf("failed to attach the volume to the VM: %s", err))
+		return fmt.Errorf("failed to attach the volume to the VM: %w", err)
 	}
 
 	vm.Volume.ID = vol.ID
@@ -462,7 +493,7 @@ func createAndAttachVolume(vm *VM) error {
 }
 
 // deattachAndDeleteVolume deattaches the volume from the given VM and then completely deletes the volume.
-func deattachAndDeleteVolume(vm *VM) error {
+func deattachAndDeleteVolume(ctx context.Context, vm *VM) error {
 	if vm.InstanceID == "" {
 		// Probably need to call Provision first.
 		return ErrNoInstanceID
@@ -470,7 +501,7 @@ func deattachAndDeleteVolume(vm *VM) error {
 
 	cClient, err := getComputeClient(vm)
 	if err != nil {
-		return fmt.Errorf("compute client is not set for the VM, %s", err)
+		return fmt.Errorf("compute client is not set for the VM, %w", err)
 	}
 
 	bsClient, err := getBlockStorageClient(vm)
@@ -481,58 +512,51 @@ func deattachAndDeleteVolume(vm *VM) error {
 	// Deattach the volume from the VM
 	err = volumeattach.Delete(cClient, vm.InstanceID, vm.Volume.ID).ExtractErr()
 	if err != nil {
-		return fmt.Errorf("failed to deattach volume from the VM: %s", err)
+		return fmt.Errorf("failed to deattach volume from the VM: %w", err)
 	}
 
 	// Wait until Volume is de-attached from the VM
-	err = waitUntilVolume(bsClient, vm.Volume.ID, volumeStateAvailable)
+	err = waitUntilVolume(ctx, bsClient, vm.Volume.ID, volumeStateAvailable)
 	if err != nil {
-		return fmt.Errorf("failed to deattach volume from the VM: %s", err)
+		return fmt.Errorf("failed to deattach volume from the VM: %w", err)
 	}
 
 	// Delete the volume
 	err = volumes.Delete(bsClient, vm.Volume.ID).ExtractErr()
 	if err != nil {
-		return fmt.Errorf("failed to delete volume: %s", err)
+		return fmt.Errorf("failed to delete volume: %w", err)
 	}
 
 	// Wait until Volume is deleted
-	err = waitUntilVolume(bsClient, vm.Volume.ID, volumeStateDeleted)
+	err = waitUntilVolume(ctx, bsClient, vm.Volume.ID, volumeStateDeleted)
 	if err != nil {
-		return fmt.Errorf("failed to delete volume: %s", err)
+		return fmt.Errorf("failed to delete volume: %w", err)
 	}
 
 	return nil
 }
 
 // Delete the instance
-func deleteVM(client *gophercloud.ServiceClient, vm *VM) error {
+func deleteVM(ctx context.Context, client *gophercloud.ServiceClient, vm *VM) error {
 	err := servers.Delete(client, vm.InstanceID).ExtractErr()
 	if err != nil {
-		return fmt.Errorf("failed to destroy the vm: %s", err)
+		return fmt.Errorf("failed to destroy the vm: %w", err)
 	}
 
 	// Wait until its status becomes nil within ActionTimeout seconds.
-	var server *servers.Server
-	for i := 0; i < ActionTimeout; i++ {
-		server, err = getServer(vm)
+	return waitErr(actionWaiter.Until(ctx, func(ctx context.Context) (bool, error) {
+		server, err := getServer(vm)
 		if err != nil {
-			return err
+			return false, err
 		}
 
 		if server == nil {
-			break
+			return true, nil
 		} else if server.Status == StateError {
-			return fmt.Errorf("error on destroying the vm")
+			return false, fmt.Errorf("error on destroying the vm")
 		}
-
-		time.Sleep(1 * time.Second)
-	}
-
-	if server != nil {
-		return ErrActionTimeout
-	}
-	return nil
+		return false, nil
+	}))
 }
 
 // findImageIDByName finds the ImageID for the given imageName, returns an error if there is
@@ -549,12 +573,12 @@ func findImageIDByName(client *gophercloud.ServiceClient, imageName string) (str
 	// Retrieve image list
 	page, err := images.ListDetail(client, opts).AllPages()
 	if err != nil {
-		return "", fmt.Errorf("error on retrieving image pages: %s", err)
+		return "", fmt.Errorf("error on retrieving image pages: %w", err)
 	}
 
 	imageList, err := images.ExtractImages(page)
 	if err != nil {
-		return "", fmt.Errorf("error on extracting image list: %s", err)
+		return "", fmt.Errorf("error on extracting image list: %w", err)
 	}
 
 	if len(imageList) == 0 {
@@ -569,22 +593,22 @@ func findImageIDByName(client *gophercloud.ServiceClient, imageName string) (str
 }
 
 // waitUntilVolume waits until the given volume turns into given state under given VolumeActionTimeout seconds
-func waitUntilVolume(blockStorateClient *gophercloud.ServiceClient, volumeID string, state string) error {
-	for i := 0; i < VolumeActionTimeout; i++ {
+// or until ctx is done.
+func waitUntilVolume(ctx context.Context, blockStorateClient *gophercloud.ServiceClient, volumeID string, state string) error {
+	return waitErr(volumeWaiter.Until(ctx, func(ctx context.Context) (bool, error) {
 		vol, err := volumes.Get(blockStorateClient, volumeID).Extract()
 		switch {
 		case vol == nil && state == "nil":
-			return nil
+			return true, nil
 		case vol == nil || err != nil:
-			return fmt.Errorf("failed on getting volume Status: %s", err)
+			return false, fmt.Errorf("failed on getting volume Status: %w", err)
 		case vol.Status == state:
-			return nil
+			return true, nil
 		case vol.Status == lvm.VMError || vol.Status == volumeStateErrorDeleting:
-			return fmt.Errorf("failed to bring the volume to state %s, ended up at state %s", state, vol.Status)
+			return false, fmt.Errorf("failed to bring the volume to state %s, ended up at state %s", state, vol.Status)
 		}
-		time.Sleep(1 * time.Second)
-	}
-	return ErrActionTimeout
+		return false, nil
+	}))
 }
 
 // NewDefaultImageMetadata creates a ImageMetadata with default values
@@ -606,3 +630,19 @@ func NewDefaultVolume() Volume {
 		Device: "/dev/vdb",
 	}
 }
+
+// classify gives err the lvm.Kind that matches the HTTP status of the
+// Openstack error in its chain, if any.
+func classify(err error) error {
+	var rerr *gophercloud.UnexpectedResponseCodeError
+	if errors.As(err, &rerr) {
+		return lvm.NewError(lvm.KindForStatus(rerr.Actual), err)
+	}
+	return err
+}
+
+// classifyErr replaces *err with classify(*err). It is deferred by the
+// exported methods of VM.
+func classifyErr(err *error) {
+	*err = classify(*err)
+}
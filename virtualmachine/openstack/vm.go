@@ -3,9 +3,11 @@
 package openstack
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"time"
 
 	"github.com/apcera/libretto/ssh"
@@ -17,32 +19,38 @@ import (
 	"github.com/rackspace/gophercloud/openstack/compute/v2/flavors"
 	"github.com/rackspace/gophercloud/openstack/compute/v2/servers"
 	"github.com/rackspace/gophercloud/openstack/networking/v2/networks"
+	cssh "golang.org/x/crypto/ssh"
 )
 
-// Compiler will complain if openstack.VM doesn't implement VirtualMachine interface.
-var _ lvm.VirtualMachine = (*VM)(nil)
+// Compiler will complain if openstack.VM doesn't implement VirtualMachineContext interface.
+var _ lvm.VirtualMachineContext = (*VM)(nil)
+
+var _ lvm.StateDetailer = (*VM)(nil)
+var _ lvm.Capabler = (*VM)(nil)
+var _ lvm.HostKeyer = (*VM)(nil)
 
 var (
 	// ErrAuthOptions is returned if the credentials are not set properly as a environment variable
-	ErrAuthOptions = errors.New("Openstack credentials (username and password) are not set properly")
+	ErrAuthOptions = lvm.NewError(lvm.AuthFailed, errors.New("Openstack credentials (username and password) are not set properly"))
 	// ErrAuthenticatingClient is returned if the openstack do not return any provider.
-	ErrAuthenticatingClient = errors.New("Failed to authenticate the client")
+	ErrAuthenticatingClient = lvm.NewError(lvm.AuthFailed, errors.New("Failed to authenticate the client"))
 	// ErrInvalidRegion is returned if the region is an invalid.
 	ErrInvalidRegion = errors.New("Invalid Openstack region")
 	// ErrNoRegion is returned if the region is missing.
 	ErrNoRegion = errors.New("Missing Openstack region")
 	// ErrNoFlavor is returned querying an flavor, but none is found.
-	ErrNoFlavor = errors.New("Requested flavor is not found")
+	ErrNoFlavor = lvm.NewError(lvm.NotFound, errors.New("Requested flavor is not found"))
 	// ErrNoImage is returned querying an image, but none is found.
-	ErrNoImage = errors.New("Requested image is not found")
+	ErrNoImage = lvm.NewError(lvm.NotFound, errors.New("Requested image is not found"))
 	// ErrCreatingInstance is returned if a new server/instance is not created successfully.
 	ErrCreatingInstance = errors.New("Failed to create instance")
 	// ErrNoInstanceID is returned when attempting to perform an operation on an instance, but the ID is missing.
-	ErrNoInstanceID = errors.New("Missing instance ID")
+	// It is lvm.ErrNoInstanceID.
+	ErrNoInstanceID = lvm.ErrNoInstanceID
 	// ErrNoInstance is returned querying an instance, but none is found.
-	ErrNoInstance = errors.New("No instance found")
+	ErrNoInstance = lvm.NewError(lvm.NotFound, errors.New("No instance found"))
 	// ErrActionTimeout is returned when the Openstack instance takes too long to enter waited state.
-	ErrActionTimeout = errors.New("Openstack action timeout")
+	ErrActionTimeout = lvm.NewError(lvm.Timeout, errors.New("Openstack action timeout"))
 	// ErrNoIPs is returned when no IP addresses are found for an instance.
 	ErrNoIPs = errors.New("No IPs found for instance")
 )
@@ -69,6 +77,28 @@ const (
 	StateShutOff = "SHUTOFF"
 	// StateError is the state Openstack reports when the given action fails on VM.
 	StateError = "ERROR"
+	// StateBuild is the state Openstack reports while the VM is being created.
+	StateBuild = "BUILD"
+	// StateSuspended is the state Openstack reports when the VM is suspended.
+	StateSuspended = "SUSPENDED"
+	// StatePaused is the state Openstack reports when the VM is paused.
+	StatePaused = "PAUSED"
+	// StateDeleted is the state Openstack reports when the VM is deleted.
+	StateDeleted = "DELETED"
+	// StateSoftDeleted is the state Openstack reports when the VM is deleted
+	// but can still be restored.
+	StateSoftDeleted = "SOFT_DELETED"
+	// StateReboot is the state Openstack reports while the VM reboots.
+	StateReboot = "REBOOT"
+	// StateHardReboot is the state Openstack reports while the VM is power
+	// cycled.
+	StateHardReboot = "HARD_REBOOT"
+	// StateRebuild is the state Openstack reports while the VM is rebuilt.
+	StateRebuild = "REBUILD"
+	// StateResize is the state Openstack reports while the VM is resized.
+	StateResize = "RESIZE"
+	// StateMigrating is the state Openstack reports while the VM migrates.
+	StateMigrating = "MIGRATING"
 
 	// volumeStateAvailable is the state Openstack reports when the volume is created
 	volumeStateAvailable = "available"
@@ -169,6 +199,14 @@ type VM struct {
 	// Credentials are the credentials to use when connecting to the VM over SSH
 	Credentials ssh.Credentials
 
+	// KeepOnFailure keeps the resources created by a failed Provision, such as
+	// the server, floating IP and volume, so that they can be inspected.
+	KeepOnFailure bool
+
+	// Observer receives the events of this VM, in addition to the observers
+	// registered with lvm.AddObserver. It may be nil.
+	Observer lvm.Observer
+
 	// computeClient represents the client to access to gophercloud compute api. It is set within Provision
 	// and set to nil in destroy.
 	computeClient *gophercloud.ServiceClient
@@ -179,15 +217,35 @@ func (vm *VM) GetName() string {
 	return vm.Name
 }
 
+// events returns the Events of the VM, sent to its Observer and the global
+// observers.
+func (vm *VM) events() lvm.Events {
+	return lvm.Events{Provider: providerName, Name: vm.Name, VM: vm, Observer: vm.Observer}
+}
+
 // Provision creates a virtual machine on Openstack. It returns an error if
 // there was a problem during creation, if there was a problem adding a tag, or
 // if the VM takes too long to enter "running" state.
 func (vm *VM) Provision() error {
+	return vm.ProvisionContext(context.Background())
+}
+
+// ProvisionContext is like Provision but stops waiting on the instance,
+// image upload and volume when ctx is done. Resources created before a
+// failure or cancellation are removed unless KeepOnFailure is set.
+func (vm *VM) ProvisionContext(ctx context.Context) (err error) {
+	var out lvm.Outcome
+	defer vm.events().BeginWith(ctx, lvm.OpProvision, &out)(&err)
+	defer classifyErr(&err)
 	client, err := getComputeClient(vm)
 	if err != nil {
-		return fmt.Errorf("compute client is not set for the VM: %s", err)
+		return fmt.Errorf("compute client is not set for the VM: %w", err)
 	}
 
+	rb := lvm.NewRollback(vm.KeepOnFailure)
+	rb.Events = vm.events()
+	defer rb.Finish(&err)
+
 	// Get back an flavor ID string
 	flavorID, err := flavors.IDFromName(client, vm.FlavorName)
 	if err != nil {
@@ -199,12 +257,12 @@ func (vm *VM) Provision() error {
 	if vm.ImageID == "" {
 		imageID, err = findImageIDByName(client, vm.ImageMetadata.Name)
 		if err != nil {
-			return fmt.Errorf("error on searching image: %s", err)
+			return fmt.Errorf("error on searching image: %w", err)
 		}
 
 		if imageID == "" {
 			// Create an image ID and return the image ID
-			imageID, err = createImage(vm)
+			imageID, err = createImage(ctx, vm, rb)
 			if err != nil {
 				return err
 			}
@@ -240,26 +298,26 @@ func (vm *VM) Provision() error {
 		return err
 	}
 
-	// Cleanup VM if something goes wrong
-	var cleanup = func(err error) error {
-		if errDestroy := vm.Destroy(); errDestroy != nil {
-			return fmt.Errorf("%s %s", err, errDestroy)
-		}
-		return err
-	}
-
 	// Set the server ID to VM ID
 	vm.InstanceID = server.ID
+	rb.Add("server "+server.ID, func(ctx context.Context) error {
+		if err := deleteVM(ctx, client, vm); err != nil {
+			return err
+		}
+		vm.InstanceID = ""
+		return nil
+	})
 
 	// Wait until VM runs
-	err = waitUntil(vm, lvm.VMRunning)
+	err = waitUntil(ctx, vm, lvm.VMRunning)
 	if err != nil {
-		return cleanup(err)
+		return err
 	}
+	out.State = lvm.VMRunning
 
 	// Create and associate an floating IP for this VM
 	if vm.FloatingIPPool == "" {
-		return cleanup(fmt.Errorf("empty floating IP pool"))
+		return fmt.Errorf("empty floating IP pool")
 	}
 
 	fip, err := floatingip.Create(client, &floatingip.CreateOpts{
@@ -267,28 +325,36 @@ func (vm *VM) Provision() error {
 	}).Extract()
 
 	if err != nil {
-		return cleanup(fmt.Errorf("unable to create a floating ip: %s", err))
+		return fmt.Errorf("unable to create a floating ip: %w", err)
 	}
+	rb.Add("floating ip "+fip.IP, func(ctx context.Context) error {
+		return floatingip.Delete(client, fip.ID).ExtractErr()
+	})
 
 	err = floatingip.Associate(client, server.ID, fip.IP).ExtractErr()
 	if err != nil {
-		errFipDelete := floatingip.Delete(client, fip.ID).ExtractErr()
-		err = fmt.Errorf("%s %s", err, errFipDelete)
-		return cleanup(fmt.Errorf("unable to associate a floating ip: %s", err))
+		return fmt.Errorf("unable to associate a floating ip: %w", err)
 	}
 	vm.FloatingIP = fip
+	rb.Add("floating ip association", func(ctx context.Context) error {
+		if err := floatingip.Disassociate(client, server.ID, fip.IP).ExtractErr(); err != nil {
+			return err
+		}
+		vm.FloatingIP = nil
+		return nil
+	})
 
 	// Wait until the VM gets ready for SSH
-	err = waitUntilSSHReady(vm)
+	err = waitUntilSSHReady(ctx, vm)
 	if err != nil {
-		return cleanup(err)
+		return err
 	}
 
 	// Create and attach a volume to this VM, if the volume size is > 0
 	if vm.Volume.Size > 0 {
-		err = createAndAttachVolume(vm)
+		err = createAndAttachVolume(ctx, vm, rb)
 		if err != nil {
-			return cleanup(err)
+			return err
 		}
 	}
 
@@ -299,6 +365,16 @@ func (vm *VM) Provision() error {
 // PrivateIP consts can be used to retrieve respective IP address type. It
 // returns nil if there was an error obtaining the IPs.
 func (vm *VM) GetIPs() ([]net.IP, error) {
+	return vm.GetIPsContext(context.Background())
+}
+
+// GetIPsContext is like GetIPs but returns ctx.Err() once ctx is done.
+func (vm *VM) GetIPsContext(ctx context.Context) (ips []net.IP, err error) {
+	defer classifyErr(&err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	server, err := getServer(vm)
 	if server == nil || err != nil {
 		// Probably need to call Provision first.
@@ -310,8 +386,12 @@ func (vm *VM) GetIPs() ([]net.IP, error) {
 		// Probably need to create some network first.
 		return nil, err
 	}
-	ips := make([]net.IP, 2)
+	ips = make([]net.IP, 2)
 	for _, networkID := range vm.Networks {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		network, err := networks.Get(client, networkID).Extract()
 		if err != nil {
 			return nil, err
@@ -336,7 +416,14 @@ func (vm *VM) GetIPs() ([]net.IP, error) {
 
 // Destroy terminates the VM on Openstack. It returns an error if there is no instance ID.
 func (vm *VM) Destroy() error {
+	return vm.DestroyContext(context.Background())
+}
 
+// DestroyContext is like Destroy but stops waiting on the volume and the
+// instance deletion when ctx is done.
+func (vm *VM) DestroyContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpDestroy)(&err)
+	defer classifyErr(&err)
 	if vm.InstanceID == "" {
 		// Probably need to call Provision first.
 		return ErrNoInstanceID
@@ -344,7 +431,7 @@ func (vm *VM) Destroy() error {
 
 	client, err := getComputeClient(vm)
 	if err != nil {
-		return fmt.Errorf("compute client is not set for the VM, %s", err)
+		return fmt.Errorf("compute client is not set for the VM, %w", err)
 	}
 
 	// Delete the floating IP first before destroying the VM
@@ -352,25 +439,25 @@ func (vm *VM) Destroy() error {
 	if vm.FloatingIP != nil {
 		err = floatingip.Disassociate(client, vm.InstanceID, vm.FloatingIP.IP).ExtractErr()
 		if err != nil {
-			errors = append(errors, fmt.Errorf("unable to disassociate floating ip from instance: %s", err))
+			errors = append(errors, fmt.Errorf("unable to disassociate floating ip from instance: %w", err))
 		} else {
 			err = floatingip.Delete(client, vm.FloatingIP.ID).ExtractErr()
 			if err != nil {
-				errors = append(errors, fmt.Errorf("unable to delete floating ip: %s", err))
+				errors = append(errors, fmt.Errorf("unable to delete floating ip: %w", err))
 			}
 		}
 	}
 
 	// De-attach and delete the volume, if there is an attached one
 	if vm.Volume.ID != "" {
-		err = deattachAndDeleteVolume(vm)
+		err = deattachAndDeleteVolume(ctx, vm)
 		if err != nil {
 			errors = append(errors, err)
 		}
 	}
 
 	// Delete the instance
-	err = deleteVM(client, vm)
+	err = deleteVM(ctx, client, vm)
 	if err != nil {
 		errors = append(errors, err)
 	}
@@ -395,41 +482,122 @@ func (vm *VM) Destroy() error {
 // GetSSH returns an SSH client that can be used to connect to a VM. An error is
 // returned if the VM has no IPs.
 func (vm *VM) GetSSH(options ssh.Options) (ssh.Client, error) {
-	ips, err := util.GetVMIPs(vm, options)
+	return vm.GetSSHContext(context.Background(), options)
+}
+
+// GetSSHContext is like GetSSH but the IP lookup is bound to ctx.
+func (vm *VM) GetSSHContext(ctx context.Context, options ssh.Options) (ssh.Client, error) {
+	ips, err := util.GetVMIPsContext(ctx, vm, options)
 	if err != nil {
 		return nil, err
 	}
 
-	client := ssh.SSHClient{Creds: &vm.Credentials, IP: ips[PublicIP], Port: 22, Options: options}
+	client := ssh.SSHClient{Creds: &vm.Credentials, IP: util.SSHIP(ips, options, PublicIP, PrivateIP), Port: 22, Options: options}
 	return &client, nil
 }
 
-// GetState returns the state of the VM, such as "ACTIVE". An error is returned
-// if the instance ID is missing, if there was a problem querying Openstack, or if
-// there are no instances.
+// GetState returns the state of the VM, such as lvm.VMRunning. An error is
+// returned if the instance ID is missing or if there was a problem querying
+// Openstack. lvm.VMNotFound is returned if the instance does not exist.
 func (vm *VM) GetState() (string, error) {
-	server, err := getServer(vm)
+	return vm.GetStateContext(context.Background())
+}
+
+// GetStateContext is like GetState but returns ctx.Err() once ctx is done.
+func (vm *VM) GetStateContext(ctx context.Context) (string, error) {
+	d, err := vm.GetStateDetail(ctx)
+	return d.State, err
+}
+
+// GetHostKeys returns the SSH host keys cloud-init printed in the console log
+// of the server.
+func (vm *VM) GetHostKeys(ctx context.Context) (keys []cssh.PublicKey, err error) {
+	defer classifyErr(&err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if vm.InstanceID == "" {
+		// Probably need to call Provision first.
+		return nil, ErrNoInstanceID
+	}
+
+	client, err := getComputeClient(vm)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if server == nil {
-		// VM state "unknown"
-		return "", lvm.ErrVMInfoFailed
+	var out struct {
+		Output string `json:"output"`
+	}
+	_, err = client.Request("POST", client.ServiceURL("servers", vm.InstanceID, "action"), gophercloud.RequestOpts{
+		JSONBody:     map[string]interface{}{"os-getConsoleOutput": map[string]interface{}{}},
+		JSONResponse: &out,
+		OkCodes:      []int{http.StatusOK},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the console log: %w", err)
+	}
+	return ssh.ParseHostKeys([]byte(out.Output))
+}
+
+// GetStateDetail is like GetStateContext but also returns the server status
+// reported by Openstack, such as "SHUTOFF".
+func (vm *VM) GetStateDetail(ctx context.Context) (d lvm.StateDetail, err error) {
+	defer classifyErr(&err)
+	if err := ctx.Err(); err != nil {
+		return lvm.StateDetail{}, err
 	}
 
-	if server.Status == StateActive {
-		return lvm.VMRunning, nil
-	} else if server.Status == StateShutOff {
-		return lvm.VMHalted, nil
-	} else if server.Status == StateError {
-		return lvm.VMError, nil
+	if vm.InstanceID == "" {
+		// Probably need to call Provision first.
+		return lvm.StateDetail{}, ErrNoInstanceID
 	}
-	return lvm.VMUnknown, nil
+
+	client, err := getComputeClient(vm)
+	if err != nil {
+		return lvm.StateDetail{}, err
+	}
+
+	server, err := servers.Get(client, vm.InstanceID).Extract()
+	if err != nil {
+		if e, ok := err.(*gophercloud.UnexpectedResponseCodeError); ok && e.Actual == http.StatusNotFound {
+			return lvm.StateDetail{State: lvm.VMNotFound}, nil
+		}
+		return lvm.StateDetail{}, lvm.WrapErrors(lvm.ErrVMInfoFailed, err)
+	}
+
+	d = lvm.StateDetail{Raw: server.Status}
+	switch server.Status {
+	case StateActive:
+		d.State = lvm.VMRunning
+	case StateBuild:
+		d.State = lvm.VMStarting
+	case StateShutOff:
+		d.State = lvm.VMHalted
+	case StateSuspended, StatePaused:
+		d.State = lvm.VMSuspended
+	case StateError:
+		d.State = lvm.VMError
+	case StateDeleted, StateSoftDeleted:
+		d.State = lvm.VMTerminated
+	case StateReboot, StateHardReboot, StateRebuild, StateResize, StateMigrating:
+		d.State = lvm.VMPending
+	default:
+		d.State = lvm.VMUnknown
+	}
+	return d, nil
 }
 
 // Halt shuts down the insance on Openstack.
 func (vm *VM) Halt() error {
+	return vm.HaltContext(context.Background())
+}
+
+// HaltContext is like Halt but stops waiting for the instance when ctx is done.
+func (vm *VM) HaltContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpHalt)(&err)
+	defer classifyErr(&err)
 	if vm.InstanceID == "" {
 		// Probably need to call Provision first.
 		return ErrNoInstanceID
@@ -437,11 +605,11 @@ func (vm *VM) Halt() error {
 
 	client, err := getComputeClient(vm)
 	if err != nil {
-		return fmt.Errorf("compute client is not set for the VM, %s", err)
+		return fmt.Errorf("compute client is not set for the VM, %w", err)
 	}
 
 	// Take a look at the initial state of the VM. Make sure it is in ACTIVE state
-	state, err := vm.GetState()
+	state, err := vm.GetStateContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -453,15 +621,22 @@ func (vm *VM) Halt() error {
 	// Stop the VM (instance)
 	err = ss.Stop(client, vm.InstanceID).ExtractErr()
 	if err != nil {
-		return fmt.Errorf("failed to stop the instance: %s", err)
+		return fmt.Errorf("failed to stop the instance: %w", err)
 	}
 
 	// Wait until VM halts
-	return waitUntil(vm, lvm.VMHalted)
+	return waitUntil(ctx, vm, lvm.VMHalted)
 }
 
 // Start boots a stopped VM.
 func (vm *VM) Start() error {
+	return vm.StartContext(context.Background())
+}
+
+// StartContext is like Start but stops waiting for SSH when ctx is done.
+func (vm *VM) StartContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpStart)(&err)
+	defer classifyErr(&err)
 	if vm.InstanceID == "" {
 		// Probably need to call Provision first.
 		return ErrNoInstanceID
@@ -469,11 +644,11 @@ func (vm *VM) Start() error {
 
 	client, err := getComputeClient(vm)
 	if err != nil {
-		return fmt.Errorf("compute client is not set for the VM, %s", err)
+		return fmt.Errorf("compute client is not set for the VM, %w", err)
 	}
 
 	// Take a look at the initial state of the VM. Make sure it is in ACTIVE state
-	state, err := vm.GetState()
+	state, err := vm.GetStateContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -489,7 +664,13 @@ func (vm *VM) Start() error {
 	}
 
 	// Wait until the VM gets ready for SSH
-	return waitUntilSSHReady(vm)
+	return waitUntilSSHReady(ctx, vm)
+}
+
+// Capabilities reports that Openstack VMs can have a volume attached
+// and be connected to several networks.
+func (vm *VM) Capabilities() lvm.Capabilities {
+	return lvm.Capabilities{MultipleNICs: true, Volumes: true}
 }
 
 // Suspend always returns an error since we do not support for Openstack for now.
@@ -503,3 +684,13 @@ func (vm *VM) Suspend() error {
 func (vm *VM) Resume() error {
 	return lvm.ErrResumeNotSupported
 }
+
+// SuspendContext always returns an error since we do not support for Openstack for now.
+func (vm *VM) SuspendContext(ctx context.Context) error {
+	return lvm.ErrSuspendNotSupported
+}
+
+// ResumeContext always returns an error since we do not support for Openstack for now.
+func (vm *VM) ResumeContext(ctx context.Context) error {
+	return lvm.ErrResumeNotSupported
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Factory builds a provider's VM from a Spec. It only fills in the VM; the
+// caller is responsible for provisioning it.
+type Factory func(spec *Spec) (VirtualMachine, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// ErrNoProvider is returned by New when the spec does not name a provider.
+var ErrNoProvider = errors.New("no provider specified")
+
+// Register makes a provider available to New under name. Providers call it
+// from their init function, so importing a provider package, even only for
+// its side effects, is enough to use it. Register panics if it is called
+// twice with the same name or with a nil factory.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("virtualmachine: Register factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("virtualmachine: Register called twice for provider " + name)
+	}
+	factories[name] = factory
+}
+
+// Providers returns the sorted names of the registered providers.
+func Providers() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New builds a VM with the factory registered for spec.Provider.
+func New(spec *Spec) (VirtualMachine, error) {
+	if spec.Provider == "" {
+		return nil, ErrNoProvider
+	}
+	factoriesMu.RLock()
+	factory, ok := factories[spec.Provider]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q (forgotten import?)", spec.Provider)
+	}
+
+	spec, err := spec.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return factory(spec)
+}
+
+// ProviderNamer is implemented by VMs that report the name their provider is
+// registered under.
+type ProviderNamer interface {
+	Provider() string
+}
+
+// ProviderOf returns the name vm's provider is registered under, or "" if vm
+// does not implement ProviderNamer.
+func ProviderOf(vm VirtualMachine) string {
+	if p, ok := vm.(ProviderNamer); ok {
+		return p.Provider()
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine_test
+
+import (
+	"strings"
+	"testing"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/mockprovider"
+)
+
+// captureProvider is registered by the tests to see the spec given to its
+// factory.
+const captureProvider = "test-capture"
+
+var captured *lvm.Spec
+
+func init() {
+	lvm.Register(captureProvider, func(spec *lvm.Spec) (lvm.VirtualMachine, error) {
+		captured = spec
+		return &mockprovider.VM{}, nil
+	})
+}
+
+// TestNew makes sure New builds a VM with the factory of the spec's provider.
+func TestNew(t *testing.T) {
+	vm, err := lvm.New(&lvm.Spec{Provider: "mock", Name: "test-vm"})
+	if err != nil {
+		t.Fatalf("New returned %s", err)
+	}
+	if _, ok := vm.(*mockprovider.VM); !ok {
+		t.Fatalf("New returned a %T, want *mockprovider.VM", vm)
+	}
+	if name := vm.GetName(); name != "test-vm" {
+		t.Fatalf("GetName() = %q, want test-vm", name)
+	}
+}
+
+// TestNewErrors makes sure New rejects specs without a known provider.
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		provider string
+		err      string
+	}{
+		{"", lvm.ErrNoProvider.Error()},
+		{"no-such-provider", `unknown provider "no-such-provider"`},
+	}
+	for _, tt := range tests {
+		_, err := lvm.New(&lvm.Spec{Provider: tt.provider})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("New(%q) returned %v, want %q", tt.provider, err, tt.err)
+		}
+	}
+}
+
+// TestRegisterPanics makes sure Register refuses duplicate names and nil
+// factories.
+func TestRegisterPanics(t *testing.T) {
+	tests := []struct {
+		name    string
+		factory lvm.Factory
+	}{
+		{"mock", mockprovider.FromSpec},
+		{"test-nil", nil},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("Register(%q) did not panic", tt.name)
+				}
+			}()
+			lvm.Register(tt.name, tt.factory)
+		}()
+	}
+}
+
+// TestProviders makes sure Providers lists the registered names in order.
+func TestProviders(t *testing.T) {
+	names := lvm.Providers()
+	var mock, capture int
+	for i, name := range names {
+		if i > 0 && names[i-1] >= name {
+			t.Fatalf("Providers() = %v, not sorted", names)
+		}
+		switch name {
+		case "mock":
+			mock++
+		case captureProvider:
+			capture++
+		}
+	}
+	if mock != 1 || capture != 1 {
+		t.Fatalf("Providers() = %v, want mock and %s once", names, captureProvider)
+	}
+}
+
+// TestProviderOf makes sure ProviderOf reports the provider a VM was built by.
+func TestProviderOf(t *testing.T) {
+	vm, err := lvm.New(&lvm.Spec{Provider: "mock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := lvm.ProviderOf(vm); name != "mock" {
+		t.Fatalf("ProviderOf returned %q, want mock", name)
+	}
+	if name := lvm.ProviderOf(noHandleVM{}); name != "" {
+		t.Fatalf("ProviderOf returned %q for a VM without ProviderNamer", name)
+	}
+}
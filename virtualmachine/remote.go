@@ -0,0 +1,71 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine
+
+import (
+	"errors"
+	"net"
+
+	"github.com/apcera/libretto/remote"
+	"github.com/apcera/libretto/ssh"
+)
+
+// Remoter is implemented by VMs that can be reached over other transports
+// than SSH, such as Windows VMs over WinRM.
+type Remoter interface {
+	GetRemote(options remote.Options) (remote.Remote, error)
+}
+
+// ErrTransportNotSupported is returned when a VM cannot be reached with the
+// transport asked of GetRemote.
+var ErrTransportNotSupported = NewError(NotSupported, errors.New("VM cannot be reached with this transport"))
+
+// GetRemote returns a Remote that runs commands on vm:
+//
+//	r, err := lvm.GetRemote(vm, remote.Options{Transport: remote.WinRM})
+//	if err != nil {
+//		return err
+//	}
+//	defer r.Close()
+//	if err := r.WaitReady(ctx, 10*time.Minute); err != nil {
+//		return err
+//	}
+//	err = r.Run(ctx, "ipconfig /all", os.Stdout, os.Stderr)
+//
+// VMs that do not implement Remoter are only reached over SSH, through
+// GetSSH.
+func GetRemote(vm VirtualMachine, options remote.Options) (remote.Remote, error) {
+	if r, ok := vm.(Remoter); ok {
+		return r.GetRemote(options)
+	}
+	if options.Transport != "" && options.Transport != remote.SSH {
+		return nil, ErrTransportNotSupported
+	}
+	return sshRemote(vm, options)
+}
+
+// NewRemote returns a Remote for vm over the transport of options: SSH,
+// through GetSSH, or WinRM, to the IP winrmIP returns, logging in with the
+// user and password of creds unless options.WinRM sets them. Providers whose
+// VMs can run Windows implement Remoter with it.
+func NewRemote(vm VirtualMachine, options remote.Options, creds *ssh.Credentials, winrmIP func() (net.IP, error)) (remote.Remote, error) {
+	switch options.Transport {
+	case "", remote.SSH:
+		return sshRemote(vm, options)
+	case remote.WinRM:
+		ip, err := winrmIP()
+		if err != nil {
+			return nil, err
+		}
+		return remote.NewWinRM(ip, creds, options.WinRM), nil
+	}
+	return nil, ErrTransportNotSupported
+}
+
+func sshRemote(vm VirtualMachine, options remote.Options) (remote.Remote, error) {
+	client, err := vm.GetSSH(options.SSH)
+	if err != nil {
+		return nil, err
+	}
+	return remote.NewSSH(client), nil
+}
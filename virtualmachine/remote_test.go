@@ -0,0 +1,41 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/apcera/libretto/remote"
+	"github.com/apcera/libretto/ssh"
+	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/mockprovider"
+)
+
+// TestNewRemote makes sure NewRemote picks the transport of the options and
+// only looks up the WinRM IP for WinRM.
+func TestNewRemote(t *testing.T) {
+	errNoIP := errors.New("no IP")
+	client := &ssh.MockSSHClient{}
+	vm := &mockprovider.VM{MockGetSSH: func(ssh.Options) (ssh.Client, error) { return client, nil }}
+	winrmIP := func() (net.IP, error) { return nil, errNoIP }
+
+	for _, transport := range []remote.Transport{"", remote.SSH} {
+		r, err := lvm.NewRemote(vm, remote.Options{Transport: transport}, nil, winrmIP)
+		if err != nil || r == nil {
+			t.Fatalf("transport %q: NewRemote returned %v", transport, err)
+		}
+	}
+	if _, err := lvm.NewRemote(vm, remote.Options{Transport: remote.WinRM}, nil, winrmIP); err != errNoIP {
+		t.Fatalf("WinRM: NewRemote returned %v, want the error of winrmIP", err)
+	}
+	if _, err := lvm.NewRemote(vm, remote.Options{Transport: "telnet"}, nil, winrmIP); err != lvm.ErrTransportNotSupported {
+		t.Fatalf("telnet: NewRemote returned %v, want ErrTransportNotSupported", err)
+	}
+
+	// VMs that do not implement Remoter are only reached over SSH.
+	if _, err := lvm.GetRemote(vm, remote.Options{Transport: remote.WinRM}); err != lvm.ErrTransportNotSupported {
+		t.Fatalf("GetRemote returned %v, want ErrTransportNotSupported", err)
+	}
+}
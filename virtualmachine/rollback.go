@@ -0,0 +1,92 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RollbackTimeout bounds the time Rollback.Finish spends undoing resources.
+// This is a global var, so modifying it will apply to all rollbacks.
+var RollbackTimeout = 10 * time.Minute
+
+// undoStep removes one resource created during provisioning.
+type undoStep struct {
+	name string
+	undo func(ctx context.Context) error
+}
+
+// Rollback records the resources a provider creates while provisioning a VM,
+// so that they can be removed if provisioning fails partway. Providers use it
+// in Provision:
+//
+//	rb := lvm.NewRollback(vm.KeepOnFailure)
+//	defer rb.Finish(&err)
+//
+//	id, err := createDisk(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	rb.Add("disk "+id, func(ctx context.Context) error {
+//		return deleteDisk(ctx, id)
+//	})
+type Rollback struct {
+	// Events receives ResourceCreated for every resource added and
+	// ResourceDeleted for every resource removed. Providers set it to the
+	// Events of the VM being provisioned.
+	Events Events
+
+	steps []undoStep
+	keep  bool
+}
+
+// NewRollback returns an empty Rollback. If keep is set, Finish leaves the
+// resources in place so that a failed VM can be inspected.
+func NewRollback(keep bool) *Rollback {
+	return &Rollback{keep: keep}
+}
+
+// Add records a resource that undo removes. Resources are removed in the
+// reverse order they were added.
+func (r *Rollback) Add(name string, undo func(ctx context.Context) error) {
+	r.steps = append(r.steps, undoStep{name: name, undo: undo})
+	r.Events.ResourceCreated(name)
+}
+
+// Run removes the recorded resources, most recent first, and forgets them.
+// It carries on after a failed step and returns the errors of all the failed
+// steps.
+func (r *Rollback) Run(ctx context.Context) error {
+	var errs []error
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		s := r.steps[i]
+		if err := s.undo(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("error removing %s: %w", s.name, err))
+			continue
+		}
+		r.Events.ResourceDeleted(s.name)
+	}
+	r.steps = nil
+	if len(errs) == 0 {
+		return nil
+	}
+	return JoinErrors("; ", errs...)
+}
+
+// Finish removes the recorded resources if *err is not nil and the Rollback
+// was not told to keep them. It is meant to be deferred with a pointer to
+// Provision's named error result. The resources are removed with a fresh
+// context bounded by RollbackTimeout, since the one passed to Provision may
+// be the reason it failed. Errors removing them are added to *err.
+func (r *Rollback) Finish(err *error) {
+	if *err == nil || r.keep || len(r.steps) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RollbackTimeout)
+	defer cancel()
+	if rerr := r.Run(ctx); rerr != nil {
+		*err = WrapErrors(*err, fmt.Errorf("rollback failed: %w", rerr))
+	}
+}
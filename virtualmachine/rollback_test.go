@@ -0,0 +1,109 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+// TestRollbackFinish makes sure Finish undoes the resources, most recent
+// first, only when provisioning failed and the resources are not kept.
+func TestRollbackFinish(t *testing.T) {
+	errProvision := errors.New("provisioning failed")
+	tests := []struct {
+		name string
+		err  error
+		keep bool
+		want []string
+	}{
+		{"success", nil, false, nil},
+		{"failure", errProvision, false, []string{"nic", "disk", "ip"}},
+		{"keep", errProvision, true, nil},
+	}
+	for _, tt := range tests {
+		var undone []string
+		rb := lvm.NewRollback(tt.keep)
+		for _, name := range []string{"ip", "disk", "nic"} {
+			name := name
+			rb.Add(name, func(ctx context.Context) error {
+				if _, ok := ctx.Deadline(); !ok {
+					t.Fatalf("%s: undo of %s got a context without deadline", tt.name, name)
+				}
+				undone = append(undone, name)
+				return nil
+			})
+		}
+
+		err := tt.err
+		rb.Finish(&err)
+		if err != tt.err {
+			t.Fatalf("%s: Finish changed the error to %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(undone, tt.want) {
+			t.Fatalf("%s: undid %v, want %v", tt.name, undone, tt.want)
+		}
+	}
+}
+
+// TestRollbackErrors makes sure a failed step does not stop the others and
+// that Finish adds the failures to the error of Provision.
+func TestRollbackErrors(t *testing.T) {
+	errProvision := errors.New("provisioning failed")
+	errDisk := lvm.NewError(lvm.Transient, errors.New("disk busy"))
+	errNIC := errors.New("nic in use")
+
+	var undone []string
+	rb := lvm.NewRollback(false)
+	rb.Add("ip", func(context.Context) error {
+		undone = append(undone, "ip")
+		return nil
+	})
+	rb.Add("disk", func(context.Context) error { return errDisk })
+	rb.Add("nic", func(context.Context) error { return errNIC })
+
+	err := errProvision
+	rb.Finish(&err)
+	if !reflect.DeepEqual(undone, []string{"ip"}) {
+		t.Fatalf("undid %v, want [ip]", undone)
+	}
+	for _, target := range []error{errProvision, errDisk, errNIC, lvm.Transient} {
+		if !errors.Is(err, target) {
+			t.Fatalf("error %q does not contain %q", err, target)
+		}
+	}
+	want := "provisioning failed: rollback failed: error removing nic: nic in use; error removing disk: disk busy"
+	if err.Error() != want {
+		t.Fatalf("Finish set the error to %q, want %q", err, want)
+	}
+
+	// The steps are forgotten once run.
+	if err := rb.Run(context.Background()); err != nil {
+		t.Fatalf("second Run returned %s", err)
+	}
+}
+
+// TestRollbackEvents makes sure resources are reported as created and
+// deleted.
+func TestRollbackEvents(t *testing.T) {
+	var events []string
+	rb := lvm.NewRollback(false)
+	rb.Events.Observer = lvm.ObserverFunc(func(e lvm.Event) {
+		events = append(events, string(e.Type)+" "+e.Resource)
+	})
+	rb.Add("disk", func(context.Context) error { return nil })
+	rb.Add("nic", func(context.Context) error { return errors.New("nic in use") })
+	if err := rb.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "nic in use") {
+		t.Fatalf("Run returned %v", err)
+	}
+
+	want := []string{"resource-created disk", "resource-created nic", "resource-deleted disk"}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("events are %v, want %v", events, want)
+	}
+}
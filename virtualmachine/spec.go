@@ -0,0 +1,131 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Spec is a provider-neutral description of a VM. A provider's Factory maps
+// it to the provider's own VM type; fields the provider has no use for are
+// ignored. Settings that only make sense for one provider, including the
+// credentials used to reach its API, go in Options under the keys documented
+// by that provider's factory.
+type Spec struct {
+	// Provider is the name the provider was registered under, such as "aws".
+	Provider string `json:"provider" yaml:"provider"`
+	// Name is the name of the VM.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Image identifies the image, template or source file the VM boots from.
+	Image string `json:"image,omitempty" yaml:"image,omitempty"`
+	// Size is the machine type, instance type, flavor or offering.
+	Size string `json:"size,omitempty" yaml:"size,omitempty"`
+	// Region is the region, zone or location the VM is created in.
+	Region string `json:"region,omitempty" yaml:"region,omitempty"`
+	// Disks are the disks to attach to the VM, the first one being the boot
+	// disk on providers that let it be configured.
+	Disks []DiskSpec `json:"disks,omitempty" yaml:"disks,omitempty"`
+	// Networks are the networks to attach the VM to.
+	Networks []NetworkSpec `json:"networks,omitempty" yaml:"networks,omitempty"`
+	// SSH holds the credentials used to connect to the VM.
+	SSH SSHSpec `json:"ssh,omitempty" yaml:"ssh,omitempty"`
+	// UserData is passed to the VM on first boot, usually for cloud-init.
+	UserData string `json:"user_data,omitempty" yaml:"user_data,omitempty"`
+	// Tags are key/value pairs attached to the VM.
+	Tags map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	// KeepOnFailure keeps the resources created by a failed Provision so that
+	// they can be inspected, instead of removing them.
+	KeepOnFailure bool `json:"keep_on_failure,omitempty" yaml:"keep_on_failure,omitempty"`
+	// Options holds provider-specific settings.
+	Options map[string]string `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+// DiskSpec describes a disk attached to a VM.
+type DiskSpec struct {
+	Name   string `json:"name,omitempty" yaml:"name,omitempty"`
+	Device string `json:"device,omitempty" yaml:"device,omitempty"`
+	Type   string `json:"type,omitempty" yaml:"type,omitempty"`
+	SizeGB int    `json:"size_gb,omitempty" yaml:"size_gb,omitempty"`
+}
+
+// NetworkSpec describes a network a VM is attached to.
+type NetworkSpec struct {
+	Name           string   `json:"name,omitempty" yaml:"name,omitempty"`
+	Subnet         string   `json:"subnet,omitempty" yaml:"subnet,omitempty"`
+	SecurityGroups []string `json:"security_groups,omitempty" yaml:"security_groups,omitempty"`
+}
+
+// SSHSpec holds the credentials used to connect to a VM. If PrivateKey is
+// empty, New reads it from PrivateKeyFile.
+type SSHSpec struct {
+	User           string `json:"user,omitempty" yaml:"user,omitempty"`
+	Password       string `json:"password,omitempty" yaml:"password,omitempty"`
+	PrivateKey     string `json:"private_key,omitempty" yaml:"private_key,omitempty"`
+	PrivateKeyFile string `json:"private_key_file,omitempty" yaml:"private_key_file,omitempty"`
+	PublicKey      string `json:"public_key,omitempty" yaml:"public_key,omitempty"`
+}
+
+// ParseSpec parses a Spec from YAML or JSON.
+func ParseSpec(data []byte) (*Spec, error) {
+	spec := &Spec{}
+	// JSON is a subset of YAML, so one decoder handles both.
+	if err := yaml.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("error parsing VM spec: %w", err)
+	}
+	return spec, nil
+}
+
+// LoadSpec reads a Spec from a YAML or JSON file. A relative
+// ssh.private_key_file is resolved against the directory of the file.
+func LoadSpec(path string) (*Spec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := ParseSpec(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if f := spec.SSH.PrivateKeyFile; f != "" && !filepath.IsAbs(f) {
+		spec.SSH.PrivateKeyFile = filepath.Join(filepath.Dir(path), f)
+	}
+	return spec, nil
+}
+
+// Option returns the provider-specific option key, or "" if it is not set.
+func (s *Spec) Option(key string) string {
+	return s.Options[key]
+}
+
+// BoolOption returns the provider-specific option key parsed as a bool. It
+// returns false if the option is not set and an error if it does not parse.
+func (s *Spec) BoolOption(key string) (bool, error) {
+	v, ok := s.Options[key]
+	if !ok || v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("option %s: %w", key, err)
+	}
+	return b, nil
+}
+
+// resolve returns a copy of s with the private key loaded from
+// PrivateKeyFile, so factories only have to look at PrivateKey.
+func (s *Spec) resolve() (*Spec, error) {
+	spec := *s
+	if spec.SSH.PrivateKey == "" && spec.SSH.PrivateKeyFile != "" {
+		key, err := ioutil.ReadFile(spec.SSH.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading private key: %w", err)
+		}
+		spec.SSH.PrivateKey = string(key)
+	}
+	return &spec, nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+// TestParseSpec makes sure YAML and JSON specs parse to the same Spec.
+func TestParseSpec(t *testing.T) {
+	want := &lvm.Spec{
+		Provider: "aws",
+		Name:     "web",
+		Image:    "ami-1234",
+		Size:     "t2.micro",
+		Disks:    []lvm.DiskSpec{{Device: "/dev/sda1", SizeGB: 20}},
+		Networks: []lvm.NetworkSpec{{Subnet: "subnet-1", SecurityGroups: []string{"sg-1", "sg-2"}}},
+		SSH:      lvm.SSHSpec{User: "ubuntu"},
+		Tags:     map[string]string{"team": "infra"},
+		Options:  map[string]string{"key_pair": "deploy"},
+	}
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"yaml", `
+provider: aws
+name: web
+image: ami-1234
+size: t2.micro
+disks:
+  - device: /dev/sda1
+    size_gb: 20
+networks:
+  - subnet: subnet-1
+    security_groups: [sg-1, sg-2]
+ssh:
+  user: ubuntu
+tags:
+  team: infra
+options:
+  key_pair: deploy
+`},
+		{"json", `{
+	"provider": "aws",
+	"name": "web",
+	"image": "ami-1234",
+	"size": "t2.micro",
+	"disks": [{"device": "/dev/sda1", "size_gb": 20}],
+	"networks": [{"subnet": "subnet-1", "security_groups": ["sg-1", "sg-2"]}],
+	"ssh": {"user": "ubuntu"},
+	"tags": {"team": "infra"},
+	"options": {"key_pair": "deploy"}
+}`},
+	}
+	for _, tt := range tests {
+		spec, err := lvm.ParseSpec([]byte(tt.data))
+		if err != nil {
+			t.Fatalf("%s: ParseSpec returned %s", tt.name, err)
+		}
+		if !reflect.DeepEqual(spec, want) {
+			t.Fatalf("%s: ParseSpec returned %+v, want %+v", tt.name, spec, want)
+		}
+	}
+
+	if _, err := lvm.ParseSpec([]byte("provider: [")); err == nil {
+		t.Fatalf("ParseSpec accepted invalid YAML")
+	}
+}
+
+// TestBoolOption makes sure BoolOption parses options and rejects garbage.
+func TestBoolOption(t *testing.T) {
+	spec := &lvm.Spec{Options: map[string]string{"yes": "true", "no": "0", "empty": "", "bad": "maybe"}}
+	tests := []struct {
+		key     string
+		want    bool
+		wantErr bool
+	}{
+		{"yes", true, false},
+		{"no", false, false},
+		{"empty", false, false},
+		{"missing", false, false},
+		{"bad", false, true},
+	}
+	for _, tt := range tests {
+		got, err := spec.BoolOption(tt.key)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Fatalf("BoolOption(%q) = %v, %v, want %v and error %v", tt.key, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if _, err := spec.BoolOption("bad"); !errors.Is(err, strconv.ErrSyntax) {
+		t.Fatalf("BoolOption does not wrap the parse error: %v", err)
+	}
+}
+
+// TestLoadSpecPrivateKey makes sure a relative private_key_file is resolved
+// against the spec file and read by New.
+func TestLoadSpecPrivateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "id_rsa"), []byte("private key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "vm.yaml")
+	data := "provider: " + captureProvider + "\nssh:\n  private_key_file: id_rsa\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	spec, err := lvm.LoadSpec(path)
+	if err != nil {
+		t.Fatalf("LoadSpec returned %s", err)
+	}
+	if want := filepath.Join(dir, "id_rsa"); spec.SSH.PrivateKeyFile != want {
+		t.Fatalf("PrivateKeyFile = %q, want %q", spec.SSH.PrivateKeyFile, want)
+	}
+
+	if _, err := lvm.New(spec); err != nil {
+		t.Fatalf("New returned %s", err)
+	}
+	if captured.SSH.PrivateKey != "private key" {
+		t.Fatalf("factory got private key %q", captured.SSH.PrivateKey)
+	}
+	if spec.SSH.PrivateKey != "" {
+		t.Fatalf("New modified the caller's spec")
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine
+
+import (
+	"context"
+)
+
+// StateDetail is the state of a VM as one of the VM* constants, together with
+// the state string the provider reported.
+type StateDetail struct {
+	// State is one of VMStarting, VMRunning, VMHalted, VMSuspended, VMPending,
+	// VMError, VMTerminated, VMNotFound or VMUnknown.
+	State string
+	// Raw is the provider's own name for the state, such as "stopping" on
+	// AWS or "PowerState/deallocated" on Azure.
+	Raw string
+}
+
+// StateDetailer is implemented by VMs that can report the provider's own
+// state alongside the normalized one returned by GetState.
+type StateDetailer interface {
+	GetStateDetail(ctx context.Context) (StateDetail, error)
+}
+
+// GetStateDetail returns the detailed state of vm. If vm does not implement
+// StateDetailer, Raw is the same as State.
+func GetStateDetail(ctx context.Context, vm VirtualMachine) (StateDetail, error) {
+	if d, ok := vm.(StateDetailer); ok {
+		return d.GetStateDetail(ctx)
+	}
+	state, err := AsContext(vm).GetStateContext(ctx)
+	if err != nil {
+		return StateDetail{}, err
+	}
+	return StateDetail{State: state, Raw: state}, nil
+}
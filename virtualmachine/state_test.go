@@ -0,0 +1,47 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualmachine_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/mockprovider"
+)
+
+// detailedVM reports a raw state through lvm.StateDetailer.
+type detailedVM struct {
+	*mockprovider.VM
+	detail lvm.StateDetail
+}
+
+func (vm detailedVM) GetStateDetail(ctx context.Context) (lvm.StateDetail, error) {
+	return vm.detail, nil
+}
+
+// TestGetStateDetail makes sure GetStateDetail prefers StateDetailer and
+// otherwise reports the normalized state as the raw one.
+func TestGetStateDetail(t *testing.T) {
+	errBoom := errors.New("boom")
+	running := &mockprovider.VM{MockGetState: func() (string, error) { return lvm.VMRunning, nil }}
+	failing := &mockprovider.VM{MockGetState: func() (string, error) { return "", errBoom }}
+
+	tests := []struct {
+		name string
+		vm   lvm.VirtualMachine
+		want lvm.StateDetail
+		err  error
+	}{
+		{"detailer", detailedVM{running, lvm.StateDetail{State: lvm.VMPending, Raw: "stopping"}}, lvm.StateDetail{State: lvm.VMPending, Raw: "stopping"}, nil},
+		{"fallback", running, lvm.StateDetail{State: lvm.VMRunning, Raw: lvm.VMRunning}, nil},
+		{"error", failing, lvm.StateDetail{}, errBoom},
+	}
+	for _, tt := range tests {
+		d, err := lvm.GetStateDetail(context.Background(), tt.vm)
+		if d != tt.want || err != tt.err {
+			t.Fatalf("%s: GetStateDetail returned %+v, %v, want %+v, %v", tt.name, d, err, tt.want, tt.err)
+		}
+	}
+}
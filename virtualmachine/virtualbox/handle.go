@@ -0,0 +1,41 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualbox
+
+import (
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+var _ lvm.Handler = (*VM)(nil)
+
+// handle holds what is needed to manage a VM from another process.
+type handle struct {
+	Name string `json:"name"`
+	Src  string `json:"src,omitempty"`
+}
+
+// MarshalHandle serializes the name VirtualBox knows the VM by.
+func (vm *VM) MarshalHandle() ([]byte, error) {
+	if vm.Name == "" {
+		return nil, lvm.ErrHandleIncomplete
+	}
+	return lvm.EncodeHandle(providerName, handle{
+		Name: vm.Name,
+		Src:  vm.Src,
+	})
+}
+
+// UnmarshalHandle restores a handle written by MarshalHandle into the VM.
+func (vm *VM) UnmarshalHandle(data []byte) error {
+	var h handle
+	if err := lvm.DecodeHandle(providerName, data, &h); err != nil {
+		return err
+	}
+	if h.Name == "" {
+		return lvm.ErrHandleIncomplete
+	}
+
+	vm.Name = h.Name
+	vm.Src = h.Src
+	return nil
+}
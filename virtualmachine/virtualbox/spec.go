@@ -0,0 +1,57 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualbox
+
+import (
+	"fmt"
+
+	libssh "github.com/apcera/libretto/ssh"
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+// providerName is the name the provider is registered under.
+const providerName = "virtualbox"
+
+func init() {
+	lvm.Register(providerName, FromSpec)
+}
+
+// Provider returns the name the provider is registered under.
+func (vm *VM) Provider() string {
+	return providerName
+}
+
+// FromSpec builds a VirtualBox VM from a provider-neutral spec. Image is the
+// path of the OVA to import. Each network adds a NIC, starting at index 1,
+// whose bridged adapter is the network's Name. The following option is read:
+//
+//	nic_backing  "nat" or "bridged" (the default)
+func FromSpec(spec *lvm.Spec) (lvm.VirtualMachine, error) {
+	vm := &VM{
+		Src:  spec.Image,
+		Name: spec.Name,
+		Credentials: libssh.Credentials{
+			SSHUser:       spec.SSH.User,
+			SSHPassword:   spec.SSH.Password,
+			SSHPrivateKey: spec.SSH.PrivateKey,
+		},
+		KeepOnFailure: spec.KeepOnFailure,
+	}
+
+	backing := Bridged
+	switch b := spec.Option("nic_backing"); b {
+	case "", "bridged":
+	case "nat":
+		backing = Nat
+	default:
+		return nil, fmt.Errorf("unsupported nic backing %q", b)
+	}
+	for i, n := range spec.Networks {
+		vm.Config.NICs = append(vm.Config.NICs, NIC{
+			Idx:           i + 1,
+			Backing:       backing,
+			BackingDevice: n.Name,
+		})
+	}
+	return vm, nil
+}
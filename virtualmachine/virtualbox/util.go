@@ -3,13 +3,14 @@
 package virtualbox
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strings"
-	"sync"
 	"time"
 
 	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/wait"
 )
 
 type ifKeyValue struct {
@@ -130,12 +131,12 @@ func (vm *VM) configure() error {
 }
 
 // This function makes a single request to get IPs from a VM.
-func (vm *VM) requestIPs() []net.IP {
+func (vm *VM) requestIPs(ctx context.Context) []net.IP {
 	if vm.ipUpdate == nil {
 		vm.ipUpdate = map[string]string{}
 	}
 	var ips []net.IP
-	stdout, _, _ := runner.Run("guestproperty", "enumerate", vm.Name)
+	stdout, _, _ := run(ctx, "guestproperty", "enumerate", vm.Name)
 	for _, line := range strings.Split(stdout, "\n") {
 		if match := ipLineRegexp.FindStringSubmatch(line); match != nil {
 			if match := ipAddrRegexp.FindStringSubmatch(line); match != nil {
@@ -154,74 +155,47 @@ func (vm *VM) requestIPs() []net.IP {
 	return ips
 }
 
-func (vm *VM) waitUntilReady() error {
+// bootWaiter polls for the IPs of a booting VM every 2s for up to 90s.
+var bootWaiter = wait.Waiter{
+	Backoff: wait.Constant(2 * time.Second),
+	Timeout: 90 * time.Second,
+}
+
+func (vm *VM) waitUntilReady(ctx context.Context) error {
 	// Check if the VM already has IPs before starting the VM. If it does then
 	// wait until the timestamp for at least one of the changes.
-	ips := vm.requestIPs()
+	vm.requestIPs(ctx)
 	timestamps := map[string]string{}
 	for k, v := range vm.ipUpdate {
 		timestamps[k] = v
 	}
 
-	err := vm.Start()
+	err := vm.StartContext(ctx)
 	if err != nil {
 		return err
 	}
-	quit := make(chan bool, 1)
-	success := make(chan bool, 1)
-	timer := time.NewTimer(time.Second * 90)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			select {
-			case <-quit:
-				success <- false
-				return
-			default:
-				ips = vm.requestIPs()
-				if len(ips) == 0 {
-					time.Sleep(2 * time.Second)
-					continue
-				} else {
-					// Check if the timestamps have changed
-					for k, v := range vm.ipUpdate {
-						// Check if the key even existed before, if it is a new key then all is good
-						timestamp, ok := timestamps[k]
-						if !ok {
-							success <- true
-							return
-						}
-						// If it is not a new key, then check if the timestamp is updated
-						if timestamp != v {
-							success <- true
-							return
-						}
-					}
-				}
-			}
+	err = bootWaiter.Until(ctx, func(ctx context.Context) (bool, error) {
+		if len(vm.requestIPs(ctx)) == 0 {
+			return false, nil
 		}
-	}()
-	var r error
-OuterLoop:
-	for {
-		select {
-		case s := <-success:
-			if !s {
-				r = lvm.ErrVMNoIP
+		// Check if the timestamps have changed
+		for k, v := range vm.ipUpdate {
+			// Check if the key even existed before, if it is a new key then all is good
+			timestamp, ok := timestamps[k]
+			if !ok {
+				return true, nil
+			}
+			// If it is not a new key, then check if the timestamp is updated
+			if timestamp != v {
+				return true, nil
 			}
-			timer.Stop()
-			break OuterLoop
-		case <-timer.C:
-			quit <- true
-			r = lvm.ErrVMBootTimeout
-			break OuterLoop
-
 		}
+		return false, nil
+	})
+	if err == wait.ErrTimeout {
+		return lvm.ErrVMBootTimeout
 	}
-	wg.Wait()
-	return r
+	return err
 }
 
 // DeleteNIC deletes the specified network interface on the vm.
@@ -271,3 +245,27 @@ func DeleteNICs(vm *VM) error {
 	}
 	return nil
 }
+
+// translateState maps a state reported by VBoxManage showvminfo, or "not
+// found" for an unregistered VM, to one of the lvm.VM* states.
+func translateState(raw string) string {
+	switch raw {
+	case "running":
+		return lvm.VMRunning
+	case "paused", "saved":
+		return lvm.VMSuspended
+	case "powered off", "aborted":
+		return lvm.VMHalted
+	case "starting", "restoring":
+		return lvm.VMStarting
+	case "stopping", "saving", "teleporting", "live snapshotting",
+		"restoring snapshot", "deleting snapshot":
+		return lvm.VMPending
+	case "guru meditation":
+		return lvm.VMError
+	case "not found":
+		return lvm.VMNotFound
+	default:
+		return lvm.VMUnknown
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package virtualbox
+
+import (
+	"testing"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+func TestTranslateState(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"running", lvm.VMRunning},
+		{"paused", lvm.VMSuspended},
+		{"saved", lvm.VMSuspended},
+		{"powered off", lvm.VMHalted},
+		{"aborted", lvm.VMHalted},
+		{"starting", lvm.VMStarting},
+		{"restoring", lvm.VMStarting},
+		{"stopping", lvm.VMPending},
+		{"deleting snapshot", lvm.VMPending},
+		{"guru meditation", lvm.VMError},
+		{"not found", lvm.VMNotFound},
+		{"stuck", lvm.VMUnknown},
+		{"", lvm.VMUnknown},
+	}
+	for _, tt := range tests {
+		if got := translateState(tt.raw); got != tt.want {
+			t.Errorf("translateState(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
@@ -4,6 +4,7 @@ package virtualbox
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"os"
@@ -48,20 +49,33 @@ type Runner interface {
 	RunCombinedError(args ...string) (string, error)
 }
 
-// vboxRunner implements the Runner interface.
+// ContextRunner is a Runner whose commands can be cancelled. If the package
+// runner implements it, the Context methods of VM kill VBoxManage when their
+// context is done.
+type ContextRunner interface {
+	Runner
+	RunContext(ctx context.Context, args ...string) (string, string, error)
+}
+
+// vboxRunner implements the ContextRunner interface.
 type vboxRunner struct {
 }
 
 var runner Runner = vboxRunner{}
 
+var _ ContextRunner = vboxRunner{}
+
+var _ lvm.VirtualMachineContext = (*VM)(nil)
+var _ lvm.StateDetailer = (*VM)(nil)
+var _ lvm.Capabler = (*VM)(nil)
+
 // Regexp for parsing vboxmanage output.
 var (
 	ipLineRegexp    = regexp.MustCompile(`/VirtualBox/GuestInfo/Net/0/V4/IP`)
 	ipAddrRegexp    = regexp.MustCompile(`value: .*, timestamp`)
 	timestampRegexp = regexp.MustCompile(`timestamp: \d*`)
 	networkRegexp   = regexp.MustCompile(`(?s)Name:.*?VBoxNetworkName`)
-	stateRegexp     = regexp.MustCompile(`^State:`)
-	runningRegexp   = regexp.MustCompile(`running`)
+	stateRegexp     = regexp.MustCompile(`^State:\s*(.*?)(?: \(since .*\))?\s*$`)
 	backingRegexp   = regexp.MustCompile(`Attachment: NAT`)
 	disabledRegexp  = regexp.MustCompile(`disabled$`)
 	nicRegexp       = regexp.MustCompile(`^NIC \d\d?:`)
@@ -83,6 +97,13 @@ type VM struct {
 	Name        string
 	Config      Config
 	ipUpdate    map[string]string
+
+	// KeepOnFailure keeps the imported VM if Provision fails.
+	KeepOnFailure bool
+
+	// Observer receives the events of this VM, in addition to the observers
+	// registered with lvm.AddObserver. It may be nil.
+	Observer lvm.Observer
 }
 
 // GetName returns the name of the virtual machine
@@ -90,9 +111,20 @@ func (vm *VM) GetName() string {
 	return vm.Name
 }
 
+// events returns the Events of the VM, sent to its Observer and the global
+// observers.
+func (vm *VM) events() lvm.Events {
+	return lvm.Events{Provider: providerName, Name: vm.Name, VM: vm, Observer: vm.Observer}
+}
+
 // GetSSH returns an ssh client for the the VM.
 func (vm *VM) GetSSH(options libssh.Options) (libssh.Client, error) {
-	ips, err := util.GetVMIPs(vm, options)
+	return vm.GetSSHContext(context.Background(), options)
+}
+
+// GetSSHContext is like GetSSH but waiting for the IPs is bound to ctx.
+func (vm *VM) GetSSHContext(ctx context.Context, options libssh.Options) (libssh.Client, error) {
+	ips, err := util.GetVMIPsContext(ctx, vm, options)
 	if err != nil {
 		return nil, err
 	}
@@ -104,16 +136,27 @@ func (vm *VM) GetSSH(options libssh.Options) (libssh.Client, error) {
 
 // Destroy powers off the VM and deletes its files from disk.
 func (vm *VM) Destroy() error {
-	err := vm.Halt()
+	return vm.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but kills VBoxManage if ctx is done first.
+func (vm *VM) DestroyContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpDestroy)(&err)
+	err = vm.HaltContext(ctx)
 	if err != nil {
 		return err
 	}
 
 	// vbox will not release it's lock immediately after the stop
-	time.Sleep(1 * time.Second)
+	if err := util.Sleep(ctx, 1*time.Second); err != nil {
+		return err
+	}
 
-	_, err = runner.RunCombinedError("unregistervm", vm.Name, "--delete")
+	_, err = runCombinedError(ctx, "unregistervm", vm.Name, "--delete")
 	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
 		return lvm.WrapErrors(lvm.ErrDeletingVM, err)
 	}
 	return nil
@@ -121,15 +164,24 @@ func (vm *VM) Destroy() error {
 
 // Halt powers off the VM without destroying it
 func (vm *VM) Halt() error {
-	state, err := vm.GetState()
+	return vm.HaltContext(context.Background())
+}
+
+// HaltContext is like Halt but kills VBoxManage if ctx is done first.
+func (vm *VM) HaltContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpHalt)(&err)
+	state, err := vm.GetStateContext(ctx)
 	if err != nil {
 		return err
 	}
-	if state == lvm.VMHalted {
+	if state != lvm.VMRunning {
 		return nil
 	}
-	_, err = runner.RunCombinedError("controlvm", vm.Name, "poweroff")
+	_, err = runCombinedError(ctx, "controlvm", vm.Name, "poweroff")
 	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
 		return lvm.WrapErrors(lvm.ErrStoppingVM, err)
 	}
 	return nil
@@ -137,12 +189,24 @@ func (vm *VM) Halt() error {
 
 // Start powers on the VM
 func (vm *VM) Start() error {
-	_, err := runner.RunCombinedError("startvm", vm.Name)
+	return vm.StartContext(context.Background())
+}
+
+// StartContext is like Start but kills VBoxManage if ctx is done first.
+func (vm *VM) StartContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpStart)(&err)
+	_, err = runCombinedError(ctx, "startvm", vm.Name)
 	if err != nil {
-		// If the user has paused the VM it reads as halted but the Start
+		if ctx.Err() != nil {
+			return err
+		}
+		// If the user has paused the VM it reads as suspended but the Start
 		// command will fail. Try to resume it as a backup.
-		_, rerr := runner.RunCombinedError("controlvm", vm.Name, "resume")
+		_, rerr := runCombinedError(ctx, "controlvm", vm.Name, "resume")
 		if rerr != nil {
+			if ctx.Err() != nil {
+				return rerr
+			}
 			// If neither succeeds, return both errors.
 			return lvm.WrapErrors(lvm.ErrStartingVM, err, rerr)
 		}
@@ -150,10 +214,25 @@ func (vm *VM) Start() error {
 	return nil
 }
 
+// Capabilities reports that VirtualBox VMs can be suspended and have
+// several NICs.
+func (vm *VM) Capabilities() lvm.Capabilities {
+	return lvm.Capabilities{Suspend: true, MultipleNICs: true}
+}
+
 // Suspend suspends the active state of the VM.
 func (vm *VM) Suspend() error {
-	_, err := runner.RunCombinedError("controlvm", vm.Name, "savestate")
+	return vm.SuspendContext(context.Background())
+}
+
+// SuspendContext is like Suspend but kills VBoxManage if ctx is done first.
+func (vm *VM) SuspendContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpSuspend)(&err)
+	_, err = runCombinedError(ctx, "controlvm", vm.Name, "savestate")
 	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
 		return lvm.WrapErrors(lvm.ErrSuspendingVM, err)
 	}
 	return nil
@@ -164,29 +243,56 @@ func (vm *VM) Resume() error {
 	return vm.Start()
 }
 
+// ResumeContext is like Resume but kills VBoxManage if ctx is done first.
+func (vm *VM) ResumeContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpResume)(&err)
+	return vm.StartContext(ctx)
+}
+
 // GetIPs returns a list of ip addresses associated with the vm through VBox Guest Additions.
 func (vm *VM) GetIPs() ([]net.IP, error) {
-	vm.waitUntilReady()
+	return vm.GetIPsContext(context.Background())
+}
+
+// GetIPsContext is like GetIPs but stops waiting for the VM when ctx is done.
+func (vm *VM) GetIPsContext(ctx context.Context) ([]net.IP, error) {
+	if err := vm.waitUntilReady(ctx); err == ctx.Err() && err != nil {
+		return nil, err
+	}
 
 	return vm.ips, nil
 }
 
 // GetState gets the power state of the VM being serviced by this driver.
 func (vm *VM) GetState() (string, error) {
-	stdout, err := runner.RunCombinedError("showvminfo", vm.Name)
+	return vm.GetStateContext(context.Background())
+}
+
+// GetStateContext is like GetState but kills VBoxManage if ctx is done first.
+func (vm *VM) GetStateContext(ctx context.Context) (string, error) {
+	d, err := vm.GetStateDetail(ctx)
+	return d.State, err
+}
+
+// GetStateDetail returns the state of the VM along with the state reported by
+// VBoxManage showvminfo, such as "powered off", "saved" or "paused".
+func (vm *VM) GetStateDetail(ctx context.Context) (lvm.StateDetail, error) {
+	stdout, err := runCombinedError(ctx, "showvminfo", vm.Name)
 	if err != nil {
-		return "", lvm.WrapErrors(lvm.ErrVMInfoFailed, err)
+		if ctx.Err() != nil {
+			return lvm.StateDetail{}, err
+		}
+		if strings.Contains(err.Error(), "Could not find a registered machine") {
+			return lvm.StateDetail{State: translateState("not found"), Raw: "not found"}, nil
+		}
+		return lvm.StateDetail{}, lvm.WrapErrors(lvm.ErrVMInfoFailed, err)
 	}
 	for _, line := range strings.Split(stdout, "\n") {
-		// See if this is a NIC
 		if match := stateRegexp.FindStringSubmatch(line); match != nil {
-			if match := runningRegexp.FindStringSubmatch(line); match != nil {
-				return lvm.VMRunning, nil
-			}
-			return lvm.VMHalted, nil
+			return lvm.StateDetail{State: translateState(match[1]), Raw: match[1]}, nil
 		}
 	}
-	return lvm.VMUnknown, lvm.ErrVMStateFailed
+	return lvm.StateDetail{State: lvm.VMUnknown}, lvm.ErrVMStateFailed
 }
 
 // GetInterfaces gets all the network cards attached to this VM
@@ -223,8 +329,17 @@ func (vm *VM) GetInterfaces() ([]NIC, error) {
 	return nics, nil
 }
 
-// Provision imports the VM and waits until it is booted up.
+// Provision imports the VM and waits until it is booted up. If it fails after
+// the import, the VM is unregistered and deleted unless KeepOnFailure is set.
 func (vm *VM) Provision() error {
+	return vm.ProvisionContext(context.Background())
+}
+
+// ProvisionContext is like Provision but stops waiting for the VM, and kills
+// any running VBoxManage command, when ctx is done.
+func (vm *VM) ProvisionContext(ctx context.Context) (err error) {
+	var out lvm.Outcome
+	defer vm.events().BeginWith(ctx, lvm.OpProvision, &out)(&err)
 	var name string
 	if vm.Name == "" {
 		name = fmt.Sprintf("vm-%s", uuid.Variant4())
@@ -243,22 +358,38 @@ func (vm *VM) Provision() error {
 
 	// See comment on mutex definition for details.
 	createMutex.Lock()
-	_, err = runner.RunCombinedError("import", vm.Src, "--vsys", "0", "--vmname", vm.Name)
+	_, err = runCombinedError(ctx, "import", vm.Src, "--vsys", "0", "--vmname", vm.Name)
 	createMutex.Unlock()
 	if err != nil {
 		return err
 	}
 
+	rb := lvm.NewRollback(vm.KeepOnFailure)
+	rb.Events = vm.events()
+	defer rb.Finish(&err)
+	rb.Add("VM "+vm.Name, vm.DestroyContext)
+
 	err = vm.configure()
 	if err != nil {
 		return err
 	}
 
-	return vm.waitUntilReady()
+	if err := vm.waitUntilReady(ctx); err != nil {
+		return err
+	}
+	// Asking for the IPs again would wait for the VM to boot once more.
+	out.State, out.IPs = lvm.VMRunning, vm.ips
+	return nil
 }
 
 // Run runs a VBoxManage command.
 func (f vboxRunner) Run(args ...string) (string, string, error) {
+	return f.RunContext(context.Background(), args...)
+}
+
+// RunContext runs a VBoxManage command, killing it if ctx is done before it
+// exits.
+func (f vboxRunner) RunContext(ctx context.Context, args ...string) (string, string, error) {
 	var vboxManagePath string
 	// If vBoxManage is not found in the system path, fall back to the
 	// hard coded path.
@@ -267,7 +398,7 @@ func (f vboxRunner) Run(args ...string) (string, string, error) {
 	} else {
 		vboxManagePath = VBOXMANAGE
 	}
-	cmd := exec.Command(vboxManagePath, args...)
+	cmd := exec.CommandContext(ctx, vboxManagePath, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -275,6 +406,9 @@ func (f vboxRunner) Run(args ...string) (string, string, error) {
 	var stderr bytes.Buffer
 	cmd.Stdout, cmd.Stderr = &stdout, &stderr
 	err := cmd.Run()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
 	return stdout.String(), stderr.String(), err
 }
 
@@ -291,3 +425,29 @@ func (f vboxRunner) RunCombinedError(args ...string) (string, error) {
 
 	return wout, nil
 }
+
+// run runs a VBoxManage command with the package runner, bound to ctx if the
+// runner supports it.
+func run(ctx context.Context, args ...string) (string, string, error) {
+	if r, ok := runner.(ContextRunner); ok {
+		return r.RunContext(ctx, args...)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+	return runner.Run(args...)
+}
+
+// runCombinedError is like run but the error includes stderr, as in
+// Runner.RunCombinedError.
+func runCombinedError(ctx context.Context, args ...string) (string, error) {
+	wout, werr, err := run(ctx, args...)
+	if err != nil {
+		if werr != "" && ctx.Err() == nil {
+			return wout, fmt.Errorf("%s: %s", err, werr)
+		}
+		return wout, err
+	}
+
+	return wout, nil
+}
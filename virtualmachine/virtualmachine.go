@@ -3,9 +3,9 @@
 package virtualmachine
 
 import (
+	"context"
 	"errors"
 	"net"
-	"strings"
 
 	"github.com/apcera/libretto/ssh"
 )
@@ -24,6 +24,97 @@ type VirtualMachine interface {
 	GetSSH(ssh.Options) (ssh.Client, error)
 }
 
+// VirtualMachineContext is a VirtualMachine whose operations can be cancelled
+// or bounded by a deadline. Providers stop polling and abort in-flight API
+// calls as soon as ctx is done, returning ctx.Err(). The methods from
+// VirtualMachine behave like their Context counterparts called with
+// context.Background().
+type VirtualMachineContext interface {
+	VirtualMachine
+	ProvisionContext(ctx context.Context) error
+	GetIPsContext(ctx context.Context) ([]net.IP, error)
+	DestroyContext(ctx context.Context) error
+	GetStateContext(ctx context.Context) (string, error)
+	SuspendContext(ctx context.Context) error
+	ResumeContext(ctx context.Context) error
+	HaltContext(ctx context.Context) error
+	StartContext(ctx context.Context) error
+	GetSSHContext(ctx context.Context, options ssh.Options) (ssh.Client, error)
+}
+
+// AsContext returns vm as a VirtualMachineContext. If vm does not implement
+// the interface, its methods are wrapped so that they refuse to start once ctx
+// is done; a call that is already running cannot be interrupted.
+func AsContext(vm VirtualMachine) VirtualMachineContext {
+	if c, ok := vm.(VirtualMachineContext); ok {
+		return c
+	}
+	return contextVM{vm}
+}
+
+type contextVM struct {
+	VirtualMachine
+}
+
+func (vm contextVM) ProvisionContext(ctx context.Context) error {
+	return runContext(ctx, vm.Provision)
+}
+
+func (vm contextVM) GetIPsContext(ctx context.Context) ([]net.IP, error) {
+	var ips []net.IP
+	err := runContext(ctx, func() (err error) {
+		ips, err = vm.GetIPs()
+		return err
+	})
+	return ips, err
+}
+
+func (vm contextVM) DestroyContext(ctx context.Context) error {
+	return runContext(ctx, vm.Destroy)
+}
+
+func (vm contextVM) GetStateContext(ctx context.Context) (string, error) {
+	var state string
+	err := runContext(ctx, func() (err error) {
+		state, err = vm.GetState()
+		return err
+	})
+	return state, err
+}
+
+func (vm contextVM) SuspendContext(ctx context.Context) error {
+	return runContext(ctx, vm.Suspend)
+}
+
+func (vm contextVM) ResumeContext(ctx context.Context) error {
+	return runContext(ctx, vm.Resume)
+}
+
+func (vm contextVM) HaltContext(ctx context.Context) error {
+	return runContext(ctx, vm.Halt)
+}
+
+func (vm contextVM) StartContext(ctx context.Context) error {
+	return runContext(ctx, vm.Start)
+}
+
+func (vm contextVM) GetSSHContext(ctx context.Context, options ssh.Options) (ssh.Client, error) {
+	var client ssh.Client
+	err := runContext(ctx, func() (err error) {
+		client, err = vm.GetSSH(options)
+		return err
+	})
+	return client, err
+}
+
+// runContext calls fn unless ctx is already done.
+func runContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fn()
+}
+
 const (
 	// VMStarting is the state to use when the VM is starting
 	VMStarting = "starting"
@@ -39,6 +130,11 @@ const (
 	VMError = "error"
 	// VMUnknown is the state to use when the VM is unknown state
 	VMUnknown = "unknown"
+	// VMTerminated is the state to use when the VM has been destroyed but the
+	// provider still reports it
+	VMTerminated = "terminated"
+	// VMNotFound is the state to use when the provider has no record of the VM
+	VMNotFound = "not_found"
 )
 
 var (
@@ -46,7 +142,7 @@ var (
 	ErrVMNoIP = errors.New("error getting a new IP for the virtual machine")
 
 	// ErrVMBootTimeout is returned when a timeout occurs waiting for a vm to boot.
-	ErrVMBootTimeout = errors.New("timed out waiting for virtual machine")
+	ErrVMBootTimeout = NewError(Timeout, errors.New("timed out waiting for virtual machine"))
 
 	// ErrNICAlreadyDisabled is returned when a NIC we are trying to disable is already disabled.
 	ErrNICAlreadyDisabled = errors.New("NIC already disabled")
@@ -85,22 +181,21 @@ var (
 	ErrResumingVM = errors.New("error resuming the VM")
 
 	// ErrNotImplemented is returned when the operation is not implemented
-	ErrNotImplemented = errors.New("operation not implemented")
+	ErrNotImplemented = NewError(NotSupported, errors.New("operation not implemented"))
 
 	// ErrSuspendNotSupported is returned when vm.Suspend() is called, but not supported.
-	ErrSuspendNotSupported = errors.New("suspend action not supported")
+	ErrSuspendNotSupported = NewError(NotSupported, errors.New("suspend action not supported"))
 
 	// ErrResumeNotSupported is returned when vm.Resume() is called, but not supported.
-	ErrResumeNotSupported = errors.New("resume action not supported")
+	ErrResumeNotSupported = NewError(NotSupported, errors.New("resume action not supported"))
+
+	// ErrNoInstanceID is returned when an operation needs the provider's ID
+	// of the VM, but the VM has not been provisioned.
+	ErrNoInstanceID = errors.New("missing instance ID")
 )
 
 // WrapErrors squashes multiple errors into a single error, separated by ": ".
+// errors.Is and errors.As see every one of errs.
 func WrapErrors(errs ...error) error {
-	s := []string{}
-	for _, e := range errs {
-		if e != nil {
-			s = append(s, e.Error())
-		}
-	}
-	return errors.New(strings.Join(s, ": "))
+	return JoinErrors(": ", errs...)
 }
@@ -0,0 +1,47 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package vmrun
+
+import (
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+var _ lvm.Handler = (*VM)(nil)
+
+// handle holds what is needed to manage a VM from another process.
+type handle struct {
+	Name        string `json:"name,omitempty"`
+	Src         string `json:"src"`
+	Dst         string `json:"dst"`
+	VmxFilePath string `json:"vmx_file_path,omitempty"`
+}
+
+// MarshalHandle serializes the paths of the VM.
+func (vm *VM) MarshalHandle() ([]byte, error) {
+	if vm.Src == "" || vm.Dst == "" {
+		return nil, lvm.ErrHandleIncomplete
+	}
+	return lvm.EncodeHandle(providerName, handle{
+		Name:        vm.Name,
+		Src:         vm.Src,
+		Dst:         vm.Dst,
+		VmxFilePath: vm.VmxFilePath,
+	})
+}
+
+// UnmarshalHandle restores a handle written by MarshalHandle into the VM.
+func (vm *VM) UnmarshalHandle(data []byte) error {
+	var h handle
+	if err := lvm.DecodeHandle(providerName, data, &h); err != nil {
+		return err
+	}
+	if h.Src == "" || h.Dst == "" {
+		return lvm.ErrHandleIncomplete
+	}
+
+	vm.Name = h.Name
+	vm.Src = h.Src
+	vm.Dst = h.Dst
+	vm.VmxFilePath = h.VmxFilePath
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package vmrun
+
+import (
+	"fmt"
+
+	libssh "github.com/apcera/libretto/ssh"
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+// providerName is the name the provider is registered under.
+const providerName = "vmrun"
+
+func init() {
+	lvm.Register(providerName, FromSpec)
+}
+
+// Provider returns the name the provider is registered under.
+func (vm *VM) Provider() string {
+	return providerName
+}
+
+// FromSpec builds a VMware Fusion or Workstation VM from a provider-neutral
+// spec. Image is the path of the source VMX file. Each network adds a NIC
+// whose backing device is the network's Name. The following options are
+// read:
+//
+//	dst          directory the VM is copied to (required)
+//	nic_backing  "nat" or "bridged" (the default)
+func FromSpec(spec *lvm.Spec) (lvm.VirtualMachine, error) {
+	vm := &VM{
+		Name: spec.Name,
+		Src:  spec.Image,
+		Dst:  spec.Option("dst"),
+		Credentials: libssh.Credentials{
+			SSHUser:       spec.SSH.User,
+			SSHPassword:   spec.SSH.Password,
+			SSHPrivateKey: spec.SSH.PrivateKey,
+		},
+		KeepOnFailure: spec.KeepOnFailure,
+	}
+
+	backing := Bridged
+	switch b := spec.Option("nic_backing"); b {
+	case "", "bridged":
+	case "nat":
+		backing = Nat
+	default:
+		return nil, fmt.Errorf("unsupported nic backing %q", b)
+	}
+	for i, n := range spec.Networks {
+		vm.Config.NICs = append(vm.Config.NICs, NIC{
+			Idx:           i,
+			Backing:       backing,
+			BackingDevice: n.Name,
+		})
+	}
+	return vm, nil
+}
@@ -4,6 +4,7 @@ package vmrun
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"html/template"
@@ -15,12 +16,12 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
-	"sync"
 	"time"
 
 	libssh "github.com/apcera/libretto/ssh"
 	"github.com/apcera/libretto/util"
 	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/wait"
 )
 
 // Backing information for Fusion network cards
@@ -41,7 +42,7 @@ ethernet{{.Idx}}.virtualdev = "vmxnet3"
 const vmrunTimeout = 90 * time.Second
 
 // ErrVmrunTimeout is returned when vmrun doesn't finish executing in `vmrunTimeout` seconds.
-var ErrVmrunTimeout = errors.New("Timed out waiting for vmrun")
+var ErrVmrunTimeout = lvm.NewError(lvm.Timeout, errors.New("Timed out waiting for vmrun"))
 
 // ErrVmrunNotFound is returned when no vmrun was found in host.
 var ErrVmrunNotFound = errors.New("Failed to find vmrun")
@@ -72,12 +73,27 @@ type Runner interface {
 	RunCombinedError(args ...string) (string, error)
 }
 
-// vmrunRunner implements the Runner interface.
+// ContextRunner is a Runner whose commands can be cancelled. If the package
+// runner implements it, the Context methods of VM kill vmrun when their
+// context is done.
+type ContextRunner interface {
+	Runner
+	RunContext(ctx context.Context, args ...string) (string, string, error)
+}
+
+// vmrunRunner implements the ContextRunner interface.
 type vmrunRunner struct {
 }
 
+var _ ContextRunner = vmrunRunner{}
+
 // Run runs a vmrun command.
 func (f vmrunRunner) Run(args ...string) (string, string, error) {
+	return f.RunContext(context.Background(), args...)
+}
+
+// RunContext runs a vmrun command, killing it if ctx is done before it exits.
+func (f vmrunRunner) RunContext(ctx context.Context, args ...string) (string, string, error) {
 	var vmrunPath string
 
 	// If vmrun is not found in the system path, fall back to the
@@ -93,7 +109,7 @@ func (f vmrunRunner) Run(args ...string) (string, string, error) {
 		return "", "", ErrVmrunNotFound
 	}
 
-	cmd := exec.Command(vmrunPath, args...)
+	cmd := exec.CommandContext(ctx, vmrunPath, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -110,12 +126,41 @@ func (f vmrunRunner) Run(args ...string) (string, string, error) {
 	e := cmd.Wait()
 	timer.Stop()
 
+	if ctx.Err() != nil {
+		return stdout.String(), stderr.String(), ctx.Err()
+	}
 	if err != nil || e != nil {
 		err = lvm.WrapErrors(err, e)
 	}
 	return stdout.String(), stderr.String(), err
 }
 
+// run runs a vmrun command with the package runner, bound to ctx if the
+// runner supports it.
+func run(ctx context.Context, args ...string) (string, string, error) {
+	if r, ok := runner.(ContextRunner); ok {
+		return r.RunContext(ctx, args...)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+	return runner.Run(args...)
+}
+
+// runCombinedError is like run but the error includes stderr, as in
+// Runner.RunCombinedError.
+func runCombinedError(ctx context.Context, args ...string) (string, error) {
+	wout, werr, err := run(ctx, args...)
+	if err != nil {
+		if werr != "" && ctx.Err() == nil {
+			return wout, fmt.Errorf("%s: %s", err, werr)
+		}
+		return wout, err
+	}
+
+	return wout, nil
+}
+
 // RunCombinedError runs a vmrun command.  The output is stdout and the the
 // combined err/stderr from the command.
 func (f vmrunRunner) RunCombinedError(args ...string) (string, error) {
@@ -139,18 +184,40 @@ type VM struct {
 	ips         []net.IP
 	Credentials libssh.Credentials
 	Config      Config
+
+	// KeepOnFailure keeps the copy of the VM in Dst if Provision fails.
+	KeepOnFailure bool
+
+	// Observer receives the events of this VM, in addition to the observers
+	// registered with lvm.AddObserver. It may be nil.
+	Observer lvm.Observer
 }
 
 var backingList = []string{"nat", "bridged"}
 
+var _ lvm.VirtualMachineContext = (*VM)(nil)
+var _ lvm.StateDetailer = (*VM)(nil)
+var _ lvm.Capabler = (*VM)(nil)
+
 // GetName returns the name of the virtual machine
 func (vm *VM) GetName() string {
 	return vm.Name
 }
 
+// events returns the Events of the VM, sent to its Observer and the global
+// observers.
+func (vm *VM) events() lvm.Events {
+	return lvm.Events{Provider: providerName, Name: vm.Name, VM: vm, Observer: vm.Observer}
+}
+
 // GetSSH returns an ssh client for the the vm.
 func (vm *VM) GetSSH(options libssh.Options) (libssh.Client, error) {
-	ips, err := util.GetVMIPs(vm, options)
+	return vm.GetSSHContext(context.Background(), options)
+}
+
+// GetSSHContext is like GetSSH but waiting for the IPs is bound to ctx.
+func (vm *VM) GetSSHContext(ctx context.Context, options libssh.Options) (libssh.Client, error) {
+	ips, err := util.GetVMIPsContext(ctx, vm, options)
 	if err != nil {
 		return nil, err
 	}
@@ -161,8 +228,14 @@ func (vm *VM) GetSSH(options libssh.Options) (libssh.Client, error) {
 }
 
 // Destroy powers off the VM and deletes its files from disk.
-func (vm *VM) Destroy() (err error) {
-	err = vm.haltWithFlag(true)
+func (vm *VM) Destroy() error {
+	return vm.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but kills vmrun if ctx is done first.
+func (vm *VM) DestroyContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpDestroy)(&err)
+	err = vm.haltWithFlag(ctx, true)
 	if err != nil {
 		return err
 	}
@@ -176,7 +249,7 @@ func (vm *VM) Destroy() (err error) {
 	return
 }
 
-func (vm *VM) haltWithFlag(hard bool) error {
+func (vm *VM) haltWithFlag(ctx context.Context, hard bool) error {
 	src := vm.Src
 	dst := vm.Dst
 
@@ -190,17 +263,35 @@ func (vm *VM) haltWithFlag(hard bool) error {
 		flag = "hard"
 	}
 
-	_, err := runner.RunCombinedError("stop", vm.VmxFilePath, flag)
+	_, err := runCombinedError(ctx, "stop", vm.VmxFilePath, flag)
 	return err
 }
 
 // Halt powers off the VM without destroying it
 func (vm *VM) Halt() error {
-	return vm.haltWithFlag(false)
+	return vm.HaltContext(context.Background())
+}
+
+// HaltContext is like Halt but kills vmrun if ctx is done first.
+func (vm *VM) HaltContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpHalt)(&err)
+	return vm.haltWithFlag(ctx, false)
+}
+
+// Capabilities reports that VMware VMs can be suspended and have
+// several NICs.
+func (vm *VM) Capabilities() lvm.Capabilities {
+	return lvm.Capabilities{Suspend: true, MultipleNICs: true}
 }
 
 // Suspend suspends the active state of the VM.
 func (vm *VM) Suspend() error {
+	return vm.SuspendContext(context.Background())
+}
+
+// SuspendContext is like Suspend but kills vmrun if ctx is done first.
+func (vm *VM) SuspendContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpSuspend)(&err)
 	src := vm.Src
 	dst := vm.Dst
 
@@ -209,7 +300,7 @@ func (vm *VM) Suspend() error {
 
 	// FIXME: Cannot use nogui flag here, it breaks vmrun's getGuestIP
 	// functionality.
-	_, err := runner.RunCombinedError("suspend", vm.VmxFilePath)
+	_, err = runCombinedError(ctx, "suspend", vm.VmxFilePath)
 	return err
 }
 
@@ -218,8 +309,20 @@ func (vm *VM) Resume() error {
 	return vm.Start()
 }
 
+// ResumeContext is like Resume but kills vmrun if ctx is done first.
+func (vm *VM) ResumeContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpResume)(&err)
+	return vm.StartContext(ctx)
+}
+
 // Start powers on the VM
 func (vm *VM) Start() error {
+	return vm.StartContext(context.Background())
+}
+
+// StartContext is like Start but kills vmrun if ctx is done first.
+func (vm *VM) StartContext(ctx context.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpStart)(&err)
 	src := vm.Src
 	dst := vm.Dst
 
@@ -228,8 +331,11 @@ func (vm *VM) Start() error {
 
 	// FIXME: Cannot use nogui flag here, it breaks vmrun's getGuestIP
 	// functionality.
-	out, err := runner.RunCombinedError("start", vm.VmxFilePath)
+	out, err := runCombinedError(ctx, "start", vm.VmxFilePath)
 	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
 		return lvm.WrapErrors(err, errors.New(out))
 	}
 
@@ -238,49 +344,88 @@ func (vm *VM) Start() error {
 
 // GetIPs returns a list of ip addresses associated with the vm through VMware tools
 func (vm *VM) GetIPs() ([]net.IP, error) {
-	vm.waitUntilReady()
+	return vm.GetIPsContext(context.Background())
+}
+
+// GetIPsContext is like GetIPs but stops waiting for the VM when ctx is done.
+func (vm *VM) GetIPsContext(ctx context.Context) ([]net.IP, error) {
+	if err := vm.waitUntilReady(ctx); err == ctx.Err() && err != nil {
+		return nil, err
+	}
 
 	return vm.ips, nil
 }
 
 // GetState gets the power state of the VM through VMware tools.
 func (vm *VM) GetState() (string, error) {
-	stdout, stderr, err := runner.Run("list")
+	return vm.GetStateContext(context.Background())
+}
+
+// GetStateContext is like GetState but kills vmrun if ctx is done first.
+func (vm *VM) GetStateContext(ctx context.Context) (string, error) {
+	d, err := vm.GetStateDetail(ctx)
+	return d.State, err
+}
+
+// GetStateDetail returns the state of the VM along with the state vmrun
+// reported, which is either "running" or "not running". A VM that is not
+// running is reported as suspended if it has a suspend file next to its vmx
+// file and as halted otherwise.
+func (vm *VM) GetStateDetail(ctx context.Context) (lvm.StateDetail, error) {
+	stdout, stderr, err := run(ctx, "list")
 	if err != nil {
-		return "", err
+		return lvm.StateDetail{}, err
 	}
 	if stderr != "" {
-		return "", fmt.Errorf("Failed to get state using the vmrun utility: %s", stderr)
+		return lvm.StateDetail{}, fmt.Errorf("Failed to get state using the vmrun utility: %s", stderr)
 	}
 
 	if strings.Contains(stdout, vm.Dst) {
-		return lvm.VMRunning, nil
+		return lvm.StateDetail{State: lvm.VMRunning, Raw: "running"}, nil
 	}
 
 	// Maybe vm.Dst is a symlink?
 	p, err := filepath.EvalSymlinks(vm.Dst)
+	if os.IsNotExist(err) {
+		return lvm.StateDetail{State: lvm.VMNotFound, Raw: "not running"}, nil
+	}
 	if err != nil {
-		return "", err
+		return lvm.StateDetail{}, err
 	}
 
 	absp, err := filepath.Abs(p)
 	if err != nil {
-		return "", err
+		return lvm.StateDetail{}, err
 	}
 
 	if strings.Contains(stdout, absp) {
-		return lvm.VMRunning, nil
+		return lvm.StateDetail{State: lvm.VMRunning, Raw: "running"}, nil
 	}
 
-	// Originally reported these as VMHalted, but for our purposes it was better
-	// to list them as VMSuspended so that we did not assume they would start up
-	// in an initial state.
-	return lvm.VMSuspended, nil
+	// VMware writes the suspended memory state to a .vmss file next to the
+	// vmx file and removes it when the VM resumes.
+	suspended, err := filepath.Glob(filepath.Join(filepath.Dir(absp), "*.vmss"))
+	if err != nil {
+		return lvm.StateDetail{}, err
+	}
+	if len(suspended) > 0 {
+		return lvm.StateDetail{State: lvm.VMSuspended, Raw: "not running"}, nil
+	}
+	return lvm.StateDetail{State: lvm.VMHalted, Raw: "not running"}, nil
 }
 
 // Provision clones this VM and powers it on, while waiting for it to get an IP address.
+// If it fails, the clone is removed unless KeepOnFailure is set.
 // FIXME (Preet): Should make the wait for IP part optional.
 func (vm *VM) Provision() error {
+	return vm.ProvisionContext(context.Background())
+}
+
+// ProvisionContext is like Provision but stops waiting for the VM, and kills
+// any running vmrun command, when ctx is done.
+func (vm *VM) ProvisionContext(ctx context.Context) (err error) {
+	var out lvm.Outcome
+	defer vm.events().BeginWith(ctx, lvm.OpProvision, &out)(&err)
 	src := vm.Src
 	dst := vm.Dst
 
@@ -310,8 +455,18 @@ func (vm *VM) Provision() error {
 		return lvm.ErrCreatingVM
 	}
 
+	// Dst did not exist, so everything in it is ours to remove.
+	rb := lvm.NewRollback(vm.KeepOnFailure)
+	rb.Events = vm.events()
+	defer rb.Finish(&err)
+	rb.Add(dst, func(ctx context.Context) error {
+		// The VM may not be running, in which case stop fails.
+		vm.haltWithFlag(ctx, true)
+		return os.RemoveAll(dst)
+	})
+
 	// Copy over the source path to the destination.
-	err := copyDir(srcPath, dst)
+	err = copyDir(srcPath, dst)
 	if err != nil {
 		return err
 	}
@@ -329,7 +484,12 @@ func (vm *VM) Provision() error {
 		return err
 	}
 
-	return vm.waitUntilReady()
+	if err := vm.waitUntilReady(ctx); err != nil {
+		return err
+	}
+	// Asking for the IPs again would wait for the VM to boot once more.
+	out.State, out.IPs = lvm.VMRunning, vm.ips
+	return nil
 }
 
 func (vm *VM) configure() error {
@@ -373,11 +533,11 @@ func (vm *VM) configure() error {
 }
 
 // This function makes a single request to get IPs from a VM.
-func (vm *VM) requestIPs() []net.IP {
+func (vm *VM) requestIPs(ctx context.Context) []net.IP {
 	ips := []net.IP{}
 	// FIXME: Cannot use nogui flag here, it breaks vmrun's getGuestIP
 	// functionality.
-	stdout, _, _ := runner.Run("getGuestIPAddress", vm.VmxFilePath, "wait")
+	stdout, _, _ := run(ctx, "getGuestIPAddress", vm.VmxFilePath, "wait")
 	if stdout != "" {
 		if ip := net.ParseIP(strings.TrimSpace(stdout)); ip != nil {
 			ips = append(ips, ip)
@@ -389,74 +549,32 @@ func (vm *VM) requestIPs() []net.IP {
 	return ips
 }
 
-func (vm *VM) waitUntilReady() error {
-	errorChannel := make(chan error, 1)
+// bootWaiter polls for the IPs of a booting VM every 2s for up to 90s.
+var bootWaiter = wait.Waiter{
+	Backoff: wait.Constant(2 * time.Second),
+	Timeout: 90 * time.Second,
+}
+
+func (vm *VM) waitUntilReady(ctx context.Context) error {
 	// Wait up to 90s until the VM boots up
-	timer := time.NewTimer(time.Second * 90)
-	go func() {
-		err := vm.Start()
-		errorChannel <- err
-	}()
-
-ForLoop:
-	for {
-		select {
-		case e := <-errorChannel:
-			timer.Stop()
-			if e != nil {
-				return e
-			}
-			break ForLoop
-		case <-timer.C:
+	startCtx, cancel := context.WithTimeout(ctx, bootWaiter.Timeout)
+	err := vm.StartContext(startCtx)
+	cancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if startCtx.Err() != nil {
 			return lvm.ErrVMBootTimeout
 		}
+		return err
 	}
 
-	var wg sync.WaitGroup
-	quit := make(chan bool, 1)
-	success := make(chan bool, 1)
-	timer = time.NewTimer(time.Second * 90)
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			select {
-			case <-quit:
-				success <- false
-				return
-			default:
-				ips := vm.requestIPs()
-
-				if len(ips) == 0 {
-					time.Sleep(2 * time.Second)
-					continue
-				} else {
-					success <- true
-					return
-				}
-			}
-		}
-	}()
-
-	var r error
-OuterLoop:
-	for {
-		select {
-		case s := <-success:
-			if !s {
-				r = lvm.ErrVMNoIP
-			}
-			timer.Stop()
-			break OuterLoop
-		case <-timer.C:
-			quit <- true
-			r = lvm.ErrVMBootTimeout
-			break OuterLoop
-		}
+	err = bootWaiter.Until(ctx, func(ctx context.Context) (bool, error) {
+		return len(vm.requestIPs(ctx)) > 0, nil
+	})
+	if err == wait.ErrTimeout {
+		return lvm.ErrVMBootTimeout
 	}
-
-	wg.Wait()
-
-	return r
+	return err
 }
@@ -0,0 +1,58 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package vsphere
+
+import (
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+var _ lvm.Handler = (*VM)(nil)
+
+// handle holds what is needed to manage a VM from another process.
+type handle struct {
+	Name        string      `json:"name"`
+	Host        string      `json:"host"`
+	Insecure    bool        `json:"insecure,omitempty"`
+	Datacenter  string      `json:"datacenter"`
+	Destination Destination `json:"destination"`
+	Template    string      `json:"template,omitempty"`
+	Datastore   string      `json:"datastore,omitempty"`
+}
+
+// MarshalHandle serializes the host, datacenter and name that identify the VM
+// and the datastore it was cloned to. The vSphere username and password are
+// not included.
+func (vm *VM) MarshalHandle() ([]byte, error) {
+	if vm.Name == "" || vm.Host == "" {
+		return nil, lvm.ErrHandleIncomplete
+	}
+	return lvm.EncodeHandle(providerName, handle{
+		Name:        vm.Name,
+		Host:        vm.Host,
+		Insecure:    vm.Insecure,
+		Datacenter:  vm.Datacenter,
+		Destination: vm.Destination,
+		Template:    vm.Template,
+		Datastore:   vm.datastore,
+	})
+}
+
+// UnmarshalHandle restores a handle written by MarshalHandle into the VM.
+func (vm *VM) UnmarshalHandle(data []byte) error {
+	var h handle
+	if err := lvm.DecodeHandle(providerName, data, &h); err != nil {
+		return err
+	}
+	if h.Name == "" || h.Host == "" {
+		return lvm.ErrHandleIncomplete
+	}
+
+	vm.Name = h.Name
+	vm.Host = h.Host
+	vm.Insecure = h.Insecure
+	vm.Datacenter = h.Datacenter
+	vm.Destination = h.Destination
+	vm.Template = h.Template
+	vm.datastore = h.Datastore
+	return nil
+}
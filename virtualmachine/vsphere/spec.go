@@ -0,0 +1,97 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package vsphere
+
+import (
+	"strings"
+
+	"github.com/apcera/libretto/ssh"
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+// providerName is the name the provider is registered under.
+const providerName = "vsphere"
+
+func init() {
+	lvm.Register(providerName, FromSpec)
+}
+
+// Provider returns the name the provider is registered under.
+func (vm *VM) Provider() string {
+	return providerName
+}
+
+// FromSpec builds a vSphere VM from a provider-neutral spec. Image is the path
+// of the OVF file and Region the datacenter. Each disk is added as an extra
+// disk on the controller named by its Type. Each network maps the OVF network
+// label in Name to the vSphere network in Subnet. The following options are
+// read:
+//
+//	host                 vSphere host (required)
+//	username             vSphere username (required)
+//	password             vSphere password (required)
+//	insecure             "true" to skip certificate validation
+//	template             name of the template to clone from
+//	datastores           comma-separated datastores to pick from
+//	destination_name     name of the destination to clone to
+//	destination_type     type of the destination, such as "host"
+//	host_system          host to run the VM on
+//	use_local_templates  "true" to upload the template to every datastore
+//	skip_existing        "true" to reuse an existing template
+//	use_linked_clones    "true" to create linked clones
+func FromSpec(spec *lvm.Spec) (lvm.VirtualMachine, error) {
+	vm := &VM{
+		Host: spec.Option("host"),
+		Destination: Destination{
+			DestinationName: spec.Option("destination_name"),
+			DestinationType: spec.Option("destination_type"),
+			HostSystem:      spec.Option("host_system"),
+		},
+		Username:   spec.Option("username"),
+		Password:   spec.Option("password"),
+		Datacenter: spec.Region,
+		OvfPath:    spec.Image,
+		Name:       spec.Name,
+		Template:   spec.Option("template"),
+		Credentials: ssh.Credentials{
+			SSHUser:       spec.SSH.User,
+			SSHPassword:   spec.SSH.Password,
+			SSHPrivateKey: spec.SSH.PrivateKey,
+		},
+		KeepOnFailure: spec.KeepOnFailure,
+	}
+
+	if ds := spec.Option("datastores"); ds != "" {
+		for _, d := range strings.Split(ds, ",") {
+			vm.Datastores = append(vm.Datastores, strings.TrimSpace(d))
+		}
+	}
+
+	var err error
+	if vm.Insecure, err = spec.BoolOption("insecure"); err != nil {
+		return nil, err
+	}
+	if vm.UseLocalTemplates, err = spec.BoolOption("use_local_templates"); err != nil {
+		return nil, err
+	}
+	if vm.SkipExisting, err = spec.BoolOption("skip_existing"); err != nil {
+		return nil, err
+	}
+	if vm.UseLinkedClones, err = spec.BoolOption("use_linked_clones"); err != nil {
+		return nil, err
+	}
+
+	for _, d := range spec.Disks {
+		vm.Disks = append(vm.Disks, Disk{
+			Size:       int64(d.SizeGB) * 1024 * 1024,
+			Controller: d.Type,
+		})
+	}
+	if len(spec.Networks) > 0 {
+		vm.Networks = make(map[string]string)
+		for _, n := range spec.Networks {
+			vm.Networks[n.Name] = n.Subnet
+		}
+	}
+	return vm, nil
+}
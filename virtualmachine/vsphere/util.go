@@ -67,7 +67,11 @@ var SetupSession = func(vm *VM) error {
 	}
 	u.User = url.UserPassword(vm.Username, vm.Password)
 	vm.uri = u
-	vm.ctx, vm.cancel = context.WithCancel(context.Background())
+	parent := vm.parent
+	if parent == nil {
+		parent = context.Background()
+	}
+	vm.ctx, vm.cancel = context.WithCancel(parent)
 	client, err := newClient(vm)
 	if err != nil {
 		return NewErrorClientFailed(err)
@@ -111,12 +115,12 @@ var readAll = func(r io.Reader) ([]byte, error) {
 var parseOvf = func(ovfLocation string) (string, error) {
 	ovf, err := open(ovfLocation)
 	if err != nil {
-		return "", fmt.Errorf("Failed to open the ovf file: %s", err)
+		return "", fmt.Errorf("Failed to open the ovf file: %w", err)
 	}
 
 	ovfContent, err := readAll(ovf)
 	if err != nil {
-		return "", fmt.Errorf("Failed to open the ovf file: %s", err)
+		return "", fmt.Errorf("Failed to open the ovf file: %w", err)
 	}
 	return string(ovfContent), nil
 }
@@ -225,7 +229,7 @@ var uploadOvf = func(vm *VM, specResult *types.OvfCreateImportSpecResult, lease
 	// Ask the server to wait on the NFC lease
 	leaseInfo, err := lease.Wait()
 	if err != nil {
-		return fmt.Errorf("error waiting on the nfc lease: %s", err)
+		return fmt.Errorf("error waiting on the nfc lease: %w", err)
 	}
 
 	//FIXME (Preet): Hard coded to just upload the first device.
@@ -246,7 +250,7 @@ var uploadOvf = func(vm *VM, specResult *types.OvfCreateImportSpecResult, lease
 	}
 	info, _ := file.Stat()
 	totalBytes := info.Size()
-	reader := NewProgressReader(file, totalBytes, lease)
+	reader := NewProgressReader(file, totalBytes, observedLease{Lease: lease, events: vm.events(), file: path})
 	reader.StartProgress()
 	err = createRequest(reader, "POST", vm.Insecure, totalBytes, url, "application/x-vnd.vmware-streamVmdk")
 	if err != nil {
@@ -256,6 +260,20 @@ var uploadOvf = func(vm *VM, specResult *types.OvfCreateImportSpecResult, lease
 	return nil
 }
 
+// observedLease reports the progress set on a Lease as UploadProgress events.
+type observedLease struct {
+	Lease
+	events lvm.Events
+	file   string
+}
+
+// HTTPNfcLeaseProgress sends the progress to the VM's observers and sets it
+// on the lease.
+func (l observedLease) HTTPNfcLeaseProgress(p int) {
+	l.events.UploadProgress(l.file, p)
+	l.Lease.HTTPNfcLeaseProgress(p)
+}
+
 var clientDo = func(c *http.Client, r *http.Request) (*http.Response, error) {
 	return c.Do(r)
 }
@@ -329,7 +347,7 @@ func searchTree(vm *VM, mor types.ManagedObjectReference, name string) (*mo.Virt
 	return nil, NewErrorObjectNotFound(errors.New("could not find the vm"), name)
 }
 
-var cloneFromTemplate = func(vm *VM, dcMo *mo.Datacenter, usableDatastores []string) error {
+var cloneFromTemplate = func(vm *VM, dcMo *mo.Datacenter, usableDatastores []string, rb *lvm.Rollback) error {
 	n := util.Random(1, len(usableDatastores))
 	vm.datastore = usableDatastores[n-1]
 	dsMo, err := findDatastore(vm, dcMo, vm.datastore)
@@ -340,7 +358,7 @@ var cloneFromTemplate = func(vm *VM, dcMo *mo.Datacenter, usableDatastores []str
 	template := createTemplateName(vm.Template, vm.datastore)
 	vmMo, err := findVM(vm, dcMo, template)
 	if err != nil {
-		return fmt.Errorf("error retrieving template: %s", err)
+		return fmt.Errorf("error retrieving template: %w", err)
 	}
 	vmObj := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
 
@@ -384,18 +402,19 @@ var cloneFromTemplate = func(vm *VM, dcMo *mo.Datacenter, usableDatastores []str
 	folderObj := object.NewFolder(vm.client.Client, dcMo.VmFolder)
 	t, err := vmObj.Clone(vm.ctx, folderObj, vm.Name, cisp)
 	if err != nil {
-		return fmt.Errorf("error cloning vm from template: %s", err)
+		return fmt.Errorf("error cloning vm from template: %w", err)
 	}
+	rb.Add("VM "+vm.Name, vm.removeStep(dcMo, vm.Name))
 	tInfo, err := t.WaitForResult(vm.ctx, nil)
 	if err != nil {
-		return fmt.Errorf("error waiting for clone task to finish: %s", err)
+		return fmt.Errorf("error waiting for clone task to finish: %w", err)
 	}
 	if tInfo.Error != nil {
 		return fmt.Errorf("clone task finished with error: %s", tInfo.Error)
 	}
 	vmMo, err = findVM(vm, dcMo, vm.Name)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve cloned VM: %s", err)
+		return fmt.Errorf("failed to retrieve cloned VM: %w", err)
 	}
 	if len(vm.Disks) > 0 {
 		if err = reconfigureVM(vm, vmMo); err != nil {
@@ -412,6 +431,44 @@ var cloneFromTemplate = func(vm *VM, dcMo *mo.Datacenter, usableDatastores []str
 	return nil
 }
 
+// removeVM powers off and destroys the VM or template called name, with the
+// calls bound to ctx rather than to the session of vm. It does nothing if
+// there is no such VM.
+var removeVM = func(ctx context.Context, vm *VM, dcMo *mo.Datacenter, name string) error {
+	// findVM uses the context of the session, so look the VM up through a
+	// session sharing its client but bound to ctx.
+	session := &VM{
+		QuestionResponses: vm.QuestionResponses,
+		ctx:               ctx,
+		client:            vm.client,
+		collector:         vm.collector,
+	}
+	vmMo, err := findVM(session, dcMo, name)
+	if err != nil {
+		if _, ok := err.(ErrorObjectNotFound); ok {
+			return nil
+		}
+		return err
+	}
+	vmo := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
+	// Powering off fails if the VM is not running, which is fine.
+	if t, err := vmo.PowerOff(ctx); err == nil {
+		t.WaitForResult(ctx, nil)
+	}
+	destroyTask, err := vmo.Destroy(ctx)
+	if err != nil {
+		return fmt.Errorf("error creating a destroy task on the vm: %w", err)
+	}
+	tInfo, err := destroyTask.WaitForResult(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error waiting for destroy task: %w", err)
+	}
+	if tInfo.Error != nil {
+		return fmt.Errorf("destroy task returned an error: %s", tInfo.Error)
+	}
+	return nil
+}
+
 var reconfigureVM = func(vm *VM, vmMo *mo.VirtualMachine) error {
 	vmObj := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
 	devices, err := vmObj.Device(vm.ctx)
@@ -436,7 +493,7 @@ var waitForIP = func(vm *VM, vmMo *mo.VirtualMachine) error {
 	vmObj := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
 	ipString, err := vmObj.WaitForIP(vm.ctx)
 	if err != nil {
-		return fmt.Errorf("failed to wait for VM to boot up: %s", err)
+		return fmt.Errorf("failed to wait for VM to boot up: %w", err)
 	}
 
 	// Parse the IP to make sure tools was running
@@ -460,14 +517,14 @@ var halt = func(vm *VM) error {
 	vmo := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
 	poweroffTask, err := vmo.PowerOff(vm.ctx)
 	if err != nil {
-		return fmt.Errorf("error creating a poweroff task on the vm: %s", err)
+		return fmt.Errorf("error creating a poweroff task on the vm: %w", err)
 	}
 	tInfo, err := poweroffTask.WaitForResult(vm.ctx, nil)
 	if err != nil {
-		return fmt.Errorf("error waiting for poweroff task: %s", err)
+		return fmt.Errorf("error waiting for poweroff task: %w", err)
 	}
 	if tInfo.Error != nil {
-		return fmt.Errorf("poweroff task returned an error: %s", err)
+		return fmt.Errorf("poweroff task returned an error: %w", err)
 	}
 	return nil
 }
@@ -489,14 +546,14 @@ var start = func(vm *VM) error {
 	vmo := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
 	poweronTask, err := vmo.PowerOn(vm.ctx)
 	if err != nil {
-		return fmt.Errorf("error creating a poweron task on the vm: %s", err)
+		return fmt.Errorf("error creating a poweron task on the vm: %w", err)
 	}
 	tInfo, err := poweronTask.WaitForResult(vm.ctx, nil)
 	if err != nil {
-		return fmt.Errorf("error waiting for poweron task: %s", err)
+		return fmt.Errorf("error waiting for poweron task: %w", err)
 	}
 	if tInfo.Error != nil {
-		return fmt.Errorf("poweron task returned an error: %s", err)
+		return fmt.Errorf("poweron task returned an error: %w", err)
 	}
 	if err = waitForIP(vm, vmMo); err != nil {
 		return err
@@ -600,7 +657,7 @@ var createTemplateName = func(t string, ds string) string {
 	return fmt.Sprintf("%s-%s", t, ds)
 }
 
-var uploadTemplate = func(vm *VM, dcMo *mo.Datacenter, selectedDatastore string) error {
+var uploadTemplate = func(vm *VM, dcMo *mo.Datacenter, selectedDatastore string, rb *lvm.Rollback) error {
 	template := createTemplateName(vm.Template, selectedDatastore)
 	vm.datastore = selectedDatastore
 	// Read the ovf file
@@ -638,7 +695,7 @@ var uploadTemplate = func(vm *VM, dcMo *mo.Datacenter, selectedDatastore string)
 	specResult, err := ovfManager.CreateImportSpec(vm.ctx, ovfContent, rpo,
 		object.NewDatastore(vm.client.Client, dsMo.Reference()), cisp)
 	if err != nil {
-		return fmt.Errorf("failed to create an import spec for the VM: %s", err)
+		return fmt.Errorf("failed to create an import spec for the VM: %w", err)
 	}
 
 	// FIXME (Preet) specResult can also have warnings. Need to log/return those.
@@ -654,17 +711,18 @@ var uploadTemplate = func(vm *VM, dcMo *mo.Datacenter, selectedDatastore string)
 	fo := object.NewFolder(vm.client.Client, dcMo.VmFolder)
 	lease, err := rpo.ImportVApp(vm.ctx, specResult.ImportSpec, fo, hso)
 	if err != nil {
-		return fmt.Errorf("error getting an nfc lease: %s", err)
+		return fmt.Errorf("error getting an nfc lease: %w", err)
 	}
+	rb.Add("template "+template, vm.removeStep(dcMo, template))
 
 	err = uploadOvf(vm, specResult, NewLease(vm.ctx, lease))
 	if err != nil {
-		return fmt.Errorf("error uploading the ovf template: %s", err)
+		return fmt.Errorf("error uploading the ovf template: %w", err)
 	}
 
 	vmMo, err := findVM(vm, dcMo, template)
 	if err != nil {
-		return fmt.Errorf("error getting the uploaded VM: %s", err)
+		return fmt.Errorf("error getting the uploaded VM: %w", err)
 	}
 
 	// LinkedClones cannot be created from templates, but must be created from snapshots of VMs.
@@ -683,19 +741,19 @@ var uploadTemplate = func(vm *VM, dcMo *mo.Datacenter, selectedDatastore string)
 		snapshotTask, err := vmo.CreateSnapshot(vm.ctx, s.Name, s.Description, s.Memory, s.Quiesce)
 
 		if err != nil {
-			return fmt.Errorf("error creating snapshot of the vm: %s", err)
+			return fmt.Errorf("error creating snapshot of the vm: %w", err)
 		}
 		tInfo, err := snapshotTask.WaitForResult(vm.ctx, nil)
 		if err != nil {
-			return fmt.Errorf("error waiting for snapshot to finish: %s", err)
+			return fmt.Errorf("error waiting for snapshot to finish: %w", err)
 		}
 		if tInfo.Error != nil {
-			return fmt.Errorf("snapshot task returned an error: %s", err)
+			return fmt.Errorf("snapshot task returned an error: %w", err)
 		}
 	} else {
 		err = vmo.MarkAsTemplate(vm.ctx)
 		if err != nil {
-			return fmt.Errorf("error converting the uploaded VM to a template: %s", err)
+			return fmt.Errorf("error converting the uploaded VM to a template: %w", err)
 		}
 	}
 	return nil
@@ -764,17 +822,44 @@ func validateHost(vm *VM, hsMor types.ManagedObjectReference) (bool, error) {
 }
 
 func getState(vm *VM) (state string, err error) {
+	state, found, err := lookupState(vm)
+	if err != nil || !found {
+		return "", lvm.ErrVMInfoFailed
+	}
+	return state, nil
+}
+
+// lookupState returns the guest state of the VM, or found set to false if
+// there is no VM with its name in the datacenter.
+func lookupState(vm *VM) (state string, found bool, err error) {
 	// Get a reference to the datacenter with host and vm folders populated
 	dcMo, err := GetDatacenter(vm)
 	if err != nil {
-		return "", lvm.ErrVMInfoFailed
+		return "", false, lvm.ErrVMInfoFailed
 	}
 	vmMo, err := findVM(vm, dcMo, vm.Name)
 	if err != nil {
-		return "", lvm.ErrVMInfoFailed
+		if _, ok := err.(ErrorObjectNotFound); ok {
+			return "", false, nil
+		}
+		return "", false, lvm.ErrVMInfoFailed
 	}
 
-	return vmMo.Guest.GuestState, nil
+	return vmMo.Guest.GuestState, true, nil
+}
+
+// translateState maps a vSphere guest state to one of the lvm.VM* states.
+func translateState(raw string) string {
+	switch raw {
+	case "running":
+		return lvm.VMRunning
+	case "standby":
+		return lvm.VMSuspended
+	case "shuttingDown", "resetting", "notRunning":
+		return lvm.VMHalted
+	default:
+		return lvm.VMUnknown
+	}
 }
 
 // answerQuestion checks to see if there are currently pending questions on the
@@ -790,7 +875,7 @@ func (vm *VM) answerQuestion(vmMo *mo.VirtualMachine) error {
 
 	for qre, ans := range vm.QuestionResponses {
 		if match, err := regexp.MatchString(qre, q.Text); err != nil {
-			return fmt.Errorf("error while parsing automated responses: %v", err)
+			return fmt.Errorf("error while parsing automated responses: %w", err)
 		} else if match {
 			ans, validOptions := resolveAnswerAndOptions(q.Choice.ChoiceInfo, ans)
 			err = answerVSphereQuestion(vm, vmMo, q.Id, ans)
@@ -3,6 +3,7 @@
 package vsphere
 
 import (
+	stdcontext "context"
 	"errors"
 	"fmt"
 	"io"
@@ -13,12 +14,15 @@ import (
 	"sync"
 	"time"
 
+	"github.com/apcera/libretto/remote"
 	"github.com/apcera/libretto/ssh"
 	"github.com/apcera/libretto/util"
 	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/wait"
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
 
 	"golang.org/x/net/context"
@@ -136,12 +140,12 @@ func (r ReadProgress) Wait() {
 
 var (
 	// ErrorVMExists is returned when the VM being provisioned already exists.
-	ErrorVMExists = errors.New("VM already exists")
+	ErrorVMExists = lvm.NewError(lvm.AlreadyExists, errors.New("VM already exists"))
 	//ErrorDestinationNotSupported is returned when the destination is not supported for provisioning.
-	ErrorDestinationNotSupported = errors.New("destination is not supported by this provisioner")
+	ErrorDestinationNotSupported = lvm.NewError(lvm.NotSupported, errors.New("destination is not supported by this provisioner"))
 	// ErrorVMPowerStateChanging is returned when the power state of the VM is resetting or shuttingdown
 	// The VM can't be started in this state
-	ErrorVMPowerStateChanging = errors.New("the power state of the vm is changing, try again later")
+	ErrorVMPowerStateChanging = lvm.NewError(lvm.Transient, errors.New("the power state of the vm is changing, try again later"))
 	errNoHostsInCluster       = errors.New("the cluster does not have any hosts in it")
 )
 
@@ -172,6 +176,12 @@ func (e ErrorBadResponse) Error() string {
 	return fmt.Sprintf("Bad response to HTTP request. Status code: %d Body: '%s'", e.resp.StatusCode, body)
 }
 
+// Is reports whether target is the lvm.Kind of the response's status code.
+func (e ErrorBadResponse) Is(target error) bool {
+	k := lvm.KindForStatus(e.resp.StatusCode)
+	return k != "" && target == k
+}
+
 // ErrorClientFailed is returned when a client cannot be created using the given creds
 type ErrorClientFailed struct {
 	err error
@@ -181,6 +191,11 @@ func (e ErrorClientFailed) Error() string {
 	return fmt.Sprintf("error connecting to the VI SDK: %s", e.err)
 }
 
+// Unwrap returns the error returned by the VI SDK.
+func (e ErrorClientFailed) Unwrap() error {
+	return e.err
+}
+
 // ErrorObjectNotFound is returned when the object being searched for is not found.
 type ErrorObjectNotFound struct {
 	err error
@@ -191,6 +206,16 @@ func (e ErrorObjectNotFound) Error() string {
 	return fmt.Sprintf("Could not retrieve the object '%s' from the vSphere API: %s", e.obj, e.err)
 }
 
+// Unwrap returns the underlying error.
+func (e ErrorObjectNotFound) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether target is lvm.NotFound.
+func (e ErrorObjectNotFound) Is(target error) bool {
+	return target == lvm.NotFound
+}
+
 // ErrorPropertyRetrieval is returned when the object being searched for is not found.
 type ErrorPropertyRetrieval struct {
 	err error
@@ -202,6 +227,11 @@ func (e ErrorPropertyRetrieval) Error() string {
 	return fmt.Sprintf("Could not retrieve '%s' for object '%s': %s", e.ps, e.mor, e.err)
 }
 
+// Unwrap returns the underlying error.
+func (e ErrorPropertyRetrieval) Unwrap() error {
+	return e.err
+}
+
 func (e ErrorParsingURL) Error() string {
 	if e.err != nil {
 		return fmt.Sprintf("Error parsing sdk uri. Url: %s, Error: %s", e.uri, e.err)
@@ -339,10 +369,17 @@ type VM struct {
 	// prevent normal operation. The response strings should be the string value
 	// of the intended response index.
 	QuestionResponses map[string]string
+	// KeepOnFailure keeps the templates uploaded and the VM cloned by a failed
+	// Provision, so that they can be inspected.
+	KeepOnFailure bool
+	// Observer receives the events of this VM, in addition to the observers
+	// registered with lvm.AddObserver. It may be nil.
+	Observer lvm.Observer
 	// UseLinkedClones is a flag to indicate whether VMs cloned from templates should be
 	// linked clones.
 	UseLinkedClones bool
 	uri             *url.URL
+	parent          context.Context
 	ctx             context.Context
 	cancel          context.CancelFunc
 	client          *govmomi.Client
@@ -351,10 +388,48 @@ type VM struct {
 	datastore       string
 }
 
-// Provision provisions this VM.
+var _ lvm.VirtualMachineContext = (*VM)(nil)
+var _ lvm.StateDetailer = (*VM)(nil)
+var _ lvm.Capabler = (*VM)(nil)
+
+// setupSession sets up a session whose SDK calls are cancelled when ctx is
+// done.
+func (vm *VM) setupSession(ctx stdcontext.Context) error {
+	vm.parent = ctx
+	return SetupSession(vm)
+}
+
+// contextErr adds ctx.Err() in front of *err if ctx is done, so callers see
+// the cancellation as well as the SDK error it caused and, for Provision, the
+// resources that could not be rolled back.
+func contextErr(ctx stdcontext.Context, err *error) {
+	if *err != nil && ctx.Err() != nil && !errors.Is(*err, ctx.Err()) {
+		*err = lvm.WrapErrors(ctx.Err(), *err)
+	}
+}
+
+// removeStep returns a rollback step that removes the VM or template called
+// name. Provision may be failing because its session was cancelled, so the
+// step uses the context of the rollback instead.
+func (vm *VM) removeStep(dcMo *mo.Datacenter, name string) func(stdcontext.Context) error {
+	return func(ctx stdcontext.Context) error {
+		return removeVM(ctx, vm, dcMo, name)
+	}
+}
+
+// Provision provisions this VM. If it fails, the templates it uploaded and the
+// VM it cloned are removed unless KeepOnFailure is set.
 func (vm *VM) Provision() (err error) {
-	if err := SetupSession(vm); err != nil {
-		return fmt.Errorf("Error setting up vSphere session: %s", err)
+	return vm.ProvisionContext(stdcontext.Background())
+}
+
+// ProvisionContext is like Provision but the vSphere session is cancelled
+// when ctx is done.
+func (vm *VM) ProvisionContext(ctx stdcontext.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpProvision)(&err)
+	defer contextErr(ctx, &err)
+	if err := vm.setupSession(ctx); err != nil {
+		return fmt.Errorf("Error setting up vSphere session: %w", err)
 	}
 
 	// Cancel the sdk context
@@ -363,9 +438,14 @@ func (vm *VM) Provision() (err error) {
 	// Get a reference to the datacenter with host and vm folders populated
 	dcMo, err := GetDatacenter(vm)
 	if err != nil {
-		return fmt.Errorf("Failed to retrieve datacenter: %s", err)
+		return fmt.Errorf("Failed to retrieve datacenter: %w", err)
 	}
 
+	// Remove the templates uploaded and the VM cloned if a later step fails
+	rb := lvm.NewRollback(vm.KeepOnFailure)
+	rb.Events = vm.events()
+	defer rb.Finish(&err)
+
 	// Upload a template to all the datastores if `UseLocalTemplates` is set.
 	// Otherwise pick a random datastore out of the list that was passed in.
 	var datastores = vm.Datastores
@@ -380,7 +460,7 @@ func (vm *VM) Provision() (err error) {
 		// Does the VM template already exist?
 		e, err := Exists(vm, dcMo, template)
 		if err != nil {
-			return fmt.Errorf("failed to check if the template already exists: %s", err)
+			return fmt.Errorf("failed to check if the template already exists: %w", err)
 		}
 
 		// If it does exist, return an error if the skip existing flag is not set
@@ -391,7 +471,7 @@ func (vm *VM) Provision() (err error) {
 		} else {
 			// Upload the template if  it does not exist. If it exists and SkipExisting is true,
 			// use the existing template
-			if err := uploadTemplate(vm, dcMo, d); err != nil {
+			if err := uploadTemplate(vm, dcMo, d, rb); err != nil {
 				return err
 			}
 		}
@@ -402,15 +482,15 @@ func (vm *VM) Provision() (err error) {
 	// Does the VM already exist?
 	e, err := Exists(vm, dcMo, vm.Name)
 	if err != nil {
-		return fmt.Errorf("failed to check if the vm already exists: %s", err)
+		return fmt.Errorf("failed to check if the vm already exists: %w", err)
 	}
 	if e {
 		return ErrorVMExists
 	}
 
-	err = cloneFromTemplate(vm, dcMo, usableDatastores)
+	err = cloneFromTemplate(vm, dcMo, usableDatastores, rb)
 	if err != nil {
-		return fmt.Errorf("error while cloning vm from template: %s", err)
+		return fmt.Errorf("error while cloning vm from template: %w", err)
 	}
 	return
 }
@@ -420,10 +500,23 @@ func (vm *VM) GetName() string {
 	return vm.Name
 }
 
+// events returns the Events of the VM, sent to its Observer and the global
+// observers.
+func (vm *VM) events() lvm.Events {
+	return lvm.Events{Provider: providerName, Name: vm.Name, VM: vm, Observer: vm.Observer}
+}
+
 // GetIPs returns the IPs of this VM. Returns all the IPs known to the API for
 // the different network cards for this VM. Includes IPV4 and IPV6 addresses.
 func (vm *VM) GetIPs() ([]net.IP, error) {
-	if err := SetupSession(vm); err != nil {
+	return vm.GetIPsContext(stdcontext.Background())
+}
+
+// GetIPsContext is like GetIPs but the vSphere session is cancelled when ctx
+// is done.
+func (vm *VM) GetIPsContext(ctx stdcontext.Context) (_ []net.IP, err error) {
+	defer contextErr(ctx, &err)
+	if err := vm.setupSession(ctx); err != nil {
 		return nil, err
 	}
 	defer vm.cancel()
@@ -460,9 +553,24 @@ func (vm *VM) GetIPs() ([]net.IP, error) {
 	return ips, nil
 }
 
+// powerOffWaiter polls the state of a VM being powered off every second for
+// up to 90s.
+var powerOffWaiter = wait.Waiter{
+	Backoff: wait.Constant(time.Second),
+	Timeout: 90 * time.Second,
+}
+
 // Destroy deletes this VM from vSphere.
 func (vm *VM) Destroy() (err error) {
-	if err := SetupSession(vm); err != nil {
+	return vm.DestroyContext(stdcontext.Background())
+}
+
+// DestroyContext is like Destroy but the vSphere session is cancelled, and
+// waiting for the VM to power off stops, when ctx is done.
+func (vm *VM) DestroyContext(ctx stdcontext.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpDestroy)(&err)
+	defer contextErr(ctx, &err)
+	if err := vm.setupSession(ctx); err != nil {
 		return err
 	}
 	defer vm.cancel()
@@ -482,43 +590,25 @@ func (vm *VM) Destroy() (err error) {
 
 	if state != "notRunning" {
 		// Only possible states are running, shuttingDown, resetting or notRunning
-		timer := time.NewTimer(time.Second * 90)
-		wg := sync.WaitGroup{}
-		wg.Add(1)
-
-		go func() {
-			defer timer.Stop()
-			defer wg.Done()
-		Outerloop:
-			for {
-				state, e := getState(vm)
-				if e != nil {
-					err = e
-					break
-				}
-				if state == "notRunning" {
-					break
-				}
-
-				if state == "running" {
-					e = halt(vm)
-					if e != nil {
-						err = e
-						break
-					}
-				}
+		err = powerOffWaiter.Until(vm.ctx, func(stdcontext.Context) (bool, error) {
+			state, err := getState(vm)
+			if err != nil {
+				return false, err
+			}
+			if state == "notRunning" {
+				return true, nil
+			}
 
-				select {
-				case <-timer.C:
-					err = fmt.Errorf("timed out waiting for VM to power off")
-					break Outerloop
-				default:
-					// No action
+			if state == "running" {
+				if err := halt(vm); err != nil {
+					return false, err
 				}
-				time.Sleep(time.Second)
 			}
-		}()
-		wg.Wait()
+			return false, nil
+		})
+		if err == wait.ErrTimeout {
+			return fmt.Errorf("timed out waiting for VM to power off")
+		}
 		if err != nil {
 			return err
 		}
@@ -536,44 +626,73 @@ func (vm *VM) Destroy() (err error) {
 	vmo := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
 	destroyTask, err := vmo.Destroy(vm.ctx)
 	if err != nil {
-		return fmt.Errorf("error creating a destroy task on the vm: %s", err)
+		return fmt.Errorf("error creating a destroy task on the vm: %w", err)
 	}
 	tInfo, err := destroyTask.WaitForResult(vm.ctx, nil)
 	if err != nil {
-		return fmt.Errorf("error waiting for destroy task: %s", err)
+		return fmt.Errorf("error waiting for destroy task: %w", err)
 	}
 	if tInfo.Error != nil {
-		return fmt.Errorf("destroy task returned an error: %s", err)
+		return fmt.Errorf("destroy task returned an error: %w", err)
 	}
 	return nil
 }
 
 // GetState returns the power state of this VM.
 func (vm *VM) GetState() (state string, err error) {
-	if err := SetupSession(vm); err != nil {
+	return vm.GetStateContext(stdcontext.Background())
+}
+
+// GetStateContext is like GetState but the vSphere session is cancelled when
+// ctx is done.
+func (vm *VM) GetStateContext(ctx stdcontext.Context) (state string, err error) {
+	d, err := vm.GetStateDetail(ctx)
+	if err != nil {
+		return "", err
+	}
+	if d.State == lvm.VMUnknown {
+		// VM state "unknown"
 		return "", lvm.ErrVMInfoFailed
 	}
+	return d.State, nil
+}
+
+// GetStateDetail returns the state of this VM along with the guest state
+// reported by vSphere, such as "notRunning" or "shuttingDown".
+func (vm *VM) GetStateDetail(ctx stdcontext.Context) (d lvm.StateDetail, err error) {
+	defer contextErr(ctx, &err)
+	if err := vm.setupSession(ctx); err != nil {
+		return lvm.StateDetail{}, lvm.ErrVMInfoFailed
+	}
 	defer vm.cancel()
 
-	state, err = getState(vm)
+	raw, found, err := lookupState(vm)
 	if err != nil {
-		return "", err
+		return lvm.StateDetail{}, err
 	}
-
-	if state == "running" {
-		return lvm.VMRunning, nil
-	} else if state == "standby" {
-		return lvm.VMSuspended, nil
-	} else if state == "shuttingDown" || state == "resetting" || state == "notRunning" {
-		return lvm.VMHalted, nil
+	if !found {
+		return lvm.StateDetail{State: lvm.VMNotFound}, nil
 	}
-	// VM state "unknown"
-	return "", lvm.ErrVMInfoFailed
+	return lvm.StateDetail{State: translateState(raw), Raw: raw}, nil
+}
+
+// Capabilities reports that vSphere VMs can be suspended, have extra
+// disks and be connected to several networks.
+func (vm *VM) Capabilities() lvm.Capabilities {
+	return lvm.Capabilities{Suspend: true, MultipleNICs: true, Volumes: true}
 }
 
 // Suspend suspends this VM.
 func (vm *VM) Suspend() (err error) {
-	if err := SetupSession(vm); err != nil {
+	return vm.SuspendContext(stdcontext.Background())
+}
+
+// SuspendContext is like Suspend but the vSphere session is cancelled when
+// ctx is done.
+func (vm *VM) SuspendContext(ctx stdcontext.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpSuspend)(&err)
+	defer contextErr(ctx, &err)
+	if err := vm.setupSession(ctx); err != nil {
 		return err
 	}
 	defer vm.cancel()
@@ -590,21 +709,29 @@ func (vm *VM) Suspend() (err error) {
 	vmo := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
 	suspendTask, err := vmo.Suspend(vm.ctx)
 	if err != nil {
-		return fmt.Errorf("error creating a suspend task on the vm: %s", err)
+		return fmt.Errorf("error creating a suspend task on the vm: %w", err)
 	}
 	tInfo, err := suspendTask.WaitForResult(vm.ctx, nil)
 	if err != nil {
-		return fmt.Errorf("error waiting for suspend task: %s", err)
+		return fmt.Errorf("error waiting for suspend task: %w", err)
 	}
 	if tInfo.Error != nil {
-		return fmt.Errorf("suspend task returned an error: %s", err)
+		return fmt.Errorf("suspend task returned an error: %w", err)
 	}
 	return nil
 }
 
 // Halt halts this VM.
 func (vm *VM) Halt() (err error) {
-	if err := SetupSession(vm); err != nil {
+	return vm.HaltContext(stdcontext.Background())
+}
+
+// HaltContext is like Halt but the vSphere session is cancelled when ctx is
+// done.
+func (vm *VM) HaltContext(ctx stdcontext.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpHalt)(&err)
+	defer contextErr(ctx, &err)
+	if err := vm.setupSession(ctx); err != nil {
 		return err
 	}
 	defer vm.cancel()
@@ -613,7 +740,15 @@ func (vm *VM) Halt() (err error) {
 
 // Start powers on this VM.
 func (vm *VM) Start() (err error) {
-	if err := SetupSession(vm); err != nil {
+	return vm.StartContext(stdcontext.Background())
+}
+
+// StartContext is like Start but the vSphere session is cancelled when ctx is
+// done.
+func (vm *VM) StartContext(ctx stdcontext.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpStart)(&err)
+	defer contextErr(ctx, &err)
+	if err := vm.setupSession(ctx); err != nil {
 		return err
 	}
 	defer vm.cancel()
@@ -625,9 +760,21 @@ func (vm *VM) Resume() (err error) {
 	return vm.Start()
 }
 
+// ResumeContext is like Resume but the vSphere session is cancelled when ctx
+// is done.
+func (vm *VM) ResumeContext(ctx stdcontext.Context) (err error) {
+	defer vm.events().Begin(ctx, lvm.OpResume)(&err)
+	return vm.StartContext(ctx)
+}
+
 // GetSSH returns an ssh client configured for this VM.
 func (vm *VM) GetSSH(options ssh.Options) (ssh.Client, error) {
-	ips, err := util.GetVMIPs(vm, options)
+	return vm.GetSSHContext(stdcontext.Background(), options)
+}
+
+// GetSSHContext is like GetSSH but waiting for the IPs is bound to ctx.
+func (vm *VM) GetSSHContext(ctx stdcontext.Context, options ssh.Options) (ssh.Client, error) {
+	ips, err := util.GetVMIPsContext(ctx, vm, options)
 	if err != nil {
 		return nil, err
 	}
@@ -635,3 +782,16 @@ func (vm *VM) GetSSH(options ssh.Options) (ssh.Client, error) {
 	client := ssh.SSHClient{Creds: &vm.Credentials, IP: ips[0], Port: 22, Options: options}
 	return &client, nil
 }
+
+// GetRemote returns a Remote for the VM: over SSH, as GetSSH does, or over
+// WinRM for Windows guests. WinRM logs in with the user and password of
+// Credentials unless options.WinRM sets them.
+func (vm *VM) GetRemote(options remote.Options) (remote.Remote, error) {
+	return lvm.NewRemote(vm, options, &vm.Credentials, func() (net.IP, error) {
+		ips, err := util.GetVMIPs(vm, options.SSH)
+		if err != nil {
+			return nil, err
+		}
+		return ips[0], nil
+	})
+}
@@ -704,6 +704,63 @@ func TestUploadOvfHappyPath(t *testing.T) {
 	}
 }
 
+func TestUploadOvfReportsProgress(t *testing.T) {
+	var oldNewProgressReader = NewProgressReader
+	defer func() {
+		NewProgressReader = oldNewProgressReader
+	}()
+	var lease Lease
+	NewProgressReader = func(r io.Reader, t int64, l Lease) ProgressReader {
+		lease = l
+		return mockProgressReader{}
+	}
+	var oldOpen = open
+	var oldCreateRequest = createRequest
+	defer func() {
+		open = oldOpen
+		createRequest = oldCreateRequest
+	}()
+	fileName := "test"
+	open = func(name string) (file *os.File, err error) {
+		return os.Create(fileName)
+	}
+	defer os.RemoveAll(fileName)
+	createRequest = func(r io.Reader, method string, insecure bool, length int64, url string, contentType string) error {
+		return errors.New("stop")
+	}
+
+	var set int
+	l := mockLease{
+		MockWait: func() (*types.HttpNfcLeaseInfo, error) {
+			return &types.HttpNfcLeaseInfo{DeviceUrl: []types.HttpNfcLeaseDeviceUrl{{}}}, nil
+		},
+		MockLeaseProgress: func(p int) {
+			set = p
+		},
+	}
+	var events []virtualmachine.Event
+	vm := VM{Name: "vm", Observer: virtualmachine.ObserverFunc(func(e virtualmachine.Event) {
+		events = append(events, e)
+	})}
+	sr := types.OvfCreateImportSpecResult{FileItem: []types.OvfFileItem{{Path: "/disk.vmdk"}}}
+	uploadOvf(&vm, &sr, l)
+	if lease == nil {
+		t.Fatal("Expected uploadOvf to create a progress reader")
+	}
+
+	lease.HTTPNfcLeaseProgress(42)
+	if set != 42 {
+		t.Fatalf("Expected the lease progress to be 42, got: %d", set)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got: %d", len(events))
+	}
+	e := events[0]
+	if e.Type != virtualmachine.UploadProgress || e.Percent != 42 || e.Resource != "/disk.vmdk" || e.Name != "vm" {
+		t.Fatalf("Unexpected event: %+v", e)
+	}
+}
+
 func TestCreateRequestNewRequestError(t *testing.T) {
 	errProtocol := `unsupported protocol scheme ""`
 	err := createRequest(mockProgressReader{}, "foo", true, 0, "", "foo")
@@ -848,3 +905,94 @@ func TestResolveAnswerAndOptions(t *testing.T) {
 		}
 	}
 }
+
+func TestContextErr(t *testing.T) {
+	sdkErr := errors.New("task was canceled")
+	rollbackErr := errors.New("rollback failed")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err := virtualmachine.WrapErrors(sdkErr, rollbackErr)
+	contextErr(ctx, &err)
+	if err.Error() != "task was canceled: rollback failed" {
+		t.Fatalf("Expected the error to be left alone while ctx is not done, got: %s", err)
+	}
+
+	cancel()
+	contextErr(ctx, &err)
+	if !errors.Is(err, context.Canceled) || !errors.Is(err, rollbackErr) {
+		t.Fatalf("Expected the cancellation and the rollback failure, got: %s", err)
+	}
+	if err.Error() != "context canceled: task was canceled: rollback failed" {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	contextErr(ctx, &err)
+	if err.Error() != "context canceled: task was canceled: rollback failed" {
+		t.Fatalf("Expected the cancellation to be added once, got: %s", err)
+	}
+
+	var noErr error
+	contextErr(ctx, &noErr)
+	if noErr != nil {
+		t.Fatalf("Expected no error, got: %s", noErr)
+	}
+}
+
+func TestTranslateState(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"running", virtualmachine.VMRunning},
+		{"standby", virtualmachine.VMSuspended},
+		{"shuttingDown", virtualmachine.VMHalted},
+		{"resetting", virtualmachine.VMHalted},
+		{"notRunning", virtualmachine.VMHalted},
+		{"unknown", virtualmachine.VMUnknown},
+		{"", virtualmachine.VMUnknown},
+	}
+	for _, tt := range tests {
+		if got := translateState(tt.raw); got != tt.want {
+			t.Errorf("translateState(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestLookupStateNotFound(t *testing.T) {
+	defer func(f func(*VM, *mo.Datacenter, string) (*mo.VirtualMachine, error)) { findVM = f }(findVM)
+
+	f := mockFinder{}
+	f.MockDatacenterList = func(context.Context, string) ([]*object.Datacenter, error) {
+		return []*object.Datacenter{{}}, nil
+	}
+	c := mockCollector{}
+	c.MockRetrieveOne = func(_ context.Context, _ types.ManagedObjectReference, _ []string, dst interface{}) error {
+		dst.(*mo.Datacenter).Name = "test-dc"
+		return nil
+	}
+	vm := &VM{Name: "vm", finder: f, collector: c, Datacenter: "test-dc"}
+
+	findVM = func(*VM, *mo.Datacenter, string) (*mo.VirtualMachine, error) {
+		return nil, NewErrorObjectNotFound(errors.New("could not find the vm"), "vm")
+	}
+	raw, found, err := lookupState(vm)
+	if err != nil || found || raw != "" {
+		t.Fatalf("Expected the VM not to be found, got %q, %v, %v", raw, found, err)
+	}
+
+	findVM = func(*VM, *mo.Datacenter, string) (*mo.VirtualMachine, error) {
+		return nil, errors.New("connection reset")
+	}
+	if _, _, err := lookupState(vm); err != virtualmachine.ErrVMInfoFailed {
+		t.Fatalf("Expected ErrVMInfoFailed, got: %v", err)
+	}
+
+	findVM = func(*VM, *mo.Datacenter, string) (*mo.VirtualMachine, error) {
+		vmMo := &mo.VirtualMachine{}
+		vmMo.Guest = &types.GuestInfo{GuestState: "notRunning"}
+		return vmMo, nil
+	}
+	raw, found, err = lookupState(vm)
+	if err != nil || !found || raw != "notRunning" {
+		t.Fatalf("Expected the guest state, got %q, %v, %v", raw, found, err)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package wait
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff decides how long to sleep between two polls.
+type Backoff interface {
+	// Delay returns how long to sleep after the given attempt, counting
+	// from 0 for the first poll.
+	Delay(attempt int) time.Duration
+}
+
+// Constant sleeps for the same duration after every poll.
+type Constant time.Duration
+
+// Delay returns c.
+func (c Constant) Delay(attempt int) time.Duration {
+	return time.Duration(c)
+}
+
+// Exponential sleeps for Initial after the first poll and multiplies the delay
+// by Multiplier after every following one. If Jitter is set, each delay is
+// scaled by a random factor between 1-Jitter and 1+Jitter so that callers
+// started at the same time do not poll in lockstep.
+type Exponential struct {
+	// Initial is the delay after the first poll.
+	Initial time.Duration
+	// Multiplier is the growth factor of the delay. It defaults to 2.
+	Multiplier float64
+	// Jitter is the fraction, between 0 and 1, by which delays are randomized.
+	Jitter float64
+}
+
+// Delay returns Initial * Multiplier^attempt, randomized by Jitter.
+func (e Exponential) Delay(attempt int) time.Duration {
+	m := e.Multiplier
+	if m == 0 {
+		m = 2
+	}
+	d := float64(e.Initial) * math.Pow(m, float64(attempt))
+	if e.Jitter > 0 {
+		d *= 1 + e.Jitter*(2*rand.Float64()-1)
+	}
+	// Avoid overflowing time.Duration after many attempts.
+	if d > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+// Capped limits the delays of Backoff to Max.
+type Capped struct {
+	Backoff Backoff
+	Max     time.Duration
+}
+
+// Delay returns the delay of c.Backoff, or c.Max if it is longer.
+func (c Capped) Delay(attempt int) time.Duration {
+	d := c.Backoff.Delay(attempt)
+	if d > c.Max {
+		return c.Max
+	}
+	return d
+}
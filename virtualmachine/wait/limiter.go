@@ -0,0 +1,91 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package wait
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/apcera/libretto/util"
+)
+
+// Limiter spaces out calls to an API so that at most one proceeds every
+// Interval. Concurrent callers queue up: each one waits Interval longer than
+// the one before it, but never more than MaxWait. A Limiter is safe for
+// concurrent use and is usually shared by all the VMs of a provider.
+type Limiter struct {
+	// Interval is the minimum time between two calls.
+	Interval time.Duration
+	// MaxWait bounds the time a caller waits. Zero means no limit.
+	MaxWait time.Duration
+
+	mu   sync.Mutex
+	next time.Time // when the next caller may proceed
+}
+
+var (
+	limitersMu sync.RWMutex
+	limiters   = make(map[string]*Limiter)
+)
+
+// waitedKey is the context key under which Waited records a Limiter.
+type waitedKey struct {
+	l *Limiter
+}
+
+// SetLimiter makes l the Limiter shared by the VMs of provider. Providers that
+// rate limit their calls set it from their init function, so that callers
+// such as the fleet package space out their calls with the same Limiter.
+func SetLimiter(provider string, l *Limiter) {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	limiters[provider] = l
+}
+
+// LimiterOf returns the Limiter set for provider, or nil if there is none.
+func LimiterOf(provider string) *Limiter {
+	limitersMu.RLock()
+	defer limitersMu.RUnlock()
+	return limiters[provider]
+}
+
+// NewLimiter returns a Limiter that lets one call through every interval and
+// delays callers by at most maxWait.
+func NewLimiter(interval, maxWait time.Duration) *Limiter {
+	return &Limiter{Interval: interval, MaxWait: maxWait}
+}
+
+// Wait blocks until the caller is allowed to proceed. It returns ctx.Err() if
+// ctx is done first, and returns at once if ctx comes from Waited for l.
+func (l *Limiter) Wait(ctx context.Context) error {
+	if ctx.Value(waitedKey{l}) != nil {
+		return nil
+	}
+	return util.Sleep(ctx, l.reserve(time.Now()))
+}
+
+// Waited returns a copy of ctx recording that the caller already waited for
+// l, so that a call made with it does not wait for l a second time.
+func (l *Limiter) Waited(ctx context.Context) context.Context {
+	return context.WithValue(ctx, waitedKey{l}, true)
+}
+
+// reserve books the next slot at or after now and returns how long the caller
+// has to wait for it.
+func (l *Limiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	// The wall clock may have gone back, so bound the wait even if the queue
+	// does not justify it.
+	if l.MaxWait > 0 && start.Sub(now) > l.MaxWait {
+		start = now.Add(l.MaxWait)
+	}
+	l.next = start.Add(l.Interval)
+	return start.Sub(now)
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// Package wait polls VMs until they reach a state, get IP addresses or accept
+// connections. Providers use it for all their polling so that timeouts and
+// cancellation behave the same everywhere.
+package wait
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/apcera/libretto/util"
+	lvm "github.com/apcera/libretto/virtualmachine"
+)
+
+var (
+	// ErrTimeout is returned when the condition was not met within the
+	// Waiter's Timeout or MaxAttempts.
+	ErrTimeout = lvm.NewError(lvm.Timeout, errors.New("timed out waiting for condition"))
+
+	// ErrVMError is returned by ForState when the VM enters lvm.VMError and
+	// that was not one of the states waited for.
+	ErrVMError = errors.New("VM entered the error state")
+)
+
+// Condition reports whether polling is done. Returning an error stops
+// polling and Until returns that error.
+type Condition func(ctx context.Context) (done bool, err error)
+
+// Waiter polls a Condition, sleeping between polls as told by its Backoff.
+// Polling stops when the condition is met, when it returns an error, when
+// Timeout elapses or MaxAttempts polls were made, or when the context is
+// done.
+type Waiter struct {
+	// Backoff decides how long to sleep between polls. If nil, the Waiter
+	// polls once a second.
+	Backoff Backoff
+	// Timeout bounds the total time spent waiting, including the time
+	// spent in the condition. Zero means no limit besides the context.
+	Timeout time.Duration
+	// MaxAttempts bounds the number of polls. Zero means no limit.
+	MaxAttempts int
+}
+
+// Default is the Waiter used by the package-level functions. It polls with an
+// exponential backoff, from 1s up to 10s between polls, for up to 10 minutes.
+var Default = Waiter{
+	Backoff: Capped{
+		Backoff: Exponential{Initial: time.Second, Multiplier: 1.5, Jitter: 0.1},
+		Max:     10 * time.Second,
+	},
+	Timeout: 10 * time.Minute,
+}
+
+// Until polls cond until it is met. It returns ErrTimeout if the Waiter gave
+// up, or ctx.Err() if ctx is done first.
+func (w Waiter) Until(ctx context.Context, cond Condition) error {
+	pollCtx := ctx
+	if w.Timeout > 0 {
+		var cancel context.CancelFunc
+		pollCtx, cancel = context.WithTimeout(ctx, w.Timeout)
+		defer cancel()
+	}
+
+	backoff := w.Backoff
+	if backoff == nil {
+		backoff = Constant(time.Second)
+	}
+
+	for attempt := 0; w.MaxAttempts == 0 || attempt < w.MaxAttempts; attempt++ {
+		done, err := cond(pollCtx)
+		if err != nil {
+			return w.contextErr(ctx, pollCtx, err)
+		}
+		if done {
+			return nil
+		}
+		if w.MaxAttempts != 0 && attempt == w.MaxAttempts-1 {
+			break
+		}
+		if err := util.Sleep(pollCtx, backoff.Delay(attempt)); err != nil {
+			return w.contextErr(ctx, pollCtx, err)
+		}
+	}
+	return ErrTimeout
+}
+
+// contextErr returns ErrTimeout in place of err if the Waiter's own timeout
+// expired, and ctx.Err() if the caller's context is done.
+func (w Waiter) contextErr(ctx, pollCtx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if pollCtx.Err() != nil {
+		return ErrTimeout
+	}
+	return err
+}
+
+// ForState waits until vm is in one of states and returns that state. Errors
+// getting the state stop the wait, as does the VM entering lvm.VMError
+// unless it is one of states.
+func (w Waiter) ForState(ctx context.Context, vm lvm.VirtualMachine, states ...string) (string, error) {
+	cvm := lvm.AsContext(vm)
+	var state string
+	err := w.Until(ctx, func(ctx context.Context) (bool, error) {
+		var err error
+		state, err = cvm.GetStateContext(ctx)
+		if err != nil {
+			return false, err
+		}
+		for _, s := range states {
+			if state == s {
+				return true, nil
+			}
+		}
+		if state == lvm.VMError {
+			return false, ErrVMError
+		}
+		return false, nil
+	})
+	return state, err
+}
+
+// ForIPs waits until vm has at least n IP addresses and returns them. Errors
+// getting the IPs are retried if they have no kind or are retryable, since
+// providers often report them until the VM has booted; others, such as
+// lvm.NotFound or lvm.AuthFailed, stop the wait. If the wait times out, the
+// last error getting the IPs is joined to ErrTimeout.
+func (w Waiter) ForIPs(ctx context.Context, vm lvm.VirtualMachine, n int) ([]net.IP, error) {
+	cvm := lvm.AsContext(vm)
+	var (
+		ips     []net.IP
+		lastErr error
+	)
+	err := w.Until(ctx, func(ctx context.Context) (bool, error) {
+		var err error
+		ips, err = cvm.GetIPsContext(ctx)
+		if err != nil {
+			if lvm.KindOf(err) != "" && !lvm.IsRetryable(err) {
+				return false, err
+			}
+			lastErr = err
+			return false, nil
+		}
+		lastErr = nil
+		return len(ips) >= n, nil
+	})
+	if err == ErrTimeout && lastErr != nil {
+		return nil, lvm.WrapErrors(err, lastErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+// ForPort waits until a TCP connection to port on ip succeeds.
+func (w Waiter) ForPort(ctx context.Context, ip net.IP, port int) error {
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	return w.Until(ctx, func(ctx context.Context) (bool, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return false, nil
+		}
+		conn.Close()
+		return true, nil
+	})
+}
+
+// Until polls cond with the Default Waiter.
+func Until(ctx context.Context, cond Condition) error {
+	return Default.Until(ctx, cond)
+}
+
+// WaitForState waits with the Default Waiter until vm is in one of states.
+func WaitForState(ctx context.Context, vm lvm.VirtualMachine, states ...string) (string, error) {
+	return Default.ForState(ctx, vm, states...)
+}
+
+// WaitForIPs waits with the Default Waiter until vm has at least n IP
+// addresses.
+func WaitForIPs(ctx context.Context, vm lvm.VirtualMachine, n int) ([]net.IP, error) {
+	return Default.ForIPs(ctx, vm, n)
+}
+
+// WaitForPort waits with the Default Waiter until port on ip accepts TCP
+// connections.
+func WaitForPort(ctx context.Context, ip net.IP, port int) error {
+	return Default.ForPort(ctx, ip, port)
+}
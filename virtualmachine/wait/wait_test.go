@@ -0,0 +1,182 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package wait
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	lvm "github.com/apcera/libretto/virtualmachine"
+	"github.com/apcera/libretto/virtualmachine/mockprovider"
+)
+
+// TestExponential makes sure delays grow by the multiplier and stay within
+// the jitter.
+func TestExponential(t *testing.T) {
+	b := Exponential{Initial: time.Second, Multiplier: 2}
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		if d := b.Delay(i); d != want {
+			t.Fatalf("Delay(%d) = %s, want %s", i, d, want)
+		}
+	}
+
+	b.Jitter = 0.5
+	for i := 0; i < 1000; i++ {
+		if d := b.Delay(2); d < 2*time.Second || d > 6*time.Second {
+			t.Fatalf("Delay(2) = %s, want between 2s and 6s", d)
+		}
+	}
+}
+
+// TestCapped makes sure delays never exceed the cap.
+func TestCapped(t *testing.T) {
+	b := Capped{Backoff: Exponential{Initial: time.Second}, Max: 5 * time.Second}
+	if d := b.Delay(1); d != 2*time.Second {
+		t.Fatalf("Delay(1) = %s, want 2s", d)
+	}
+	if d := b.Delay(100); d != 5*time.Second {
+		t.Fatalf("Delay(100) = %s, want 5s", d)
+	}
+}
+
+// TestUntil makes sure Until polls until the condition is met.
+func TestUntil(t *testing.T) {
+	polls := 0
+	w := Waiter{Backoff: Constant(time.Millisecond)}
+	err := w.Until(context.Background(), func(context.Context) (bool, error) {
+		polls++
+		return polls == 3, nil
+	})
+	if err != nil {
+		t.Fatalf("Until returned %s", err)
+	}
+	if polls != 3 {
+		t.Fatalf("Until polled %d times, want 3", polls)
+	}
+}
+
+// TestUntilLimits makes sure Until gives up after MaxAttempts or Timeout and
+// stops on errors and cancellation.
+func TestUntilLimits(t *testing.T) {
+	never := func(context.Context) (bool, error) { return false, nil }
+
+	polls := 0
+	w := Waiter{Backoff: Constant(time.Millisecond), MaxAttempts: 4}
+	err := w.Until(context.Background(), func(ctx context.Context) (bool, error) {
+		polls++
+		return never(ctx)
+	})
+	if err != ErrTimeout || polls != 4 {
+		t.Fatalf("Until returned %v after %d polls, want ErrTimeout after 4", err, polls)
+	}
+
+	w = Waiter{Backoff: Constant(time.Millisecond), Timeout: 20 * time.Millisecond}
+	if err := w.Until(context.Background(), never); err != ErrTimeout {
+		t.Fatalf("Until returned %v, want ErrTimeout", err)
+	}
+
+	errBoom := errors.New("boom")
+	err = w.Until(context.Background(), func(context.Context) (bool, error) {
+		return false, errBoom
+	})
+	if err != errBoom {
+		t.Fatalf("Until returned %v, want %v", err, errBoom)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := w.Until(ctx, never); err != context.Canceled {
+		t.Fatalf("Until returned %v, want context.Canceled", err)
+	}
+}
+
+// TestForIPs makes sure ForIPs retries errors without a kind or retryable
+// ones, stops on others and reports the last error when it times out.
+func TestForIPs(t *testing.T) {
+	w := Waiter{Backoff: Constant(time.Millisecond), MaxAttempts: 5}
+	ip := net.ParseIP("10.0.0.1")
+
+	polls := 0
+	vm := &mockprovider.VM{MockGetIPs: func() ([]net.IP, error) {
+		polls++
+		switch polls {
+		case 1:
+			return nil, errors.New("not booted")
+		case 2:
+			return nil, lvm.NewError(lvm.Transient, errors.New("throttled"))
+		}
+		return []net.IP{ip}, nil
+	}}
+	ips, err := w.ForIPs(context.Background(), vm, 1)
+	if err != nil || len(ips) != 1 || !ips[0].Equal(ip) {
+		t.Fatalf("ForIPs returned %v, %v, want [%s]", ips, err, ip)
+	}
+
+	errGone := lvm.NewError(lvm.NotFound, errors.New("no such instance"))
+	polls = 0
+	vm.MockGetIPs = func() ([]net.IP, error) {
+		polls++
+		return nil, errGone
+	}
+	if _, err := w.ForIPs(context.Background(), vm, 1); err != errGone || polls != 1 {
+		t.Fatalf("ForIPs returned %v after %d polls, want %v after 1", err, polls, errGone)
+	}
+
+	errBooting := errors.New("still booting")
+	vm.MockGetIPs = func() ([]net.IP, error) { return nil, errBooting }
+	_, err = w.ForIPs(context.Background(), vm, 1)
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, errBooting) {
+		t.Fatalf("ForIPs returned %v, want ErrTimeout and %v", err, errBooting)
+	}
+}
+
+// TestLimiterReserve makes sure concurrent callers queue up one interval
+// apart and never wait longer than MaxWait.
+func TestLimiterReserve(t *testing.T) {
+	l := NewLimiter(time.Second, 3*time.Second)
+	now := time.Now()
+	for i, want := range []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		if d := l.reserve(now); d != want {
+			t.Fatalf("reserve #%d = %s, want %s", i, d, want)
+		}
+	}
+
+	// Once the queue has drained, callers go through right away.
+	if d := l.reserve(now.Add(time.Minute)); d != 0 {
+		t.Fatalf("reserve after the queue drained = %s, want 0", d)
+	}
+}
+
+// TestLimiterWaited makes sure a context from Waited skips only the Limiter it
+// was made for.
+func TestLimiterWaited(t *testing.T) {
+	l := NewLimiter(time.Hour, 0)
+	other := NewLimiter(time.Hour, 0)
+	l.reserve(time.Now())
+	other.reserve(time.Now())
+
+	ctx, cancel := context.WithTimeout(l.Waited(context.Background()), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); err != nil {
+		t.Fatalf("Wait returned %s", err)
+	}
+	if err := other.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Wait on another Limiter returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// TestSetLimiter makes sure LimiterOf returns the Limiter set for a provider.
+func TestSetLimiter(t *testing.T) {
+	l := NewLimiter(time.Second, 0)
+	SetLimiter("test", l)
+	defer SetLimiter("test", nil)
+	if got := LimiterOf("test"); got != l {
+		t.Fatalf("LimiterOf returned %p, want %p", got, l)
+	}
+	if got := LimiterOf("no-such-provider"); got != nil {
+		t.Fatalf("LimiterOf returned %p for an unknown provider", got)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package winrm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// WS-Management actions and URIs used to drive a remote shell.
+const (
+	nsShell = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell"
+
+	actionCreate  = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Create"
+	actionDelete  = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Delete"
+	actionCommand = nsShell + "/Command"
+	actionReceive = nsShell + "/Receive"
+	actionSignal  = nsShell + "/Signal"
+
+	resourceCmd     = nsShell + "/cmd"
+	stateDone       = nsShell + "/CommandState/Done"
+	signalTerminate = nsShell + "/signal/terminate"
+
+	// codeTimedOut is the WS-Management fault sent when a Receive sees no
+	// output within the operation timeout. It is not an error.
+	codeTimedOut = "2150858793"
+)
+
+var envelopeTemplate = template.Must(template.New("envelope").Parse(`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:w="http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd" xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell">
+<s:Header>
+<a:To>{{.To}}</a:To>
+<a:ReplyTo><a:Address s:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address></a:ReplyTo>
+<a:Action s:mustUnderstand="true">{{.Action}}</a:Action>
+<a:MessageID>uuid:{{.MessageID}}</a:MessageID>
+<w:ResourceURI s:mustUnderstand="true">` + resourceCmd + `</w:ResourceURI>
+<w:MaxEnvelopeSize s:mustUnderstand="true">153600</w:MaxEnvelopeSize>
+<w:OperationTimeout>{{.Timeout}}</w:OperationTimeout>
+<w:Locale xml:lang="en-US" s:mustUnderstand="false"/>
+{{if .ShellID}}<w:SelectorSet><w:Selector Name="ShellId">{{.ShellID}}</w:Selector></w:SelectorSet>
+{{end}}{{if .Options}}<w:OptionSet>{{range $name, $value := .Options}}<w:Option Name="{{$name}}">{{$value}}</w:Option>{{end}}</w:OptionSet>
+{{end}}</s:Header>
+<s:Body>{{.Body}}</s:Body>
+</s:Envelope>`))
+
+// envelope is a WS-Management request.
+type envelope struct {
+	To        string
+	Action    string
+	MessageID string
+	Timeout   string
+	ShellID   string
+	Options   map[string]string
+	// Body is the XML of the body, escaped by the caller.
+	Body string
+}
+
+func (e *envelope) bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := envelopeTemplate.Execute(&buf, e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// duration formats d as an xs:duration, such as "PT60.000S".
+func duration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// escape returns s escaped for an XML text node.
+func escape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// response is the part of the WS-Management responses the client reads.
+// Elements are matched by local name only.
+type response struct {
+	Header struct {
+		Selectors []struct {
+			Name  string `xml:"Name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"ResourceCreated>ReferenceParameters>SelectorSet>Selector"`
+	} `xml:"Header"`
+	Body struct {
+		ShellID   string `xml:"Shell>ShellId"`
+		CommandID string `xml:"CommandResponse>CommandId"`
+		Receive   struct {
+			Streams []struct {
+				Name string `xml:"Name,attr"`
+				Data string `xml:",chardata"`
+			} `xml:"Stream"`
+			CommandState struct {
+				State    string `xml:"State,attr"`
+				ExitCode *int   `xml:"ExitCode"`
+			} `xml:"CommandState"`
+		} `xml:"ReceiveResponse"`
+		Fault *struct {
+			Reason string `xml:"Reason>Text"`
+			Detail struct {
+				Code    string `xml:"Code,attr"`
+				Message string `xml:"Message"`
+			} `xml:"Detail>WSManFault"`
+		} `xml:"Fault"`
+	} `xml:"Body"`
+}
+
+// shellID returns the ID of the shell created by a Create request.
+func (r *response) shellID() string {
+	if r.Body.ShellID != "" {
+		return r.Body.ShellID
+	}
+	for _, s := range r.Header.Selectors {
+		if s.Name == "ShellId" {
+			return s.Value
+		}
+	}
+	return ""
+}
+
+// fault returns the SOAP fault in r, if any.
+func (r *response) fault() *Fault {
+	f := r.Body.Fault
+	if f == nil {
+		return nil
+	}
+	msg := strings.TrimSpace(f.Detail.Message)
+	if msg == "" {
+		msg = strings.TrimSpace(f.Reason)
+	}
+	return &Fault{Code: f.Detail.Code, Message: msg}
+}
@@ -0,0 +1,443 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// Package winrm runs commands and copies files on Windows machines over
+// Windows Remote Management, the WS-Management service Windows listens to on
+// ports 5985 (HTTP) and 5986 (HTTPS).
+//
+// Clients use HTTPS, so the service needs an HTTPS listener. The client does
+// not seal NTLM messages, so plain HTTP is only accepted by the service when
+// AllowUnencrypted is set on it, and sends the commands and files in clear.
+package winrm
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/Azure/go-ntlmssp"
+)
+
+const (
+	// DefaultPort is the port of WinRM over HTTP.
+	DefaultPort = 5985
+	// DefaultHTTPSPort is the port of WinRM over HTTPS, which clients use by
+	// default.
+	DefaultHTTPSPort = 5986
+	// DefaultOperationTimeout is how long the service waits for output
+	// before it answers a request.
+	DefaultOperationTimeout = 60 * time.Second
+
+	// uploadChunk is the number of bytes sent by each command of Upload.
+	// Base64-encoded, it stays well below the 8191 characters cmd.exe
+	// accepts on a command line, and as a multiple of 3 it needs no padding,
+	// so that the chunks add up to valid base64.
+	uploadChunk = 4095
+)
+
+var (
+	// ErrUnauthorized is returned when the service rejects the credentials.
+	ErrUnauthorized = errors.New("Access denied by the WinRM service")
+
+	// ErrTimeout is returned when WinRM is not ready within the time given
+	// to WaitReady.
+	ErrTimeout = errors.New("Timed out waiting for WinRM to respond")
+
+	// waitInterval is the time between the attempts of WaitReady.
+	waitInterval = 5 * time.Second
+)
+
+// AuthMethod is how the client logs in to the service.
+type AuthMethod string
+
+const (
+	// NTLM is the authentication of local accounts. It is on by default.
+	NTLM AuthMethod = "ntlm"
+	// Basic is HTTP basic authentication. It must be enabled on the service
+	// and only works for local accounts.
+	Basic AuthMethod = "basic"
+)
+
+// Options configures a WinRM client.
+type Options struct {
+	// Port is the port of the service. It defaults to DefaultHTTPSPort, or
+	// DefaultPort with HTTP.
+	Port int
+	// HTTP talks to the service over plain HTTP rather than TLS. The service
+	// only accepts it when AllowUnencrypted is set on it.
+	HTTP bool
+	// Insecure skips the verification of the certificate of the service,
+	// which is usually self-signed.
+	Insecure bool
+	// Auth defaults to NTLM.
+	Auth AuthMethod
+	// User and Password replace the credentials the client is created with.
+	// User may be given as DOMAIN\user.
+	User     string
+	Password string
+	// OperationTimeout defaults to DefaultOperationTimeout.
+	OperationTimeout time.Duration
+}
+
+// Fault is a SOAP fault returned by the service.
+type Fault struct {
+	// Code is the WS-Management error code, if any.
+	Code    string
+	Message string
+}
+
+func (f *Fault) Error() string {
+	if f.Code == "" {
+		return "WinRM fault: " + f.Message
+	}
+	return fmt.Sprintf("WinRM fault %s: %s", f.Code, f.Message)
+}
+
+// Client runs commands on a Windows machine.
+type Client struct {
+	endpoint string
+	user     string
+	password string
+	options  Options
+	http     *http.Client
+}
+
+// NewClient returns a client for the service of host, logging in as user.
+func NewClient(host, user, password string, options Options) *Client {
+	if options.User != "" {
+		user, password = options.User, options.Password
+	}
+	if options.Auth == "" {
+		options.Auth = NTLM
+	}
+	if options.OperationTimeout == 0 {
+		options.OperationTimeout = DefaultOperationTimeout
+	}
+	scheme, port := "https", DefaultHTTPSPort
+	if options.HTTP {
+		scheme, port = "http", DefaultPort
+	}
+	if options.Port != 0 {
+		port = options.Port
+	}
+
+	// NTLM authenticates a connection, not a request: keep a single one.
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: options.Insecure},
+		MaxConnsPerHost: 1,
+		IdleConnTimeout: 90 * time.Second,
+	}
+	if options.Auth == NTLM {
+		// The negotiator turns the basic credentials of requests into an
+		// NTLM handshake.
+		transport = ntlmssp.Negotiator{RoundTripper: transport}
+	}
+	return &Client{
+		endpoint: fmt.Sprintf("%s://%s/wsman", scheme, net.JoinHostPort(host, strconv.Itoa(port))),
+		user:     user,
+		password: password,
+		options:  options,
+		// Requests must outlive the operation timeout of the service.
+		http: &http.Client{Transport: transport, Timeout: options.OperationTimeout + 30*time.Second},
+	}
+}
+
+// Run runs command in cmd.exe and copies its output to stdout and stderr,
+// which may be nil. It returns the exit code of the command. If ctx is
+// canceled, the command is terminated and ctx.Err() is returned.
+func (c *Client) Run(ctx context.Context, command string, stdout, stderr io.Writer) (int, error) {
+	shell, err := c.createShell(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer c.deleteShell(shell)
+	return c.run(ctx, shell, command, stdout, stderr)
+}
+
+// RunPowerShell runs script in PowerShell. The script is passed on the
+// command line and must stay short, a couple of thousand characters at most.
+func (c *Client) RunPowerShell(ctx context.Context, script string, stdout, stderr io.Writer) (int, error) {
+	return c.Run(ctx, powerShell(script), stdout, stderr)
+}
+
+// Upload copies src to the file dst, creating its directory if needed. The
+// data is sent in base64 chunks appended to a temporary file, then decoded
+// by PowerShell, which is slow: Upload suits scripts and configuration
+// rather than large files.
+func (c *Client) Upload(ctx context.Context, src io.Reader, dst string) error {
+	shell, err := c.createShell(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.deleteShell(shell)
+
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	tmp := "libretto-" + id + ".b64"
+	if err := c.runChecked(ctx, shell, fmt.Sprintf(`type NUL > "%%TEMP%%\%s"`, tmp), nil); err != nil {
+		return err
+	}
+
+	buf := make([]byte, uploadChunk)
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			// The space keeps a final digit from being read as a handle
+			// number by the redirection.
+			cmd := fmt.Sprintf(`echo %s >> "%%TEMP%%\%s"`, base64.StdEncoding.EncodeToString(buf[:n]), tmp)
+			if err := c.runChecked(ctx, shell, cmd, nil); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	script := fmt.Sprintf(`$ErrorActionPreference = 'Stop'
+$tmp = Join-Path $env:TEMP '%s'
+$dst = %s
+$dir = Split-Path -Parent $dst
+if ($dir -and -not (Test-Path $dir)) { New-Item -ItemType Directory -Force -Path $dir | Out-Null }
+$data = [IO.File]::ReadAllText($tmp) -replace '\s', ''
+[IO.File]::WriteAllBytes($dst, [Convert]::FromBase64String($data))
+Remove-Item $tmp`, tmp, quotePowerShell(dst))
+	return c.runChecked(ctx, shell, powerShell(script), nil)
+}
+
+// Download copies the file src to dst. The file is read in memory, so, as
+// with Upload, it should not be large.
+func (c *Client) Download(ctx context.Context, dst io.Writer, src string) error {
+	script := fmt.Sprintf(`$ErrorActionPreference = 'Stop'
+[Convert]::ToBase64String([IO.File]::ReadAllBytes(%s))`, quotePowerShell(src))
+	shell, err := c.createShell(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.deleteShell(shell)
+	var stdout bytes.Buffer
+	if err := c.runChecked(ctx, shell, powerShell(script), &stdout); err != nil {
+		return err
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(stdout.String()), ""))
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(data)
+	return err
+}
+
+// WaitReady waits until the service runs commands, for at most maxWait. It
+// returns ErrTimeout if it does not.
+func (c *Client) WaitReady(ctx context.Context, maxWait time.Duration) error {
+	deadline := time.Now().Add(maxWait)
+	for {
+		_, err := c.Run(ctx, "echo ready", nil, nil)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Now().Add(waitInterval).After(deadline) {
+			return ErrTimeout
+		}
+		select {
+		case <-time.After(waitInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// runChecked runs command in shell, copying its output to stdout, and
+// turns a non-zero exit code into an error reporting what it wrote to
+// stderr.
+func (c *Client) runChecked(ctx context.Context, shell, command string, stdout io.Writer) error {
+	var stderr bytes.Buffer
+	code, err := c.run(ctx, shell, command, stdout, &stderr)
+	if err != nil || code == 0 {
+		return err
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("Command exited with code %d: %s", code, msg)
+	}
+	return fmt.Errorf("Command exited with code %d", code)
+}
+
+func (c *Client) createShell(ctx context.Context) (string, error) {
+	body := `<rsp:Shell><rsp:InputStreams>stdin</rsp:InputStreams><rsp:OutputStreams>stdout stderr</rsp:OutputStreams></rsp:Shell>`
+	options := map[string]string{"WINRS_NOPROFILE": "FALSE", "WINRS_CODEPAGE": "65001"}
+	resp, err := c.send(ctx, actionCreate, "", options, body)
+	if err != nil {
+		return "", err
+	}
+	id := resp.shellID()
+	if id == "" {
+		return "", errors.New("WinRM did not return a shell ID")
+	}
+	return id, nil
+}
+
+// deleteShell deletes shell, even if the context of the command is done.
+func (c *Client) deleteShell(shell string) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.OperationTimeout)
+	defer cancel()
+	c.send(ctx, actionDelete, shell, nil, "")
+}
+
+// run runs command in shell and waits for it to exit.
+func (c *Client) run(ctx context.Context, shell, command string, stdout, stderr io.Writer) (int, error) {
+	body := fmt.Sprintf(`<rsp:CommandLine><rsp:Command>%s</rsp:Command></rsp:CommandLine>`, escape(command))
+	options := map[string]string{"WINRS_CONSOLEMODE_STDIN": "TRUE", "WINRS_SKIP_CMD_SHELL": "FALSE"}
+	resp, err := c.send(ctx, actionCommand, shell, options, body)
+	if err != nil {
+		return 0, err
+	}
+	id := resp.Body.CommandID
+	if id == "" {
+		return 0, errors.New("WinRM did not return a command ID")
+	}
+
+	receive := fmt.Sprintf(`<rsp:Receive><rsp:DesiredStream CommandId="%s">stdout stderr</rsp:DesiredStream></rsp:Receive>`, escape(id))
+	for {
+		resp, err := c.send(ctx, actionReceive, shell, nil, receive)
+		if f, ok := err.(*Fault); ok && f.Code == codeTimedOut {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				c.terminate(shell, id)
+				return 0, ctx.Err()
+			}
+			return 0, err
+		}
+
+		r := resp.Body.Receive
+		for _, s := range r.Streams {
+			w := stdout
+			if s.Name == "stderr" {
+				w = stderr
+			}
+			if w == nil || s.Data == "" {
+				continue
+			}
+			data, err := base64.StdEncoding.DecodeString(s.Data)
+			if err != nil {
+				return 0, err
+			}
+			if _, err := w.Write(data); err != nil {
+				return 0, err
+			}
+		}
+		if r.CommandState.State == stateDone {
+			if r.CommandState.ExitCode == nil {
+				return 0, nil
+			}
+			return *r.CommandState.ExitCode, nil
+		}
+	}
+}
+
+// terminate stops the command id of shell.
+func (c *Client) terminate(shell, id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.OperationTimeout)
+	defer cancel()
+	body := fmt.Sprintf(`<rsp:Signal CommandId="%s"><rsp:Code>%s</rsp:Code></rsp:Signal>`, escape(id), signalTerminate)
+	c.send(ctx, actionSignal, shell, nil, body)
+}
+
+// send sends a request to the service and parses its response. SOAP faults
+// are returned as a *Fault.
+func (c *Client) send(ctx context.Context, action, shell string, options map[string]string, body string) (*response, error) {
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	e := &envelope{
+		To:        c.endpoint,
+		Action:    action,
+		MessageID: id,
+		Timeout:   duration(c.options.OperationTimeout),
+		ShellID:   shell,
+		Options:   options,
+		Body:      body,
+	}
+	b, err := e.bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	req.SetBasicAuth(c.user, c.password)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, ErrUnauthorized
+	}
+	r := &response{}
+	if len(bytes.TrimSpace(data)) > 0 {
+		err := xml.Unmarshal(data, r)
+		if err == nil && r.fault() != nil {
+			return nil, r.fault()
+		}
+		if err != nil && resp.StatusCode == http.StatusOK {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("WinRM returned HTTP status %s", resp.Status)
+	}
+	return r, nil
+}
+
+// powerShell returns the command line that runs script in PowerShell.
+func powerShell(script string) string {
+	return "powershell -NoProfile -NonInteractive -ExecutionPolicy Bypass -EncodedCommand " +
+		base64.StdEncoding.EncodeToString(encodeUTF16(script))
+}
+
+// quotePowerShell quotes s as a PowerShell string literal.
+func quotePowerShell(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// encodeUTF16 encodes s in UTF-16LE, as PowerShell expects.
+func encodeUTF16(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, r := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+	return b
+}
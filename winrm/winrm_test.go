@@ -0,0 +1,359 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package winrm
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+const envelopeStart = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell"><s:Body>`
+
+const timedOutFault = `<s:Fault><s:Code><s:Value>s:Receiver</s:Value></s:Code><s:Reason><s:Text xml:lang="en-US">The operation timed out.</s:Text></s:Reason><s:Detail><f:WSManFault xmlns:f="http://schemas.microsoft.com/wbem/wsman/1/wsmanfault" Code="2150858793"><f:Message>The WS-Management service cannot complete the operation within the time specified in OperationTimeout.</f:Message></f:WSManFault></s:Detail></s:Fault>`
+
+// fakeService is a WinRM service that runs commands with handler.
+type fakeService struct {
+	t              *testing.T
+	auth           AuthMethod
+	user, password string
+	handler        func(command string) (stdout, stderr string, code int)
+
+	mu       sync.Mutex
+	shells   int
+	deleted  int
+	signals  []string
+	commands map[string]string
+	received map[string]bool
+}
+
+func newFakeService(t *testing.T, auth AuthMethod) (*fakeService, *httptest.Server) {
+	f := &fakeService{
+		t:        t,
+		auth:     auth,
+		user:     "Administrator",
+		password: "secret",
+		commands: map[string]string{},
+		received: map[string]bool{},
+	}
+	return f, httptest.NewTLSServer(f)
+}
+
+// client returns a client of the service at s, logging in with password.
+func (f *fakeService) client(s *httptest.Server, password string) *Client {
+	host, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return NewClient(host, f.user, password, Options{Port: p, Auth: f.auth, Insecure: true})
+}
+
+func (f *fakeService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.authenticate(w, r) {
+		return
+	}
+	var req struct {
+		Action  string `xml:"Header>Action"`
+		ShellID string `xml:"Header>SelectorSet>Selector"`
+		Body    struct {
+			Command string `xml:"CommandLine>Command"`
+			Receive struct {
+				CommandID string `xml:"CommandId,attr"`
+			} `xml:"Receive>DesiredStream"`
+			Signal struct {
+				CommandID string `xml:"CommandId,attr"`
+				Code      string `xml:"Code"`
+			} `xml:"Signal"`
+		} `xml:"Body"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.t.Errorf("Invalid request: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var body string
+	switch req.Action {
+	case actionCreate:
+		f.shells++
+		body = fmt.Sprintf("<rsp:Shell><rsp:ShellId>shell-%d</rsp:ShellId></rsp:Shell>", f.shells)
+	case actionDelete:
+		f.deleted++
+	case actionCommand:
+		id := fmt.Sprintf("command-%d", len(f.commands))
+		f.commands[id] = req.Body.Command
+		body = fmt.Sprintf("<rsp:CommandResponse><rsp:CommandId>%s</rsp:CommandId></rsp:CommandResponse>", id)
+	case actionSignal:
+		f.signals = append(f.signals, req.Body.Signal.Code)
+	case actionReceive:
+		id := req.Body.Receive.CommandID
+		command := f.commands[id]
+		// Time out once, as the service does when a command is slow.
+		if !f.received[id] || command == "hang" {
+			f.received[id] = true
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, envelopeStart+timedOutFault+"</s:Body></s:Envelope>")
+			return
+		}
+		stdout, stderr, code := f.handler(command)
+		body = fmt.Sprintf(`<rsp:ReceiveResponse><rsp:Stream Name="stdout" CommandId="%s">%s</rsp:Stream><rsp:Stream Name="stderr" CommandId="%s">%s</rsp:Stream><rsp:CommandState CommandId="%s" State="%s"><rsp:ExitCode>%d</rsp:ExitCode></rsp:CommandState></rsp:ReceiveResponse>`,
+			id, base64.StdEncoding.EncodeToString([]byte(stdout)),
+			id, base64.StdEncoding.EncodeToString([]byte(stderr)),
+			id, stateDone, code)
+	default:
+		f.t.Errorf("Unexpected action %s", req.Action)
+	}
+	fmt.Fprint(w, envelopeStart+body+"</s:Body></s:Envelope>")
+}
+
+// authenticate checks the credentials of r, with basic authentication or
+// NTLMv2, and answers with a 401 if they are missing or wrong.
+func (f *fakeService) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	if f.auth == Basic {
+		user, password, ok := r.BasicAuth()
+		if ok && user == f.user && password == f.password {
+			return true
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	msg, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(r.Header.Get("Authorization"), "Negotiate "))
+	if len(msg) >= 12 && binary.LittleEndian.Uint32(msg[8:]) == 1 {
+		w.Header().Set("WWW-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString(fakeChallenge()))
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	if len(msg) < 64 || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+		w.Header().Set("WWW-Authenticate", "Negotiate")
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	field := func(i int) []byte {
+		n := int(binary.LittleEndian.Uint16(msg[12+8*i:]))
+		off := int(binary.LittleEndian.Uint32(msg[16+8*i:]))
+		return msg[off : off+n]
+	}
+	lm, nt, domain, user := field(0), field(1), decodeUTF16(field(2)), decodeUTF16(field(3))
+	m := hmac.New(md5.New, ntowfv2(domain, user, f.password))
+	m.Write([]byte("01234567"))
+	m.Write(nt[16:])
+	// The LMv2 response is empty when the server sends its time.
+	if user != f.user || !hmac.Equal(m.Sum(nil), nt[:16]) || len(lm) != 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// ntowfv2 returns the NTLMv2 response key of user, as in MS-NLMP 3.3.2.
+func ntowfv2(domain, user, password string) []byte {
+	h := md4.New()
+	h.Write(encodeUTF16(password))
+	m := hmac.New(md5.New, h.Sum(nil))
+	m.Write(encodeUTF16(strings.ToUpper(user) + domain))
+	return m.Sum(nil)
+}
+
+// fakeChallenge returns a CHALLENGE_MESSAGE with the server challenge
+// "01234567" and a timestamp. Its flags ask for Unicode, NTLM, extended
+// session security and target info.
+func fakeChallenge() []byte {
+	const flags = 0x00000001 | 0x00000200 | 0x00080000 | 0x00800000
+	// MsvAvTimestamp, then MsvAvEOL.
+	info := []byte{7, 0, 8, 0, 1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0}
+	b := make([]byte, 48)
+	copy(b, "NTLMSSP\x00")
+	binary.LittleEndian.PutUint32(b[8:], 2)
+	binary.LittleEndian.PutUint32(b[20:], flags)
+	copy(b[24:], "01234567")
+	binary.LittleEndian.PutUint16(b[40:], uint16(len(info)))
+	binary.LittleEndian.PutUint16(b[42:], uint16(len(info)))
+	binary.LittleEndian.PutUint32(b[44:], 48)
+	return append(b, info...)
+}
+
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+var (
+	echoPattern      = regexp.MustCompile(`^echo (\S+) >> "%TEMP%\\(.+)"$`)
+	truncatePattern  = regexp.MustCompile(`^type NUL > "%TEMP%\\(.+)"$`)
+	encodedPattern   = regexp.MustCompile(`-EncodedCommand (\S+)$`)
+	tmpPattern       = regexp.MustCompile(`Join-Path \$env:TEMP '(.+)'`)
+	dstPattern       = regexp.MustCompile(`\$dst = '(.+)'`)
+	readBytesPattern = regexp.MustCompile(`ReadAllBytes\('(.+)'\)`)
+)
+
+// fileHandler runs the commands of Upload and Download on files.
+func fileHandler(files map[string]string) func(string) (string, string, int) {
+	return func(command string) (string, string, int) {
+		if m := truncatePattern.FindStringSubmatch(command); m != nil {
+			files[m[1]] = ""
+			return "", "", 0
+		}
+		if m := echoPattern.FindStringSubmatch(command); m != nil {
+			files[m[2]] += m[1] + " \r\n"
+			return "", "", 0
+		}
+		m := encodedPattern.FindStringSubmatch(command)
+		if m == nil {
+			return "", "'" + command + "' is not recognized as an internal or external command", 1
+		}
+		b, _ := base64.StdEncoding.DecodeString(m[1])
+		script := decodeUTF16(b)
+		if m := readBytesPattern.FindStringSubmatch(script); m != nil {
+			src := strings.Replace(m[1], "''", "'", -1)
+			data, ok := files[src]
+			if !ok {
+				return "", "Could not find file '" + src + "'.", 1
+			}
+			return base64.StdEncoding.EncodeToString([]byte(data)) + "\r\n", "", 0
+		}
+		tmp, dst := tmpPattern.FindStringSubmatch(script), dstPattern.FindStringSubmatch(script)
+		if tmp == nil || dst == nil {
+			return "", "Unexpected script", 1
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(files[tmp[1]]), ""))
+		if err != nil {
+			return "", err.Error(), 1
+		}
+		delete(files, tmp[1])
+		files[strings.Replace(dst[1], "''", "'", -1)] = string(data)
+		return "", "", 0
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	tests := []struct {
+		options  Options
+		endpoint string
+	}{
+		{Options{}, "https://10.0.0.1:5986/wsman"},
+		{Options{HTTP: true}, "http://10.0.0.1:5985/wsman"},
+		{Options{HTTP: true, Port: 8080}, "http://10.0.0.1:8080/wsman"},
+	}
+	for _, tt := range tests {
+		if c := NewClient("10.0.0.1", "Administrator", "secret", tt.options); c.endpoint != tt.endpoint {
+			t.Errorf("%+v: expected endpoint %s, got %s", tt.options, tt.endpoint, c.endpoint)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	for _, auth := range []AuthMethod{NTLM, Basic} {
+		f, s := newFakeService(t, auth)
+		f.handler = func(command string) (string, string, int) {
+			if command == "dir C:\\" {
+				return "Windows\r\n", "warning\r\n", 3
+			}
+			return "", "", 1
+		}
+
+		var stdout, stderr bytes.Buffer
+		code, err := f.client(s, "secret").Run(context.Background(), `dir C:\`, &stdout, &stderr)
+		if err != nil {
+			t.Fatalf("Expected no error with %s, got: %s", auth, err)
+		}
+		if code != 3 || stdout.String() != "Windows\r\n" || stderr.String() != "warning\r\n" {
+			t.Fatalf("Unexpected result %d, %q, %q", code, stdout.String(), stderr.String())
+		}
+		if f.shells != 1 || f.deleted != 1 {
+			t.Fatalf("Expected the shell to be deleted, got %d shells and %d deleted", f.shells, f.deleted)
+		}
+
+		if _, err := f.client(s, "wrong").Run(context.Background(), "dir", nil, nil); err != ErrUnauthorized {
+			t.Fatalf("Expected ErrUnauthorized with %s, got: %v", auth, err)
+		}
+		s.Close()
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	f, s := newFakeService(t, NTLM)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := f.client(s, "secret").Run(ctx, "hang", nil, nil); err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.signals) != 1 || f.signals[0] != signalTerminate || f.deleted != 1 {
+		t.Fatalf("Expected the command to be terminated, got %q and %d deleted", f.signals, f.deleted)
+	}
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	f, s := newFakeService(t, NTLM)
+	defer s.Close()
+	files := map[string]string{}
+	f.handler = fileHandler(files)
+	client := f.client(s, "secret")
+
+	data := strings.Repeat("0123456789", 1000)
+	dst := `C:\Program Files\it's\app.conf`
+	if err := client.Upload(context.Background(), strings.NewReader(data), dst); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if files[dst] != data || len(files) != 1 {
+		t.Fatalf("Expected the file to be uploaded, got %d files", len(files))
+	}
+	if f.shells != 1 {
+		t.Fatalf("Expected the upload to use a single shell, got %d", f.shells)
+	}
+
+	var download bytes.Buffer
+	if err := client.Download(context.Background(), &download, dst); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if download.String() != data {
+		t.Fatalf("Expected the file to be downloaded, got %d bytes", download.Len())
+	}
+	err := client.Download(context.Background(), ioutil.Discard, `C:\missing`)
+	if err == nil || !strings.Contains(err.Error(), "Could not find file") {
+		t.Fatalf("Expected the missing file to be reported, got: %v", err)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	oldInterval := waitInterval
+	defer func() { waitInterval = oldInterval }()
+	waitInterval = 10 * time.Millisecond
+
+	f, s := newFakeService(t, NTLM)
+	f.handler = func(string) (string, string, int) { return "ready\r\n", "", 0 }
+	client := f.client(s, "secret")
+	if err := client.WaitReady(context.Background(), time.Second); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	s.Close()
+
+	if err := client.WaitReady(context.Background(), 0); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got: %v", err)
+	}
+}